@@ -195,7 +195,8 @@ func NewServer(args *PilotArgs, initFuncs ...func(*Server)) (*Server, error) {
 	e.SetLedger(buildLedger(args.RegistryOptions))
 
 	ac := aggregate.NewController(aggregate.Options{
-		MeshHolder: e,
+		MeshHolder:     e,
+		PrimaryCluster: getClusterID(args),
 	})
 	e.ServiceDiscovery = ac
 
@@ -723,6 +724,11 @@ func (s *Server) waitForShutdown(stop <-chan struct{}) {
 			}
 		}
 
+		// Wait for the service registries to be done with their queues.
+		if err := s.ServiceController().Shutdown(ctx); err != nil {
+			log.Warn(err)
+		}
+
 		// Shutdown the DiscoveryServer.
 		s.XDSServer.Shutdown()
 	}()
@@ -881,7 +887,7 @@ func (s *Server) initRegistryEventHandlers() {
 		}
 		s.XDSServer.ConfigUpdate(pushReq)
 	}
-	s.ServiceController().AppendServiceHandler(serviceHandler)
+	s.ServiceController().RegisterServiceHandler(aggregate.NamedServiceHandler("xds-push", serviceHandler))
 
 	if s.configController != nil {
 		configHandler := func(prev config.Config, curr config.Config, event model.Event) {
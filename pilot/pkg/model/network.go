@@ -20,6 +20,7 @@ import (
 	"strings"
 
 	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/network"
 )
 
@@ -33,6 +34,12 @@ type NetworkGateway struct {
 	Addr string
 	// gateway port
 	Port uint32
+	// Weight is the share of the traffic to the network this gateway should get, relative to the other gateways
+	// of the network. Zero means the registry gave none.
+	Weight uint32
+	// Service is the hostname of the service backing the gateway in its cluster. Empty for the gateways given
+	// by address.
+	Service host.Name
 }
 
 // NewNetworkManager creates a new NetworkManager from the Environment by merging
@@ -432,6 +432,25 @@ type IstioEndpoint struct {
 
 	// Determines the discoverability of this endpoint throughout the mesh.
 	DiscoverabilityPolicy EndpointDiscoverabilityPolicy `json:"-"`
+
+	// Indicates the endpoint health status. Registries that do not track health leave it unset,
+	// in which case the endpoint is considered healthy.
+	HealthStatus HealthStatus
+}
+
+// HealthStatus is the health status of an endpoint.
+type HealthStatus int32
+
+const (
+	// Healthy indicates the endpoint is ready to accept traffic.
+	Healthy HealthStatus = 1
+	// UnHealthy indicates the endpoint is not ready to accept traffic.
+	UnHealthy HealthStatus = 2
+)
+
+// IsHealthy returns false only if the endpoint is known to be unhealthy.
+func (ep *IstioEndpoint) IsHealthy() bool {
+	return ep.HealthStatus != UnHealthy
 }
 
 // GetLoadBalancingWeight returns the weight for this endpoint, normalized to always be > 0.
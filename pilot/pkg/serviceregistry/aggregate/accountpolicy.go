@@ -0,0 +1,118 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+)
+
+// ServiceAccountPolicy selects the service accounts GetIstioServiceAccounts returns for a service that has both
+// accounts provided by an annotation, such as GCP service accounts, and accounts derived from its endpoints.
+type ServiceAccountPolicy int
+
+const (
+	// ServiceAccountsUnion returns both kinds of accounts.
+	ServiceAccountsUnion ServiceAccountPolicy = iota
+	// ServiceAccountsAnnotationWins returns only the accounts provided by an annotation, if any registry has
+	// some: the annotation replaces the derived accounts.
+	ServiceAccountsAnnotationWins
+	// ServiceAccountsDerivedWins returns only the accounts derived from the endpoints, if any registry has some.
+	ServiceAccountsDerivedWins
+)
+
+// serviceAccountsBySourceGetter is implemented by registries able to tell the accounts of a service provided by an
+// annotation from those derived from its endpoints. The accounts of the other registries are told apart by their
+// form, see classifyServiceAccounts.
+type serviceAccountsBySourceGetter interface {
+	GetIstioServiceAccountsBySource(svc *model.Service, ports []int) (annotated, derived []string)
+}
+
+// sourcedAccounts are the service accounts of a registry, by source.
+type sourcedAccounts struct {
+	annotated []string
+	derived   []string
+}
+
+// classifyServiceAccounts splits accounts in canonical form by their form: the Kubernetes form
+// spiffe://<trust domain>/ns/<namespace>/sa/<service account> is derived from the endpoints, any other, such as
+// spiffe://<trust domain>/<account>@iam.gserviceaccount.com, is provided by an annotation.
+func classifyServiceAccounts(accounts []string) sourcedAccounts {
+	var out sourcedAccounts
+	for _, sa := range accounts {
+		if parseServiceIdentity(sa).Namespace != "" {
+			out.derived = append(out.derived, sa)
+		} else {
+			out.annotated = append(out.annotated, sa)
+		}
+	}
+	return out
+}
+
+// registrySourcedAccounts returns the service accounts of svc in the registry r, in canonical form, or false if
+// r did not answer within Options.RegistryTimeout. The accounts are only split by source if a policy other than
+// ServiceAccountsUnion needs it, all of them are derived otherwise.
+func (c *Controller) registrySourcedAccounts(r serviceregistry.Instance, svc *model.Service, ports []int) (sourcedAccounts, bool) {
+	getter, bySource := r.(serviceAccountsBySourceGetter)
+	bySource = bySource && c.accountPolicy != ServiceAccountsUnion
+	result, ok := c.callWithTimeout(r, "GetIstioServiceAccounts", func() interface{} {
+		var accounts sourcedAccounts
+		if bySource {
+			accounts.annotated, accounts.derived = getter.GetIstioServiceAccountsBySource(svc, ports)
+		} else {
+			accounts.derived = r.GetIstioServiceAccounts(svc, ports)
+		}
+		return accounts
+	})
+	if !ok {
+		return sourcedAccounts{}, false
+	}
+	out := result.(sourcedAccounts)
+	// the accounts provided by an annotation are declared by the service, and back all its ports
+	if c.verifyAccountPorts {
+		out.derived = portServiceAccounts(r, svc, ports, out.derived)
+	}
+	key := registryKey{cluster: r.Cluster(), provider: r.Provider()}
+	out.annotated = canonicalServiceAccounts(key, out.annotated)
+	out.derived = canonicalServiceAccounts(key, out.derived)
+	if c.accountPolicy != ServiceAccountsUnion && !bySource {
+		out = classifyServiceAccounts(out.derived)
+	}
+	return out, true
+}
+
+// applyServiceAccountPolicy drops, from the accounts of every registry, those the policy discards. Either kind
+// of accounts found in no registry leaves the other kind untouched.
+func applyServiceAccountPolicy(policy ServiceAccountPolicy, results []sourcedAccounts) {
+	if policy == ServiceAccountsUnion {
+		return
+	}
+	annotated, derived := false, false
+	for _, res := range results {
+		annotated = annotated || len(res.annotated) > 0
+		derived = derived || len(res.derived) > 0
+	}
+	if !annotated || !derived {
+		return
+	}
+	for i := range results {
+		switch policy {
+		case ServiceAccountsAnnotationWins:
+			results[i].derived = nil
+		case ServiceAccountsDerivedWins:
+			results[i].annotated = nil
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// sourcingRegistry is an accountsRegistry telling the accounts provided by an annotation from the others.
+type sourcingRegistry struct {
+	*accountsRegistry
+	annotated []string
+}
+
+func (r *sourcingRegistry) GetIstioServiceAccountsBySource(svc *model.Service, ports []int) ([]string, []string) {
+	return r.annotated, r.accountsRegistry.GetIstioServiceAccounts(svc, ports)
+}
+
+func (r *sourcingRegistry) GetIstioServiceAccounts(svc *model.Service, ports []int) []string {
+	return append(append([]string(nil), r.annotated...), r.accountsRegistry.GetIstioServiceAccounts(svc, ports)...)
+}
+
+func TestServiceAccountPolicy(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "east")
+	// the annotation of cluster east provides an account of the form of the derived ones, which it tells apart
+	east := &sourcingRegistry{
+		accountsRegistry: newAccountsRegistry("east", svc, "spiffe://cluster.local/ns/default/sa/east-pod"),
+		annotated:        []string{"spiffe://cluster.local/ns/default/sa/east-annotated"},
+	}
+	// the accounts of cluster west are told apart by their form
+	west := newAccountsRegistry("west", svc,
+		"spiffe://cluster.local/ns/default/sa/west-pod",
+		"spiffe://cluster.local/west@iam.gserviceaccount.com")
+	derivedOnly := newAccountsRegistry("west", svc, "spiffe://cluster.local/ns/default/sa/west-pod")
+
+	annotated := []string{"spiffe://cluster.local/ns/default/sa/east-annotated", "spiffe://cluster.local/west@iam.gserviceaccount.com"}
+	derived := []string{"spiffe://cluster.local/ns/default/sa/east-pod", "spiffe://cluster.local/ns/default/sa/west-pod"}
+	cases := []struct {
+		name   string
+		policy ServiceAccountPolicy
+		west   *accountsRegistry
+		want   []string
+	}{
+		{
+			name:   "union",
+			policy: ServiceAccountsUnion,
+			west:   west,
+			want: []string{
+				"spiffe://cluster.local/ns/default/sa/east-annotated",
+				"spiffe://cluster.local/ns/default/sa/east-pod",
+				"spiffe://cluster.local/ns/default/sa/west-pod",
+				"spiffe://cluster.local/west@iam.gserviceaccount.com",
+			},
+		},
+		{"annotation wins", ServiceAccountsAnnotationWins, west, annotated},
+		{"derived wins", ServiceAccountsDerivedWins, west, derived},
+		{
+			name:   "annotation wins in another cluster",
+			policy: ServiceAccountsAnnotationWins,
+			west:   derivedOnly,
+			want:   []string{"spiffe://cluster.local/ns/default/sa/east-annotated"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctl := NewController(Options{ServiceAccountPolicy: tc.policy})
+			ctl.AddRegistry(east)
+			ctl.AddRegistry(tc.west)
+			if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected the accounts %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	// without accounts of the winning kind, the others are kept
+	ctl := NewController(Options{ServiceAccountPolicy: ServiceAccountsAnnotationWins})
+	ctl.AddRegistry(derivedOnly)
+	want := []string{"spiffe://cluster.local/ns/default/sa/west-pod"}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts %v, got %v", want, got)
+	}
+}
+
+func TestServiceAccountPolicyReturnedAfterTimeout(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	slow := &sourcingRegistry{
+		accountsRegistry: newAccountsRegistry("cluster-1", svc, "spiffe://cluster.local/ns/default/sa/derived"),
+		annotated:        []string{"spiffe://cluster.local/ns/default/sa/annotated"},
+	}
+	slow.latency = 100 * time.Millisecond
+	ctl := NewController(Options{RegistryTimeout: 20 * time.Millisecond, ServiceAccountPolicy: ServiceAccountsAnnotationWins})
+	ctl.AddRegistry(slow)
+
+	// the call returning after the timeout does not change the result of the lookup, run with -race
+	if got := ctl.GetIstioServiceAccounts(svc, nil); len(got) != 0 {
+		t.Fatalf("expected no accounts from the timed out registry, got %v", got)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if len(ctl.UnhealthyRegistries()) != 0 {
+			return errors.New("the slow registry is still unhealthy")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,202 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/config/host"
+)
+
+// serviceAccountsCache caches the result of GetIstioServiceAccounts for each service and ports. The accounts are
+// those of the service and of its instances, so the entries of a service are invalidated by its service events,
+// and by the workload events of its namespace, where its instances are.
+type serviceAccountsCache struct {
+	mu      sync.Mutex
+	entries *simplelru.LRU
+	// byHostname and byNamespace index the cache keys by service hostname and namespace, for the invalidation
+	// on service and workload events.
+	byHostname  map[host.Name]map[string]struct{}
+	byNamespace map[string]map[string]struct{}
+	// invalidations tracks the hostnames and namespaces invalidated, so that accounts computed concurrently
+	// with an invalidation of their service are not stored.
+	invalidations invalidationTokens
+}
+
+type serviceAccountsEntry struct {
+	hostname  host.Name
+	namespace string
+	// trustDomainAliases identifies the aliases the accounts were expanded with.
+	trustDomainAliases []string
+	accounts           []string
+}
+
+func newServiceAccountsCache(size int) *serviceAccountsCache {
+	ac := &serviceAccountsCache{
+		byHostname:    map[host.Name]map[string]struct{}{},
+		byNamespace:   map[string]map[string]struct{}{},
+		invalidations: newInvalidationTokens(size),
+	}
+	entries, err := simplelru.NewLRU(size, func(key, value interface{}) {
+		ac.unindex(key.(string), value.(*serviceAccountsEntry))
+	})
+	if err != nil {
+		panic(err)
+	}
+	ac.entries = entries
+	return ac
+}
+
+// serviceAccountsKey identifies the inputs of GetIstioServiceAccounts, regardless of the order of the ports.
+func serviceAccountsKey(svc *model.Service, ports []int) string {
+	sorted := append([]int(nil), ports...)
+	sort.Ints(sorted)
+	var b strings.Builder
+	b.WriteString(string(svc.ClusterLocal.Hostname))
+	b.WriteByte('~')
+	b.WriteString(svc.Attributes.Namespace)
+	for _, p := range sorted {
+		b.WriteByte('~')
+		b.WriteString(strconv.Itoa(p))
+	}
+	return b.String()
+}
+
+// get returns a copy of the accounts cached for the key, if they were expanded with the trust domain aliases
+// identified by the signature.
+func (ac *serviceAccountsCache) get(key string, trustDomainAliases []string) ([]string, uint64, bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if e, ok := ac.entries.Get(key); ok {
+		entry := e.(*serviceAccountsEntry)
+		if equalStrings(entry.trustDomainAliases, trustDomainAliases) {
+			return append([]string(nil), entry.accounts...), ac.invalidations.token(), true
+		}
+		ac.entries.Remove(key)
+	}
+	return nil, ac.invalidations.token(), false
+}
+
+// add stores the accounts computed for the service, unless the service or its namespace were invalidated since
+// token was read.
+func (ac *serviceAccountsCache) add(token uint64, key string, svc *model.Service, trustDomainAliases, accounts []string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	hostname, namespace := svc.ClusterLocal.Hostname, svc.Attributes.Namespace
+	if !ac.invalidations.valid(token, hostname, namespace) {
+		return
+	}
+	if old, ok := ac.entries.Peek(key); ok {
+		ac.unindex(key, old.(*serviceAccountsEntry))
+	}
+	ac.entries.Add(key, &serviceAccountsEntry{
+		hostname:           hostname,
+		namespace:          namespace,
+		trustDomainAliases: append([]string(nil), trustDomainAliases...),
+		accounts:           append([]string(nil), accounts...),
+	})
+	keys := ac.byHostname[hostname]
+	if keys == nil {
+		keys = map[string]struct{}{}
+		ac.byHostname[hostname] = keys
+	}
+	keys[key] = struct{}{}
+	keys = ac.byNamespace[namespace]
+	if keys == nil {
+		keys = map[string]struct{}{}
+		ac.byNamespace[namespace] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (ac *serviceAccountsCache) unindex(key string, e *serviceAccountsEntry) {
+	if keys := ac.byHostname[e.hostname]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(ac.byHostname, e.hostname)
+		}
+	}
+	if keys := ac.byNamespace[e.namespace]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(ac.byNamespace, e.namespace)
+		}
+	}
+}
+
+// invalidateHostname drops the entries of the services with the given hostname.
+func (ac *serviceAccountsCache) invalidateHostname(hostname host.Name) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.invalidations.invalidate(hostname)
+	for key := range ac.byHostname[hostname] {
+		ac.entries.Remove(key)
+	}
+}
+
+// invalidateNamespace drops the entries of the services of the given namespace.
+func (ac *serviceAccountsCache) invalidateNamespace(namespace string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.invalidations.invalidate(namespace)
+	for key := range ac.byNamespace[namespace] {
+		ac.entries.Remove(key)
+	}
+}
+
+// clear drops every entry.
+func (ac *serviceAccountsCache) clear() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.invalidations.invalidateAll()
+	ac.entries.Purge()
+	ac.byHostname = map[host.Name]map[string]struct{}{}
+	ac.byNamespace = map[string]map[string]struct{}{}
+}
+
+func (ac *serviceAccountsCache) len() int {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.entries.Len()
+}
+
+// watchForAccountsCache invalidates the cached service accounts on the events of the registry.
+func (c *Controller) watchForAccountsCache(registry serviceregistry.Instance) {
+	registry.AppendServiceHandler(func(svc *model.Service, _ model.Event) {
+		c.accountsCache.invalidateHostname(svc.ClusterLocal.Hostname)
+	})
+	registry.AppendWorkloadHandler(func(wi *model.WorkloadInstance, _ model.Event) {
+		c.accountsCache.invalidateNamespace(wi.Namespace)
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,222 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/host"
+)
+
+// accountsRegistry returns the accounts set for each hostname, counting the calls.
+type accountsRegistry struct {
+	serviceregistry.Simple
+	mu       sync.Mutex
+	accounts map[host.Name][]string
+	calls    atomic.Int32
+	// during is called while computing the accounts, once.
+	during func()
+	// latency is added to every call.
+	latency time.Duration
+}
+
+func newAccountsRegistry(clusterID cluster.ID, svc *model.Service, accounts ...string) *accountsRegistry {
+	return &accountsRegistry{
+		Simple:   newMemoryRegistry(provider.Kubernetes, clusterID, svc),
+		accounts: map[host.Name][]string{svc.ClusterLocal.Hostname: accounts},
+	}
+}
+
+func (r *accountsRegistry) GetIstioServiceAccounts(svc *model.Service, _ []int) []string {
+	r.calls.Inc()
+	r.mu.Lock()
+	out := append([]string(nil), r.accounts[svc.ClusterLocal.Hostname]...)
+	during := r.during
+	r.during = nil
+	r.mu.Unlock()
+	if during != nil {
+		during()
+	}
+	time.Sleep(r.latency)
+	return out
+}
+
+func (r *accountsRegistry) setAccounts(hostname host.Name, accounts ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.accounts[hostname] = accounts
+}
+
+func TestServiceAccountsCache(t *testing.T) {
+	hello := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	world := mock.MakeService("world.other.svc.cluster.local", "10.10.0.1", []string{}, "cluster-1")
+	world.Attributes.Namespace = "other"
+	r := newAccountsRegistry("cluster-1", hello, "spiffe://cluster.local/ns/default/sa/hello")
+	r.setAccounts(world.ClusterLocal.Hostname, "spiffe://cluster.local/ns/other/sa/world")
+	holder := &mockMeshConfigHolder{}
+	ctl := NewController(Options{MeshHolder: holder, ServiceAccountsCacheSize: 10})
+	ctl.AddRegistry(r)
+
+	// expect checks the accounts of the service, and whether the registry was called for them
+	expect := func(t *testing.T, svc *model.Service, ports []int, called bool, want ...string) {
+		t.Helper()
+		before := r.calls.Load()
+		got := ctl.GetIstioServiceAccounts(svc, ports)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected the accounts %v, got %v", want, got)
+		}
+		if (r.calls.Load() != before) != called {
+			t.Fatalf("expected the registry to be called %v, got %d calls", called, r.calls.Load()-before)
+		}
+	}
+	helloSA := "spiffe://cluster.local/ns/default/sa/hello"
+	worldSA := "spiffe://cluster.local/ns/other/sa/world"
+
+	t.Run("cached", func(t *testing.T) {
+		expect(t, hello, []int{80, 443}, true, helloSA)
+		expect(t, hello, []int{443, 80}, false, helloSA)
+		// the ports are part of the key
+		expect(t, hello, []int{80}, true, helloSA)
+		// the cached accounts are not modified by the callers
+		ctl.GetIstioServiceAccounts(hello, []int{80})[0] = "modified"
+		expect(t, hello, []int{80}, false, helloSA)
+	})
+
+	t.Run("service event", func(t *testing.T) {
+		expect(t, world, []int{80}, true, worldSA)
+		r.setAccounts(hello.ClusterLocal.Hostname, "spiffe://cluster.local/ns/default/sa/hello2")
+		fakeControllerOf(r.Simple).fireService(hello, model.EventUpdate)
+		expect(t, hello, []int{80}, true, "spiffe://cluster.local/ns/default/sa/hello2")
+		// the other services are kept
+		expect(t, world, []int{80}, false, worldSA)
+		r.setAccounts(hello.ClusterLocal.Hostname, helloSA)
+		fakeControllerOf(r.Simple).fireService(hello, model.EventUpdate)
+	})
+
+	t.Run("workload event", func(t *testing.T) {
+		expect(t, hello, []int{80}, true, helloSA)
+		expect(t, world, []int{80}, false, worldSA)
+		r.setAccounts(world.ClusterLocal.Hostname, worldSA, "spiffe://cluster.local/ns/other/sa/pod")
+		fakeControllerOf(r.Simple).fireWorkload(&model.WorkloadInstance{Name: "pod", Namespace: "other"}, model.EventAdd)
+		expect(t, world, []int{80}, true, "spiffe://cluster.local/ns/other/sa/pod", worldSA)
+		// the services of the other namespaces are kept
+		expect(t, hello, []int{80}, false, helloSA)
+	})
+
+	t.Run("registry added and deleted", func(t *testing.T) {
+		expect(t, hello, []int{80}, false, helloSA)
+		other := newAccountsRegistry("cluster-2", hello, "spiffe://cluster.local/ns/default/sa/remote")
+		ctl.AddRegistry(other)
+		expect(t, hello, []int{80}, true, helloSA, "spiffe://cluster.local/ns/default/sa/remote")
+		ctl.DeleteRegistry("cluster-2", provider.Kubernetes)
+		expect(t, hello, []int{80}, true, helloSA)
+	})
+
+	t.Run("registry stopped", func(t *testing.T) {
+		expect(t, hello, []int{80}, false, helloSA)
+		if err := ctl.StopRegistry("cluster-1", provider.Kubernetes); err != nil {
+			t.Fatal(err)
+		}
+		// a stopped registry is left out of the lookup
+		if got := ctl.GetIstioServiceAccounts(hello, []int{80}); len(got) != 0 {
+			t.Fatalf("expected no accounts from the stopped registry, got %v", got)
+		}
+		if err := ctl.StartRegistry("cluster-1", provider.Kubernetes); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, hello, []int{80}, true, helloSA)
+	})
+
+	t.Run("trust domain aliases", func(t *testing.T) {
+		expect(t, hello, []int{80}, false, helloSA)
+		holder.trustDomainAliases = []string{"cluster.local", "example.com"}
+		expect(t, hello, []int{80}, true, helloSA, "spiffe://example.com/ns/default/sa/hello")
+		expect(t, hello, []int{80}, false, helloSA, "spiffe://example.com/ns/default/sa/hello")
+		holder.trustDomainAliases = nil
+		expect(t, hello, []int{80}, true, helloSA)
+	})
+
+	t.Run("invalidated while computed", func(t *testing.T) {
+		fakeControllerOf(r.Simple).fireService(hello, model.EventUpdate)
+		r.mu.Lock()
+		r.during = func() {
+			fakeControllerOf(r.Simple).fireService(hello, model.EventUpdate)
+		}
+		r.mu.Unlock()
+		expect(t, hello, []int{80}, true, helloSA)
+		// the accounts computed concurrently with the event may be stale, and are not stored
+		expect(t, hello, []int{80}, true, helloSA)
+		expect(t, hello, []int{80}, false, helloSA)
+	})
+
+	t.Run("other service invalidated while computed", func(t *testing.T) {
+		fakeControllerOf(r.Simple).fireService(hello, model.EventUpdate)
+		r.mu.Lock()
+		r.during = func() {
+			fakeControllerOf(r.Simple).fireService(world, model.EventUpdate)
+			fakeControllerOf(r.Simple).fireWorkload(&model.WorkloadInstance{Name: "pod", Namespace: "other"}, model.EventUpdate)
+		}
+		r.mu.Unlock()
+		expect(t, hello, []int{80}, true, helloSA)
+		// the events of the other services and namespaces do not affect the accounts
+		expect(t, hello, []int{80}, false, helloSA)
+	})
+}
+
+func TestServiceAccountsCacheInvalidationsBounded(t *testing.T) {
+	ac := newServiceAccountsCache(2)
+	svc := &model.Service{ClusterLocal: model.HostVIPs{Hostname: "a.default"}, Attributes: model.ServiceAttributes{Namespace: "default"}}
+	key := serviceAccountsKey(svc, nil)
+	_, token, _ := ac.get(key, nil)
+	ac.invalidateHostname(svc.ClusterLocal.Hostname)
+	// the invalidations of the other keys past the limit are forgotten, and drop the concurrent computations
+	for _, h := range []host.Name{"b.default", "c.default"} {
+		ac.invalidateHostname(h)
+	}
+	if len(ac.invalidations.keys) > 2 {
+		t.Fatalf("expected the invalidations to be bounded to 2 keys, got %d", len(ac.invalidations.keys))
+	}
+	ac.add(token, key, svc, nil, []string{"a"})
+	if ac.len() != 0 {
+		t.Fatalf("expected the accounts computed before the invalidation not to be stored")
+	}
+	_, token, _ = ac.get(key, nil)
+	ac.add(token, key, svc, nil, []string{"a"})
+	if ac.len() != 1 {
+		t.Fatalf("expected the accounts computed after the invalidation to be stored")
+	}
+}
+
+func TestServiceAccountsCacheBounded(t *testing.T) {
+	ac := newServiceAccountsCache(2)
+	for _, h := range []host.Name{"a.default", "b.default", "c.default"} {
+		svc := &model.Service{ClusterLocal: model.HostVIPs{Hostname: h}}
+		_, token, _ := ac.get(serviceAccountsKey(svc, nil), nil)
+		ac.add(token, serviceAccountsKey(svc, nil), svc, nil, []string{string(h)})
+	}
+	if ac.len() != 2 {
+		t.Fatalf("expected the cache to be bounded to 2 entries, got %d", ac.len())
+	}
+}
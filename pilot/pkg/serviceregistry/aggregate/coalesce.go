@@ -0,0 +1,139 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+type pendingServiceEvent struct {
+	// first is the first event of the window, last the latest service reported.
+	first     model.Event
+	last      *model.Service
+	lastEvent model.Event
+}
+
+// serviceEventCoalescer merges the service events of a hostname received within a window, from any registry,
+// into a single event delivered once the window expires.
+type serviceEventCoalescer struct {
+	window time.Duration
+	// dispatch delivers a merged event. Calls are serialized.
+	dispatch func(*model.Service, model.Event)
+	// merged returns the service as merged across the registries, nil if no registry has it anymore.
+	merged func(host.Name) (*model.Service, error)
+
+	mu      sync.Mutex
+	pending map[host.Name]*pendingServiceEvent
+	// dispatchMu serializes the deliveries, which are run by timers.
+	dispatchMu sync.Mutex
+}
+
+func newServiceEventCoalescer(window time.Duration, merged func(host.Name) (*model.Service, error),
+	dispatch func(*model.Service, model.Event)) *serviceEventCoalescer {
+	return &serviceEventCoalescer{
+		window:   window,
+		dispatch: dispatch,
+		merged:   merged,
+		pending:  map[host.Name]*pendingServiceEvent{},
+	}
+}
+
+// enqueue records a service event of a registry, starting a window for its hostname if none is pending.
+func (q *serviceEventCoalescer) enqueue(svc *model.Service, event model.Event) {
+	hostname := svc.ClusterLocal.Hostname
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if p, f := q.pending[hostname]; f {
+		p.last, p.lastEvent = svc, event
+		return
+	}
+	q.pending[hostname] = &pendingServiceEvent{first: event, last: svc, lastEvent: event}
+	time.AfterFunc(q.window, func() {
+		q.flush(hostname)
+	})
+}
+
+// flush delivers the pending event of the hostname, carrying the service merged across the registries. It is a
+// delete if no registry has the service anymore, an add if the window started with an add, and an update
+// otherwise. Events received while flushing start a new window, so the final state is always delivered.
+func (q *serviceEventCoalescer) flush(hostname host.Name) {
+	q.dispatchMu.Lock()
+	defer q.dispatchMu.Unlock()
+	q.mu.Lock()
+	p := q.pending[hostname]
+	delete(q.pending, hostname)
+	q.mu.Unlock()
+	if p == nil {
+		return
+	}
+
+	merged, err := q.merged(hostname)
+	switch {
+	case err != nil && merged == nil:
+		// the merged state is unknown, deliver the latest event as received
+		q.dispatch(p.last, p.lastEvent)
+	case merged == nil:
+		q.dispatch(p.last, model.EventDelete)
+	case p.first == model.EventAdd:
+		q.dispatch(merged, model.EventAdd)
+	default:
+		q.dispatch(merged, model.EventUpdate)
+	}
+}
+
+// notificationCoalescer runs a notification in the background, in a single goroutine: the requests received
+// while it runs are merged into a single run after it. The runs are thus serialized and follow the last
+// request, and at most one is pending.
+type notificationCoalescer struct {
+	notify func()
+
+	mu      sync.Mutex
+	pending bool
+	running bool
+}
+
+func newNotificationCoalescer(notify func()) *notificationCoalescer {
+	return &notificationCoalescer{notify: notify}
+}
+
+// request schedules a run of the notification, starting the goroutine if none is running.
+func (q *notificationCoalescer) request() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = true
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+}
+
+// run notifies until no request is pending.
+func (q *notificationCoalescer) run() {
+	for {
+		q.mu.Lock()
+		if !q.pending {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		q.pending = false
+		q.mu.Unlock()
+		q.notify()
+	}
+}
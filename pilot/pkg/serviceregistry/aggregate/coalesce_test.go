@@ -0,0 +1,166 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+const coalesceWindow = 20 * time.Millisecond
+
+type serviceEvent struct {
+	svc   *model.Service
+	event model.Event
+}
+
+// expectServiceEvent waits for the next service event, and checks no other follows it within a few windows.
+func expectServiceEvent(t *testing.T, events chan serviceEvent) serviceEvent {
+	t.Helper()
+	var got serviceEvent
+	select {
+	case got = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the coalesced event")
+	}
+	select {
+	case extra := <-events:
+		t.Fatalf("expected a single event, got another %v", extra.event)
+	case <-time.After(5 * coalesceWindow):
+	}
+	return got
+}
+
+func TestCoalesceServiceEventsBurst(t *testing.T) {
+	ctl := NewController(Options{CoalesceServiceEvents: coalesceWindow})
+	var registries []serviceregistry.Simple
+	for i := 0; i < 5; i++ {
+		clusterID := cluster.ID(fmt.Sprintf("cluster-%d", i))
+		svc := mock.MakeService("hello.default.svc.cluster.local", fmt.Sprintf("10.10.0.%d", i), []string{}, clusterID)
+		r := newMemoryRegistry(provider.Kubernetes, clusterID, svc)
+		ctl.AddRegistry(r)
+		registries = append(registries, r)
+	}
+	events := make(chan serviceEvent, 10)
+	ctl.AppendServiceHandler(func(svc *model.Service, event model.Event) {
+		events <- serviceEvent{svc, event}
+	})
+
+	for _, r := range registries {
+		svc, _ := r.GetService("hello.default.svc.cluster.local")
+		fakeControllerOf(r).fireService(svc, model.EventAdd)
+	}
+	got := expectServiceEvent(t, events)
+	if got.event != model.EventAdd {
+		t.Errorf("expected an add, got %v", got.event)
+	}
+	if vips := len(got.svc.ClusterLocal.ClusterVIPs.GetAddresses()); vips != 5 {
+		t.Errorf("expected the service merged across the 5 clusters, got %d VIPs", vips)
+	}
+}
+
+// svcUpdater ignores the service updates of the memory registry.
+type svcUpdater struct {
+	model.XDSUpdater
+}
+
+func (svcUpdater) SvcUpdate(model.ShardKey, string, string, model.Event) {}
+
+func TestCoalesceServiceEventsDeleteAfterAdd(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	r := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	r.ServiceDiscovery.(*memory.ServiceDiscovery).EDSUpdater = svcUpdater{}
+	ctl := NewController(Options{CoalesceServiceEvents: coalesceWindow})
+	ctl.AddRegistry(r)
+	events := make(chan serviceEvent, 10)
+	ctl.AppendServiceHandler(func(svc *model.Service, event model.Event) {
+		events <- serviceEvent{svc, event}
+	})
+
+	fakeControllerOf(r).fireService(svc, model.EventAdd)
+	r.ServiceDiscovery.(*memory.ServiceDiscovery).RemoveService(svc.ClusterLocal.Hostname)
+	fakeControllerOf(r).fireService(svc, model.EventDelete)
+	// the last state, the service being deleted, is delivered
+	if got := expectServiceEvent(t, events); got.event != model.EventDelete || got.svc != svc {
+		t.Errorf("expected the delete of the service, got %v", got.event)
+	}
+
+	// a later event starts a new window
+	r.ServiceDiscovery.(*memory.ServiceDiscovery).AddService(svc.ClusterLocal.Hostname, svc)
+	fakeControllerOf(r).fireService(svc, model.EventAdd)
+	if got := expectServiceEvent(t, events); got.event != model.EventAdd {
+		t.Errorf("expected the add of the service, got %v", got.event)
+	}
+}
+
+func TestNotificationCoalescer(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var running, concurrent, calls atomic.Int32
+	q := newNotificationCoalescer(func() {
+		if running.Inc() > 1 {
+			concurrent.Inc()
+		}
+		calls.Inc()
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		running.Dec()
+	})
+
+	q.request()
+	<-started
+	// the requests received while the notification runs are merged into one run after it
+	for i := 0; i < 100; i++ {
+		q.request()
+	}
+	close(release)
+	retry.UntilSuccessOrFail(t, func() error {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.running {
+			return fmt.Errorf("expected the notifications to be done")
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected the requests to be merged into 2 notifications, got %d", got)
+	}
+	if concurrent.Load() != 0 {
+		t.Fatalf("expected the notifications not to run concurrently")
+	}
+
+	// a request after the runs starts a new one
+	q.request()
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := calls.Load(); got != 3 {
+			return fmt.Errorf("expected a third notification, got %d", got)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
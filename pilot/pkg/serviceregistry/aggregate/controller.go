@@ -15,8 +15,10 @@
 package aggregate
 
 import (
+	"context"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"go.uber.org/atomic"
@@ -28,6 +30,7 @@ import (
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/network"
 	"istio.io/istio/pkg/spiffe"
 	"istio.io/pkg/log"
 )
@@ -42,48 +45,476 @@ var (
 // Controller aggregates data across different registries and monitors for changes
 type Controller struct {
 	registries []serviceregistry.Instance
+	// generation is incremented whenever a registry is added or deleted.
+	generation uint64
 	storeLock  sync.RWMutex
 	meshHolder mesh.Holder
 	running    *atomic.Bool
+
+	skipInstanceDedup    bool
+	skipInstanceSort     bool
+	centralLabelMatching bool
+	filterNetworks       bool
+	fanOutWorkers        int
+	proxyClusterFallback bool
+	registryTimeout      time.Duration
+	requireSynced        bool
+	strictSync           bool
+	restartPanicked      bool
+	blockUntilSync       bool
+	blockSyncTimeout     time.Duration
+	registrySyncTimeout  time.Duration
+	stuckSyncThreshold   time.Duration
+	verifyAccountPorts   bool
+	accountPolicy        ServiceAccountPolicy
+	maxExpandedAccounts  int
+	bundleEndpoints      map[string]string
+	primaryCluster       cluster.ID
+	primarySyncTimeout   time.Duration
+	selectWorkloads      bool
+	handlerQueueSize     int
+	handlerOverflow      HandlerOverflowPolicy
+	handlerMetrics       bool
+	handlerFailures      int
+	mergeHook            InstanceMergeHook
+	meshGateways         bool
+	// fallbackLogLimiter rate limits the warnings about proxies found through the cluster fallback.
+	fallbackLogLimiter *keyedLimiter
+	// timeoutLogLimiter rate limits the warnings about registries timing out.
+	timeoutLogLimiter *keyedLimiter
+	// expansionLogLimiter rate limits the warnings about truncated service accounts, by hostname.
+	expansionLogLimiter *keyedLimiter
+	// conflictLogLimiter rate limits the warnings about conflicting gateways, by address and port.
+	conflictLogLimiter *keyedLimiter
+	// health tracks the registries with calls that timed out.
+	health *registryHealth
+	// syncs tracks when the registries were added and synced.
+	syncs *registrySyncs
+	// contributions records how many instances each registry contributes to sampled lookups.
+	contributions *contributionStats
+	// proxyCache caches the service instances of proxies, nil if disabled.
+	proxyCache *proxyInstancesCache
+	// accountsCache caches the service accounts of services, nil if disabled.
+	accountsCache *serviceAccountsCache
+	// gatewayCache caches the merged network gateways, nil if disabled.
+	gatewayCache *networkGatewaysCache
+	// gatewayEndpoints caches the healthy endpoint counts of the services backing the gateways, nil if disabled.
+	gatewayEndpoints *gatewayEndpointsCache
+	// workloads indexes the workload instances reported by the registries.
+	workloads *workloadIndex
+	// serviceHandlers and workloadHandlers are the handlers appended to the aggregate, in order. They are
+	// attached to the registries added later. Guarded by storeLock.
+	serviceHandlers  []*serviceHandler
+	workloadHandlers []*workloadHandler
+	lastHandlerID    HandlerID
+	// gatewayHandlers are called when the network gateways change. Guarded by storeLock.
+	gatewayHandlers []gatewayHandler
+	// mergedGateways are the network gateways last computed, to notify only their changes. Guarded by
+	// gatewayMutex, which serializes their computations.
+	mergedGateways []model.NetworkGateway
+	gatewayMutex   sync.Mutex
+	// gatewayNotifications notifies the gateway handlers of the changes of the gateway sources.
+	gatewayNotifications *notificationCoalescer
+	// meshConfigHandlers are called when the trust domain aliases change. Guarded by storeLock.
+	meshConfigHandlers []meshConfigHandler
+	// meshWatched is set once watching the changes of the mesh config, and meshAliases is then the
+	// signature of the trust domain aliases. Guarded by storeLock.
+	meshWatched bool
+	meshAliases string
+	// meshNetsWatched is set once watching the changes of the mesh networks. Guarded by storeLock.
+	meshNetsWatched bool
+	// sequencer orders the dispatch of the service events of each hostname.
+	sequencer *eventSequencer
+	// coalescer merges the service events delivered to the handlers, nil if disabled.
+	coalescer *serviceEventCoalescer
+	// unchanged suppresses the service events not changing the merged services, nil if disabled.
+	unchanged *unchangedServices
+	// attached is cleared when the registry is deleted, to stop the deliveries to the handlers of its cluster.
+	// Guarded by storeLock.
+	attached map[registryKey]*atomic.Bool
+	// streams are the consumers of Events. Guarded by storeLock.
+	streams []*eventStream
+	// stop is the channel given to Run, once running. Guarded by storeLock.
+	stop <-chan struct{}
+	// runContext is the context given to RunWithContext, or the background one for Run. Guarded by storeLock.
+	runContext context.Context
+	// runs tracks the start of the registries. Guarded by storeLock.
+	runs map[registryKey]*registryRun
+	// runningRegistries are the runs of the registries not returned yet. registriesExited is closed once there
+	// are none, and shutdowns counts the calls to Shutdown waiting for them, during which no registry is
+	// started. Guarded by storeLock.
+	runningRegistries map[*registryGoroutine]struct{}
+	registriesExited  chan struct{}
+	shutdowns         int
+	// primaryPending is set while Run waits for the primary cluster to sync. Guarded by storeLock.
+	primaryPending bool
+	// synced is the syncedState of the registries HasSynced last found synced, if any.
+	synced atomic.Value
+	// lifecycle is the current or next run of the aggregate. Guarded by storeLock.
+	lifecycle *runLifecycle
+	// stoppedRegistries counts the registries stopped by StopRegistry, to skip looking them up when none is.
+	stoppedRegistries atomic.Int32
+	// lifecycleEvents buffers the events of LifecycleEvents.
+	lifecycleEvents lifecycleStream
+	// allSynced is set once AllSynced is reported, and cleared when a registry is added.
+	allSynced atomic.Bool
 }
 
 type Options struct {
 	MeshHolder mesh.Holder
+
+	// SkipInstanceDedup disables collapsing of identical endpoints reported by more than one registry.
+	// Deduplication costs a map pass over every returned instance, which may matter for very large services.
+	SkipInstanceDedup bool
+
+	// SkipInstanceSort disables sorting the aggregated instances by cluster, address and port. Without
+	// sorting, the order depends on the registries and may change between calls with identical state,
+	// churning the generated EDS.
+	SkipInstanceSort bool
+
+	// CentralLabelMatching makes InstancesByPort request every instance from the registries and match the
+	// labels once on the aggregated result, so the matching semantics do not depend on each registry's
+	// implementation. The registries may then return many more instances than needed.
+	CentralLabelMatching bool
+
+	// FilterUnreachableNetworks drops, from GetProxyServiceInstances and InstancesByPortForProxy, the
+	// instances on networks other than the proxy's that have no gateway. The MeshHolder may also implement
+	// mesh.NetworksHolder to provide the gateways declared in the mesh networks. Nothing is filtered while
+	// no gateway is known at all.
+	FilterUnreachableNetworks bool
+
+	// InstanceStatsSampling records the number of instances each registry contributes to one in this many
+	// InstancesByPort and GetProxyServiceInstances calls, see InstanceContributionStats. Zero disables the
+	// recording.
+	InstanceStatsSampling int
+
+	// RegistryTimeout bounds the time GetProxyServiceInstances and GetIstioServiceAccounts wait for each
+	// registry. A registry not answering in time is skipped, returning partial results, and is reported by
+	// UnhealthyRegistries until the call returns. Zero waits indefinitely.
+	RegistryTimeout time.Duration
+
+	// InstanceMergeHook, if set, replaces the built-in concatenation and deduplication of the instances
+	// reported by the registries to InstancesByPort, GetProxyServiceInstances and the other instance
+	// lookups. See DedupInstancesByAddress and CapInstancesPerCluster.
+	InstanceMergeHook InstanceMergeHook
+
+	// RequireSyncedRegistries skips the registries that have not synced yet in the instance, network
+	// gateway and service account lookups, rather than serving what they have so far. A registry of a cluster that is still
+	// syncing usually knows few endpoints, which would briefly drain that cluster from the mesh.
+	RequireSyncedRegistries bool
+
+	// SelectWorkloadsAcrossRegistries adds, to the instances of Kubernetes services with a selector, the
+	// matching workload instances reported by the workload events of any searched registry, such as
+	// WorkloadEntries of the External registry. Registries only select the workloads they were told about,
+	// which misses the workloads of registries in other clusters.
+	SelectWorkloadsAcrossRegistries bool
+
+	// CoalesceServiceEvents merges the service events of a hostname received from any registry within this
+	// window into a single event, carrying the service merged across the registries, delivered to the handlers
+	// once the window expires. This saves consumers from rebuilding their state for each cluster of a service.
+	// Handlers added with AppendServiceHandlerForCluster are not coalesced. Zero disables coalescing.
+	CoalesceServiceEvents time.Duration
+
+	// AsyncHandlerQueueSize makes the service and workload handlers added to the aggregate called
+	// asynchronously, each on its own goroutine with a queue of this many events, so that a slow handler does
+	// not hold up the registries and the other handlers. Each handler still receives the events in order.
+	// Zero calls the handlers synchronously, from the registries.
+	AsyncHandlerQueueSize int
+
+	// AsyncHandlerOverflow selects what happens to the events of a handler whose queue is full, see
+	// AsyncHandlerQueueSize. The default blocks the registry.
+	AsyncHandlerOverflow HandlerOverflowPolicy
+
+	// HandlerMetrics records the number and duration of the calls to each service and workload handler added
+	// to the aggregate, see AppendServiceHandlerNamed.
+	HandlerMetrics bool
+
+	// SuppressUnchangedServiceEvents drops the service events that leave the service merged across the
+	// registries unchanged since the previous event of its hostname, typically when several clusters report
+	// the same change. Only the ports, addresses, labels, service accounts and resolution of the service are
+	// compared. Deletes are always delivered, and so are the events of the handlers added with
+	// AppendServiceHandlerForCluster or AppendServiceHandlerWithSource.
+	SuppressUnchangedServiceEvents bool
+
+	// HandlerFailureBuffer keeps the last failures of each service and workload handler, up to this many, to
+	// be inspected with HandlerFailures. A failure is a panic of the handler, or an error returned by a handler
+	// added with AppendServiceHandlerWithError. Zero keeps none.
+	HandlerFailureBuffer int
+
+	// FanOutWorkers bounds the number of registries queried concurrently when aggregating instances and
+	// service accounts.
+	// Zero selects a default; 1 queries the registries serially, in order, which can help debugging.
+	FanOutWorkers int
+
+	// ProxyClusterFallback searches the registries of every cluster when none of the registries for the
+	// cluster reported by a proxy know about it. This helps proxies reporting a stale or wrong CLUSTER_ID.
+	ProxyClusterFallback bool
+
+	// ProxyInstancesCacheSize enables caching the result of GetProxyServiceInstances for up to this many
+	// proxies. Entries are invalidated by the service and workload events of the registries. Every call gets
+	// its own slice, which the callers such as model.Proxy.SetServiceInstances sort in place. Zero disables
+	// the cache.
+	ProxyInstancesCacheSize int
+
+	// ServiceAccountsCacheSize enables caching the result of GetIstioServiceAccounts for up to this many
+	// services and ports. Entries are invalidated by the service events of the service, by the workload events
+	// of its namespace, by the changes of the registries and of the trust domain aliases. Zero disables the
+	// cache.
+	ServiceAccountsCacheSize int
+
+	// CacheNetworkGateways enables caching the result of NetworkGateways, which is otherwise merged from the
+	// registries on every call. The gateways are invalidated by the gateway notifications of the registries,
+	// by the service events of the registries not sending them, and by the changes of the registries and of
+	// their sync and health.
+	CacheNetworkGateways bool
+
+	// ResolveMeshNetworkGateways adds the gateways of the mesh networks configuration to NetworkGateways, the
+	// MeshHolder implementing mesh.NetworksHolder. The gateways given by registryServiceName are resolved
+	// against the services of the registries of their network, and notified to the gateway handlers as the
+	// configuration or the services change.
+	ResolveMeshNetworkGateways bool
+
+	// RequireGatewayEndpoints leaves out of NetworkGateways the gateways whose backing service has no healthy
+	// instance in their cluster, as when the gateway deployment is scaled to zero, so that no cross-network
+	// traffic is sent to them. The gateways given by address, with no backing service, are kept. The gateway
+	// handlers are notified as the gateways are dropped and restored, on the service events of the backing
+	// services, and on the workload events of their namespace.
+	RequireGatewayEndpoints bool
+
+	// MaxExpandedServiceAccounts bounds the number of service accounts GetIstioServiceAccounts returns once
+	// expanded with the trust domain aliases, as each alias multiplies them. Past it, the expanded accounts
+	// are truncated, keeping the first ones in order, and a warning is logged. The accounts reported by the
+	// registries are always kept. Zero does not bound them.
+	MaxExpandedServiceAccounts int
+
+	// SpiffeBundleEndpoints maps trust domains to the endpoint of their SPIFFE bundle, for the trust domains
+	// reported by TrustDomainsForService without an endpoint of their own.
+	SpiffeBundleEndpoints map[string]string
+
+	// ServiceAccountPolicy selects the service accounts GetIstioServiceAccounts returns for a service having both
+	// accounts provided by an annotation and accounts derived from its endpoints. The default returns both.
+	ServiceAccountPolicy ServiceAccountPolicy
+
+	// VerifyServiceAccountPorts makes GetIstioServiceAccounts drop the accounts a registry reports for a service
+	// that none of its instances on the requested ports run as, since some registries ignore the ports. The
+	// accounts declared by the service itself are kept, the accounts of the workloads the service selects are kept
+	// if they serve one of the ports. This costs a lookup of the instances of each port.
+	VerifyServiceAccountPorts bool
+
+	// StrictSync makes HasSynced wait for every registry, including those the aggregate is not serving: the
+	// registries with calls that timed out, those whose Run panicked, and those stopped by StopRegistry. By
+	// default, they are excluded from the sync and reported as such by SyncStatus, so that a wedged remote
+	// cluster does not keep the aggregate unsynced.
+	StrictSync bool
+
+	// RestartPanickedRegistries runs again, after a backoff, the registries whose Run panicked. Such a registry
+	// is otherwise left dead, and reported by UnhealthyRegistries, until the aggregate is run again.
+	RestartPanickedRegistries bool
+
+	// BlockRunUntilSync makes Run report the aggregate running only once all registries have synced, including
+	// those added meanwhile, or once BlockRunUntilSyncTimeout has expired, to avoid serving empty data. The
+	// registries are still started at once, by Run and AddRegistry.
+	BlockRunUntilSync bool
+	// BlockRunUntilSyncTimeout bounds the wait of BlockRunUntilSync, after which the aggregate runs without the
+	// registries still syncing. Zero waits until they have synced.
+	BlockRunUntilSyncTimeout time.Duration
+
+	// RegistrySyncTimeout excludes from HasSynced the registries that have not synced within this time after
+	// they are started, so that a cluster that never syncs does not keep the aggregate unsynced. Such a registry
+	// is reported by SyncStatus, and rejoins once synced, its services then being notified to the handlers as
+	// updated. Zero waits for the registries indefinitely.
+	RegistrySyncTimeout time.Duration
+
+	// StuckSyncThreshold makes the running aggregate warn about the registries still syncing this long after
+	// they were added, again at 5 and 10 times the threshold with a raised log level, without changing what
+	// HasSynced returns. Zero disables the warnings.
+	StuckSyncThreshold time.Duration
+
+	// PrimaryCluster is the cluster whose registries Run starts first, usually the config cluster, so that its
+	// services are known before those of the remote clusters, which they take precedence over when merged.
+	PrimaryCluster cluster.ID
+	// PrimarySyncTimeout makes Run wait for the registries of PrimaryCluster to sync, for at most this time,
+	// before starting the others, including those added meanwhile. Zero starts them all at once.
+	PrimarySyncTimeout time.Duration
 }
 
+// defaultFanOutWorkers is the number of registries queried concurrently when Options.FanOutWorkers is unset.
+const defaultFanOutWorkers = 16
+
 // NewController creates a new Aggregate controller
 func NewController(opt Options) *Controller {
-	return &Controller{
-		registries: make([]serviceregistry.Instance, 0),
-		meshHolder: opt.MeshHolder,
-		running:    atomic.NewBool(false),
+	fanOutWorkers := opt.FanOutWorkers
+	if fanOutWorkers <= 0 {
+		fanOutWorkers = defaultFanOutWorkers
+	}
+	c := &Controller{
+		registries:           make([]serviceregistry.Instance, 0),
+		meshHolder:           opt.MeshHolder,
+		running:              atomic.NewBool(false),
+		skipInstanceDedup:    opt.SkipInstanceDedup,
+		skipInstanceSort:     opt.SkipInstanceSort,
+		centralLabelMatching: opt.CentralLabelMatching,
+		filterNetworks:       opt.FilterUnreachableNetworks,
+		contributions:        newContributionStats(opt.InstanceStatsSampling),
+		registryTimeout:      opt.RegistryTimeout,
+		mergeHook:            opt.InstanceMergeHook,
+		requireSynced:        opt.RequireSyncedRegistries,
+		strictSync:           opt.StrictSync,
+		restartPanicked:      opt.RestartPanickedRegistries,
+		blockUntilSync:       opt.BlockRunUntilSync,
+		blockSyncTimeout:     opt.BlockRunUntilSyncTimeout,
+		registrySyncTimeout:  opt.RegistrySyncTimeout,
+		stuckSyncThreshold:   opt.StuckSyncThreshold,
+		verifyAccountPorts:   opt.VerifyServiceAccountPorts,
+		accountPolicy:        opt.ServiceAccountPolicy,
+		maxExpandedAccounts:  opt.MaxExpandedServiceAccounts,
+		bundleEndpoints:      opt.SpiffeBundleEndpoints,
+		primaryCluster:       opt.PrimaryCluster,
+		primarySyncTimeout:   opt.PrimarySyncTimeout,
+		selectWorkloads:      opt.SelectWorkloadsAcrossRegistries,
+		handlerQueueSize:     opt.AsyncHandlerQueueSize,
+		handlerOverflow:      opt.AsyncHandlerOverflow,
+		handlerMetrics:       opt.HandlerMetrics,
+		meshGateways:         opt.ResolveMeshNetworkGateways,
+		handlerFailures:      opt.HandlerFailureBuffer,
+		timeoutLogLimiter:    newKeyedLimiter(defaultLogInterval),
+		expansionLogLimiter:  newKeyedLimiter(defaultLogInterval),
+		conflictLogLimiter:   newKeyedLimiter(defaultLogInterval),
+		health:               newRegistryHealth(),
+		syncs:                newRegistrySyncs(),
+		fanOutWorkers:        fanOutWorkers,
+		proxyClusterFallback: opt.ProxyClusterFallback,
+		fallbackLogLimiter:   newKeyedLimiter(defaultLogInterval),
+		workloads:            newWorkloadIndex(),
+		attached:             map[registryKey]*atomic.Bool{},
+		sequencer:            newEventSequencer(),
+		runs:                 map[registryKey]*registryRun{},
+		runningRegistries:    map[*registryGoroutine]struct{}{},
+		registriesExited:     closedChannel(),
+		lifecycle:            newRunLifecycle(),
+	}
+	c.gatewayNotifications = newNotificationCoalescer(c.notifyNetworkGatewayHandlers)
+	if opt.SuppressUnchangedServiceEvents {
+		c.unchanged = newUnchangedServices()
+	}
+	if opt.CoalesceServiceEvents > 0 {
+		c.coalescer = newServiceEventCoalescer(opt.CoalesceServiceEvents, c.GetService, func(svc *model.Service, event model.Event) {
+			c.dispatchServiceEvent(svc, event, nil)
+		})
+	}
+	if opt.ProxyInstancesCacheSize > 0 {
+		c.proxyCache = newProxyInstancesCache(opt.ProxyInstancesCacheSize)
 	}
+	if opt.ServiceAccountsCacheSize > 0 {
+		c.accountsCache = newServiceAccountsCache(opt.ServiceAccountsCacheSize)
+	}
+	if opt.CacheNetworkGateways {
+		c.gatewayCache = newNetworkGatewaysCache()
+	}
+	if opt.RequireGatewayEndpoints {
+		c.gatewayEndpoints = newGatewayEndpointsCache()
+	}
+	return c
 }
 
-// AddRegistry adds registries into the aggregated controller
+// AddRegistry adds registries into the aggregated controller. The registry is started by Run, or at once with
+// the stop channel given to Run if the aggregate is running. Once that channel is closed, the registry is left
+// not started, as reported by RegistryRunning, until the next Run; it can still be deleted meanwhile.
 func (c *Controller) AddRegistry(registry serviceregistry.Instance) {
-	c.storeLock.Lock()
-	defer c.storeLock.Unlock()
+	c.addRegistry(registry, nil)
+}
+
+// AddRegistryAndRun is like AddRegistry, but the registry is run with the given stop channel rather than the one
+// given to Run, so that it can be stopped on its own. It is still started by the aggregate, once running.
+func (c *Controller) AddRegistryAndRun(registry serviceregistry.Instance, stop <-chan struct{}) {
+	c.addRegistry(registry, stop)
+}
 
+func (c *Controller) addRegistry(registry serviceregistry.Instance, stop <-chan struct{}) {
+	key := registryKey{cluster: registry.Cluster(), provider: registry.Provider()}
+	lastEvent := c.syncs.addRegistry(key)
+	if c.proxyCache != nil {
+		c.watchForProxyCache(registry)
+	}
+	if c.accountsCache != nil {
+		c.watchForAccountsCache(registry)
+	}
+	if c.meshGateways {
+		c.watchMeshGatewayServices(registry)
+	}
+	if c.gatewayEndpoints != nil {
+		c.watchGatewayEndpoints(registry)
+	}
+	if hasController(registry) {
+		c.watchWorkloads(key, registry, lastEvent)
+	}
+
+	c.storeLock.Lock()
+	c.attached[registryKey{cluster: registry.Cluster(), provider: registry.Provider()}] = atomic.NewBool(true)
+	// the registry is reported before its events
+	c.notifyStreams(RegistryAdded, registry)
+	c.notifyLifecycle(LifecycleRegistryAdded, registry.Cluster(), registry.Provider())
+	c.allSynced.Store(false)
+	if c.coalescer != nil && hasController(registry) {
+		registry.AppendServiceHandler(c.coalescer.enqueue)
+	}
+	c.watchServiceEvents(registry, lastEvent)
+	for _, h := range c.workloadHandlers {
+		c.attachWorkloadHandler(registry, h)
+	}
+	c.watchNetworkGateways(registry)
 	c.registries = append(c.registries, registry)
+	c.registriesChanged()
+	c.runs[key] = &registryRun{stop: stop, state: RunStateNotStarted}
+	if c.stop != nil {
+		// the aggregate is running, and starts the registries added later
+		c.startRegistry(key, registry)
+	}
+	c.storeLock.Unlock()
+
+	c.notifyNetworkGatewayHandlers()
 }
 
 // DeleteRegistry deletes specified registry from the aggregated controller
 func (c *Controller) DeleteRegistry(clusterID cluster.ID, providerID provider.ID) {
+	if deleted := c.deleteRegistry(clusterID, providerID); deleted != nil {
+		c.notifyNetworkGatewayHandlers()
+	}
+}
+
+// deleteRegistry deletes the registry, returning it, or nil if it is not found.
+func (c *Controller) deleteRegistry(clusterID cluster.ID, providerID provider.ID) serviceregistry.Instance {
 	c.storeLock.Lock()
 	defer c.storeLock.Unlock()
 
 	if len(c.registries) == 0 {
 		log.Warnf("Registry list is empty, nothing to delete")
-		return
+		return nil
 	}
 	index, ok := c.getRegistryIndex(clusterID, providerID)
 	if !ok {
 		log.Warnf("Registry %s is not found in the registries list, nothing to delete", clusterID)
-		return
+		return nil
 	}
+	deleted := c.registries[index]
 	c.registries = append(c.registries[:index], c.registries[index+1:]...)
+	c.notifyStreams(RegistryDeleted, deleted)
+	c.notifyLifecycle(LifecycleRegistryRemoved, clusterID, providerID)
+	c.registriesChanged()
+	c.workloads.deleteRegistry(registryKey{cluster: clusterID, provider: providerID})
+	c.contributions.deleteRegistry(registryKey{cluster: clusterID, provider: providerID})
+	c.health.deleteRegistry(registryKey{cluster: clusterID, provider: providerID})
+	c.syncs.deleteRegistry(registryKey{cluster: clusterID, provider: providerID})
+	if attached, f := c.attached[registryKey{cluster: clusterID, provider: providerID}]; f {
+		attached.Store(false)
+		delete(c.attached, registryKey{cluster: clusterID, provider: providerID})
+	}
+	if run, f := c.runs[registryKey{cluster: clusterID, provider: providerID}]; f && run.stopped {
+		c.stoppedRegistries.Dec()
+	}
+	delete(c.runs, registryKey{cluster: clusterID, provider: providerID})
 	log.Infof("Registry for the cluster %s has been deleted.", clusterID)
+	return deleted
 }
 
 // GetRegistries returns a copy of all registries
@@ -99,6 +530,47 @@ func (c *Controller) GetRegistries() []serviceregistry.Instance {
 	return out
 }
 
+// syncedRegistries leaves out the registries stopped by StopRegistry, and those that have not synced yet if
+// Options.RequireSyncedRegistries is set, recording that the lookup is served partial data.
+func (c *Controller) syncedRegistries(lookup string, registries []serviceregistry.Instance) []serviceregistry.Instance {
+	if !c.requireSynced && c.stoppedRegistries.Load() == 0 {
+		return registries
+	}
+	out := registries[:0]
+	for _, r := range registries {
+		if c.registryServed(lookup, r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// registryServed returns false if the lookup skips the registry, as syncedRegistries does, recording the
+// unsynced registries skipped.
+func (c *Controller) registryServed(lookup string, r serviceregistry.Instance) bool {
+	if !c.requireSynced && c.stoppedRegistries.Load() == 0 {
+		return true
+	}
+	if c.registryStopped(registryKey{cluster: r.Cluster(), provider: r.Provider()}) {
+		return false
+	}
+	if c.requireSynced && !r.HasSynced() {
+		unsyncedRegistriesSkipped.With(clusterTag.Value(string(r.Cluster())), providerTag.Value(string(r.Provider())),
+			searchTag.Value(lookup)).Increment()
+		return false
+	}
+	return true
+}
+
+// getRegistriesAndGeneration returns a copy of all registries along with the generation of the registry set.
+func (c *Controller) getRegistriesAndGeneration() ([]serviceregistry.Instance, uint64) {
+	c.storeLock.RLock()
+	defer c.storeLock.RUnlock()
+	out := make([]serviceregistry.Instance, len(c.registries))
+	copy(out, c.registries)
+	return out, c.generation
+}
+
 func (c *Controller) getRegistryIndex(clusterID cluster.ID, provider provider.ID) (int, bool) {
 	for i, r := range c.registries {
 		if r.Cluster().Equals(clusterID) && r.Provider() == provider {
@@ -182,22 +654,430 @@ func mergeService(dst, src *model.Service, srcRegistry serviceregistry.Instance)
 }
 
 // NetworkGateways merges the service-based cross-network gateways from each registry.
+// The gateways are sorted by network, address and port. A gateway with the same network, address and port
+// discovered by more than one registry, as the east-west gateway of a primary-remote setup is, is returned
+// once. See mergeNetworkGateways for the resulting weight, and for the gateway kept when the same address
+// and port are given for several networks, as reported by GatewayConflicts. The registries stopped, unhealthy,
+// or unsynced with Options.RequireSyncedRegistries are left out, see gatewayRegistries. With
+// Options.ResolveMeshNetworkGateways, the gateways of the mesh networks configuration are added. With
+// Options.RequireGatewayEndpoints, the gateways whose backing service has no healthy instance are left out.
 func (c *Controller) NetworkGateways() []*model.NetworkGateway {
-	var gws []*model.NetworkGateway
-	for _, r := range c.GetRegistries() {
-		gws = append(gws, r.NetworkGateways()...)
+	if c.gatewayCache != nil {
+		return c.cachedNetworkGateways()
 	}
+	gws, conflicts := c.mergedNetworkGateways()
+	c.reportGatewayConflicts(conflicts)
 	return gws
 }
 
 // InstancesByPort retrieves instances for a service on a given port that match
 // any of the supplied labels. All instances match an empty label list.
+// Identical endpoints reported by more than one registry are collapsed into one, unless
+// Options.SkipInstanceDedup is set.
 func (c *Controller) InstancesByPort(svc *model.Service, port int, labels labels.Collection) []*model.ServiceInstance {
-	var instances []*model.ServiceInstance
-	for _, r := range c.GetRegistries() {
-		instances = append(instances, r.InstancesByPort(svc, port, labels)...)
+	return c.InstancesByPortForCluster(svc, port, labels, "")
+}
+
+// InstancesByPortForCluster is like InstancesByPort, but only consults the registries of the given cluster, of
+// any provider. Registries that are not cluster specific, such as ServiceEntry stores with no cluster, are
+// skipped, unlike when finding the instances of a proxy. An empty clusterID consults every registry.
+func (c *Controller) InstancesByPortForCluster(svc *model.Service, port int, labels labels.Collection,
+	clusterID cluster.ID) []*model.ServiceInstance {
+	return c.aggregateInstances(c.registryInstancesByPort(svc, port, labels, clusterID), labels)
+}
+
+// registryInstancesByPort fans out InstancesByPort to the registries searched for clusterID, returning
+// the result of each registry.
+func (c *Controller) registryInstancesByPort(svc *model.Service, port int, labels labels.Collection,
+	clusterID cluster.ID) []registryInstances {
+	registries := c.instanceRegistries(clusterID)
+	registryLabels := c.registryLabels(labels)
+	results := make([]registryInstances, len(registries))
+	c.fanOut(registries, func(i int, r serviceregistry.Instance) {
+		results[i] = registryInstances{cluster: r.Cluster(), provider: r.Provider(), instances: r.InstancesByPort(svc, port, registryLabels)}
+	})
+	return c.completeRegistryInstances(svc, port, registryLabels, registries, results)
+}
+
+// instanceRegistries returns the registries searched for the instances of a service for clusterID.
+func (c *Controller) instanceRegistries(clusterID cluster.ID) []serviceregistry.Instance {
+	var registries []serviceregistry.Instance
+	for _, r := range c.syncedRegistries(string(SearchInstances), c.GetRegistries()) {
+		if skip, _ := c.skipRegistry(SearchInstances, clusterID, r); skip {
+			continue
+		}
+		registries = append(registries, r)
+	}
+	return registries
+}
+
+// registryLabels returns the labels the registries are asked to match, none with Options.CentralLabelMatching.
+func (c *Controller) registryLabels(lbls labels.Collection) labels.Collection {
+	if c.centralLabelMatching {
+		return nil
+	}
+	return lbls
+}
+
+// completeRegistryInstances records the instances each registry reported for a port of the service, and adds
+// the workloads the service selects across the registries with Options.SelectWorkloadsAcrossRegistries.
+func (c *Controller) completeRegistryInstances(svc *model.Service, port int, registryLabels labels.Collection,
+	registries []serviceregistry.Instance, results []registryInstances) []registryInstances {
+	c.recordContributions(SearchInstances, results)
+	if c.selectWorkloads {
+		results = append(results, c.selectedWorkloadInstances(svc, port, registryLabels, registries)...)
+	}
+	return results
+}
+
+// InstancesByPortSharded returns the instances of InstancesByPort grouped by the shard of the registry that
+// reported them, keyed by its cluster and provider. Shards without instances are omitted. Instances created
+// by an Options.InstanceMergeHook, rather than reported by a registry, are grouped under the empty key.
+func (c *Controller) InstancesByPortSharded(svc *model.Service, port int, labels labels.Collection) map[model.ShardKey][]*model.ServiceInstance {
+	results := c.registryInstancesByPort(svc, port, labels, "")
+	instances := c.aggregateInstances(results, labels)
+	out := map[model.ShardKey][]*model.ServiceInstance{}
+	if len(instances) == 0 {
+		return out
+	}
+	owners := make(map[*model.ServiceInstance]model.ShardKey, len(instances))
+	for _, res := range results {
+		shard := model.NewShardKey(res.cluster, res.provider)
+		for _, inst := range res.instances {
+			if _, f := owners[inst]; !f {
+				owners[inst] = shard
+			}
+		}
+	}
+	// walking the aggregated instances keeps their order within each shard
+	for _, inst := range instances {
+		shard := owners[inst]
+		out[shard] = append(out[shard], inst)
+	}
+	return out
+}
+
+// InstancesByPortPerCluster returns the instances of InstancesByPort grouped by the cluster of the registry
+// that reported them, so that the union of the groups is the result of InstancesByPort. Registries sharing a
+// cluster, such as the Kubernetes and External registries of a cluster, are grouped together; registries
+// without a cluster, and instances created by an Options.InstanceMergeHook, are grouped under the empty
+// cluster ID. Clusters without instances are omitted.
+func (c *Controller) InstancesByPortPerCluster(svc *model.Service, port int, labels labels.Collection) map[cluster.ID][]*model.ServiceInstance {
+	results := c.registryInstancesByPort(svc, port, labels, "")
+	instances := c.aggregateInstances(results, labels)
+	out := map[cluster.ID][]*model.ServiceInstance{}
+	if len(instances) == 0 {
+		return out
+	}
+	owners := make(map[*model.ServiceInstance]cluster.ID, len(instances))
+	for _, res := range results {
+		for _, inst := range res.instances {
+			if _, f := owners[inst]; !f {
+				owners[inst] = res.cluster
+			}
+		}
+	}
+	for _, inst := range instances {
+		clusterID := owners[inst]
+		out[clusterID] = append(out[clusterID], inst)
+	}
+	return out
+}
+
+// instancesByPortsGetter is implemented by registries able to list the instances of several ports of a
+// service at once.
+type instancesByPortsGetter interface {
+	InstancesByPorts(svc *model.Service, ports []int, labels labels.Collection) map[int][]*model.ServiceInstance
+}
+
+// InstancesByPorts returns the instances of each of the given ports of the service, as InstancesByPort
+// would for each of them, but visiting every registry once. Registries able to list several ports at once
+// are asked for all of them in a single call. Every requested port is present in the result.
+func (c *Controller) InstancesByPorts(svc *model.Service, ports []int, lbls labels.Collection) map[int][]*model.ServiceInstance {
+	registries := c.instanceRegistries("")
+	registryLabels := c.registryLabels(lbls)
+	// results holds, for each registry, its instances by port
+	results := make([]map[int][]*model.ServiceInstance, len(registries))
+	c.fanOut(registries, func(i int, r serviceregistry.Instance) {
+		if getter, ok := r.(instancesByPortsGetter); ok {
+			results[i] = getter.InstancesByPorts(svc, ports, registryLabels)
+			return
+		}
+		byPort := make(map[int][]*model.ServiceInstance, len(ports))
+		for _, port := range ports {
+			byPort[port] = r.InstancesByPort(svc, port, registryLabels)
+		}
+		results[i] = byPort
+	})
+
+	out := make(map[int][]*model.ServiceInstance, len(ports))
+	for _, port := range ports {
+		if _, f := out[port]; f {
+			continue
+		}
+		portResults := make([]registryInstances, len(registries))
+		for i, r := range registries {
+			portResults[i] = registryInstances{cluster: r.Cluster(), provider: r.Provider(), instances: results[i][port]}
+		}
+		portResults = c.completeRegistryInstances(svc, port, registryLabels, registries, portResults)
+		out[port] = c.aggregateInstances(portResults, lbls)
+	}
+	return out
+}
+
+// aggregateInstances builds the final result of an instance lookup from the per-registry results.
+func (c *Controller) aggregateInstances(results []registryInstances, lbls labels.Collection) []*model.ServiceInstance {
+	out := c.mergeInstances(results)
+	if c.centralLabelMatching && len(lbls) > 0 {
+		out = matchInstanceLabels(out, lbls)
+	}
+	if !c.skipInstanceSort {
+		sortInstances(out)
+	}
+	return out
+}
+
+// instancesByIPGetter is implemented by registries that index their instances by IP address, allowing
+// GetInstancesByIP to skip building a synthetic proxy for them.
+type instancesByIPGetter interface {
+	GetInstancesByIP(ip string) []*model.ServiceInstance
+}
+
+// GetInstancesByIP returns the service instances of the given IP address, in any registry.
+// Identical instances reported by more than one registry are deduplicated as in InstancesByPort.
+func (c *Controller) GetInstancesByIP(ip string) []*model.ServiceInstance {
+	return c.GetInstancesByIPForCluster(ip, "")
+}
+
+// GetInstancesByIPForCluster is like GetInstancesByIP, but skips the registries of clusters other than
+// clusterID, following the same rules as InstancesByPortForCluster. Like InstancesByPort, it skips the registries
+// unsynced with Options.RequireSyncedRegistries.
+func (c *Controller) GetInstancesByIPForCluster(ip string, clusterID cluster.ID) []*model.ServiceInstance {
+	var registries []serviceregistry.Instance
+	for _, r := range c.syncedRegistries("InstancesByIP", c.GetRegistries()) {
+		if skip, _ := c.skipRegistry(SearchInstances, clusterID, r); skip {
+			continue
+		}
+		registries = append(registries, r)
+	}
+	results := make([]registryInstances, len(registries))
+	c.fanOut(registries, func(i int, r serviceregistry.Instance) {
+		results[i] = registryInstances{cluster: r.Cluster(), provider: r.Provider(), instances: registryInstancesByIP(r, ip)}
+	})
+	return c.aggregateInstances(results, nil)
+}
+
+// registryInstancesByIP returns the instances of the ip in the registry, using its IP index if it has one.
+// Otherwise the registry is asked about a synthetic proxy with just that address.
+func registryInstancesByIP(r serviceregistry.Instance, ip string) []*model.ServiceInstance {
+	if getter, ok := r.(instancesByIPGetter); ok {
+		return getter.GetInstancesByIP(ip)
+	}
+	proxy := &model.Proxy{
+		ID:          ip,
+		IPAddresses: []string{ip},
+		Metadata:    &model.NodeMetadata{ClusterID: r.Cluster()},
+	}
+	return r.GetProxyServiceInstances(proxy)
+}
+
+// fanOut invokes fn for every registry, with at most fanOutWorkers invocations running concurrently.
+// fn receives the index of the registry so that it can record its result without further locking.
+// fanOut returns once every invocation has completed.
+func (c *Controller) fanOut(registries []serviceregistry.Instance, fn func(i int, r serviceregistry.Instance)) {
+	workers := c.fanOutWorkers
+	if workers > len(registries) {
+		workers = len(registries)
+	}
+	if workers <= 1 {
+		for i, r := range registries {
+			fn(i, r)
+		}
+		return
+	}
+	next := atomic.NewInt64(-1)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Inc())
+				if i >= len(registries) {
+					return
+				}
+				fn(i, registries[i])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// HealthyInstancesByPort is like InstancesByPort, but leaves out the instances whose endpoint is known to be
+// unhealthy. Instances with an unset health status are considered healthy.
+func (c *Controller) HealthyInstancesByPort(svc *model.Service, port int, labels labels.Collection) []*model.ServiceInstance {
+	return filterHealthyInstances(c.InstancesByPort(svc, port, labels))
+}
+
+// InstancesByPortAndLocality is like InstancesByPort, but only returns the instances within the given
+// locality. The locality is a "/" separated region, region/zone or region/zone/subzone prefix, matched
+// against the locality label of the endpoints; any of its parts may be "*". Instances without a locality
+// never match a non-empty locality. An empty locality does not filter.
+func (c *Controller) InstancesByPortAndLocality(svc *model.Service, port int, labels labels.Collection,
+	locality string) []*model.ServiceInstance {
+	instances := c.InstancesByPort(svc, port, labels)
+	if locality == "" {
+		return instances
+	}
+	region, zone, subzone := model.SplitLocalityLabel(locality)
+	out := make([]*model.ServiceInstance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.Endpoint != nil && localityMatches(inst.Endpoint.Locality.Label, region, zone, subzone) {
+			out = append(out, inst)
+		}
+	}
+	return out
+}
+
+// localityMatches returns true if the locality label is within the given region, zone and subzone.
+// Empty zone or subzone match any value.
+func localityMatches(label, region, zone, subzone string) bool {
+	if label == "" {
+		return false
+	}
+	r, z, sz := model.SplitLocalityLabel(label)
+	return (region == "*" || r == region) &&
+		(zone == "" || zone == "*" || z == zone) &&
+		(subzone == "" || subzone == "*" || sz == subzone)
+}
+
+// filterHealthyInstances returns the healthy instances in a new slice, leaving the input untouched since it
+// may be owned by a registry.
+func filterHealthyInstances(instances []*model.ServiceInstance) []*model.ServiceInstance {
+	out := make([]*model.ServiceInstance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.Endpoint != nil && !inst.Endpoint.IsHealthy() {
+			continue
+		}
+		out = append(out, inst)
 	}
-	return instances
+	if filtered := len(instances) - len(out); filtered > 0 {
+		unhealthyInstancesFiltered.RecordInt(int64(filtered))
+	}
+	return out
+}
+
+// matchInstanceLabels keeps the instances whose endpoint labels match the collection, filtering the slice
+// in place. It must only be given slices owned by the aggregate.
+func matchInstanceLabels(instances []*model.ServiceInstance, lbls labels.Collection) []*model.ServiceInstance {
+	out := instances[:0]
+	for _, inst := range instances {
+		if inst.Endpoint != nil && lbls.HasSubsetOf(inst.Endpoint.Labels) {
+			out = append(out, inst)
+		}
+	}
+	return out
+}
+
+// sortInstances sorts the instances in place by cluster, endpoint address and endpoint port, so that the
+// output does not depend on the order of the registries or their internal iteration order.
+// Instances without an endpoint are kept last.
+func sortInstances(instances []*model.ServiceInstance) {
+	sort.SliceStable(instances, func(i, j int) bool {
+		a, b := instances[i], instances[j]
+		if a == nil || a.Endpoint == nil {
+			return false
+		}
+		if b == nil || b.Endpoint == nil {
+			return true
+		}
+		if a.Endpoint.Locality.ClusterID != b.Endpoint.Locality.ClusterID {
+			return a.Endpoint.Locality.ClusterID < b.Endpoint.Locality.ClusterID
+		}
+		if a.Endpoint.Address != b.Endpoint.Address {
+			return a.Endpoint.Address < b.Endpoint.Address
+		}
+		return a.Endpoint.EndpointPort < b.Endpoint.EndpointPort
+	})
+}
+
+// registryInstances holds the instances returned by a single registry.
+type registryInstances struct {
+	cluster   cluster.ID
+	provider  provider.ID
+	instances []*model.ServiceInstance
+}
+
+// instanceKey identifies an endpoint when collapsing instances reported by several registries.
+// The service port tells apart the instances of a proxy exposing the same endpoint port through
+// several service ports.
+type instanceKey struct {
+	address     string
+	port        uint32
+	network     network.ID
+	servicePort int
+}
+
+// mergeInstances concatenates the per-registry results, in registry order, with a single allocation.
+// Unless deduplication is disabled, instances from different registries with the same endpoint address,
+// port, network and service port are collapsed into one, preferring the instance provided by a Kubernetes registry as it
+// carries richer labels.
+func (c *Controller) mergeInstances(results []registryInstances) []*model.ServiceInstance {
+	size, contributing := 0, 0
+	for _, res := range results {
+		size += len(res.instances)
+		if len(res.instances) > 0 {
+			contributing++
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+	if c.mergeHook != nil {
+		return c.runMergeHook(results)
+	}
+	out := make([]*model.ServiceInstance, 0, size)
+	if c.skipInstanceDedup || contributing == 1 {
+		for _, res := range results {
+			out = append(out, res.instances...)
+		}
+		return out
+	}
+
+	type seenInstance struct {
+		index    int
+		registry int
+		provider provider.ID
+	}
+	seen := make(map[instanceKey]seenInstance, size)
+	for i, res := range results {
+		for _, inst := range res.instances {
+			if inst == nil || inst.Endpoint == nil {
+				out = append(out, inst)
+				continue
+			}
+			key := instanceKey{address: inst.Endpoint.Address, port: inst.Endpoint.EndpointPort, network: inst.Endpoint.Network}
+			if inst.ServicePort != nil {
+				key.servicePort = inst.ServicePort.Port
+			}
+			prev, found := seen[key]
+			if !found {
+				seen[key] = seenInstance{index: len(out), registry: i, provider: res.provider}
+				out = append(out, inst)
+				continue
+			}
+			if prev.registry == i {
+				// duplicates within a single registry are left for the registry to resolve
+				out = append(out, inst)
+				continue
+			}
+			if res.provider == provider.Kubernetes && prev.provider != provider.Kubernetes {
+				out[prev.index] = inst
+				seen[key] = seenInstance{index: prev.index, registry: i, provider: res.provider}
+			}
+		}
+	}
+	return out
 }
 
 func nodeClusterID(node *model.Proxy) cluster.ID {
@@ -210,135 +1090,531 @@ func nodeClusterID(node *model.Proxy) cluster.ID {
 // Skip the service registry when there won't be a match
 // because the proxy is in a different cluster.
 func skipSearchingRegistryForProxy(nodeClusterID cluster.ID, r serviceregistry.Instance) bool {
-	// Always search non-kube (usually serviceentry) registry.
+	// Always search non-kube (usually serviceentry) registry, unless it declares a cluster scope.
 	// Check every registry if cluster ID isn't specified.
-	if r.Provider() != provider.Kubernetes || nodeClusterID == "" {
+	if !isClusterScoped(r) || nodeClusterID == "" {
 		return false
 	}
 
 	return !r.Cluster().Equals(nodeClusterID)
 }
 
+// isClusterScoped returns true if the registry only holds the workloads of its cluster.
+func isClusterScoped(r serviceregistry.Instance) bool {
+	if r.Provider() == provider.Kubernetes {
+		return true
+	}
+	scoped, ok := r.(serviceregistry.ClusterScoped)
+	return ok && scoped.ClusterScoped()
+}
+
 // GetProxyServiceInstances lists service instances co-located with a given proxy
 func (c *Controller) GetProxyServiceInstances(node *model.Proxy) []*model.ServiceInstance {
-	out := make([]*model.ServiceInstance, 0)
+	if c.proxyCache == nil {
+		out, _, _ := c.getProxyServiceInstances(node)
+		return c.filterUnreachableInstances(node, out)
+	}
+	key := proxyCacheKey(node)
+	cached, token, ok := c.proxyCache.get(key)
+	if ok {
+		return c.filterUnreachableInstances(node, cached)
+	}
+	out, searchedAll, complete := c.getProxyServiceInstances(node)
+	// partial results of registries timing out are not cached, the registries are searched again next time
+	if complete {
+		c.proxyCache.add(token, key, node, out, searchedAll)
+	}
+	// the gateways may change without invalidating the cache, so the cached instances are left unfiltered
+	return c.filterUnreachableInstances(node, out)
+}
+
+func (c *Controller) getProxyServiceInstances(node *model.Proxy) ([]*model.ServiceInstance, bool, bool) {
+	results, out, searchedAll, complete := c.mergedProxyServiceInstances(node)
+	c.recordContributions(SearchProxyInstances, results)
+	return out, searchedAll, complete
+}
+
+// mergedProxyServiceInstances returns the instances of the proxy reported by each registry, and their merged
+// and sorted list.
+func (c *Controller) mergedProxyServiceInstances(node *model.Proxy) ([]registryInstances, []*model.ServiceInstance, bool, bool) {
+	var results []registryInstances
+	searchedAll, complete := c.visitProxyServiceInstances(node, func(r serviceregistry.Instance, instances []*model.ServiceInstance) {
+		results = append(results, registryInstances{cluster: r.Cluster(), provider: r.Provider(), instances: instances})
+	})
+	// A workload being migrated may be described by both a WorkloadEntry and a Pod; collapsing them
+	// avoids building duplicate inbound listeners.
+	out := c.mergeInstances(results)
+	if out == nil {
+		out = make([]*model.ServiceInstance, 0)
+	}
+	if !c.skipInstanceSort {
+		sortInstances(out)
+	}
+	return results, out, searchedAll, complete
+}
+
+// watchForProxyCache invalidates the cached proxy service instances on the events of the registry.
+func (c *Controller) watchForProxyCache(registry serviceregistry.Instance) {
+	registry.AppendServiceHandler(func(*model.Service, model.Event) {
+		c.proxyCache.invalidateSearched(func(clusterID cluster.ID) bool {
+			skip, _ := c.skipRegistry(SearchProxyInstances, clusterID, registry)
+			return !skip
+		})
+	})
+	registry.AppendWorkloadHandler(func(wi *model.WorkloadInstance, _ model.Event) {
+		if wi.Endpoint != nil {
+			c.proxyCache.invalidateIP(wi.Endpoint.Address)
+		}
+	})
+}
+
+// ProxyServiceInstance is a service instance co-located with a proxy, along with the identity of the
+// registry that reported it.
+type ProxyServiceInstance struct {
+	Instance *model.ServiceInstance `json:"instance"`
+	Cluster  cluster.ID             `json:"cluster"`
+	Provider provider.ID            `json:"provider"`
+}
+
+// GetProxyServiceInstancesDetailed is like GetProxyServiceInstances, but also reports which registry
+// produced each instance. It is intended for debugging. The instances are those GetProxyServiceInstances
+// returns, merged, sorted and filtered alike, but looked up again rather than read from the cache; instances
+// created by an Options.InstanceMergeHook have no cluster nor provider.
+func (c *Controller) GetProxyServiceInstancesDetailed(node *model.Proxy) []ProxyServiceInstance {
+	results, instances, _, _ := c.mergedProxyServiceInstances(node)
+	instances = c.filterUnreachableInstances(node, instances)
+	owners := make(map[*model.ServiceInstance]registryKey, len(instances))
+	for _, res := range results {
+		for _, inst := range res.instances {
+			if _, f := owners[inst]; !f {
+				owners[inst] = registryKey{cluster: res.cluster, provider: res.provider}
+			}
+		}
+	}
+	out := make([]ProxyServiceInstance, 0, len(instances))
+	for _, inst := range instances {
+		owner := owners[inst]
+		out = append(out, ProxyServiceInstance{Instance: inst, Cluster: owner.cluster, Provider: owner.provider})
+	}
+	return out
+}
+
+// visitProxyServiceInstances calls fn with the non-empty service instances of the proxy found in each registry.
+// It returns whether every registry was searched through the proxy cluster fallback, and whether every
+// searched registry answered in time.
+func (c *Controller) visitProxyServiceInstances(node *model.Proxy, fn func(serviceregistry.Instance, []*model.ServiceInstance)) (bool, bool) {
+	found, complete := false, true
 	nodeClusterID := nodeClusterID(node)
-	for _, r := range c.GetRegistries() {
-		if skipSearchingRegistryForProxy(nodeClusterID, r) {
-			log.Debugf("GetProxyServiceInstances(): not searching registry %v: proxy %v CLUSTER_ID is %v",
-				r.Cluster(), node.ID, nodeClusterID)
+	var skipped []serviceregistry.Instance
+	for _, r := range c.syncedRegistries(string(SearchProxyInstances), c.GetRegistries()) {
+		if skip, reason := c.skipRegistry(SearchProxyInstances, nodeClusterID, r); skip {
+			log.Debugf("GetProxyServiceInstances(): not searching registry %v: proxy %v CLUSTER_ID is %v: %s",
+				r.Cluster(), node.ID, nodeClusterID, reason)
+			skipped = append(skipped, r)
 			continue
 		}
 
-		instances := r.GetProxyServiceInstances(node)
+		instances, ok := c.registryProxyServiceInstances(r, node)
+		if !ok {
+			complete = false
+			continue
+		}
 		if len(instances) > 0 {
-			out = append(out, instances...)
+			found = true
+			fn(r, instances)
 		}
 	}
 
-	return out
+	if found || !c.proxyClusterFallback || len(skipped) == 0 {
+		return false, complete
+	}
+	var foundIn []cluster.ID
+	for _, r := range skipped {
+		instances, ok := c.registryProxyServiceInstances(r, node)
+		if !ok {
+			complete = false
+		}
+		if len(instances) > 0 {
+			foundIn = append(foundIn, r.Cluster())
+			fn(r, instances)
+		}
+	}
+	if len(foundIn) > 0 && c.fallbackLogLimiter.Allow(node.ID) {
+		log.Warnf("GetProxyServiceInstances(): proxy %v reports CLUSTER_ID %v, but was only found in clusters %v",
+			node.ID, nodeClusterID, foundIn)
+	}
+	return true, complete
+}
+
+// registryProxyServiceInstances returns the instances of the proxy in the registry, or false if the
+// registry did not answer within Options.RegistryTimeout.
+func (c *Controller) registryProxyServiceInstances(r serviceregistry.Instance, node *model.Proxy) ([]*model.ServiceInstance, bool) {
+	result, ok := c.callWithTimeout(r, "GetProxyServiceInstances", func() interface{} {
+		return r.GetProxyServiceInstances(node)
+	})
+	if !ok {
+		return nil, false
+	}
+	instances, _ := result.([]*model.ServiceInstance)
+	return instances, true
 }
 
+// GetProxyWorkloadLabels returns the workload labels of the proxy, collected from every registry of the
+// proxy's cluster, or from every registry if the proxy does not report a cluster.
+// A workload may be known to several registries, for example a VM described by a WorkloadEntry while being
+// migrated to a pod. If more than one registry reports labels, they are merged into a single set of labels,
+// where the value from a Kubernetes registry wins when the same key is reported twice, and otherwise the value
+// from the registry added first wins.
 func (c *Controller) GetProxyWorkloadLabels(proxy *model.Proxy) labels.Collection {
-	var out labels.Collection
+	out, _ := c.GetProxyWorkloadLabelsDetailed(proxy)
+	return out
+}
+
+// WorkloadLabelSource identifies the registry a workload label was read from.
+type WorkloadLabelSource struct {
+	Cluster  cluster.ID  `json:"cluster"`
+	Provider provider.ID `json:"provider"`
+}
+
+// GetProxyWorkloadLabelsDetailed is like GetProxyWorkloadLabels, but also reports for each label key the
+// registry its value was read from. This helps diagnosing mislabeled workloads. The registries stopped with
+// StopRegistry are left out.
+func (c *Controller) GetProxyWorkloadLabelsDetailed(proxy *model.Proxy) (labels.Collection, map[string]WorkloadLabelSource) {
 	clusterID := nodeClusterID(proxy)
+	var kube, other []sourcedLabels
 	for _, r := range c.GetRegistries() {
 		// If proxy clusterID unset, we may find incorrect workload label.
 		// This can not happen in k8s env.
-		if clusterID == "" {
-			wlLabels := r.GetProxyWorkloadLabels(proxy)
-			if len(wlLabels) > 0 {
-				out = append(out, wlLabels...)
-				break
-			}
-		} else if clusterID == r.Cluster() {
-			// find proxy in the specified cluster
-			wlLabels := r.GetProxyWorkloadLabels(proxy)
-			if len(wlLabels) > 0 {
-				out = append(out, wlLabels...)
-			}
-			break
+		if skip, _ := c.skipRegistry(SearchWorkloadLabels, clusterID, r); skip {
+			continue
+		}
+		// the labels of a workload of a stopped registry may be stale
+		if c.registryStopped(registryKey{cluster: r.Cluster(), provider: r.Provider()}) {
+			continue
+		}
+		wlLabels := r.GetProxyWorkloadLabels(proxy)
+		if len(wlLabels) == 0 {
+			continue
+		}
+		collection := sourcedLabels{source: WorkloadLabelSource{Cluster: r.Cluster(), Provider: r.Provider()}, labels: wlLabels}
+		if r.Provider() == provider.Kubernetes {
+			kube = append(kube, collection)
+		} else {
+			other = append(other, collection)
 		}
 	}
 
-	return out
+	return mergeWorkloadLabels(append(kube, other...))
 }
 
-// Run starts all the controllers
-func (c *Controller) Run(stop <-chan struct{}) {
-	for _, r := range c.GetRegistries() {
-		go r.Run(stop)
-	}
-	c.running.Store(true)
-	<-stop
-	log.Info("Registry Aggregator terminated")
+// sourcedLabels is a label collection along with the registry it was read from.
+type sourcedLabels struct {
+	source WorkloadLabelSource
+	labels labels.Collection
 }
 
-// Running returns true after Run has been called. If already running, registries passed to AddRegistry
-// should be started outside of this aggregate controller.
-func (c *Controller) Running() bool {
-	return c.running.Load()
+// mergeWorkloadLabels merges label collections ordered by precedence; for a key present in more than one
+// collection, the first value wins. A single collection is returned unchanged. The source of each key of
+// the result is returned alongside it.
+func mergeWorkloadLabels(collections []sourcedLabels) (labels.Collection, map[string]WorkloadLabelSource) {
+	if len(collections) == 0 {
+		return nil, nil
+	}
+	sources := map[string]WorkloadLabelSource{}
+	if len(collections) == 1 {
+		for _, instance := range collections[0].labels {
+			for k := range instance {
+				if _, f := sources[k]; !f {
+					sources[k] = collections[0].source
+				}
+			}
+		}
+		return collections[0].labels, sources
+	}
+	merged := labels.Instance{}
+	for _, collection := range collections {
+		for _, instance := range collection.labels {
+			for k, v := range instance {
+				if _, f := merged[k]; !f {
+					merged[k] = v
+					sources[k] = collection.source
+				}
+			}
+		}
+	}
+	return labels.Collection{merged}, sources
 }
 
-// HasSynced returns true when all registries have synced
+// HasSynced returns true when all registries have synced, leaving out those the aggregate is not serving unless
+// Options.StrictSync is set. Once true, the result is kept until the registries change, as one is added,
+// deleted, stopped or started, or until a registry excluded for its health rejoins.
 func (c *Controller) HasSynced() bool {
-	for _, r := range c.GetRegistries() {
-		if !r.HasSynced() {
+	c.storeLock.RLock()
+	current := syncedState{generation: c.generation, healthEpoch: c.health.epoch()}
+	c.storeLock.RUnlock()
+	if cached, ok := c.synced.Load().(syncedState); ok && cached == current {
+		return true
+	}
+	registries, generation := c.getRegistriesAndGeneration()
+	for _, r := range registries {
+		if c.syncExcluded(r) == "" && !c.hasSynced(r) {
 			log.Debugf("registry %s is syncing", r.Cluster())
 			return false
 		}
 	}
-	return true
-}
-
-// AppendServiceHandler implements a service catalog operation
-func (c *Controller) AppendServiceHandler(f func(*model.Service, model.Event)) {
-	for _, r := range c.GetRegistries() {
-		r.AppendServiceHandler(f)
+	if generation == current.generation {
+		c.synced.Store(current)
+	}
+	if c.allSynced.CAS(false, true) {
+		c.notifyLifecycle(LifecycleAllSynced, "", "")
 	}
+	return true
 }
 
-func (c *Controller) AppendWorkloadHandler(f func(*model.WorkloadInstance, model.Event)) {
-	for _, r := range c.GetRegistries() {
-		r.AppendWorkloadHandler(f)
-	}
+// syncedState identifies the registries and their health when HasSynced found them synced.
+type syncedState struct {
+	generation  uint64
+	healthEpoch uint64
 }
 
 // GetIstioServiceAccounts implements model.ServiceAccounts operation.
 // The returned list contains all SPIFFE based identities that backs the service.
-// This method also expand the results from different registries based on the mesh config trust domain aliases.
+// This method also expand the results from different registries based on the mesh config trust domain aliases,
+// or on the aliases of their cluster if the mesh holder is a ClusterTrustDomainHolder.
 // To retain such trust domain expansion behavior, the xDS server implementation should wrap any (even if single)
 // service registry by this aggreated one.
+// The registries are asked concurrently, as bounded by Options.FanOutWorkers.
+// The SPIFFE identities are normalized, with the spiffe:// prefix and the trust domain in lowercase, so that an
+// identity formatted differently by two registries is returned once.
+// For a service with a selector, the accounts of the workloads it selects, as reported by the workload events of
+// the registries, are included once every registry has synced, so that VMs selected by a Kubernetes service are
+// accounted for even when its registry does not report them.
 // For example,
 // - { "spiffe://cluster.local/bar@iam.gserviceaccount.com"}; when annotation is used on corresponding workloads.
 // - { "spiffe://cluster.local/ns/default/sa/foo" }; normal kubernetes cases
 // - { "spiffe://cluster.local/ns/default/sa/foo", "spiffe://trust-domain-alias/ns/default/sa/foo" };
 //   if the trust domain alias is configured.
 func (c *Controller) GetIstioServiceAccounts(svc *model.Service, ports []int) []string {
+	start := time.Now()
+	defer func() {
+		serviceAccountsLatency.Record(time.Since(start).Seconds())
+	}()
+	registries := c.GetRegistries()
+	aliases, signature := c.trustDomainAliases(registries)
+	if c.accountsCache == nil {
+		out, _ := c.getIstioServiceAccounts(svc, ports, registries, aliases)
+		return out
+	}
+	key := serviceAccountsKey(svc, ports)
+	cached, token, ok := c.accountsCache.get(key, signature)
+	if ok {
+		serviceAccountsCacheLookups.With(resultTag.Value("hit")).Increment()
+		return cached
+	}
+	serviceAccountsCacheLookups.With(resultTag.Value("miss")).Increment()
+	// the registries may have changed before the token was read
+	registries = c.GetRegistries()
+	aliases, signature = c.trustDomainAliases(registries)
+	out, complete := c.getIstioServiceAccounts(svc, ports, registries, aliases)
+	if complete {
+		c.accountsCache.add(token, key, svc, signature, out)
+	}
+	return out
+}
+
+// GetIstioServiceAccountsRaw is like GetIstioServiceAccounts, but returns the accounts as reported by the
+// registries, without the expansion with the trust domain aliases. It is not cached.
+func (c *Controller) GetIstioServiceAccountsRaw(svc *model.Service, ports []int) []string {
+	out, _ := c.getIstioServiceAccounts(svc, ports, c.GetRegistries(), nil)
+	return out
+}
+
+// ServiceAccountsByCluster returns the service accounts of GetIstioServiceAccounts, keyed by the cluster of the
+// registry they were found in, for auditing the identities backing a service. An account found in several
+// clusters is listed under each of them; the accounts of each cluster are expanded with its trust domain
+// aliases, and sorted. Clusters without accounts are omitted. It is not cached.
+func (c *Controller) ServiceAccountsByCluster(svc *model.Service, ports []int) map[cluster.ID][]string {
+	registries := c.GetRegistries()
+	aliases, _ := c.trustDomainAliases(registries)
+	results, _ := c.registryServiceAccounts(svc, ports, registries, aliases)
+	byCluster := map[cluster.ID]map[string]struct{}{}
+	for _, res := range results {
+		if len(res.accounts) == 0 {
+			continue
+		}
+		accounts, f := byCluster[res.cluster]
+		if !f {
+			accounts = map[string]struct{}{}
+			byCluster[res.cluster] = accounts
+		}
+		for sa := range res.accounts {
+			accounts[sa] = struct{}{}
+		}
+	}
+	out := make(map[cluster.ID][]string, len(byCluster))
+	for clusterID, accounts := range byCluster {
+		out[clusterID] = sortedAccounts(accounts)
+	}
+	return out
+}
+
+// getIstioServiceAccounts merges the service accounts of svc found in the registries, see registryServiceAccounts.
+// It returns false if the result is not to be cached.
+func (c *Controller) getIstioServiceAccounts(svc *model.Service, ports []int, registries []serviceregistry.Instance,
+	aliases [][]string) ([]string, bool) {
+	results, complete := c.registryServiceAccounts(svc, ports, registries, aliases)
 	out := map[string]struct{}{}
-	for _, r := range c.GetRegistries() {
-		svcAccounts := r.GetIstioServiceAccounts(svc, ports)
-		for _, sa := range svcAccounts {
+	for _, res := range results {
+		for sa := range res.accounts {
 			out[sa] = struct{}{}
 		}
 	}
-	result := make([]string, 0, len(out))
-	for k := range out {
-		result = append(result, k)
+	var result []string
+	if c.maxExpandedAccounts > 0 && len(out) > c.maxExpandedAccounts && aliases != nil {
+		result = c.truncateExpandedAccounts(svc, results, out)
+	} else {
+		result = sortedAccounts(out)
+	}
+	if aliases != nil {
+		recordServiceAccountCounts(results, len(result))
+	}
+	return result, complete
+}
+
+// recordServiceAccountCounts records the number of accounts of a service reported by the registries, and once
+// expanded.
+func recordServiceAccountCounts(results []registryAccounts, expanded int) {
+	reported := map[string]struct{}{}
+	for _, res := range results {
+		for _, sa := range res.reported {
+			reported[sa] = struct{}{}
+		}
+	}
+	serviceAccountCounts.With(stageTag.Value("reported")).Record(float64(len(reported)))
+	serviceAccountCounts.With(stageTag.Value("expanded")).Record(float64(expanded))
+}
+
+// registryAccounts are the service accounts found in a registry.
+type registryAccounts struct {
+	cluster  cluster.ID
+	accounts map[string]struct{}
+	// reported are the accounts before the expansion with the trust domain aliases, which are the aliases of
+	// the registry, nil if not expanded.
+	reported []string
+	aliases  []string
+}
+
+// registryServiceAccounts returns the service accounts of svc found in each of the registries and in the
+// workloads they reported that svc selects, as selected by Options.ServiceAccountPolicy, in canonical form, those
+// of the i-th registry expanded with aliases[i] unless aliases is nil. The registries are asked concurrently,
+// leaving out those left out of the lookups by syncedRegistries and those that do not answer within
+// Options.RegistryTimeout. It returns false if a registry was left out for being unsynced or not answering, or if
+// the selected workloads are not known yet, the result is then not to be cached.
+func (c *Controller) registryServiceAccounts(svc *model.Service, ports []int, registries []serviceregistry.Instance,
+	aliases [][]string) ([]registryAccounts, bool) {
+	complete := true
+	// indexes maps the registries asked to their index in registries, and thus in aliases
+	asked := make([]serviceregistry.Instance, 0, len(registries))
+	indexes := make([]int, 0, len(registries))
+	for i, r := range registries {
+		if c.registryStopped(registryKey{cluster: r.Cluster(), provider: r.Provider()}) {
+			continue
+		}
+		if c.requireSynced && !r.HasSynced() {
+			unsyncedRegistriesSkipped.With(clusterTag.Value(string(r.Cluster())), providerTag.Value(string(r.Provider())),
+				searchTag.Value("ServiceAccounts")).Increment()
+			complete = false
+			continue
+		}
+		asked = append(asked, r)
+		indexes = append(indexes, i)
+	}
+
+	results := make([]sourcedAccounts, len(asked))
+	answered := make([]bool, len(asked))
+	c.fanOut(asked, func(i int, r serviceregistry.Instance) {
+		results[i], answered[i] = c.registrySourcedAccounts(r, svc, ports)
+	})
+
+	// the workload index is complete once every registry has synced
+	if c.HasSynced() {
+		for i, selected := range c.selectedWorkloadAccounts(svc, ports, asked) {
+			if len(selected) > 0 {
+				r := asked[i]
+				selected = canonicalServiceAccounts(registryKey{cluster: r.Cluster(), provider: r.Provider()}, selected)
+				results[i].derived = append(results[i].derived[:len(results[i].derived):len(results[i].derived)], selected...)
+			}
+		}
+	} else if len(svc.Attributes.LabelSelectors) > 0 {
+		complete = false
 	}
-	tds := []string{}
-	if c.meshHolder != nil {
-		mesh := c.meshHolder.Mesh()
-		if mesh != nil {
-			tds = mesh.TrustDomainAliases
+	applyServiceAccountPolicy(c.accountPolicy, results)
+
+	out := make([]registryAccounts, 0, len(results))
+	for i, res := range results {
+		if !answered[i] {
+			complete = false
+		}
+		accounts := res.derived
+		if len(res.annotated) > 0 {
+			accounts = append(res.annotated[:len(res.annotated):len(res.annotated)], res.derived...)
 		}
+		if answered[i] {
+			registryServiceAccounts.With(clusterTag.Value(string(asked[i].Cluster())),
+				providerTag.Value(string(asked[i].Provider()))).Record(float64(len(accounts)))
+		}
+		r := registryAccounts{cluster: asked[i].Cluster(), reported: accounts}
+		if aliases == nil || len(aliases[indexes[i]]) == 0 {
+			r.accounts = make(map[string]struct{}, len(accounts))
+			for _, sa := range accounts {
+				r.accounts[sa] = struct{}{}
+			}
+		} else {
+			r.aliases = aliases[indexes[i]]
+			r.accounts = spiffe.ExpandWithTrustDomains(accounts, r.aliases)
+		}
+		out = append(out, r)
 	}
-	expanded := spiffe.ExpandWithTrustDomains(result, tds)
-	result = make([]string, 0, len(expanded))
-	for k := range expanded {
-		result = append(result, k)
+	return out, complete
+}
+
+// sortedAccounts returns the set of accounts as a sorted slice.
+func sortedAccounts(accounts map[string]struct{}) []string {
+	out := make([]string, 0, len(accounts))
+	for sa := range accounts {
+		out = append(out, sa)
 	}
 	// Sort to make the return result deterministic.
-	sort.Strings(result)
-	return result
+	sort.Strings(out)
+	return out
+}
+
+// portServiceAccounts returns the accounts the registry reported for the service that are declared by the
+// service, or that an instance of the registry on one of the ports runs as, see
+// Options.VerifyServiceAccountPorts. Without ports, the accounts are returned as is.
+func portServiceAccounts(r serviceregistry.Instance, svc *model.Service, ports []int, accounts []string) []string {
+	if len(ports) == 0 || len(accounts) == 0 {
+		return accounts
+	}
+	backed := map[string]struct{}{}
+	for _, sa := range svc.ServiceAccounts {
+		backed[sa] = struct{}{}
+	}
+	for _, port := range ports {
+		for _, inst := range r.InstancesByPort(svc, port, labels.Collection{}) {
+			if inst.Endpoint != nil && inst.Endpoint.ServiceAccount != "" {
+				backed[inst.Endpoint.ServiceAccount] = struct{}{}
+			}
+		}
+	}
+	out := make([]string, 0, len(accounts))
+	for _, sa := range accounts {
+		if _, f := backed[sa]; f {
+			out = append(out, sa)
+		} else {
+			log.Debugf("dropping the account %s of service %s in cluster %s, not backing the ports %v",
+				sa, svc.ClusterLocal.Hostname, r.Cluster(), ports)
+		}
+	}
+	return out
 }
@@ -17,19 +17,28 @@ package aggregate
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/atomic"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
 	"istio.io/istio/pilot/pkg/serviceregistry/mock"
 	"istio.io/istio/pilot/pkg/serviceregistry/provider"
 	"istio.io/istio/pkg/cluster"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/network"
+	"istio.io/istio/pkg/test/util/retry"
 )
 
 type mockMeshConfigHolder struct {
@@ -75,7 +84,7 @@ func buildMockController() *Controller {
 		Controller:       &mock.Controller{},
 	}
 
-	ctls := NewController(Options{&meshHolder})
+	ctls := NewController(Options{MeshHolder: &meshHolder})
 	ctls.AddRegistry(registry1)
 	ctls.AddRegistry(registry2)
 
@@ -407,6 +416,373 @@ func TestGetIstioServiceAccounts(t *testing.T) {
 	}
 }
 
+func TestGetIstioServiceAccountsRaw(t *testing.T) {
+	aggregateCtl := buildMockController()
+	meshHolder.trustDomainAliases = []string{"cluster.local", "example.com"}
+	defer func() { meshHolder.trustDomainAliases = nil }()
+
+	raw := aggregateCtl.GetIstioServiceAccountsRaw(mock.WorldService, []int{})
+	want := []string{
+		"spiffe://cluster.local/ns/default/sa/world1",
+		"spiffe://cluster.local/ns/default/sa/world2",
+	}
+	if diff := cmp.Diff(raw, want); diff != "" {
+		t.Fatalf("unexpected raw service accounts, diff %v", diff)
+	}
+	// the expanded accounts are the raw ones and those of the aliases
+	expanded := aggregateCtl.GetIstioServiceAccounts(mock.WorldService, []int{})
+	rawSet := map[string]bool{}
+	for _, sa := range raw {
+		rawSet[sa] = true
+	}
+	var derived []string
+	for _, sa := range expanded {
+		if !rawSet[sa] {
+			derived = append(derived, sa)
+		}
+	}
+	want = []string{
+		"spiffe://example.com/ns/default/sa/world1",
+		"spiffe://example.com/ns/default/sa/world2",
+	}
+	if diff := cmp.Diff(derived, want); diff != "" {
+		t.Fatalf("unexpected accounts derived from the aliases, diff %v", diff)
+	}
+	if len(expanded) != len(raw)+len(derived) {
+		t.Fatalf("expected the expanded accounts %v to include the raw ones %v", expanded, raw)
+	}
+}
+
+func TestServiceAccountsByCluster(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "east")
+	shared := "spiffe://cluster.local/ns/default/sa/shared"
+	holder := &federationHolder{
+		meshAliases:    []string{"cluster.local", "mesh.example.com"},
+		clusterAliases: map[cluster.ID][]string{"west": {"cluster.local", "west.example.com"}},
+	}
+	ctl := NewController(Options{MeshHolder: holder, ServiceAccountsCacheSize: 10})
+	ctl.AddRegistry(newAccountsRegistry("east", svc, shared, "spiffe://cluster.local/ns/default/sa/east"))
+	ctl.AddRegistry(&accountsRegistry{
+		Simple:   newMemoryRegistry(provider.External, "east", svc),
+		accounts: map[host.Name][]string{svc.ClusterLocal.Hostname: {shared, "spiffe://cluster.local/ns/default/sa/vm"}},
+	})
+	ctl.AddRegistry(newAccountsRegistry("west", svc, shared))
+	ctl.AddRegistry(newAccountsRegistry("empty", svc))
+
+	// the registries of a cluster are merged, the clusters are not, and each is expanded with its aliases
+	want := map[cluster.ID][]string{
+		"east": {
+			"spiffe://cluster.local/ns/default/sa/east",
+			shared,
+			"spiffe://cluster.local/ns/default/sa/vm",
+			"spiffe://mesh.example.com/ns/default/sa/east",
+			"spiffe://mesh.example.com/ns/default/sa/shared",
+			"spiffe://mesh.example.com/ns/default/sa/vm",
+		},
+		"west": {shared, "spiffe://west.example.com/ns/default/sa/shared"},
+	}
+	if got := ctl.ServiceAccountsByCluster(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts %v, got %v", want, got)
+	}
+	// the union of the clusters is GetIstioServiceAccounts
+	union := map[string]struct{}{}
+	for _, accounts := range want {
+		for _, sa := range accounts {
+			union[sa] = struct{}{}
+		}
+	}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, sortedAccounts(union)) {
+		t.Fatalf("expected the accounts %v, got %v", sortedAccounts(union), got)
+	}
+}
+
+// metricRow returns the data of the row of the metric with the given tags, nil if none.
+func metricRow(t *testing.T, name string, tags map[string]string) view.AggregationData {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get metric %s: %v", name, err)
+	}
+	for _, row := range rows {
+		matched := 0
+		for _, tag := range row.Tags {
+			if v, f := tags[tag.Key.Name()]; f && v == tag.Value {
+				matched++
+			}
+		}
+		if matched == len(tags) {
+			return row.Data
+		}
+	}
+	return nil
+}
+
+// distributionStats returns the count and sum of the recorded values of the row of the distribution.
+func distributionStats(t *testing.T, name string, tags map[string]string) (int64, float64) {
+	t.Helper()
+	data, ok := metricRow(t, name, tags).(*view.DistributionData)
+	if !ok {
+		return 0, 0
+	}
+	return data.Count, data.Mean * float64(data.Count)
+}
+
+func sumValue(t *testing.T, name string, tags map[string]string) float64 {
+	t.Helper()
+	data, ok := metricRow(t, name, tags).(*view.SumData)
+	if !ok {
+		return 0
+	}
+	return data.Value
+}
+
+func TestServiceAccountMetrics(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "east")
+	holder := &mockMeshConfigHolder{trustDomainAliases: []string{"cluster.local", "example.com"}}
+	ctl := NewController(Options{MeshHolder: holder, ServiceAccountsCacheSize: 10})
+	shared := "spiffe://cluster.local/ns/default/sa/shared"
+	ctl.AddRegistry(newAccountsRegistry("metrics-east", svc, shared, "spiffe://cluster.local/ns/default/sa/east"))
+	ctl.AddRegistry(newAccountsRegistry("metrics-west", svc, shared))
+
+	reported := map[string]string{"stage": "reported"}
+	expanded := map[string]string{"stage": "expanded"}
+	east := map[string]string{"cluster": "metrics-east"}
+	west := map[string]string{"cluster": "metrics-west"}
+	hit := map[string]string{"result": "hit"}
+	miss := map[string]string{"result": "miss"}
+	reportedCount, reportedSum := distributionStats(t, "pilot_aggregate_service_accounts", reported)
+	expandedCount, expandedSum := distributionStats(t, "pilot_aggregate_service_accounts", expanded)
+	latencyCount, _ := distributionStats(t, "pilot_aggregate_service_accounts_latency_seconds", nil)
+	hits := sumValue(t, "pilot_aggregate_service_accounts_cache_lookups", hit)
+	misses := sumValue(t, "pilot_aggregate_service_accounts_cache_lookups", miss)
+	eastAccounts := sumValue(t, "pilot_aggregate_registry_service_accounts", east)
+	westAccounts := sumValue(t, "pilot_aggregate_registry_service_accounts", west)
+
+	if got := ctl.GetIstioServiceAccounts(svc, nil); len(got) != 4 {
+		t.Fatalf("expected 4 accounts, got %v", got)
+	}
+	ctl.GetIstioServiceAccounts(svc, nil)
+
+	// the first call missed the cache and recorded the counts, the second hit it
+	if count, sum := distributionStats(t, "pilot_aggregate_service_accounts", reported); count != reportedCount+1 || sum != reportedSum+2 {
+		t.Errorf("expected 2 reported accounts to be recorded once, got %d records totalling %v", count-reportedCount, sum-reportedSum)
+	}
+	if count, sum := distributionStats(t, "pilot_aggregate_service_accounts", expanded); count != expandedCount+1 || sum != expandedSum+4 {
+		t.Errorf("expected 4 expanded accounts to be recorded once, got %d records totalling %v", count-expandedCount, sum-expandedSum)
+	}
+	if got := sumValue(t, "pilot_aggregate_registry_service_accounts", east); got != eastAccounts+2 {
+		t.Errorf("expected 2 accounts contributed by the east registry, got %v", got-eastAccounts)
+	}
+	if got := sumValue(t, "pilot_aggregate_registry_service_accounts", west); got != westAccounts+1 {
+		t.Errorf("expected 1 account contributed by the west registry, got %v", got-westAccounts)
+	}
+	if got := sumValue(t, "pilot_aggregate_service_accounts_cache_lookups", miss); got != misses+1 {
+		t.Errorf("expected a cache miss, got %v", got-misses)
+	}
+	if got := sumValue(t, "pilot_aggregate_service_accounts_cache_lookups", hit); got != hits+1 {
+		t.Errorf("expected a cache hit, got %v", got-hits)
+	}
+	if count, _ := distributionStats(t, "pilot_aggregate_service_accounts_latency_seconds", nil); count != latencyCount+2 {
+		t.Errorf("expected 2 calls to be timed, got %d", count-latencyCount)
+	}
+}
+
+func TestGetIstioServiceAccountsVerifyPorts(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{"spiffe://cluster.local/ns/default/sa/declared"}, "cluster-1")
+	web := makeInstance(svc, "10.0.0.1", 8080, "", nil)
+	web.Endpoint.ServiceAccount = "spiffe://cluster.local/ns/default/sa/web"
+	status := makeInstance(svc, "10.0.0.2", 8081, "", nil)
+	status.ServicePort = svc.Ports[1]
+	status.Endpoint.ServicePortName = svc.Ports[1].Name
+	status.Endpoint.ServiceAccount = "spiffe://cluster.local/ns/default/sa/status"
+	// the registry ignores the ports, and reports every account of the service
+	r := &accountsRegistry{
+		Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc, web, status),
+		accounts: map[host.Name][]string{svc.ClusterLocal.Hostname: {
+			"spiffe://cluster.local/ns/default/sa/declared",
+			"spiffe://cluster.local/ns/default/sa/status",
+			"spiffe://cluster.local/ns/default/sa/web",
+		}},
+	}
+	webPort, statusPort := svc.Ports[0].Port, svc.Ports[1].Port
+
+	testCases := []struct {
+		name   string
+		verify bool
+		ports  []int
+		want   []string
+	}{
+		{
+			name:  "not verified",
+			ports: []int{webPort},
+			want: []string{
+				"spiffe://cluster.local/ns/default/sa/declared",
+				"spiffe://cluster.local/ns/default/sa/status",
+				"spiffe://cluster.local/ns/default/sa/web",
+			},
+		},
+		{
+			name:   "web port",
+			verify: true,
+			ports:  []int{webPort},
+			want:   []string{"spiffe://cluster.local/ns/default/sa/declared", "spiffe://cluster.local/ns/default/sa/web"},
+		},
+		{
+			name:   "status port",
+			verify: true,
+			ports:  []int{statusPort},
+			want:   []string{"spiffe://cluster.local/ns/default/sa/declared", "spiffe://cluster.local/ns/default/sa/status"},
+		},
+		{
+			name:   "both ports",
+			verify: true,
+			ports:  []int{webPort, statusPort},
+			want: []string{
+				"spiffe://cluster.local/ns/default/sa/declared",
+				"spiffe://cluster.local/ns/default/sa/status",
+				"spiffe://cluster.local/ns/default/sa/web",
+			},
+		},
+		{
+			name:   "port without instances",
+			verify: true,
+			ports:  []int{svc.Ports[2].Port},
+			want:   []string{"spiffe://cluster.local/ns/default/sa/declared"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctl := NewController(Options{VerifyServiceAccountPorts: tc.verify})
+			ctl.AddRegistry(r)
+			if got := ctl.GetIstioServiceAccounts(svc, tc.ports); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected the accounts %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// accountsRegistries returns registries of svc in as many clusters, the accounts of each overlapping with the
+// accounts of the next one.
+func accountsRegistries(svc *model.Service, count int, latency time.Duration) []*accountsRegistry {
+	out := make([]*accountsRegistry, 0, count)
+	for c := 0; c < count; c++ {
+		r := newAccountsRegistry(cluster.ID(fmt.Sprintf("cluster-%d", c)), svc,
+			fmt.Sprintf("spiffe://cluster.local/ns/default/sa/sa-%d", c), fmt.Sprintf("spiffe://cluster.local/ns/default/sa/sa-%d", c+1))
+		r.latency = latency
+		out = append(out, r)
+	}
+	return out
+}
+
+// syncingAccountsRegistry is an accountsRegistry that has synced once told so.
+type syncingAccountsRegistry struct {
+	*accountsRegistry
+	synced atomic.Bool
+}
+
+func (r *syncingAccountsRegistry) HasSynced() bool {
+	return r.synced.Load()
+}
+
+func TestGetIstioServiceAccountsFanOut(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	holder := &mockMeshConfigHolder{trustDomainAliases: []string{"cluster.local", "example.com"}}
+	serial := NewController(Options{FanOutWorkers: 1, MeshHolder: holder})
+	parallel := NewController(Options{FanOutWorkers: 4, MeshHolder: holder})
+	for _, r := range accountsRegistries(svc, 10, time.Millisecond) {
+		serial.AddRegistry(r)
+		parallel.AddRegistry(r)
+	}
+
+	want := serial.GetIstioServiceAccounts(svc, nil)
+	if len(want) != 22 {
+		t.Fatalf("expected 22 accounts, got %v", want)
+	}
+	wantRaw := serial.GetIstioServiceAccountsRaw(svc, nil)
+	if len(wantRaw) != 11 {
+		t.Fatalf("expected 11 raw accounts, got %v", wantRaw)
+	}
+	for i := 0; i < 20; i++ {
+		if got := parallel.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+			t.Fatalf("parallel fan out returned %v, the serial path %v", got, want)
+		}
+		if got := parallel.GetIstioServiceAccountsRaw(svc, nil); !reflect.DeepEqual(got, wantRaw) {
+			t.Fatalf("parallel fan out returned the raw accounts %v, the serial path %v", got, wantRaw)
+		}
+	}
+}
+
+func TestGetIstioServiceAccountsSkipsRegistries(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	answering := newAccountsRegistry("cluster-1", svc, "spiffe://cluster.local/ns/default/sa/answering")
+	hung := newAccountsRegistry("cluster-2", svc, "spiffe://cluster.local/ns/default/sa/hung")
+	release := make(chan struct{})
+	hung.during = func() { <-release }
+	unsynced := &syncingAccountsRegistry{accountsRegistry: newAccountsRegistry("cluster-3", svc, "spiffe://cluster.local/ns/default/sa/unsynced")}
+	ctl := NewController(Options{
+		RegistryTimeout:          50 * time.Millisecond,
+		RequireSyncedRegistries:  true,
+		ServiceAccountsCacheSize: 10,
+	})
+	ctl.AddRegistry(answering)
+	ctl.AddRegistry(hung)
+	ctl.AddRegistry(unsynced)
+
+	want := []string{"spiffe://cluster.local/ns/default/sa/answering"}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts %v, got %v", want, got)
+	}
+	if len(ctl.UnhealthyRegistries()) != 1 {
+		t.Fatalf("expected the hung registry to be unhealthy, got %v", ctl.UnhealthyRegistries())
+	}
+	close(release)
+	retry.UntilSuccessOrFail(t, func() error {
+		if len(ctl.UnhealthyRegistries()) != 0 {
+			return errors.New("the hung registry is still unhealthy")
+		}
+		return nil
+	})
+	unsynced.synced.Store(true)
+
+	// the partial result was not cached
+	want = []string{
+		"spiffe://cluster.local/ns/default/sa/answering",
+		"spiffe://cluster.local/ns/default/sa/hung",
+		"spiffe://cluster.local/ns/default/sa/unsynced",
+	}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts %v, got %v", want, got)
+	}
+	calls := answering.calls.Load()
+	ctl.GetIstioServiceAccounts(svc, nil)
+	if answering.calls.Load() != calls {
+		t.Fatalf("expected the complete result to be cached")
+	}
+}
+
+func BenchmarkGetIstioServiceAccounts(b *testing.B) {
+	svc := mock.MakeService("bench.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	for _, bc := range []struct {
+		name    string
+		workers int
+	}{
+		{"serial", 1},
+		{"parallel", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctl := NewController(Options{FanOutWorkers: bc.workers})
+			for _, r := range accountsRegistries(svc, 20, 100*time.Microsecond) {
+				ctl.AddRegistry(r)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				_ = ctl.GetIstioServiceAccounts(svc, nil)
+			}
+		})
+	}
+}
+
 func TestAddRegistry(t *testing.T) {
 	registries := []serviceregistry.Simple{
 		{
@@ -427,6 +803,45 @@ func TestAddRegistry(t *testing.T) {
 	}
 }
 
+func TestAppendHandlersToAddedRegistries(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	existing := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl.AddRegistry(existing)
+
+	var got []string
+	ctl.AppendServiceHandler(func(s *model.Service, _ model.Event) {
+		got = append(got, "first/"+string(s.ClusterLocal.Hostname))
+	})
+	ctl.AppendServiceHandler(func(s *model.Service, _ model.Event) {
+		got = append(got, "second/"+string(s.ClusterLocal.Hostname))
+	})
+	var workloads []string
+	ctl.AppendWorkloadHandler(func(wi *model.WorkloadInstance, _ model.Event) {
+		workloads = append(workloads, wi.Name)
+	})
+
+	// a registry added after the handlers receives them, in the order they were appended
+	added := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	ctl.AddRegistry(added)
+	fakeControllerOf(added).fireService(svc, model.EventAdd)
+	fakeControllerOf(added).fireWorkload(makeWorkload("vm", "default", "1.1.1.1"), model.EventAdd)
+	want := []string{"first/hello.default.svc.cluster.local", "second/hello.default.svc.cluster.local"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected service events, diff %v", diff)
+	}
+	if diff := cmp.Diff(workloads, []string{"vm"}); diff != "" {
+		t.Errorf("unexpected workload events, diff %v", diff)
+	}
+
+	// the registries present when the handlers were appended keep receiving them once
+	got = nil
+	fakeControllerOf(existing).fireService(svc, model.EventUpdate)
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected service events of the existing registry, diff %v", diff)
+	}
+}
+
 func TestGetDeleteRegistry(t *testing.T) {
 	registries := []serviceregistry.Simple{
 		{
@@ -470,6 +885,8 @@ func TestSkipSearchingRegistryForProxy(t *testing.T) {
 	cluster2 := serviceregistry.Simple{ClusterID: "cluster-2", ProviderID: provider.Kubernetes}
 	// external registries may eventually be associated with a cluster
 	external := serviceregistry.Simple{ClusterID: "cluster-1", ProviderID: provider.External}
+	scopedExternal := clusterScopedRegistry{Simple: external, scoped: true}
+	globalExternal := clusterScopedRegistry{Simple: external, scoped: false}
 
 	cases := []struct {
 		nodeClusterID cluster.ID
@@ -488,6 +905,11 @@ func TestSkipSearchingRegistryForProxy(t *testing.T) {
 		{"", cluster1, false},
 		{"", cluster2, false},
 		{"", external, false},
+		// external registries declaring a cluster scope are searched like kube registries
+		{"cluster-1", scopedExternal, false},
+		{"cluster-2", scopedExternal, true},
+		{"", scopedExternal, false},
+		{"cluster-2", globalExternal, false},
 	}
 
 	for i, c := range cases {
@@ -499,3 +921,1124 @@ func TestSkipSearchingRegistryForProxy(t *testing.T) {
 		}
 	}
 }
+
+// clusterScopedRegistry is a registry implementing serviceregistry.ClusterScoped.
+type clusterScopedRegistry struct {
+	serviceregistry.Simple
+	scoped bool
+}
+
+func (r clusterScopedRegistry) ClusterScoped() bool {
+	return r.scoped
+}
+
+func makeInstance(svc *model.Service, address string, port uint32, nw network.ID, lbls labels.Instance) *model.ServiceInstance {
+	return &model.ServiceInstance{
+		Service:     svc,
+		ServicePort: svc.Ports[0],
+		Endpoint: &model.IstioEndpoint{
+			Address:         address,
+			EndpointPort:    port,
+			ServicePortName: svc.Ports[0].Name,
+			Network:         nw,
+			Labels:          lbls,
+		},
+	}
+}
+
+func newMemoryRegistry(providerID provider.ID, clusterID cluster.ID, svc *model.Service,
+	instances ...*model.ServiceInstance) serviceregistry.Simple {
+	sd := memory.NewServiceDiscovery([]*model.Service{svc})
+	sd.ClusterID = string(clusterID)
+	for _, inst := range instances {
+		sd.AddInstance(svc.ClusterLocal.Hostname, inst)
+	}
+	return serviceregistry.Simple{
+		ProviderID:       providerID,
+		ClusterID:        clusterID,
+		ServiceDiscovery: sd,
+		Controller:       &fakeController{},
+	}
+}
+
+// fakeController is a model.Controller whose events are fired by the tests.
+type fakeController struct {
+	mu               sync.RWMutex
+	serviceHandlers  []func(*model.Service, model.Event)
+	workloadHandlers []func(*model.WorkloadInstance, model.Event)
+	// unsynced makes HasSynced return false
+	unsynced atomic.Bool
+}
+
+func (c *fakeController) AppendServiceHandler(f func(*model.Service, model.Event)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serviceHandlers = append(c.serviceHandlers, f)
+}
+
+func (c *fakeController) AppendWorkloadHandler(f func(*model.WorkloadInstance, model.Event)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.workloadHandlers = append(c.workloadHandlers, f)
+}
+
+func (c *fakeController) Run(<-chan struct{}) {}
+
+func (c *fakeController) HasSynced() bool { return !c.unsynced.Load() }
+
+func (c *fakeController) fireService(svc *model.Service, event model.Event) {
+	c.mu.RLock()
+	handlers := c.serviceHandlers
+	c.mu.RUnlock()
+	for _, h := range handlers {
+		h(svc, event)
+	}
+}
+
+func (c *fakeController) fireWorkload(wi *model.WorkloadInstance, event model.Event) {
+	c.mu.RLock()
+	handlers := c.workloadHandlers
+	c.mu.RUnlock()
+	for _, h := range handlers {
+		h(wi, event)
+	}
+}
+
+func fakeControllerOf(r serviceregistry.Simple) *fakeController {
+	return r.Controller.(*fakeController)
+}
+
+func TestInstancesByPortDedup(t *testing.T) {
+	svc := mock.MakeService("vm.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	cases := []struct {
+		name     string
+		skip     bool
+		external []*model.ServiceInstance
+		kube     []*model.ServiceInstance
+		want     []string
+	}{
+		{
+			name:     "duplicate prefers kubernetes",
+			external: []*model.ServiceInstance{makeInstance(svc, "1.1.1.1", 80, "", labels.Instance{"source": "external"})},
+			kube:     []*model.ServiceInstance{makeInstance(svc, "1.1.1.1", 80, "", labels.Instance{"source": "kube"})},
+			want:     []string{"1.1.1.1:80/kube"},
+		},
+		{
+			name:     "different port is kept",
+			external: []*model.ServiceInstance{makeInstance(svc, "1.1.1.1", 8080, "", labels.Instance{"source": "external"})},
+			kube:     []*model.ServiceInstance{makeInstance(svc, "1.1.1.1", 80, "", labels.Instance{"source": "kube"})},
+			want:     []string{"1.1.1.1:80/kube", "1.1.1.1:8080/external"},
+		},
+		{
+			name:     "different network is kept",
+			external: []*model.ServiceInstance{makeInstance(svc, "1.1.1.1", 80, "network-2", labels.Instance{"source": "external"})},
+			kube:     []*model.ServiceInstance{makeInstance(svc, "1.1.1.1", 80, "network-1", labels.Instance{"source": "kube"})},
+			want:     []string{"1.1.1.1:80/external", "1.1.1.1:80/kube"},
+		},
+		{
+			name:     "dedup skipped",
+			skip:     true,
+			external: []*model.ServiceInstance{makeInstance(svc, "1.1.1.1", 80, "", labels.Instance{"source": "external"})},
+			kube:     []*model.ServiceInstance{makeInstance(svc, "1.1.1.1", 80, "", labels.Instance{"source": "kube"})},
+			want:     []string{"1.1.1.1:80/external", "1.1.1.1:80/kube"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctl := NewController(Options{SkipInstanceDedup: tc.skip})
+			ctl.AddRegistry(newMemoryRegistry(provider.External, "cluster-1", svc, tc.external...))
+			ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc, tc.kube...))
+
+			var got []string
+			for _, inst := range ctl.InstancesByPort(svc, port, nil) {
+				got = append(got, fmt.Sprintf("%s:%d/%s", inst.Endpoint.Address, inst.Endpoint.EndpointPort, inst.Endpoint.Labels["source"]))
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("unexpected instances, diff %v", diff)
+			}
+		})
+	}
+}
+
+func BenchmarkInstancesByPort(b *testing.B) {
+	svc := mock.MakeService("bench.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	build := func(opts Options) *Controller {
+		ctl := NewController(opts)
+		for c := 0; c < 10; c++ {
+			clusterID := cluster.ID(fmt.Sprintf("cluster-%d", c))
+			instances := make([]*model.ServiceInstance, 0, 2000)
+			for i := 0; i < 2000; i++ {
+				instances = append(instances, makeInstance(svc, fmt.Sprintf("10.%d.%d.%d", c, i/256, i%256), 80, "", nil))
+			}
+			ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, clusterID, svc, instances...))
+		}
+		return ctl
+	}
+	for _, bc := range []struct {
+		name string
+		opts Options
+	}{
+		{"dedup", Options{}},
+		{"no-dedup", Options{SkipInstanceDedup: true}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctl := build(bc.opts)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				_ = ctl.InstancesByPort(svc, port, nil)
+			}
+		})
+	}
+}
+
+func TestInstancesByPortForCluster(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	ctl := NewController(Options{})
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+		makeInstance(svc, "1.1.1.1", 80, "", nil), makeInstance(svc, "1.1.1.2", 80, "", nil)))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc,
+		makeInstance(svc, "2.2.2.1", 80, "", nil)))
+	ctl.AddRegistry(newMemoryRegistry(provider.External, "cluster-2", svc,
+		makeInstance(svc, "2.2.2.2", 80, "", nil)))
+	ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc,
+		makeInstance(svc, "3.3.3.1", 80, "", nil)))
+
+	// the registries of other clusters and with no cluster are skipped
+	cases := []struct {
+		cluster cluster.ID
+		want    []string
+	}{
+		{"cluster-1", []string{"1.1.1.1", "1.1.1.2"}},
+		{"cluster-2", []string{"2.2.2.1", "2.2.2.2"}},
+		{"cluster-3", nil},
+		{"", []string{"1.1.1.1", "1.1.1.2", "2.2.2.1", "2.2.2.2", "3.3.3.1"}},
+	}
+	for _, tc := range cases {
+		t.Run(string(tc.cluster), func(t *testing.T) {
+			var got []string
+			for _, inst := range ctl.InstancesByPortForCluster(svc, port, nil, tc.cluster) {
+				got = append(got, inst.Endpoint.Address)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("unexpected instances, diff %v", diff)
+			}
+		})
+	}
+}
+
+func TestInstancesByPortFanOutOrder(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	serial := NewController(Options{FanOutWorkers: 1})
+	parallel := NewController(Options{FanOutWorkers: 4})
+	for c := 0; c < 10; c++ {
+		clusterID := cluster.ID(fmt.Sprintf("cluster-%d", c))
+		var instances []*model.ServiceInstance
+		for i := 0; i < 5; i++ {
+			instances = append(instances, makeInstance(svc, fmt.Sprintf("10.0.%d.%d", c, i), 80, "", nil))
+		}
+		r := newMemoryRegistry(provider.Kubernetes, clusterID, svc, instances...)
+		serial.AddRegistry(r)
+		parallel.AddRegistry(r)
+	}
+
+	want := serial.InstancesByPort(svc, port, nil)
+	if len(want) != 50 {
+		t.Fatalf("expected 50 instances, got %d", len(want))
+	}
+	for i := 0; i < 20; i++ {
+		if got := parallel.InstancesByPort(svc, port, nil); !reflect.DeepEqual(got, want) {
+			t.Fatalf("parallel fan out returned a different result than the serial path")
+		}
+	}
+}
+
+func BenchmarkInstancesByPortFanOut(b *testing.B) {
+	svc := mock.MakeService("bench.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	for _, bc := range []struct {
+		name    string
+		workers int
+	}{
+		{"serial", 1},
+		{"parallel", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctl := NewController(Options{FanOutWorkers: bc.workers, SkipInstanceDedup: true})
+			for c := 0; c < 20; c++ {
+				instances := make([]*model.ServiceInstance, 0, 1000)
+				for i := 0; i < 1000; i++ {
+					instances = append(instances, makeInstance(svc, fmt.Sprintf("10.%d.%d.%d", c, i/256, i%256), 80, "", nil))
+				}
+				ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, cluster.ID(fmt.Sprintf("cluster-%d", c)), svc, instances...))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				_ = ctl.InstancesByPort(svc, port, nil)
+			}
+		})
+	}
+}
+
+func TestGetProxyServiceInstancesClusterFallback(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	build := func(fallback bool) *Controller {
+		ctl := NewController(Options{ProxyClusterFallback: fallback})
+		ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc, makeInstance(svc, "1.1.1.1", 80, "", nil)))
+		ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc, makeInstance(svc, "2.2.2.2", 80, "", nil)))
+		return ctl
+	}
+	proxy := func(ip string, clusterID cluster.ID) *model.Proxy {
+		return &model.Proxy{ID: "vm." + ip, IPAddresses: []string{ip}, Metadata: &model.NodeMetadata{ClusterID: clusterID}}
+	}
+
+	cases := []struct {
+		name     string
+		fallback bool
+		proxy    *model.Proxy
+		want     int
+	}{
+		{"correct cluster", true, proxy("1.1.1.1", "cluster-1"), 1},
+		{"wrong cluster without fallback", false, proxy("1.1.1.1", "cluster-2"), 0},
+		{"wrong cluster with fallback hit", true, proxy("1.1.1.1", "cluster-2"), 1},
+		{"wrong cluster with no match anywhere", true, proxy("3.3.3.3", "cluster-2"), 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			instances := build(tc.fallback).GetProxyServiceInstances(tc.proxy)
+			if len(instances) != tc.want {
+				t.Fatalf("expected %d instances, got %d", tc.want, len(instances))
+			}
+			for _, inst := range instances {
+				if inst.Endpoint.Address != tc.proxy.IPAddresses[0] {
+					t.Fatalf("unexpected instance %v", inst.Endpoint.Address)
+				}
+			}
+		})
+	}
+}
+
+func TestGetProxyWorkloadLabelsMerge(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	newRegistry := func(providerID provider.ID, clusterID cluster.ID, lbls labels.Instance) serviceregistry.Simple {
+		r := newMemoryRegistry(providerID, clusterID, svc)
+		if lbls != nil {
+			r.ServiceDiscovery.(*memory.ServiceDiscovery).AddWorkload("1.1.1.1", lbls)
+		}
+		return r
+	}
+	cases := []struct {
+		name     string
+		cluster  cluster.ID
+		external labels.Instance
+		kube     labels.Instance
+		want     labels.Collection
+	}{
+		{
+			name:     "disjoint",
+			cluster:  "cluster-1",
+			external: labels.Instance{"vm": "true"},
+			kube:     labels.Instance{"app": "hello"},
+			want:     labels.Collection{{"vm": "true", "app": "hello"}},
+		},
+		{
+			name:     "overlapping prefers kubernetes",
+			cluster:  "cluster-1",
+			external: labels.Instance{"app": "hello-vm", "vm": "true"},
+			kube:     labels.Instance{"app": "hello"},
+			want:     labels.Collection{{"vm": "true", "app": "hello"}},
+		},
+		{
+			name:     "single registry",
+			cluster:  "cluster-1",
+			external: labels.Instance{"app": "hello-vm"},
+			want:     labels.Collection{{"app": "hello-vm"}},
+		},
+		{
+			name:     "empty cluster id",
+			external: labels.Instance{"vm": "true"},
+			kube:     labels.Instance{"app": "hello"},
+			want:     labels.Collection{{"vm": "true", "app": "hello"}},
+		},
+		{
+			name:     "other cluster",
+			cluster:  "cluster-2",
+			external: labels.Instance{"vm": "true"},
+			kube:     labels.Instance{"app": "hello"},
+			want:     nil,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctl := NewController(Options{})
+			ctl.AddRegistry(newRegistry(provider.External, "cluster-1", tc.external))
+			ctl.AddRegistry(newRegistry(provider.Kubernetes, "cluster-1", tc.kube))
+			got := ctl.GetProxyWorkloadLabels(&model.Proxy{
+				IPAddresses: []string{"1.1.1.1"},
+				Metadata:    &model.NodeMetadata{ClusterID: tc.cluster},
+			})
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("unexpected labels, diff %v", diff)
+			}
+		})
+	}
+}
+
+func TestGetProxyServiceInstancesDetailed(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc, makeInstance(svc, "1.1.1.1", 80, "", nil)))
+	ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc, makeInstance(svc, "1.1.1.1", 8080, "", nil)))
+
+	proxy := &model.Proxy{IPAddresses: []string{"1.1.1.1"}, Metadata: &model.NodeMetadata{ClusterID: "cluster-1"}}
+	var got []string
+	for _, inst := range ctl.GetProxyServiceInstancesDetailed(proxy) {
+		got = append(got, fmt.Sprintf("%d/%s/%s", inst.Instance.Endpoint.EndpointPort, inst.Cluster, inst.Provider))
+	}
+	want := []string{"80/cluster-1/Kubernetes", "8080//External"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected instances, diff %v", diff)
+	}
+	if plain := ctl.GetProxyServiceInstances(proxy); len(plain) != len(want) {
+		t.Errorf("expected %d instances from GetProxyServiceInstances, got %d", len(want), len(plain))
+	}
+}
+
+func TestGetProxyServiceInstancesDetailedMerged(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	// the Pod and the WorkloadEntry of a workload being migrated, and an instance of the other network
+	pod := makeInstance(svc, "1.1.1.1", 80, "", nil)
+	entry := makeInstance(svc, "1.1.1.1", 80, "", nil)
+	remote := makeInstance(svc, "1.1.1.1", 81, "network-2", nil)
+	proxy := &model.Proxy{IPAddresses: []string{"1.1.1.1"}, Metadata: &model.NodeMetadata{Network: "network-1"}}
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"deduplicated", Options{}, []string{"80/cluster-1/Kubernetes", "81//External"}},
+		{"unreachable filtered", Options{
+			// only network-3 has a gateway
+			MeshHolder: &meshNetworksHolder{networks: &meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+				"network-3": {Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+					Gw:   &meshconfig.Network_IstioNetworkGateway_Address{Address: "3.3.3.3"},
+					Port: 15443,
+				}}},
+			}}},
+			FilterUnreachableNetworks: true,
+		}, []string{"80/cluster-1/Kubernetes"}},
+		{"merge hook", Options{InstanceMergeHook: CapInstancesPerCluster(1)}, []string{"80/cluster-1/Kubernetes", "81//External"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctl := NewController(tc.opts)
+			ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc, remote, entry))
+			ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc, pod))
+
+			var got []string
+			var instances []*model.ServiceInstance
+			for _, inst := range ctl.GetProxyServiceInstancesDetailed(proxy) {
+				got = append(got, fmt.Sprintf("%d/%s/%s", inst.Instance.Endpoint.EndpointPort, inst.Cluster, inst.Provider))
+				instances = append(instances, inst.Instance)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("unexpected instances, diff %v", diff)
+			}
+			if plain := ctl.GetProxyServiceInstances(proxy); !reflect.DeepEqual(plain, instances) {
+				t.Errorf("expected the instances of GetProxyServiceInstances %v, got %v", plain, instances)
+			}
+		})
+	}
+}
+
+func TestHealthyInstancesByPort(t *testing.T) {
+	svc := mock.MakeService("vm.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	withHealth := func(inst *model.ServiceInstance, status model.HealthStatus) *model.ServiceInstance {
+		inst.Endpoint.HealthStatus = status
+		return inst
+	}
+	external := []*model.ServiceInstance{
+		withHealth(makeInstance(svc, "1.1.1.1", 80, "", nil), model.Healthy),
+		withHealth(makeInstance(svc, "1.1.1.2", 80, "", nil), model.UnHealthy),
+	}
+	kube := []*model.ServiceInstance{
+		makeInstance(svc, "2.2.2.1", 80, "", nil),
+		withHealth(makeInstance(svc, "2.2.2.2", 80, "", nil), model.UnHealthy),
+		withHealth(makeInstance(svc, "2.2.2.3", 80, "", nil), model.Healthy),
+	}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(newMemoryRegistry(provider.External, "cluster-1", svc, external...))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc, kube...))
+
+	before := getCounterValue(t, "pilot_aggregate_unhealthy_instances_filtered")
+	var got []string
+	for _, inst := range ctl.HealthyInstancesByPort(svc, port, nil) {
+		got = append(got, inst.Endpoint.Address)
+	}
+	if diff := cmp.Diff(got, []string{"1.1.1.1", "2.2.2.1", "2.2.2.3"}); diff != "" {
+		t.Errorf("unexpected instances, diff %v", diff)
+	}
+	if filtered := getCounterValue(t, "pilot_aggregate_unhealthy_instances_filtered") - before; filtered != 2 {
+		t.Errorf("expected 2 filtered instances to be recorded, got %v", filtered)
+	}
+
+	// The unfiltered listing and the instances themselves are left untouched.
+	if n := len(ctl.InstancesByPort(svc, port, nil)); n != 5 {
+		t.Errorf("expected 5 instances, got %d", n)
+	}
+	if external[1].Endpoint.HealthStatus != model.UnHealthy || kube[0].Endpoint.HealthStatus != 0 {
+		t.Errorf("instances were mutated")
+	}
+}
+
+func getCounterValue(t *testing.T, name string) float64 {
+	t.Helper()
+	data, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get value for counter %s: %v", name, err)
+	}
+	if len(data) == 0 {
+		return 0
+	}
+	return data[0].Data.(*view.SumData).Value
+}
+
+// getCounterTotal sums a counter over all of its label combinations.
+func getCounterTotal(t *testing.T, name string) float64 {
+	t.Helper()
+	data, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get value for counter %s: %v", name, err)
+	}
+	total := 0.0
+	for _, row := range data {
+		total += row.Data.(*view.SumData).Value
+	}
+	return total
+}
+
+func TestInstancesSortedAcrossRegistryOrder(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	var registries []serviceregistry.Instance
+	for c := 0; c < 5; c++ {
+		clusterID := cluster.ID(fmt.Sprintf("cluster-%d", c))
+		var instances []*model.ServiceInstance
+		// add the addresses in reverse, so the registry order is not already sorted
+		for i := 4; i >= 0; i-- {
+			inst := makeInstance(svc, fmt.Sprintf("10.0.%d.%d", i, c), 80, "", nil)
+			inst.Endpoint.Locality.ClusterID = clusterID
+			instances = append(instances, inst)
+		}
+		proxyInst := makeInstance(svc, "1.1.1.1", uint32(9000-c), "", nil)
+		proxyInst.Endpoint.Locality.ClusterID = clusterID
+		instances = append(instances, proxyInst)
+		registries = append(registries, newMemoryRegistry(provider.Kubernetes, clusterID, svc, instances...))
+	}
+	proxy := &model.Proxy{IPAddresses: []string{"1.1.1.1"}}
+
+	format := func(instances []*model.ServiceInstance) []string {
+		out := make([]string, 0, len(instances))
+		for _, inst := range instances {
+			out = append(out, fmt.Sprintf("%s/%s:%d", inst.Endpoint.Locality.ClusterID, inst.Endpoint.Address, inst.Endpoint.EndpointPort))
+		}
+		return out
+	}
+	var wantInstances, wantProxy []string
+	rnd := rand.New(rand.NewSource(1))
+	for round := 0; round < 10; round++ {
+		rnd.Shuffle(len(registries), func(i, j int) { registries[i], registries[j] = registries[j], registries[i] })
+		ctl := NewController(Options{})
+		for _, r := range registries {
+			ctl.AddRegistry(r)
+		}
+		gotInstances := format(ctl.InstancesByPort(svc, port, nil))
+		gotProxy := format(ctl.GetProxyServiceInstances(proxy))
+		if round == 0 {
+			wantInstances, wantProxy = gotInstances, gotProxy
+			if !sort.StringsAreSorted(gotInstances) || !sort.StringsAreSorted(gotProxy) {
+				t.Fatalf("instances are not sorted: %v %v", gotInstances, gotProxy)
+			}
+			continue
+		}
+		if diff := cmp.Diff(gotInstances, wantInstances); diff != "" {
+			t.Fatalf("round %d: instances depend on the registry order, diff %v", round, diff)
+		}
+		if diff := cmp.Diff(gotProxy, wantProxy); diff != "" {
+			t.Fatalf("round %d: proxy instances depend on the registry order, diff %v", round, diff)
+		}
+	}
+	if len(wantInstances) != 30 || len(wantProxy) != 5 {
+		t.Fatalf("unexpected number of instances: %d, %d", len(wantInstances), len(wantProxy))
+	}
+}
+
+// ipIndexedRegistry is a registry implementing the IP lookup fast path.
+type ipIndexedRegistry struct {
+	serviceregistry.Simple
+	lookups int
+}
+
+func (r *ipIndexedRegistry) GetInstancesByIP(ip string) []*model.ServiceInstance {
+	r.lookups++
+	return r.Simple.GetProxyServiceInstances(&model.Proxy{IPAddresses: []string{ip}})
+}
+
+func TestGetInstancesByIP(t *testing.T) {
+	svc := mock.MakeService("vm.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	indexed := &ipIndexedRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-2", svc,
+		makeInstance(svc, "2.2.2.2", 80, "network-2", labels.Instance{"source": "cluster-2"}))}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc,
+		makeInstance(svc, "1.1.1.1", 80, "network-1", labels.Instance{"source": "external"})))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+		makeInstance(svc, "1.1.1.1", 80, "network-1", labels.Instance{"source": "cluster-1"}),
+		makeInstance(svc, "2.2.2.2", 80, "network-1", labels.Instance{"source": "cluster-1"})))
+	ctl.AddRegistry(indexed)
+
+	format := func(instances []*model.ServiceInstance) []string {
+		var out []string
+		for _, inst := range instances {
+			out = append(out, fmt.Sprintf("%s/%s", inst.Endpoint.Address, inst.Endpoint.Labels["source"]))
+		}
+		return out
+	}
+	cases := []struct {
+		name      string
+		ip        string
+		clusterID cluster.ID
+		want      []string
+	}{
+		{
+			name: "duplicate across providers in one cluster",
+			ip:   "1.1.1.1",
+			want: []string{"1.1.1.1/cluster-1"},
+		},
+		{
+			name: "two clusters",
+			ip:   "2.2.2.2",
+			want: []string{"2.2.2.2/cluster-1", "2.2.2.2/cluster-2"},
+		},
+		{
+			name:      "cluster scoped",
+			ip:        "2.2.2.2",
+			clusterID: "cluster-2",
+			want:      []string{"2.2.2.2/cluster-2"},
+		},
+		{
+			name: "nowhere",
+			ip:   "3.3.3.3",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			if tc.clusterID == "" {
+				got = format(ctl.GetInstancesByIP(tc.ip))
+			} else {
+				got = format(ctl.GetInstancesByIPForCluster(tc.ip, tc.clusterID))
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("unexpected instances, diff %v", diff)
+			}
+		})
+	}
+	if indexed.lookups != 4 {
+		t.Errorf("expected the IP index to be used for every lookup, got %d lookups", indexed.lookups)
+	}
+}
+
+func TestInstancesByPortAndLocality(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	withLocality := func(address, locality string) *model.ServiceInstance {
+		inst := makeInstance(svc, address, 80, "", nil)
+		inst.Endpoint.Locality.Label = locality
+		return inst
+	}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+		withLocality("1.1.1.1", "us-east/zone-a/rack-1"),
+		withLocality("1.1.1.2", "us-east/zone-a/rack-2"),
+		withLocality("1.1.1.3", "us-east/zone-b"),
+		withLocality("1.1.1.4", "")))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc,
+		withLocality("2.2.2.1", "us-east/zone-a/rack-1"),
+		withLocality("2.2.2.2", "us-east1/zone-a"),
+		withLocality("2.2.2.3", "eu-west/zone-a")))
+
+	cases := []struct {
+		locality string
+		want     []string
+	}{
+		{"", []string{"1.1.1.1", "1.1.1.2", "1.1.1.3", "1.1.1.4", "2.2.2.1", "2.2.2.2", "2.2.2.3"}},
+		{"us-east", []string{"1.1.1.1", "1.1.1.2", "1.1.1.3", "2.2.2.1"}},
+		{"us-east/zone-a", []string{"1.1.1.1", "1.1.1.2", "2.2.2.1"}},
+		{"us-east/zone-a/rack-1", []string{"1.1.1.1", "2.2.2.1"}},
+		{"*/zone-a", []string{"1.1.1.1", "1.1.1.2", "2.2.2.1", "2.2.2.2", "2.2.2.3"}},
+		{"us-east/zone-c", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.locality, func(t *testing.T) {
+			var got []string
+			for _, inst := range ctl.InstancesByPortAndLocality(svc, port, nil, tc.locality) {
+				got = append(got, inst.Endpoint.Address)
+			}
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("unexpected instances, diff %v", diff)
+			}
+		})
+	}
+}
+
+func TestGetProxyServiceInstancesDedup(t *testing.T) {
+	svc := mock.MakeService("vm.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	other := mock.MakeService("other.default.svc.cluster.local", "10.10.0.1", []string{}, "cluster-1")
+	// a VM being migrated, still described by a WorkloadEntry and already running as a Pod
+	external := newMemoryRegistry(provider.External, "", svc,
+		makeInstance(svc, "1.1.1.1", 80, "", labels.Instance{"source": "external"}))
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+		makeInstance(svc, "1.1.1.1", 80, "", labels.Instance{"source": "kube"}))
+	// the same endpoint port exposed through another service port within a single registry is kept
+	otherInstance := makeInstance(other, "1.1.1.1", 80, "", labels.Instance{"source": "kube"})
+	otherInstance.ServicePort = &model.Port{Name: "http-other", Port: 8080, Protocol: svc.Ports[0].Protocol}
+	kube.ServiceDiscovery.(*memory.ServiceDiscovery).AddService(other.ClusterLocal.Hostname, other)
+	kube.ServiceDiscovery.(*memory.ServiceDiscovery).AddInstance(other.ClusterLocal.Hostname, otherInstance)
+
+	ctl := NewController(Options{})
+	ctl.AddRegistry(external)
+	ctl.AddRegistry(kube)
+
+	var got []string
+	for _, inst := range ctl.GetProxyServiceInstances(&model.Proxy{IPAddresses: []string{"1.1.1.1"}}) {
+		got = append(got, fmt.Sprintf("%s:%d/%s", inst.Service.ClusterLocal.Hostname, inst.ServicePort.Port, inst.Endpoint.Labels["source"]))
+	}
+	want := []string{"vm.default.svc.cluster.local:80/kube", "other.default.svc.cluster.local:8080/kube"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected proxy instances, diff %v", diff)
+	}
+}
+
+// labelFilteringDiscovery filters InstancesByPort by labels, which the memory registry ignores.
+type labelFilteringDiscovery struct {
+	*memory.ServiceDiscovery
+}
+
+func (d labelFilteringDiscovery) InstancesByPort(svc *model.Service, port int, lbls labels.Collection) []*model.ServiceInstance {
+	var out []*model.ServiceInstance
+	for _, inst := range d.ServiceDiscovery.InstancesByPort(svc, port, nil) {
+		if lbls.HasSubsetOf(inst.Endpoint.Labels) {
+			out = append(out, inst)
+		}
+	}
+	return out
+}
+
+func newLabelFilteringRegistry(providerID provider.ID, clusterID cluster.ID, svc *model.Service,
+	instances ...*model.ServiceInstance) serviceregistry.Simple {
+	r := newMemoryRegistry(providerID, clusterID, svc, instances...)
+	r.ServiceDiscovery = labelFilteringDiscovery{r.ServiceDiscovery.(*memory.ServiceDiscovery)}
+	return r
+}
+
+func TestInstancesByPortCentralLabelMatching(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	selector := labels.Collection{{"version": "v1"}}
+	build := func(opts Options) *Controller {
+		ctl := NewController(opts)
+		// the memory registry ignores the labels it is given
+		ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc,
+			makeInstance(svc, "1.1.1.1", 80, "", labels.Instance{"version": "v1"}),
+			makeInstance(svc, "1.1.1.2", 80, "", labels.Instance{"version": "v2"})))
+		ctl.AddRegistry(newLabelFilteringRegistry(provider.Kubernetes, "cluster-1", svc,
+			makeInstance(svc, "2.2.2.1", 80, "", labels.Instance{"version": "v1", "app": "hello"}),
+			makeInstance(svc, "2.2.2.2", 80, "", labels.Instance{"version": "v2", "app": "hello"}),
+			makeInstance(svc, "2.2.2.3", 80, "", nil)))
+		return ctl
+	}
+	addresses := func(instances []*model.ServiceInstance) []string {
+		var out []string
+		for _, inst := range instances {
+			out = append(out, inst.Endpoint.Address)
+		}
+		return out
+	}
+
+	delegated := addresses(build(Options{}).InstancesByPort(svc, port, selector))
+	if diff := cmp.Diff(delegated, []string{"1.1.1.1", "1.1.1.2", "2.2.2.1"}); diff != "" {
+		t.Errorf("unexpected delegated matching, diff %v", diff)
+	}
+	central := build(Options{CentralLabelMatching: true})
+	if diff := cmp.Diff(addresses(central.InstancesByPort(svc, port, selector)), []string{"1.1.1.1", "2.2.2.1"}); diff != "" {
+		t.Errorf("unexpected central matching, diff %v", diff)
+	}
+	if n := len(central.InstancesByPort(svc, port, nil)); n != 5 {
+		t.Errorf("expected every instance without a selector, got %d", n)
+	}
+}
+
+func BenchmarkInstancesByPortLabelMatching(b *testing.B) {
+	svc := mock.MakeService("bench.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	selector := labels.Collection{{"app": "bench", "version": "v1", "tier": "backend"}}
+	build := func(opts Options) *Controller {
+		ctl := NewController(opts)
+		for c := 0; c < 10; c++ {
+			clusterID := cluster.ID(fmt.Sprintf("cluster-%d", c))
+			instances := make([]*model.ServiceInstance, 0, 1000)
+			for i := 0; i < 1000; i++ {
+				lbls := labels.Instance{"app": "bench", "version": fmt.Sprintf("v%d", i%2), "tier": "backend", "pod": fmt.Sprint(i)}
+				instances = append(instances, makeInstance(svc, fmt.Sprintf("10.%d.%d.%d", c, i/256, i%256), 80, "", lbls))
+			}
+			ctl.AddRegistry(newLabelFilteringRegistry(provider.Kubernetes, clusterID, svc, instances...))
+		}
+		return ctl
+	}
+	for _, bc := range []struct {
+		name string
+		opts Options
+	}{
+		{"delegated", Options{}},
+		{"central", Options{CentralLabelMatching: true}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctl := build(bc.opts)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				_ = ctl.InstancesByPort(svc, port, selector)
+			}
+		})
+	}
+}
+
+// batchRegistry implements the multi-port lookup, counting its calls.
+type batchRegistry struct {
+	serviceregistry.Simple
+	calls int
+}
+
+func (r *batchRegistry) InstancesByPorts(svc *model.Service, ports []int, lbls labels.Collection) map[int][]*model.ServiceInstance {
+	r.calls++
+	out := make(map[int][]*model.ServiceInstance, len(ports))
+	for _, port := range ports {
+		out[port] = r.InstancesByPort(svc, port, lbls)
+	}
+	return out
+}
+
+func servicePortNumbers(svc *model.Service) []int {
+	out := make([]int, 0, len(svc.Ports))
+	for _, port := range svc.Ports {
+		out = append(out, port.Port)
+	}
+	return out
+}
+
+// makeMultiPortInstances returns an instance of each address on every port of the service.
+func makeMultiPortInstances(svc *model.Service, lbls labels.Instance, addresses ...string) []*model.ServiceInstance {
+	var out []*model.ServiceInstance
+	for _, address := range addresses {
+		for _, port := range svc.Ports {
+			inst := makeInstance(svc, address, uint32(1000+port.Port), "", lbls)
+			inst.ServicePort = port
+			inst.Endpoint.ServicePortName = port.Name
+			out = append(out, inst)
+		}
+	}
+	return out
+}
+
+func TestInstancesByPorts(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ports := append(servicePortNumbers(svc), 999)
+	batch := &batchRegistry{Simple: newLabelFilteringRegistry(provider.Kubernetes, "cluster-2", svc,
+		makeMultiPortInstances(svc, labels.Instance{"version": "v1"}, "2.2.2.1", "2.2.2.2")...)}
+
+	for _, opts := range []Options{{}, {CentralLabelMatching: true}} {
+		ctl := NewController(opts)
+		ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc,
+			makeMultiPortInstances(svc, labels.Instance{"version": "v2"}, "1.1.1.1", "2.2.2.1")...))
+		ctl.AddRegistry(newLabelFilteringRegistry(provider.Kubernetes, "cluster-1", svc,
+			makeMultiPortInstances(svc, labels.Instance{"version": "v1"}, "3.3.3.1")...))
+		ctl.AddRegistry(batch)
+		for _, selector := range []labels.Collection{nil, {{"version": "v1"}}} {
+			batch.calls = 0
+			got := ctl.InstancesByPorts(svc, ports, selector)
+			if batch.calls != 1 {
+				t.Errorf("expected a single batch call, got %d", batch.calls)
+			}
+			if len(got) != len(ports) {
+				t.Errorf("expected %d ports, got %d", len(ports), len(got))
+			}
+			for _, port := range ports {
+				if want := ctl.InstancesByPort(svc, port, selector); !reflect.DeepEqual(got[port], want) {
+					t.Errorf("port %d with selector %v: got %d instances, InstancesByPort returned %d", port, selector, len(got[port]), len(want))
+				}
+			}
+		}
+	}
+}
+
+func TestInstancesByPortsOptions(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	svc.Attributes = model.ServiceAttributes{
+		ServiceRegistry: provider.Kubernetes,
+		Name:            "hello",
+		Namespace:       "default",
+		LabelSelectors:  map[string]string{"app": "hello"},
+	}
+	ports := servicePortNumbers(svc)
+	selected := makeWorkload("vm", "default", "2.2.2.2")
+	selected.Endpoint.Labels = map[string]string{"app": "hello"}
+
+	cases := map[string]Options{
+		"select workloads across registries": {SelectWorkloadsAcrossRegistries: true},
+		"merge hook":                         {InstanceMergeHook: CapInstancesPerCluster(1)},
+		"contribution stats":                 {InstanceStatsSampling: 1},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctl := NewController(opts)
+			ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+				makeMultiPortInstances(svc, nil, "1.1.1.1", "1.1.1.2")...))
+			ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc,
+				makeMultiPortInstances(svc, nil, "3.3.3.1", "3.3.3.2")...))
+			external := newMemoryRegistry(provider.External, "", svc)
+			ctl.AddRegistry(external)
+			fakeControllerOf(external).fireWorkload(selected, model.EventAdd)
+
+			got := ctl.InstancesByPorts(svc, ports, nil)
+			batched := ctl.InstanceContributionStats()
+			for _, port := range ports {
+				if want := ctl.InstancesByPort(svc, port, nil); !reflect.DeepEqual(got[port], want) {
+					t.Errorf("port %d: got %d instances, InstancesByPort returned %d", port, len(got[port]), len(want))
+				}
+			}
+			// the lookups of each port are recorded as those of InstancesByPort
+			for i, stats := range ctl.InstanceContributionStats() {
+				if i >= len(batched) || stats.Samples != 2*batched[i].Samples || stats.Total != 2*batched[i].Total {
+					t.Errorf("expected InstancesByPorts to record the contributions of InstancesByPort, got %v then %v", batched, stats)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkInstancesByPorts(b *testing.B) {
+	svc := mock.MakeService("bench.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ports := servicePortNumbers(svc)
+	ctl := NewController(Options{})
+	for c := 0; c < 15; c++ {
+		var addresses []string
+		for i := 0; i < 100; i++ {
+			addresses = append(addresses, fmt.Sprintf("10.%d.%d.%d", c, i/256, i%256))
+		}
+		ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, cluster.ID(fmt.Sprintf("cluster-%d", c)), svc,
+			makeMultiPortInstances(svc, nil, addresses...)...))
+	}
+	b.Run("per-port", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, port := range ports {
+				_ = ctl.InstancesByPort(svc, port, nil)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			_ = ctl.InstancesByPorts(svc, ports, nil)
+		}
+	})
+}
+
+func TestGetProxyWorkloadLabelsDetailed(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	newRegistry := func(providerID provider.ID, clusterID cluster.ID, lbls labels.Instance) serviceregistry.Simple {
+		r := newMemoryRegistry(providerID, clusterID, svc)
+		r.ServiceDiscovery.(*memory.ServiceDiscovery).AddWorkload("1.1.1.1", lbls)
+		return r
+	}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(newRegistry(provider.External, "cluster-1", labels.Instance{"app": "hello-vm", "vm": "true"}))
+	ctl.AddRegistry(newRegistry(provider.Kubernetes, "cluster-1", labels.Instance{"app": "hello"}))
+	ctl.AddRegistry(newRegistry(provider.Kubernetes, "cluster-2", labels.Instance{"zone": "b"}))
+
+	external := WorkloadLabelSource{Cluster: "cluster-1", Provider: provider.External}
+	kube1 := WorkloadLabelSource{Cluster: "cluster-1", Provider: provider.Kubernetes}
+	kube2 := WorkloadLabelSource{Cluster: "cluster-2", Provider: provider.Kubernetes}
+	cases := []struct {
+		name        string
+		cluster     cluster.ID
+		wantLabels  labels.Collection
+		wantSources map[string]WorkloadLabelSource
+	}{
+		{
+			name:        "explicit cluster",
+			cluster:     "cluster-1",
+			wantLabels:  labels.Collection{{"app": "hello", "vm": "true"}},
+			wantSources: map[string]WorkloadLabelSource{"app": kube1, "vm": external},
+		},
+		{
+			name:        "single registry",
+			cluster:     "cluster-2",
+			wantLabels:  labels.Collection{{"zone": "b"}},
+			wantSources: map[string]WorkloadLabelSource{"zone": kube2},
+		},
+		{
+			name:        "empty cluster id searches every registry",
+			wantLabels:  labels.Collection{{"app": "hello", "vm": "true", "zone": "b"}},
+			wantSources: map[string]WorkloadLabelSource{"app": kube1, "vm": external, "zone": kube2},
+		},
+		{
+			name:    "unknown cluster",
+			cluster: "cluster-3",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := &model.Proxy{IPAddresses: []string{"1.1.1.1"}, Metadata: &model.NodeMetadata{ClusterID: tc.cluster}}
+			gotLabels, gotSources := ctl.GetProxyWorkloadLabelsDetailed(proxy)
+			if diff := cmp.Diff(gotLabels, tc.wantLabels); diff != "" {
+				t.Errorf("unexpected labels, diff %v", diff)
+			}
+			if diff := cmp.Diff(gotSources, tc.wantSources); diff != "" {
+				t.Errorf("unexpected sources, diff %v", diff)
+			}
+			if diff := cmp.Diff(ctl.GetProxyWorkloadLabels(proxy), gotLabels); diff != "" {
+				t.Errorf("GetProxyWorkloadLabels differs from the detailed labels, diff %v", diff)
+			}
+		})
+	}
+}
+
+func TestInstancesByPortSharded(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	ctl := NewController(Options{})
+	ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc,
+		makeInstance(svc, "1.1.1.1", 80, "", nil),
+		// collapsed into the kubernetes instance
+		makeInstance(svc, "2.2.2.1", 80, "", nil)))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+		makeInstance(svc, "2.2.2.2", 80, "", nil),
+		makeInstance(svc, "2.2.2.1", 80, "", nil)))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc))
+
+	sharded := ctl.InstancesByPortSharded(svc, port, nil)
+	shardAddresses := map[model.ShardKey][]string{}
+	var union []*model.ServiceInstance
+	for shard, instances := range sharded {
+		for _, inst := range instances {
+			shardAddresses[shard] = append(shardAddresses[shard], inst.Endpoint.Address)
+		}
+		union = append(union, instances...)
+	}
+	want := map[model.ShardKey][]string{
+		model.NewShardKey("", provider.External):            {"1.1.1.1"},
+		model.NewShardKey("cluster-1", provider.Kubernetes): {"2.2.2.1", "2.2.2.2"},
+	}
+	if diff := cmp.Diff(shardAddresses, want); diff != "" {
+		t.Errorf("unexpected shards, diff %v", diff)
+	}
+
+	flat := ctl.InstancesByPort(svc, port, nil)
+	sortInstances(union)
+	if !reflect.DeepEqual(union, flat) {
+		t.Errorf("the union of the shards does not match InstancesByPort: got %d instances, want %d", len(union), len(flat))
+	}
+}
+
+func TestInstancesByPortPerCluster(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	ctl := NewController(Options{})
+	// the kubernetes and external registries of cluster-1 are grouped together
+	ctl.AddRegistry(newMemoryRegistry(provider.External, "cluster-1", svc,
+		makeInstance(svc, "1.1.1.1", 80, "", nil),
+		// collapsed into the kubernetes instance
+		makeInstance(svc, "2.2.2.1", 80, "", nil)))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+		makeInstance(svc, "2.2.2.2", 80, "", nil),
+		makeInstance(svc, "2.2.2.1", 80, "", nil)))
+	ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc, makeInstance(svc, "3.3.3.3", 80, "", nil)))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc))
+
+	perCluster := ctl.InstancesByPortPerCluster(svc, port, nil)
+	clusterAddresses := map[cluster.ID][]string{}
+	var union []*model.ServiceInstance
+	for clusterID, instances := range perCluster {
+		for _, inst := range instances {
+			clusterAddresses[clusterID] = append(clusterAddresses[clusterID], inst.Endpoint.Address)
+		}
+		union = append(union, instances...)
+	}
+	want := map[cluster.ID][]string{
+		"":          {"3.3.3.3"},
+		"cluster-1": {"1.1.1.1", "2.2.2.1", "2.2.2.2"},
+	}
+	if diff := cmp.Diff(clusterAddresses, want); diff != "" {
+		t.Errorf("unexpected clusters, diff %v", diff)
+	}
+
+	flat := ctl.InstancesByPort(svc, port, nil)
+	sortInstances(union)
+	if !reflect.DeepEqual(union, flat) {
+		t.Errorf("the union of the clusters does not match InstancesByPort: got %d instances, want %d", len(union), len(flat))
+	}
+}
+
+func TestRequireSyncedRegistries(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	synced := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc, makeInstance(svc, "1.1.1.1", 80, "", nil))
+	syncing := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc, makeInstance(svc, "1.1.1.1", 81, "network-2", nil))
+	syncing.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(&model.NetworkGateway{Network: "network-2", Cluster: "cluster-2", Addr: "2.2.2.2", Port: 15443})
+	fakeControllerOf(syncing).unsynced.Store(true)
+
+	ctl := NewController(Options{RequireSyncedRegistries: true})
+	ctl.AddRegistry(synced)
+	ctl.AddRegistry(syncing)
+	proxy := &model.Proxy{IPAddresses: []string{"1.1.1.1"}}
+
+	before := getCounterTotal(t, "pilot_aggregate_unsynced_registries_skipped")
+	if got := ctl.InstancesByPort(svc, port, nil); len(got) != 1 {
+		t.Errorf("expected the instances of the synced registry only, got %d", len(got))
+	}
+	if got := ctl.GetProxyServiceInstances(proxy); len(got) != 1 {
+		t.Errorf("expected the proxy instances of the synced registry only, got %d", len(got))
+	}
+	if got := ctl.NetworkGateways(); len(got) != 0 {
+		t.Errorf("expected no gateways, got %v", got)
+	}
+	if got := ctl.GetInstancesByIP("1.1.1.1"); len(got) != 1 {
+		t.Errorf("expected the instances of the IP in the synced registry only, got %d", len(got))
+	}
+	if got, _, err := ctl.InstancesByPortPaged(svc, port, nil, PageOptions{}); err != nil || len(got) != 1 {
+		t.Errorf("expected a page of the synced registry only, got %d instances, %v", len(got), err)
+	}
+	if skipped := getCounterTotal(t, "pilot_aggregate_unsynced_registries_skipped") - before; skipped != 5 {
+		t.Errorf("expected 5 lookups recorded as partial, got %v", skipped)
+	}
+
+	fakeControllerOf(syncing).unsynced.Store(false)
+	if got := ctl.InstancesByPort(svc, port, nil); len(got) != 2 {
+		t.Errorf("expected the instances of both registries once synced, got %d", len(got))
+	}
+	if got := ctl.GetProxyServiceInstances(proxy); len(got) != 2 {
+		t.Errorf("expected the proxy instances of both registries once synced, got %d", len(got))
+	}
+	if got := ctl.NetworkGateways(); len(got) != 1 {
+		t.Errorf("expected the gateway once synced, got %v", got)
+	}
+	if got := ctl.GetInstancesByIP("1.1.1.1"); len(got) != 2 {
+		t.Errorf("expected the instances of the IP in both registries once synced, got %d", len(got))
+	}
+	if got, _, err := ctl.InstancesByPortPaged(svc, port, nil, PageOptions{}); err != nil || len(got) != 2 {
+		t.Errorf("expected a page of both registries once synced, got %d instances, %v", len(got), err)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// instanceCounter is implemented by registries able to count the instances of a service without building them.
+type instanceCounter interface {
+	InstanceCountByPort(svc *model.Service, port int, lbls labels.Collection) int
+}
+
+// countedRegistries is the number of registries counted without allocating a copy of the registry list.
+const countedRegistries = 16
+
+// InstanceCountByPort returns the number of instances InstancesByPort would return from each registry, summed
+// across the registries. Registries implementing InstanceCountByPort count their instances without building
+// them. Unlike InstancesByPort, identical endpoints reported by more than one registry are counted once per
+// registry. Registries with a call that timed out, registries whose Run panicked, and registries not synced yet
+// when Options.RequireSyncedRegistries is set, are skipped.
+func (c *Controller) InstanceCountByPort(svc *model.Service, port int, lbls labels.Collection) int {
+	total := 0
+	c.countInstances(svc, port, lbls, func(_ cluster.ID, n int) {
+		total += n
+	})
+	return total
+}
+
+// InstanceCountByPortPerCluster is like InstanceCountByPort, but returns the count of each cluster. Registries
+// without a cluster are counted under the empty cluster ID.
+func (c *Controller) InstanceCountByPortPerCluster(svc *model.Service, port int, lbls labels.Collection) map[cluster.ID]int {
+	out := map[cluster.ID]int{}
+	c.countInstances(svc, port, lbls, func(clusterID cluster.ID, n int) {
+		out[clusterID] += n
+	})
+	return out
+}
+
+// countInstances calls fn with the number of instances of every counted registry, serially.
+func (c *Controller) countInstances(svc *model.Service, port int, lbls labels.Collection, fn func(cluster.ID, int)) {
+	var buf [countedRegistries]serviceregistry.Instance
+	c.storeLock.RLock()
+	registries := append(buf[:0], c.registries...)
+	c.storeLock.RUnlock()
+
+	for _, r := range c.syncedRegistries(string(SearchInstances), registries) {
+		if key := (registryKey{cluster: r.Cluster(), provider: r.Provider()}); c.health.hung(key) || c.health.isDead(key) {
+			continue
+		}
+		fn(r.Cluster(), c.registryInstanceCount(r, svc, port, lbls))
+	}
+}
+
+func (c *Controller) registryInstanceCount(r serviceregistry.Instance, svc *model.Service, port int, lbls labels.Collection) int {
+	if counter, ok := r.(instanceCounter); ok {
+		return counter.InstanceCountByPort(svc, port, lbls)
+	}
+	if !c.centralLabelMatching {
+		return len(r.InstancesByPort(svc, port, lbls))
+	}
+	// count the matching instances without filtering the slice in place, it may be owned by the registry
+	n := 0
+	for _, inst := range r.InstancesByPort(svc, port, nil) {
+		if inst.Endpoint != nil && lbls.HasSubsetOf(inst.Endpoint.Labels) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,96 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// countingRegistry counts its instances without building them, and fails the test if they are built.
+type countingRegistry struct {
+	serviceregistry.Simple
+	count int
+	t     testing.TB
+}
+
+func (r countingRegistry) InstanceCountByPort(*model.Service, int, labels.Collection) int {
+	return r.count
+}
+
+func (r countingRegistry) InstancesByPort(*model.Service, int, labels.Collection) []*model.ServiceInstance {
+	r.t.Fatalf("instances of a counting registry should not be built")
+	return nil
+}
+
+func TestInstanceCountByPort(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	v1 := map[string]string{"version": "v1"}
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+		makeInstance(svc, "1.1.1.1", 80, "", v1), makeInstance(svc, "1.1.1.2", 80, "", nil))
+	external := newMemoryRegistry(provider.External, "cluster-1", svc, makeInstance(svc, "2.2.2.2", 80, "", v1))
+	counting := countingRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-2", svc), count: 5, t: t}
+	hung := newMemoryRegistry(provider.Kubernetes, "cluster-3", svc, makeInstance(svc, "3.3.3.3", 80, "", nil))
+	dead := newMemoryRegistry(provider.Kubernetes, "cluster-4", svc, makeInstance(svc, "4.4.4.4", 80, "", nil))
+
+	for _, central := range []bool{false, true} {
+		t.Run(fmt.Sprintf("central label matching %v", central), func(t *testing.T) {
+			ctl := NewController(Options{CentralLabelMatching: central})
+			for _, r := range []serviceregistry.Instance{kube, external, counting, hung, dead} {
+				ctl.AddRegistry(r)
+			}
+			ctl.health.timedOut(registryKey{cluster: "cluster-3", provider: provider.Kubernetes}, "test")
+			ctl.health.died(registryKey{cluster: "cluster-4", provider: provider.Kubernetes}, "test", "")
+
+			if got := ctl.InstanceCountByPort(svc, 80, nil); got != 8 {
+				t.Errorf("expected 8 instances, got %d", got)
+			}
+			want := map[cluster.ID]int{"cluster-1": 3, "cluster-2": 5}
+			if got := ctl.InstanceCountByPortPerCluster(svc, 80, nil); !reflect.DeepEqual(got, want) {
+				t.Errorf("expected counts %v, got %v", want, got)
+			}
+			if central {
+				// the memory registry does not match labels, the aggregate does
+				if got := ctl.InstanceCountByPort(svc, 80, labels.Collection{v1}); got != 7 {
+					t.Errorf("expected 7 instances matching the labels, got %d", got)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkInstanceCountByPort(b *testing.B) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	for c := 0; c < 5; c++ {
+		clusterID := cluster.ID(fmt.Sprintf("cluster-%d", c))
+		ctl.AddRegistry(countingRegistry{Simple: newMemoryRegistry(provider.Kubernetes, clusterID, svc), count: 100, t: b})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if got := ctl.InstanceCountByPort(svc, 80, nil); got != 500 {
+			b.Fatalf("expected 500 instances, got %d", got)
+		}
+	}
+}
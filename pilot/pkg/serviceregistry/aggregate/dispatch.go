@@ -0,0 +1,174 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"context"
+	"sync"
+)
+
+// HandlerOverflowPolicy selects what happens to an event when the queue of an asynchronous handler is full.
+type HandlerOverflowPolicy int
+
+const (
+	// OverflowBlock makes the registry wait until the handler makes room in its queue.
+	OverflowBlock HandlerOverflowPolicy = iota
+	// OverflowDropOldest drops the oldest queued event of the handler to make room, counting it in the
+	// pilot_aggregate_handler_events_dropped metric. The handler may then miss the final state of a service.
+	OverflowDropOldest
+)
+
+// handlerQueue calls the queued calls of a handler in order, on its own goroutine.
+type handlerQueue struct {
+	kind   string
+	size   int
+	policy HandlerOverflowPolicy
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []queuedCall
+	closed  bool
+	// seq numbers the queued calls, and running is the number of the call in progress, zero if none.
+	seq      uint64
+	running  uint64
+	barriers []queueBarrier
+}
+
+type queuedCall struct {
+	seq  uint64
+	call func()
+}
+
+// queueBarrier is closed once the calls queued up to seq are done or dropped.
+type queueBarrier struct {
+	seq  uint64
+	done chan struct{}
+}
+
+// newHandlerQueue returns a queue for a handler of the given kind of events, and starts its goroutine.
+func newHandlerQueue(kind string, size int, policy HandlerOverflowPolicy) *handlerQueue {
+	q := &handlerQueue{kind: kind, size: size, policy: policy}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// push queues a call, applying the overflow policy if the queue is full. Calls pushed after close are dropped.
+func (q *handlerQueue) push(call func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.policy == OverflowBlock && len(q.pending) >= q.size && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return
+	}
+	if len(q.pending) >= q.size {
+		q.pending[0] = queuedCall{}
+		q.pending = q.pending[1:]
+		handlerEventsDropped.With(eventTag.Value(q.kind)).Increment()
+		q.releaseBarriers()
+	}
+	q.seq++
+	q.pending = append(q.pending, queuedCall{seq: q.seq, call: call})
+	q.cond.Broadcast()
+}
+
+// barrier returns a channel closed once the calls queued so far are done, or dropped.
+func (q *handlerQueue) barrier() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b := queueBarrier{seq: q.seq, done: make(chan struct{})}
+	q.barriers = append(q.barriers, b)
+	q.releaseBarriers()
+	return b.done
+}
+
+// releaseBarriers closes the barriers whose calls are done. The lock must be held.
+func (q *handlerQueue) releaseBarriers() {
+	n := 0
+	for _, b := range q.barriers {
+		if q.closed || (q.running == 0 || q.running > b.seq) && (len(q.pending) == 0 || q.pending[0].seq > b.seq) {
+			close(b.done)
+			continue
+		}
+		q.barriers[n] = b
+		n++
+	}
+	q.barriers = q.barriers[:n]
+}
+
+// close stops the goroutine of the queue, dropping the queued calls.
+func (q *handlerQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.pending = nil
+	q.releaseBarriers()
+	q.cond.Broadcast()
+}
+
+func (q *handlerQueue) run() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		next := q.pending[0]
+		q.pending[0] = queuedCall{}
+		q.pending = q.pending[1:]
+		q.running = next.seq
+		// wake up the registries blocked on a full queue
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		next.call()
+		q.mu.Lock()
+		q.running = 0
+		q.releaseBarriers()
+		q.mu.Unlock()
+	}
+}
+
+// SyncHandlers waits until the events already queued for the asynchronous handlers, see
+// Options.AsyncHandlerQueueSize, are handled or dropped, or until the context is done, returning its error.
+// It does not wait for the events the registries did not report yet, nor for the events being coalesced, see
+// Options.CoalesceServiceEvents. It returns at once when the handlers are called synchronously.
+func (c *Controller) SyncHandlers(ctx context.Context) error {
+	c.storeLock.RLock()
+	var barriers []<-chan struct{}
+	for _, h := range c.serviceHandlers {
+		if h.queue != nil {
+			barriers = append(barriers, h.queue.barrier())
+		}
+	}
+	for _, h := range c.workloadHandlers {
+		if h.queue != nil {
+			barriers = append(barriers, h.queue.barrier())
+		}
+	}
+	c.storeLock.RUnlock()
+	for _, b := range barriers {
+		select {
+		case <-b:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/config/host"
+)
+
+// makeServiceVersions returns n services of the hostname, told apart by their address.
+func makeServiceVersions(hostname host.Name, n int) []*model.Service {
+	out := make([]*model.Service, 0, n)
+	for i := 0; i < n; i++ {
+		out = append(out, mock.MakeService(hostname, fmt.Sprintf("10.0.0.%d", i), []string{}, "cluster-1"))
+	}
+	return out
+}
+
+func TestAsyncHandlerDropOldest(t *testing.T) {
+	versions := makeServiceVersions("hello.default.svc.cluster.local", 5)
+	ctl := NewController(Options{AsyncHandlerQueueSize: 2, AsyncHandlerOverflow: OverflowDropOldest})
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", versions[0])
+	ctl.AddRegistry(kube)
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var mu sync.Mutex
+	var got []string
+	done := make(chan struct{})
+	ctl.AppendServiceHandler(func(svc *model.Service, _ model.Event) {
+		if svc == versions[0] {
+			close(started)
+			<-unblock
+		}
+		mu.Lock()
+		got = append(got, svc.Address)
+		mu.Unlock()
+		if svc == versions[4] {
+			close(done)
+		}
+	})
+
+	before := getCounterTotal(t, "pilot_aggregate_handler_events_dropped")
+	fakeControllerOf(kube).fireService(versions[0], model.EventAdd)
+	<-started
+	// the registry is not blocked by the busy handler; the oldest queued events are dropped
+	for _, svc := range versions[1:] {
+		fakeControllerOf(kube).fireService(svc, model.EventUpdate)
+	}
+	close(unblock)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the last event")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(got, []string{"10.0.0.0", "10.0.0.3", "10.0.0.4"}); diff != "" {
+		t.Errorf("unexpected events, diff %v", diff)
+	}
+	if dropped := getCounterTotal(t, "pilot_aggregate_handler_events_dropped") - before; dropped != 2 {
+		t.Errorf("expected 2 dropped events, got %v", dropped)
+	}
+}
+
+func TestAsyncHandlerBlock(t *testing.T) {
+	versions := makeServiceVersions("hello.default.svc.cluster.local", 3)
+	ctl := NewController(Options{AsyncHandlerQueueSize: 1})
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", versions[0])
+	ctl.AddRegistry(kube)
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	ctl.AppendServiceHandler(func(svc *model.Service, _ model.Event) {
+		if svc == versions[0] {
+			close(started)
+			<-unblock
+		}
+	})
+	fakeControllerOf(kube).fireService(versions[0], model.EventAdd)
+	<-started
+	// fills the queue
+	fakeControllerOf(kube).fireService(versions[1], model.EventUpdate)
+
+	fired := make(chan struct{})
+	go func() {
+		fakeControllerOf(kube).fireService(versions[2], model.EventUpdate)
+		close(fired)
+	}()
+	select {
+	case <-fired:
+		t.Fatal("expected the registry to block on the full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(unblock)
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the registry to be unblocked")
+	}
+}
+
+func TestAsyncHandlerOrdering(t *testing.T) {
+	const hostnames, events = 4, 100
+	ctl := NewController(Options{AsyncHandlerQueueSize: 8})
+	versions := map[host.Name][]*model.Service{}
+	var registries []*fakeController
+	for i := 0; i < hostnames; i++ {
+		hostname := host.Name(fmt.Sprintf("svc-%d.default.svc.cluster.local", i))
+		versions[hostname] = makeServiceVersions(hostname, events)
+		r := newMemoryRegistry(provider.Kubernetes, "cluster-1", versions[hostname][0])
+		ctl.AddRegistry(r)
+		registries = append(registries, fakeControllerOf(r))
+	}
+
+	recorder := NewEventRecorder(ctl)
+	defer recorder.Close()
+
+	// each registry fires the versions of its hostname concurrently with the others
+	for i, r := range registries {
+		r := r
+		hostname := host.Name(fmt.Sprintf("svc-%d.default.svc.cluster.local", i))
+		go func() {
+			for _, svc := range versions[hostname] {
+				r.fireService(svc, model.EventUpdate)
+			}
+		}()
+	}
+	got := map[host.Name][]string{}
+	for hostname := range versions {
+		for i := 0; i < events; i++ {
+			got[hostname] = append(got[hostname], recorder.WaitForHostname(t, hostname, model.EventUpdate, 5*time.Second).Service.Address)
+		}
+	}
+	for hostname, services := range versions {
+		var want []string
+		for _, svc := range services {
+			want = append(want, svc.Address)
+		}
+		if diff := cmp.Diff(got[hostname], want); diff != "" {
+			t.Errorf("events of %s out of order, diff %v", hostname, diff)
+		}
+	}
+}
+
+func TestSyncHandlers(t *testing.T) {
+	if err := NewController(Options{}).SyncHandlers(context.Background()); err != nil {
+		t.Errorf("expected the synchronous handlers to be in sync, got %v", err)
+	}
+
+	for _, policy := range []HandlerOverflowPolicy{OverflowBlock, OverflowDropOldest} {
+		versions := makeServiceVersions("hello.default.svc.cluster.local", 4)
+		ctl := NewController(Options{AsyncHandlerQueueSize: 2, AsyncHandlerOverflow: policy})
+		kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", versions[0])
+		ctl.AddRegistry(kube)
+
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		var handled atomic.Int32
+		ctl.AppendServiceHandler(func(svc *model.Service, _ model.Event) {
+			if svc == versions[0] {
+				close(started)
+				<-unblock
+			}
+			handled.Inc()
+		})
+		var workloads atomic.Int32
+		ctl.AppendWorkloadHandler(func(*model.WorkloadInstance, model.Event) { workloads.Inc() })
+
+		// a backlog of events queued behind a busy handler
+		fakeControllerOf(kube).fireService(versions[0], model.EventAdd)
+		<-started
+		fakeControllerOf(kube).fireService(versions[1], model.EventUpdate)
+		fakeControllerOf(kube).fireService(versions[2], model.EventUpdate)
+		if policy == OverflowDropOldest {
+			// drops versions[1]
+			fakeControllerOf(kube).fireService(versions[3], model.EventUpdate)
+		}
+		fakeControllerOf(kube).fireWorkload(makeWorkload("vm", "default", "10.0.0.1"), model.EventAdd)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		if err := ctl.SyncHandlers(ctx); err != context.DeadlineExceeded {
+			t.Errorf("expected the sync to time out behind the busy handler, got %v", err)
+		}
+		cancel()
+
+		synced := make(chan error)
+		go func() {
+			synced <- ctl.SyncHandlers(context.Background())
+		}()
+		close(unblock)
+		select {
+		case err := <-synced:
+			if err != nil {
+				t.Errorf("expected the handlers to be in sync, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the handlers to be in sync")
+		}
+		if handled.Load() != 3 || workloads.Load() != 1 {
+			t.Errorf("expected the queued events to be handled once in sync, got %d and %d", handled.Load(), workloads.Load())
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"context"
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+// aggregateEventBuffer is the number of events buffered for a consumer of Events.
+const aggregateEventBuffer = 256
+
+// AggregateEventKind is the kind of change reported by an AggregateEvent.
+type AggregateEventKind int
+
+const (
+	// ServiceChanged is a service event of a registry.
+	ServiceChanged AggregateEventKind = iota
+	// WorkloadChanged is a workload event of a registry.
+	WorkloadChanged
+	// RegistryAdded is the addition of a registry to the aggregate.
+	RegistryAdded
+	// RegistryDeleted is the deletion of a registry from the aggregate.
+	RegistryDeleted
+)
+
+func (k AggregateEventKind) String() string {
+	switch k {
+	case ServiceChanged:
+		return "ServiceChanged"
+	case WorkloadChanged:
+		return "WorkloadChanged"
+	case RegistryAdded:
+		return "RegistryAdded"
+	case RegistryDeleted:
+		return "RegistryDeleted"
+	}
+	return "Unknown"
+}
+
+// AggregateEvent is a change in the aggregate, see Controller.Events.
+type AggregateEvent struct {
+	Kind AggregateEventKind
+	// Event is the event of the service or of the workload.
+	Event model.Event
+	// Service is set for ServiceChanged.
+	Service *model.Service
+	// Workload is set for WorkloadChanged.
+	Workload *model.WorkloadInstance
+	// Cluster and Provider are those of the registry the event is about.
+	Cluster  cluster.ID
+	Provider provider.ID
+	// Dropped is the number of events dropped right before this one, as the consumer was not keeping up.
+	Dropped int
+}
+
+// subject describes what the event is about, for the messages.
+func (e AggregateEvent) subject() string {
+	switch {
+	case e.Service != nil:
+		return "the service " + string(e.Service.ClusterLocal.Hostname)
+	case e.Workload != nil:
+		return "the workload " + e.Workload.Name
+	}
+	return "the registry"
+}
+
+// eventStream is a consumer of Events.
+type eventStream struct {
+	subscription *subscription
+
+	mu      sync.Mutex
+	events  chan AggregateEvent
+	dropped int
+}
+
+// push sends the event to the consumer, or drops it if the buffer is full.
+func (st *eventStream) push(e AggregateEvent) {
+	if !st.subscription.enter() {
+		return
+	}
+	defer st.subscription.exit()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e.Dropped = st.dropped
+	select {
+	case st.events <- e:
+		st.dropped = 0
+	default:
+		st.dropped++
+		handlerEventsDropped.With(eventTag.Value("stream")).Increment()
+	}
+}
+
+// Events returns a single stream of the service and workload events of the registries, and of the addition and
+// deletion of registries, in the order they are dispatched. The events of the registries are those given to
+// AppendServiceHandlerWithSource and AppendWorkloadHandlerWithSource; a registry is added before its first
+// event, although the events in flight when it is deleted may follow its deletion. The dispatch is not blocked
+// by a slow consumer: the events that do not fit the buffer are dropped, and counted by the next delivered
+// event. The channel is closed once the context is done.
+func (c *Controller) Events(ctx context.Context) <-chan AggregateEvent {
+	st := &eventStream{subscription: newSubscription(), events: make(chan AggregateEvent, aggregateEventBuffer)}
+	services := c.AppendServiceHandlerWithSource(func(svc *model.Service, event model.Event, clusterID cluster.ID, providerID provider.ID) {
+		st.push(AggregateEvent{Kind: ServiceChanged, Event: event, Service: svc, Cluster: clusterID, Provider: providerID})
+	})
+	workloads := c.AppendWorkloadHandlerWithSource(func(wi *model.WorkloadInstance, event model.Event, clusterID cluster.ID, providerID provider.ID) {
+		st.push(AggregateEvent{Kind: WorkloadChanged, Event: event, Workload: wi, Cluster: clusterID, Provider: providerID})
+	})
+	c.storeLock.Lock()
+	c.streams = append(c.streams, st)
+	c.storeLock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		st.subscription.cancel()
+		c.RemoveServiceHandler(services)
+		c.RemoveWorkloadHandler(workloads)
+		c.storeLock.Lock()
+		for i, s := range c.streams {
+			if s == st {
+				c.streams = append(c.streams[:i:i], c.streams[i+1:]...)
+				break
+			}
+		}
+		c.storeLock.Unlock()
+		close(st.events)
+	}()
+	return st.events
+}
+
+// notifyStreams reports the addition or deletion of the registry to the consumers of Events. The storeLock
+// must be held.
+func (c *Controller) notifyStreams(kind AggregateEventKind, r serviceregistry.Instance) {
+	for _, st := range c.streams {
+		st.push(AggregateEvent{Kind: kind, Cluster: r.Cluster(), Provider: r.Provider()})
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+func nextAggregateEvent(t *testing.T, events <-chan AggregateEvent) AggregateEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("expected an event, the stream is closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return AggregateEvent{}
+}
+
+func TestEvents(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := ctl.Events(ctx)
+
+	r := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	ctl.AddRegistry(r)
+	fakeControllerOf(r).fireService(svc, model.EventAdd)
+	fakeControllerOf(r).fireWorkload(makeWorkload("vm", "default", "10.0.0.1"), model.EventUpdate)
+	fakeControllerOf(r).fireService(svc, model.EventDelete)
+	ctl.DeleteRegistry("cluster-2", provider.Kubernetes)
+
+	want := []AggregateEvent{
+		{Kind: RegistryAdded},
+		{Kind: ServiceChanged, Event: model.EventAdd},
+		{Kind: WorkloadChanged, Event: model.EventUpdate},
+		{Kind: ServiceChanged, Event: model.EventDelete},
+		{Kind: RegistryDeleted},
+	}
+	for _, w := range want {
+		got := nextAggregateEvent(t, events)
+		if got.Kind != w.Kind || got.Event != w.Event {
+			t.Fatalf("expected %v %v, got %v %v", w.Kind, w.Event, got.Kind, got.Event)
+		}
+		if got.Cluster != "cluster-2" || got.Provider != provider.Kubernetes {
+			t.Errorf("expected the events of cluster-2, got %s/%s", got.Cluster, got.Provider)
+		}
+		if (got.Kind == ServiceChanged) != (got.Service == svc) || (got.Kind == WorkloadChanged) != (got.Workload != nil) {
+			t.Errorf("unexpected payload of %v", got.Kind)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("expected the stream to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stream to be closed")
+	}
+	ctl.storeLock.RLock()
+	defer ctl.storeLock.RUnlock()
+	if len(ctl.streams) != 0 || len(ctl.serviceHandlers) != 0 || len(ctl.workloadHandlers) != 0 {
+		t.Errorf("expected the stream to be removed")
+	}
+}
+
+func TestEventsSlowConsumer(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	r := newMemoryRegistry(provider.Kubernetes, cluster.ID("cluster-1"), svc)
+	ctl.AddRegistry(r)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := ctl.Events(ctx)
+
+	// the dispatch is not blocked by the consumer
+	for i := 0; i < aggregateEventBuffer+10; i++ {
+		fakeControllerOf(r).fireService(svc, model.EventUpdate)
+	}
+	for i := 0; i < aggregateEventBuffer; i++ {
+		if e := nextAggregateEvent(t, events); e.Dropped != 0 {
+			t.Fatalf("expected no drop before the buffered event %d, got %d", i, e.Dropped)
+		}
+	}
+	fakeControllerOf(r).fireService(svc, model.EventDelete)
+	if e := nextAggregateEvent(t, events); e.Event != model.EventDelete || e.Dropped != 10 {
+		t.Errorf("expected the delete after 10 dropped events, got %v after %d", e.Event, e.Dropped)
+	}
+}
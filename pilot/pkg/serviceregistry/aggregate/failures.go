@@ -0,0 +1,108 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/pkg/log"
+)
+
+// HandlerFailure is an event a handler failed to handle.
+type HandlerFailure struct {
+	// Name is the hostname of the service, or the namespace and name of the workload.
+	Name  string    `json:"name"`
+	Event string    `json:"event"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// failureBuffer holds the last failures of a handler.
+type failureBuffer struct {
+	mu sync.Mutex
+	// failures is a ring of the last failures, next being the position of the oldest once it is full.
+	failures []HandlerFailure
+	next     int
+	size     int
+}
+
+func newFailureBuffer(size int) *failureBuffer {
+	return &failureBuffer{size: size}
+}
+
+// record records a failure, replacing the oldest one if the buffer is full. It ignores a nil buffer.
+func (b *failureBuffer) record(name string, event model.Event, err string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f := HandlerFailure{Name: name, Event: event.String(), Error: err, Time: time.Now()}
+	if len(b.failures) < b.size {
+		b.failures = append(b.failures, f)
+		return
+	}
+	b.failures[b.next] = f
+	b.next = (b.next + 1) % b.size
+}
+
+// list returns the failures, oldest first, nil for a nil buffer.
+func (b *failureBuffer) list() []HandlerFailure {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]HandlerFailure, 0, len(b.failures))
+	out = append(out, b.failures[b.next:]...)
+	return append(out, b.failures[:b.next]...)
+}
+
+// AppendServiceHandlerWithError is like AppendServiceHandlerNamed, but the handler can fail with an error,
+// which is logged and recorded, see Options.HandlerFailureBuffer.
+func (c *Controller) AppendServiceHandlerWithError(name string, f func(*model.Service, model.Event) error) HandlerID {
+	h := &serviceHandler{name: name}
+	h.f = func(svc *model.Service, event model.Event, clusterID cluster.ID, providerID provider.ID) {
+		if err := f(svc, event); err != nil {
+			log.Warnf("service handler %s added at %s failed handling %v of %s from registry %s/%s: %v",
+				h.name, h.site, event, svc.ClusterLocal.Hostname, providerID, clusterID, err)
+			h.failures.record(string(svc.ClusterLocal.Hostname), event, err.Error())
+		}
+	}
+	return c.addServiceHandler(h)
+}
+
+// HandlerFailures returns the last failures of the service and workload handlers with the given name, oldest
+// first for each handler. It returns nothing unless Options.HandlerFailureBuffer is set.
+func (c *Controller) HandlerFailures(name string) []HandlerFailure {
+	c.storeLock.RLock()
+	defer c.storeLock.RUnlock()
+	var out []HandlerFailure
+	for _, h := range c.serviceHandlers {
+		if h.name == name {
+			out = append(out, h.failures.list()...)
+		}
+	}
+	for _, h := range c.workloadHandlers {
+		if h.name == name {
+			out = append(out, h.failures.list()...)
+		}
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/config/host"
+)
+
+func TestHandlerFailures(t *testing.T) {
+	const bad = host.Name("bad.default.svc.cluster.local")
+	ctl := NewController(Options{HandlerFailureBuffer: 2})
+	r := newMemoryRegistry(provider.Kubernetes, "cluster-1", mock.MakeService(bad, "10.10.0.0", []string{}, "cluster-1"))
+	ctl.AddRegistry(r)
+	ctl.AppendServiceHandlerWithError("failing", func(svc *model.Service, _ model.Event) error {
+		if svc.ClusterLocal.Hostname == bad {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	ctl.AppendServiceHandlerNamed("panicking", func(svc *model.Service, _ model.Event) {
+		if svc.ClusterLocal.Hostname == bad {
+			panic("boom")
+		}
+	})
+
+	for i, event := range []model.Event{model.EventAdd, model.EventUpdate, model.EventDelete} {
+		fakeControllerOf(r).fireService(mock.MakeService(bad, "10.10.0.0", []string{}, "cluster-1"), event)
+		good := host.Name(fmt.Sprintf("good-%d.default.svc.cluster.local", i))
+		fakeControllerOf(r).fireService(mock.MakeService(good, "10.10.0.1", []string{}, "cluster-1"), event)
+	}
+
+	// the buffers keep the last two failures, of the failing hostname only
+	for handler, wantErr := range map[string]string{"failing": "boom", "panicking": "panic: boom"} {
+		var got []string
+		for _, f := range ctl.HandlerFailures(handler) {
+			if f.Time.IsZero() {
+				t.Errorf("expected the time of the failure of %s", handler)
+			}
+			got = append(got, f.Name+"/"+f.Event+"/"+f.Error)
+		}
+		want := []string{string(bad) + "/update/" + wantErr, string(bad) + "/delete/" + wantErr}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("unexpected failures of %s, diff %v", handler, diff)
+		}
+	}
+	for _, info := range ctl.Handlers() {
+		if len(info.Failures) != 2 {
+			t.Errorf("expected the handler %s to report 2 failures, got %d", info.Name, len(info.Failures))
+		}
+	}
+	if got := NewController(Options{}).HandlerFailures("failing"); got != nil {
+		t.Errorf("expected no failure without buffers, got %v", got)
+	}
+}
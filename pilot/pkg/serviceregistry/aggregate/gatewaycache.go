@@ -0,0 +1,102 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// networkGatewaysCache caches the merged network gateways. The gateways are invalidated by the gateway
+// notifications of the registries able to send them, by the service events of the other registries, since
+// their gateways are derived from their services, and by the changes of the registries.
+type networkGatewaysCache struct {
+	mu    sync.Mutex
+	valid bool
+	// gateways are copies of the merged gateways, which belong to the registries.
+	gateways      []model.NetworkGateway
+	invalidations invalidationTokens
+}
+
+func newNetworkGatewaysCache() *networkGatewaysCache {
+	return &networkGatewaysCache{}
+}
+
+// get returns a copy of the cached gateways, if any.
+func (gc *networkGatewaysCache) get() ([]*model.NetworkGateway, uint64, bool) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if !gc.valid {
+		return nil, gc.invalidations.token(), false
+	}
+	return copyNetworkGateways(gc.gateways), gc.invalidations.token(), true
+}
+
+// add stores the gateways, unless the cache was invalidated since token was read.
+func (gc *networkGatewaysCache) add(token uint64, gws []*model.NetworkGateway) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if !gc.invalidations.valid(token) {
+		return
+	}
+	gc.valid = true
+	gc.gateways = make([]model.NetworkGateway, 0, len(gws))
+	for _, gw := range gws {
+		gc.gateways = append(gc.gateways, *gw)
+	}
+}
+
+// clear drops the cached gateways.
+func (gc *networkGatewaysCache) clear() {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.invalidations.invalidateAll()
+	gc.valid = false
+	gc.gateways = nil
+}
+
+func copyNetworkGateways(gws []model.NetworkGateway) []*model.NetworkGateway {
+	if len(gws) == 0 {
+		return nil
+	}
+	values := append([]model.NetworkGateway(nil), gws...)
+	out := make([]*model.NetworkGateway, len(values))
+	for i := range values {
+		out[i] = &values[i]
+	}
+	return out
+}
+
+// cachedNetworkGateways returns the cached merged gateways, computing and storing them on a miss. With
+// Options.RequireSyncedRegistries, the gateways are only stored once every registry has synced, since the
+// registries syncing later change them without notice.
+func (c *Controller) cachedNetworkGateways() []*model.NetworkGateway {
+	cached, token, ok := c.gatewayCache.get()
+	if ok {
+		return cached
+	}
+	registries := c.GetRegistries()
+	store := true
+	for i := 0; c.requireSynced && store && i < len(registries); i++ {
+		store = registries[i].HasSynced()
+	}
+	gws, conflicts := c.mergeRegistryGateways(registries)
+	c.reportGatewayConflicts(conflicts)
+	if store {
+		c.gatewayCache.add(token, gws)
+	}
+	return gws
+}
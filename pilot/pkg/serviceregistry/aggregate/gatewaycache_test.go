@@ -0,0 +1,147 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+func TestNetworkGatewaysCache(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	gw1 := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443}
+	counting := &countingGatewayRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)}
+	counting.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw1)
+	notifying := &gatewayRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)}
+	ctl := NewController(Options{CacheNetworkGateways: true})
+	ctl.AddRegistry(counting)
+	ctl.AddRegistry(notifying)
+
+	// expect checks the gateways, and whether the registries were asked for them
+	expect := func(t *testing.T, called bool, want ...*model.NetworkGateway) {
+		t.Helper()
+		counting.calls = 0
+		if diff := cmp.Diff(ctl.NetworkGateways(), want); diff != "" {
+			t.Fatalf("unexpected gateways, diff %v", diff)
+		}
+		if (counting.calls > 0) != called {
+			t.Fatalf("expected the registries to be asked %v, got %d calls", called, counting.calls)
+		}
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		expect(t, true, gw1)
+		expect(t, false, gw1)
+		// the cached gateways are not modified by the callers
+		ctl.NetworkGateways()[0].Addr = "modified"
+		expect(t, false, gw1)
+	})
+
+	gw2 := &model.NetworkGateway{Network: "network-2", Cluster: "cluster-2", Addr: "2.2.2.2", Port: 15443}
+	t.Run("gateway notification", func(t *testing.T) {
+		notifying.addGateway(gw2)
+		expect(t, true, gw1, gw2)
+		expect(t, false, gw1, gw2)
+	})
+
+	t.Run("service event", func(t *testing.T) {
+		// the registry does not notify the changes of its gateways, which follow its services
+		gw1.Addr = "1.1.1.2"
+		expect(t, false, &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443}, gw2)
+		fakeControllerOf(counting.Simple).fireService(svc, model.EventUpdate)
+		expect(t, true, gw1, gw2)
+		expect(t, false, gw1, gw2)
+	})
+
+	t.Run("registry added and deleted", func(t *testing.T) {
+		gw3 := &model.NetworkGateway{Network: "network-3", Cluster: "cluster-3", Addr: "3.3.3.3", Port: 15443}
+		other := newMemoryRegistry(provider.Kubernetes, "cluster-3", svc)
+		other.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw3)
+		ctl.AddRegistry(other)
+		expect(t, true, gw1, gw2, gw3)
+		ctl.DeleteRegistry("cluster-3", provider.Kubernetes)
+		expect(t, true, gw1, gw2)
+		expect(t, false, gw1, gw2)
+	})
+
+	t.Run("registry stopped", func(t *testing.T) {
+		if err := ctl.StopRegistry("cluster-2", provider.Kubernetes); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, true, gw1)
+		if err := ctl.StartRegistry("cluster-2", provider.Kubernetes); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, true, gw1, gw2)
+	})
+}
+
+func TestNetworkGatewaysCacheUnsynced(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	gw := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443}
+	counting := &countingGatewayRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)}
+	counting.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw)
+	fakeControllerOf(counting.Simple).unsynced.Store(true)
+	ctl := NewController(Options{CacheNetworkGateways: true, RequireSyncedRegistries: true})
+	ctl.AddRegistry(counting)
+
+	if got := ctl.NetworkGateways(); len(got) != 0 {
+		t.Fatalf("expected no gateways from the unsynced registry, got %v", got)
+	}
+	// the registry syncing changes the gateways without notice, so nothing was stored
+	fakeControllerOf(counting.Simple).unsynced.Store(false)
+	if diff := cmp.Diff(ctl.NetworkGateways(), []*model.NetworkGateway{gw}); diff != "" {
+		t.Fatalf("unexpected gateways once synced, diff %v", diff)
+	}
+	counting.calls = 0
+	ctl.NetworkGateways()
+	if counting.calls != 0 {
+		t.Fatalf("expected the gateways to be cached once synced, got %d calls", counting.calls)
+	}
+}
+
+func BenchmarkNetworkGateways(b *testing.B) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-0")
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+			ctl := NewController(Options{CacheNetworkGateways: cached})
+			for i := 0; i < 10; i++ {
+				clusterID := cluster.ID(fmt.Sprintf("cluster-%d", i))
+				r := newMemoryRegistry(provider.Kubernetes, clusterID, svc)
+				for j := 0; j < 3; j++ {
+					r.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(&model.NetworkGateway{
+						Network: "network-1",
+						Cluster: clusterID,
+						Addr:    fmt.Sprintf("10.0.%d.%d", i, j),
+						Port:    15443,
+					})
+				}
+				ctl.AddRegistry(r)
+			}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				ctl.NetworkGateways()
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/host"
+)
+
+// gatewayServiceKey identifies the service backing a gateway in its cluster.
+type gatewayServiceKey struct {
+	cluster  cluster.ID
+	hostname host.Name
+}
+
+// gatewayNamespaceKey identifies the namespace of the services backing the gateways in a cluster.
+type gatewayNamespaceKey struct {
+	cluster   cluster.ID
+	namespace string
+}
+
+// maxGatewayEndpointsInvalidations bounds the services and namespaces whose invalidations are remembered.
+const maxGatewayEndpointsInvalidations = 1024
+
+type gatewayEndpointsEntry struct {
+	namespace string
+	healthy   int
+}
+
+// gatewayEndpointsCache caches the number of healthy instances of the services backing the gateways, in their
+// cluster. The entries of a service are invalidated by its service events, and by the workload events of its
+// namespace, where its instances are.
+type gatewayEndpointsCache struct {
+	mu            sync.Mutex
+	entries       map[gatewayServiceKey]gatewayEndpointsEntry
+	invalidations invalidationTokens
+}
+
+func newGatewayEndpointsCache() *gatewayEndpointsCache {
+	return &gatewayEndpointsCache{
+		entries:       map[gatewayServiceKey]gatewayEndpointsEntry{},
+		invalidations: newInvalidationTokens(maxGatewayEndpointsInvalidations),
+	}
+}
+
+func (ec *gatewayEndpointsCache) get(key gatewayServiceKey) (int, uint64, bool) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	e, ok := ec.entries[key]
+	return e.healthy, ec.invalidations.token(), ok
+}
+
+// add stores the count of the service, unless the service or its namespace were invalidated since token was
+// read.
+func (ec *gatewayEndpointsCache) add(token uint64, key gatewayServiceKey, namespace string, healthy int) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if !ec.invalidations.valid(token, key, gatewayNamespaceKey{cluster: key.cluster, namespace: namespace}) {
+		return
+	}
+	ec.entries[key] = gatewayEndpointsEntry{namespace: namespace, healthy: healthy}
+}
+
+// invalidateService drops the entry of the service, and returns true if there was one.
+func (ec *gatewayEndpointsCache) invalidateService(key gatewayServiceKey) bool {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.invalidations.invalidate(key)
+	_, dropped := ec.entries[key]
+	delete(ec.entries, key)
+	return dropped
+}
+
+// invalidateNamespace drops the entries of the services of the namespace in the cluster, and returns true if
+// there were any.
+func (ec *gatewayEndpointsCache) invalidateNamespace(key gatewayNamespaceKey) bool {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.invalidations.invalidate(key)
+	dropped := false
+	for k, e := range ec.entries {
+		if k.cluster == key.cluster && e.namespace == key.namespace {
+			delete(ec.entries, k)
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+// clear drops every entry.
+func (ec *gatewayEndpointsCache) clear() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.invalidations.invalidateAll()
+	ec.entries = map[gatewayServiceKey]gatewayEndpointsEntry{}
+}
+
+// gatewayHasEndpoints returns true if the service backing the gateway has a healthy instance in the cluster of
+// the registry, with Options.RequireGatewayEndpoints. The gateways with no backing service, given by address,
+// always pass.
+func (c *Controller) gatewayHasEndpoints(r serviceregistry.Instance, gw *model.NetworkGateway) bool {
+	if c.gatewayEndpoints == nil || gw.Service == "" {
+		return true
+	}
+	key := gatewayServiceKey{cluster: r.Cluster(), hostname: gw.Service}
+	healthy, token, ok := c.gatewayEndpoints.get(key)
+	if !ok {
+		var namespace string
+		healthy, namespace = healthyInstanceCount(r, gw.Service)
+		c.gatewayEndpoints.add(token, key, namespace, healthy)
+	}
+	return healthy > 0
+}
+
+// healthyInstanceCount returns the number of healthy instances of the service of the registry on its ports, and
+// the namespace of the service.
+func healthyInstanceCount(r serviceregistry.Instance, hostname host.Name) (int, string) {
+	svc, err := r.GetService(hostname)
+	if err != nil || svc == nil {
+		return 0, ""
+	}
+	healthy := 0
+	for _, port := range svc.Ports {
+		for _, inst := range r.InstancesByPort(svc, port.Port, nil) {
+			if inst.Endpoint != nil && inst.Endpoint.IsHealthy() {
+				healthy++
+			}
+		}
+	}
+	return healthy, svc.Attributes.Namespace
+}
+
+// registryGateways returns the gateways of the registry, leaving out those without healthy endpoints with
+// Options.RequireGatewayEndpoints.
+func (c *Controller) registryGateways(r serviceregistry.Instance) []*model.NetworkGateway {
+	gws := r.NetworkGateways()
+	if c.gatewayEndpoints == nil {
+		return gws
+	}
+	out := make([]*model.NetworkGateway, 0, len(gws))
+	for _, gw := range gws {
+		if c.gatewayHasEndpoints(r, gw) {
+			out = append(out, gw)
+		}
+	}
+	return out
+}
+
+// watchGatewayEndpoints invalidates the counts of the services backing the gateways on the events of the
+// registry, and notifies the gateway handlers of the gateways dropped or restored as a result.
+func (c *Controller) watchGatewayEndpoints(registry serviceregistry.Instance) {
+	clusterID := registry.Cluster()
+	registry.AppendServiceHandler(func(svc *model.Service, _ model.Event) {
+		if c.gatewayEndpoints.invalidateService(gatewayServiceKey{cluster: clusterID, hostname: svc.ClusterLocal.Hostname}) {
+			c.gatewaySourcesChanged()
+		}
+	})
+	registry.AppendWorkloadHandler(func(wi *model.WorkloadInstance, _ model.Event) {
+		if c.gatewayEndpoints.invalidateNamespace(gatewayNamespaceKey{cluster: clusterID, namespace: wi.Namespace}) {
+			c.gatewaySourcesChanged()
+		}
+	})
+}
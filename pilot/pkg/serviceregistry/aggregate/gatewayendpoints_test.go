@@ -0,0 +1,153 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// endpointsRegistry is a registry whose instances of the gateway service are set by the tests.
+type endpointsRegistry struct {
+	serviceregistry.Simple
+	mu        sync.Mutex
+	instances []*model.ServiceInstance
+	// lookups counts the instance lookups.
+	lookups int
+}
+
+func (r *endpointsRegistry) InstancesByPort(svc *model.Service, port int, _ labels.Collection) []*model.ServiceInstance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	if port != svc.Ports[0].Port {
+		return nil
+	}
+	return r.instances
+}
+
+func (r *endpointsRegistry) setInstances(instances ...*model.ServiceInstance) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.instances = instances
+}
+
+func (r *endpointsRegistry) lookupCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.lookups
+	r.lookups = 0
+	return n
+}
+
+func TestRequireGatewayEndpoints(t *testing.T) {
+	svc := mock.MakeService("eastwest.istio-system.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	svc.Attributes.Namespace = "istio-system"
+	healthy := makeInstance(svc, "10.0.0.1", 15443, "", nil)
+	unhealthy := makeInstance(svc, "10.0.0.2", 15443, "", nil)
+	unhealthy.Endpoint.HealthStatus = model.UnHealthy
+
+	backed := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443, Service: svc.ClusterLocal.Hostname}
+	local := &endpointsRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)}
+	local.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(backed)
+	local.setInstances(healthy)
+	// the gateway given by address has no backing service to check
+	byAddress := &model.NetworkGateway{Network: "network-2", Cluster: "cluster-2", Addr: "2.2.2.2", Port: 15443}
+	remote := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	remote.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(byAddress)
+
+	ctl := NewController(Options{RequireGatewayEndpoints: true})
+	ctl.AddRegistry(local)
+	ctl.AddRegistry(remote)
+	calls := atomic.NewInt32(0)
+	ctl.AppendNetworkGatewayHandler(func() {
+		calls.Inc()
+	})
+
+	expect := func(t *testing.T, called bool, want ...*model.NetworkGateway) {
+		t.Helper()
+		if called {
+			retry.UntilSuccessOrFail(t, func() error {
+				if calls.Load() == 0 {
+					return fmt.Errorf("expected the gateway handler to be called")
+				}
+				return nil
+			}, retry.Timeout(time.Second*5))
+			calls.Store(0)
+		}
+		if diff := cmp.Diff(ctl.NetworkGateways(), want); diff != "" {
+			t.Fatalf("unexpected gateways, diff %v", diff)
+		}
+	}
+
+	t.Run("healthy endpoints", func(t *testing.T) {
+		expect(t, false, backed, byAddress)
+		local.lookupCount()
+		expect(t, false, backed, byAddress)
+		if n := local.lookupCount(); n != 0 {
+			t.Fatalf("expected the endpoint count to be cached, got %d lookups", n)
+		}
+	})
+	t.Run("scaled to zero", func(t *testing.T) {
+		local.setInstances()
+		fakeControllerOf(local.Simple).fireWorkload(makeWorkload("eastwest", "istio-system", "10.0.0.1"), model.EventDelete)
+		expect(t, true, byAddress)
+	})
+	t.Run("workload of another namespace", func(t *testing.T) {
+		local.setInstances(healthy)
+		fakeControllerOf(local.Simple).fireWorkload(makeWorkload("hello", "default", "10.0.0.3"), model.EventAdd)
+		expect(t, false, byAddress)
+	})
+	t.Run("scaled back", func(t *testing.T) {
+		fakeControllerOf(local.Simple).fireWorkload(makeWorkload("eastwest", "istio-system", "10.0.0.1"), model.EventAdd)
+		expect(t, true, backed, byAddress)
+	})
+	t.Run("unhealthy endpoints", func(t *testing.T) {
+		local.setInstances(unhealthy)
+		fakeControllerOf(local.Simple).fireService(svc, model.EventUpdate)
+		expect(t, true, byAddress)
+		if got := ctl.NetworkGatewaysByCluster()["cluster-1"]; len(got) != 1 {
+			t.Fatalf("expected the gateways listed by cluster not to be filtered, got %v", got)
+		}
+		local.setInstances(unhealthy, healthy)
+		fakeControllerOf(local.Simple).fireService(svc, model.EventUpdate)
+		expect(t, true, backed, byAddress)
+	})
+}
+
+func TestRequireGatewayEndpointsDisabled(t *testing.T) {
+	svc := mock.MakeService("eastwest.istio-system.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	gw := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443, Service: svc.ClusterLocal.Hostname}
+	registry := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	registry.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw)
+	ctl := NewController(Options{})
+	ctl.AddRegistry(registry)
+	if diff := cmp.Diff(ctl.NetworkGateways(), []*model.NetworkGateway{gw}); diff != "" {
+		t.Fatalf("expected the gateway without endpoints to be kept, diff %v", diff)
+	}
+}
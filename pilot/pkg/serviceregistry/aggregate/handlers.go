@@ -0,0 +1,711 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pilot/pkg/util/sets"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+)
+
+// HandlerID identifies a handler added to the aggregate, so that it can be removed.
+type HandlerID uint64
+
+// eventFilter selects kinds of events, with a bit per model.Event. The zero value selects every event.
+type eventFilter uint8
+
+func newEventFilter(events []model.Event) eventFilter {
+	var f eventFilter
+	for _, event := range events {
+		f |= 1 << uint(event)
+	}
+	return f
+}
+
+func (f eventFilter) selects(event model.Event) bool {
+	return f == 0 || f&(1<<uint(event)) != 0
+}
+
+// events returns the kinds of events selected by the filter, nil for every event.
+func (f eventFilter) events() []model.Event {
+	if f == 0 {
+		return nil
+	}
+	var events []model.Event
+	for _, event := range []model.Event{model.EventAdd, model.EventUpdate, model.EventDelete} {
+		if f.selects(event) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// serviceHandler is a service handler added to the aggregate, called by dispatchServiceEvent. Removing it
+// stops the calls to f.
+type serviceHandler struct {
+	id HandlerID
+	// name identifies the handler in the logs and metrics.
+	name string
+	// site is where the handler was added, for the logs.
+	site    string
+	metrics *handlerMetrics
+	// clusterID, if forCluster is set, is the cluster of the registries the handler is attached to.
+	clusterID  cluster.ID
+	forCluster bool
+	// withSource is set for the handlers of AppendServiceHandlerWithSource, which are not coalesced.
+	withSource bool
+	// events selects the kinds of events the handler is called for.
+	events eventFilter
+	// fired, if set, makes the handler called at most once, being set by the first event.
+	fired *atomic.Bool
+	// queue, if set, makes the handler called asynchronously.
+	queue *handlerQueue
+	// replay, if set, tracks the replay of the services to the handler, see AppendServiceHandlerWithReplay.
+	replay *serviceReplay
+	// priority orders the handlers, see AppendServiceHandlerWithPriority.
+	priority int
+	// failures, if set, holds the last failures of the handler, see Options.HandlerFailureBuffer.
+	failures *failureBuffer
+
+	mu sync.RWMutex
+	f  func(*model.Service, model.Event, cluster.ID, provider.ID)
+}
+
+// handle calls the handler with an event of the registry of the given cluster and provider.
+func (h *serviceHandler) handle(svc *model.Service, event model.Event, clusterID cluster.ID, providerID provider.ID) {
+	if h.queue != nil {
+		h.queue.push(func() {
+			h.call(svc, event, clusterID, providerID)
+		})
+		return
+	}
+	h.call(svc, event, clusterID, providerID)
+}
+
+func (h *serviceHandler) call(svc *model.Service, event model.Event, clusterID cluster.ID, providerID provider.ID) {
+	h.mu.RLock()
+	f := h.f
+	h.mu.RUnlock()
+	if f == nil {
+		return
+	}
+	if h.fired != nil {
+		// the handler was removed from the aggregate by the dispatch, release it once called
+		defer h.remove()
+	}
+	if h.metrics != nil {
+		defer h.metrics.record(time.Now())
+	}
+	defer recoverHandler(h.failures, "service", h.name, h.site, event, string(svc.ClusterLocal.Hostname), clusterID, providerID)
+	f(svc, event, clusterID, providerID)
+}
+
+// coalesced returns true if the handler receives the coalesced events, when Options.CoalesceServiceEvents is
+// set, rather than the events of each registry.
+func (h *serviceHandler) coalesced() bool {
+	return !h.forCluster && !h.withSource
+}
+
+// remove stops calling the handler, and releases it.
+func (h *serviceHandler) remove() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.f = nil
+	if h.queue != nil {
+		h.queue.close()
+	}
+}
+
+// workloadHandler is a workload handler added to the aggregate. Registries cannot remove their handlers, so
+// they are given a closure calling handle instead, which stops calling f once removed.
+type workloadHandler struct {
+	id      HandlerID
+	name    string
+	site    string
+	metrics *handlerMetrics
+	queue   *handlerQueue
+	// providerID, if forProvider is set, is the provider of the registries the handler is attached to.
+	providerID  provider.ID
+	forProvider bool
+	events      eventFilter
+	failures    *failureBuffer
+
+	mu sync.RWMutex
+	f  func(*model.WorkloadInstance, model.Event, cluster.ID, provider.ID)
+}
+
+func (h *workloadHandler) handle(wi *model.WorkloadInstance, event model.Event, clusterID cluster.ID, providerID provider.ID) {
+	if h.queue != nil {
+		h.queue.push(func() {
+			h.call(wi, event, clusterID, providerID)
+		})
+		return
+	}
+	h.call(wi, event, clusterID, providerID)
+}
+
+func (h *workloadHandler) call(wi *model.WorkloadInstance, event model.Event, clusterID cluster.ID, providerID provider.ID) {
+	h.mu.RLock()
+	f := h.f
+	h.mu.RUnlock()
+	if f == nil {
+		return
+	}
+	if h.metrics != nil {
+		defer h.metrics.record(time.Now())
+	}
+	defer recoverHandler(h.failures, "workload", h.name, h.site, event, wi.Namespace+"/"+wi.Name, clusterID, providerID)
+	f(wi, event, clusterID, providerID)
+}
+
+func (h *workloadHandler) remove() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.f = nil
+	if h.queue != nil {
+		h.queue.close()
+	}
+}
+
+// recoverHandler, deferred by the handler calls, recovers from a panic of the handler so that the registry
+// keeps running and the other handlers are still called. The panic is recorded in the failures, if set.
+func recoverHandler(failures *failureBuffer, kind, handler, site string, event model.Event, name string, clusterID cluster.ID,
+	providerID provider.ID) {
+	if r := recover(); r != nil {
+		handlerPanics.With(eventTag.Value(kind), handlerTag.Value(handler)).Increment()
+		log.Errorf("%s handler %s added at %s panicked handling %v of %s from registry %s/%s: %v",
+			kind, handler, site, event, name, providerID, clusterID, r)
+		failures.record(name, event, fmt.Sprintf("panic: %v", r))
+	}
+}
+
+// handlerMetrics records the calls to a handler, for Options.HandlerMetrics.
+type handlerMetrics struct {
+	invocations monitoring.Metric
+	latency     monitoring.Metric
+}
+
+func newHandlerMetrics(kind, name string) *handlerMetrics {
+	return &handlerMetrics{
+		invocations: handlerInvocations.With(eventTag.Value(kind), handlerTag.Value(name)),
+		latency:     handlerLatency.With(eventTag.Value(kind), handlerTag.Value(name)),
+	}
+}
+
+// record records a call started at the given time.
+func (m *handlerMetrics) record(start time.Time) {
+	m.invocations.Increment()
+	m.latency.Record(time.Since(start).Seconds())
+}
+
+// recordHandlerCount records the number of handlers of a kind of event.
+func recordHandlerCount(kind string, n int) {
+	registeredHandlers.With(eventTag.Value(kind)).Record(float64(n))
+}
+
+// handlerName returns the name of a handler, defaulting to its kind and ID.
+func handlerName(name, kind string, id HandlerID) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", kind, id)
+}
+
+// registrationSite returns the location of the first caller outside the methods of the Controller.
+func registrationSite() string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.Contains(frame.Function, "/aggregate.(*Controller).") {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// AppendServiceHandler implements a service catalog operation.
+// The handler is appended to the current registries and to every registry added later, in the order the
+// handlers were appended.
+func (c *Controller) AppendServiceHandler(f func(*model.Service, model.Event)) {
+	c.AddServiceHandler(f)
+}
+
+// AppendWorkloadHandler is like AppendServiceHandler, for workload events.
+func (c *Controller) AppendWorkloadHandler(f func(*model.WorkloadInstance, model.Event)) {
+	c.AddWorkloadHandler(f)
+}
+
+// AddServiceHandler is like AppendServiceHandler, but returns an ID to remove the handler with.
+func (c *Controller) AddServiceHandler(f func(*model.Service, model.Event)) HandlerID {
+	return c.RegisterServiceHandler(ServiceHandlerFunc(f))
+}
+
+// ServiceEventHandler is a service handler of the aggregate. Its name identifies it in the logs, in the
+// metrics recorded when Options.HandlerMetrics is set, and in Handlers. If it implements
+// ServiceEventFilter, it is only called for the kinds of events returned by Filters.
+type ServiceEventHandler interface {
+	Handle(svc *model.Service, event model.Event)
+	// Name returns the name of the handler, or an empty string to name it after its kind and ID.
+	Name() string
+}
+
+// ServiceEventFilter is implemented by the ServiceEventHandlers called for some kinds of events only, see
+// AppendServiceHandlerFiltered.
+type ServiceEventFilter interface {
+	Filters() []model.Event
+}
+
+// ServiceHandlerFunc adapts a plain function to an unnamed ServiceEventHandler.
+type ServiceHandlerFunc func(*model.Service, model.Event)
+
+// Handle calls f.
+func (f ServiceHandlerFunc) Handle(svc *model.Service, event model.Event) {
+	f(svc, event)
+}
+
+// Name returns an empty string, the handler being unnamed.
+func (f ServiceHandlerFunc) Name() string {
+	return ""
+}
+
+type namedServiceHandler struct {
+	ServiceHandlerFunc
+	name string
+}
+
+func (h namedServiceHandler) Name() string {
+	return h.name
+}
+
+// NamedServiceHandler adapts a plain function to a ServiceEventHandler with the given name.
+func NamedServiceHandler(name string, f func(*model.Service, model.Event)) ServiceEventHandler {
+	return namedServiceHandler{ServiceHandlerFunc: f, name: name}
+}
+
+// RegisterServiceHandler is like AddServiceHandler, for a ServiceEventHandler.
+func (c *Controller) RegisterServiceHandler(h ServiceEventHandler) HandlerID {
+	sh := &serviceHandler{name: h.Name(), f: withoutSource(h.Handle)}
+	if filter, ok := h.(ServiceEventFilter); ok {
+		sh.events = newEventFilter(filter.Filters())
+	}
+	return c.addServiceHandler(sh)
+}
+
+// AppendServiceHandlerNamed is like AddServiceHandler, but names the handler in the logs and in the metrics
+// recorded when Options.HandlerMetrics is set. Unnamed handlers are named after their kind and ID.
+func (c *Controller) AppendServiceHandlerNamed(name string, f func(*model.Service, model.Event)) HandlerID {
+	return c.RegisterServiceHandler(NamedServiceHandler(name, f))
+}
+
+// AppendServiceHandlerFiltered is like AddServiceHandler, but only calls the handler for the given kinds of
+// events, or for every event if none is given. Other events are dropped before reaching the queue of the
+// handler, see Options.AsyncHandlerQueueSize.
+func (c *Controller) AppendServiceHandlerFiltered(events []model.Event, f func(*model.Service, model.Event)) HandlerID {
+	return c.addServiceHandler(&serviceHandler{events: newEventFilter(events), f: withoutSource(f)})
+}
+
+// AppendServiceHandlerOnce is like AddServiceHandler, but the handler is called for a single event, the first
+// one dispatched to it, and then removed. It is called at most once even when registries report events
+// concurrently.
+func (c *Controller) AppendServiceHandlerOnce(f func(*model.Service, model.Event)) HandlerID {
+	return c.addServiceHandler(&serviceHandler{fired: atomic.NewBool(false), f: withoutSource(f)})
+}
+
+// AppendServiceHandlerOnceForCluster is like AppendServiceHandlerOnce, for the first event of a registry of the
+// given cluster, see AppendServiceHandlerForCluster.
+func (c *Controller) AppendServiceHandlerOnceForCluster(clusterID cluster.ID, f func(*model.Service, model.Event)) HandlerID {
+	return c.addServiceHandler(&serviceHandler{clusterID: clusterID, forCluster: true, fired: atomic.NewBool(false), f: withoutSource(f)})
+}
+
+// DefaultHandlerPriority is the priority of the service handlers added without one.
+const DefaultHandlerPriority = 0
+
+// AppendServiceHandlerWithPriority is like AddServiceHandler, but the handler is called for an event before the
+// handlers of a higher priority, and after those of a lower priority. Handlers of the same priority are called
+// in the order they were added; the handlers added without a priority have DefaultHandlerPriority. For
+// instance, the handlers invalidating a cache should have a lower priority than those pushing its content.
+func (c *Controller) AppendServiceHandlerWithPriority(priority int, f func(*model.Service, model.Event)) HandlerID {
+	return c.addServiceHandler(&serviceHandler{priority: priority, f: withoutSource(f)})
+}
+
+// AppendServiceHandlerWithSource is like AddServiceHandler, but the handler is also given the cluster and
+// provider of the registry reporting the event. Its events are not coalesced by Options.CoalesceServiceEvents.
+func (c *Controller) AppendServiceHandlerWithSource(f func(*model.Service, model.Event, cluster.ID, provider.ID)) HandlerID {
+	return c.addServiceHandler(&serviceHandler{withSource: true, f: f})
+}
+
+func withoutSource(f func(*model.Service, model.Event)) func(*model.Service, model.Event, cluster.ID, provider.ID) {
+	return func(svc *model.Service, event model.Event, _ cluster.ID, _ provider.ID) {
+		f(svc, event)
+	}
+}
+
+// AppendServiceHandlerForCluster is like AddServiceHandler, but only attaches the handler to the current and
+// future registries of the given cluster. The handler stops receiving the events of a registry once it is
+// deleted, although events being delivered at that time may still reach it.
+func (c *Controller) AppendServiceHandlerForCluster(clusterID cluster.ID, f func(*model.Service, model.Event)) HandlerID {
+	return c.addServiceHandler(&serviceHandler{clusterID: clusterID, forCluster: true, f: withoutSource(f)})
+}
+
+// NamespaceHandler is a service handler added by AppendServiceHandlerForNamespaces.
+type NamespaceHandler struct {
+	id HandlerID
+	// namespaces holds the sets.Set of namespaces; it is replaced, never modified.
+	namespaces atomic.Value
+}
+
+// ID returns the ID to remove the handler with RemoveServiceHandler.
+func (h *NamespaceHandler) ID() HandlerID {
+	return h.id
+}
+
+// SetNamespaces replaces the namespaces of the services the handler is called for. An empty set selects every
+// namespace. The set is copied.
+func (h *NamespaceHandler) SetNamespaces(namespaces sets.Set) {
+	h.namespaces.Store(sets.NewSet().Union(namespaces))
+}
+
+func (h *NamespaceHandler) selects(namespace string) bool {
+	namespaces := h.namespaces.Load().(sets.Set)
+	return len(namespaces) == 0 || namespaces.Contains(namespace)
+}
+
+// AppendServiceHandlerForNamespaces is like AddServiceHandler, but only calls the handler for the services of
+// the given namespaces, or of every namespace if the set is empty. The namespaces can be changed later with
+// the returned NamespaceHandler.
+func (c *Controller) AppendServiceHandlerForNamespaces(namespaces sets.Set, f func(*model.Service, model.Event)) *NamespaceHandler {
+	h := &NamespaceHandler{}
+	h.SetNamespaces(namespaces)
+	h.id = c.AddServiceHandler(func(svc *model.Service, event model.Event) {
+		if h.selects(svc.Attributes.Namespace) {
+			f(svc, event)
+		}
+	})
+	return h
+}
+
+func (c *Controller) addServiceHandler(h *serviceHandler) HandlerID {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	c.lastHandlerID++
+	h.id = c.lastHandlerID
+	h.site = registrationSite()
+	h.name = handlerName(h.name, "service", h.id)
+	if c.handlerMetrics {
+		h.metrics = newHandlerMetrics("service", h.name)
+	}
+	if c.handlerQueueSize > 0 {
+		h.queue = newHandlerQueue("service", c.handlerQueueSize, c.handlerOverflow)
+	}
+	if c.handlerFailures > 0 {
+		h.failures = newFailureBuffer(c.handlerFailures)
+	}
+	// the handlers are replaced rather than modified, so that the dispatch can use them without the lock; they
+	// are kept sorted by priority, in the order they were added within a priority
+	i := len(c.serviceHandlers)
+	for i > 0 && c.serviceHandlers[i-1].priority > h.priority {
+		i--
+	}
+	handlers := make([]*serviceHandler, 0, len(c.serviceHandlers)+1)
+	handlers = append(handlers, c.serviceHandlers[:i]...)
+	handlers = append(handlers, h)
+	c.serviceHandlers = append(handlers, c.serviceHandlers[i:]...)
+	recordHandlerCount("service", len(c.serviceHandlers))
+	return h.id
+}
+
+// watchServiceEvents dispatches the service events of the registry to the service handlers, recording the time
+// of each in lastEvent. The storeLock must be held.
+func (c *Controller) watchServiceEvents(r serviceregistry.Instance, lastEvent *atomic.Int64) {
+	if !hasController(r) {
+		return
+	}
+	clusterID, providerID := r.Cluster(), r.Provider()
+	attached := c.attached[registryKey{cluster: clusterID, provider: providerID}]
+	r.AppendServiceHandler(func(svc *model.Service, event model.Event) {
+		c.syncs.recordEvent(lastEvent)
+		c.dispatchServiceEvent(svc, event, &eventSource{cluster: clusterID, provider: providerID, attached: attached})
+	})
+}
+
+// eventSource is the registry reporting a service event.
+type eventSource struct {
+	cluster  cluster.ID
+	provider provider.ID
+	// attached is cleared once the registry is deleted.
+	attached *atomic.Bool
+}
+
+// dispatchServiceEvent calls the handlers the event applies to, by priority then in the order they were added.
+// A nil source is a coalesced event, which has no single source registry.
+func (c *Controller) dispatchServiceEvent(svc *model.Service, event model.Event, source *eventSource) {
+	c.sequencer.dispatchEvent(svc.ClusterLocal.Hostname, event == model.EventDelete, func() {
+		c.callServiceHandlers(svc, event, source)
+	})
+}
+
+// callServiceHandlers calls the handlers for the event, in its turn among the events of its hostname.
+func (c *Controller) callServiceHandlers(svc *model.Service, event model.Event, source *eventSource) {
+	c.storeLock.RLock()
+	handlers := c.serviceHandlers
+	c.storeLock.RUnlock()
+
+	suppressed := c.suppressUnchanged(svc, event, source)
+	for _, h := range handlers {
+		if !h.events.selects(event) {
+			continue
+		}
+		if suppressed && h.coalesced() {
+			continue
+		}
+		// with coalescing, the coalesced handlers only receive the coalesced events
+		if c.coalescer != nil && h.coalesced() != (source == nil) {
+			continue
+		}
+		if source != nil && h.forCluster && (source.cluster != h.clusterID || !source.attached.Load()) {
+			continue
+		}
+		if h.fired != nil && !h.fired.CAS(false, true) {
+			continue
+		}
+		var clusterID cluster.ID
+		var providerID provider.ID
+		if source != nil {
+			clusterID, providerID = source.cluster, source.provider
+		}
+		if h.replay != nil {
+			add, out, deliver := h.replay.live(svc.ClusterLocal.Hostname, event)
+			if add {
+				h.handle(svc, model.EventAdd, clusterID, providerID)
+			}
+			if deliver {
+				h.handle(svc, out, clusterID, providerID)
+			}
+			continue
+		}
+		h.handle(svc, event, clusterID, providerID)
+		if h.fired != nil {
+			// the lock is not held while dispatching; the handler releases itself once called
+			c.forgetServiceHandler(h.id)
+		}
+	}
+}
+
+// attachWorkloadHandler appends the handler to the registry, if it applies to it. The storeLock must be held.
+func (c *Controller) attachWorkloadHandler(r serviceregistry.Instance, h *workloadHandler) {
+	if !hasController(r) {
+		return
+	}
+	clusterID, providerID := r.Cluster(), r.Provider()
+	if h.forProvider && (providerID == "" || providerID != h.providerID) {
+		return
+	}
+	r.AppendWorkloadHandler(func(wi *model.WorkloadInstance, event model.Event) {
+		if h.events.selects(event) {
+			h.handle(wi, event, clusterID, providerID)
+		}
+	})
+}
+
+// AddWorkloadHandler is like AppendWorkloadHandler, but returns an ID to remove the handler with.
+func (c *Controller) AddWorkloadHandler(f func(*model.WorkloadInstance, model.Event)) HandlerID {
+	return c.addWorkloadHandler(&workloadHandler{f: workloadWithoutSource(f)})
+}
+
+// AppendWorkloadHandlerFiltered is like AppendServiceHandlerFiltered, for workload events.
+func (c *Controller) AppendWorkloadHandlerFiltered(events []model.Event, f func(*model.WorkloadInstance, model.Event)) HandlerID {
+	return c.addWorkloadHandler(&workloadHandler{events: newEventFilter(events), f: workloadWithoutSource(f)})
+}
+
+// AppendWorkloadHandlerWithSource is like AddWorkloadHandler, but the handler is also given the cluster and
+// provider of the registry reporting the event.
+func (c *Controller) AppendWorkloadHandlerWithSource(f func(*model.WorkloadInstance, model.Event, cluster.ID, provider.ID)) HandlerID {
+	return c.addWorkloadHandler(&workloadHandler{f: f})
+}
+
+func workloadWithoutSource(f func(*model.WorkloadInstance, model.Event)) func(*model.WorkloadInstance, model.Event, cluster.ID, provider.ID) {
+	return func(wi *model.WorkloadInstance, event model.Event, _ cluster.ID, _ provider.ID) {
+		f(wi, event)
+	}
+}
+
+// AppendWorkloadHandlerForProvider is like AddWorkloadHandler, but only attaches the handler to the current and
+// future registries of the given provider. Registries without a provider are skipped.
+func (c *Controller) AppendWorkloadHandlerForProvider(providerID provider.ID, f func(*model.WorkloadInstance, model.Event)) HandlerID {
+	return c.addWorkloadHandler(&workloadHandler{providerID: providerID, forProvider: true, f: workloadWithoutSource(f)})
+}
+
+func (c *Controller) addWorkloadHandler(h *workloadHandler) HandlerID {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	c.lastHandlerID++
+	h.id = c.lastHandlerID
+	h.site = registrationSite()
+	h.name = handlerName(h.name, "workload", h.id)
+	if c.handlerMetrics {
+		h.metrics = newHandlerMetrics("workload", h.name)
+	}
+	if c.handlerQueueSize > 0 {
+		h.queue = newHandlerQueue("workload", c.handlerQueueSize, c.handlerOverflow)
+	}
+	if c.handlerFailures > 0 {
+		h.failures = newFailureBuffer(c.handlerFailures)
+	}
+	c.workloadHandlers = append(c.workloadHandlers, h)
+	recordHandlerCount("workload", len(c.workloadHandlers))
+	for _, r := range c.registries {
+		c.attachWorkloadHandler(r, h)
+	}
+	return h.id
+}
+
+// RemoveServiceHandler stops calling the service handler with the given ID, for the current registries and
+// the registries added later. Events being delivered while the handler is removed may still reach it. Unknown
+// IDs are ignored.
+func (c *Controller) RemoveServiceHandler(id HandlerID) {
+	if h := c.forgetServiceHandler(id); h != nil {
+		h.remove()
+	}
+}
+
+// forgetServiceHandler stops dispatching the events to the service handler, returning it, or nil if unknown.
+func (c *Controller) forgetServiceHandler(id HandlerID) *serviceHandler {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	for i, h := range c.serviceHandlers {
+		if h.id == id {
+			c.serviceHandlers = append(c.serviceHandlers[:i:i], c.serviceHandlers[i+1:]...)
+			recordHandlerCount("service", len(c.serviceHandlers))
+			return h
+		}
+	}
+	return nil
+}
+
+// RemoveWorkloadHandler is like RemoveServiceHandler, for workload handlers.
+func (c *Controller) RemoveWorkloadHandler(id HandlerID) {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	for i, h := range c.workloadHandlers {
+		if h.id == id {
+			h.remove()
+			c.workloadHandlers = append(c.workloadHandlers[:i:i], c.workloadHandlers[i+1:]...)
+			recordHandlerCount("workload", len(c.workloadHandlers))
+			return
+		}
+	}
+}
+
+var (
+	// ErrNoRegistries is returned when a handler is added to a running aggregate without registries. The
+	// handler is not called until a registry is added.
+	ErrNoRegistries = errors.New("the aggregate is running without registries")
+	// ErrUnknownCluster is returned when a handler is filtered by a cluster without registries in the
+	// aggregate. The handler is not called until a registry of the cluster is added.
+	ErrUnknownCluster = errors.New("no registry of the cluster")
+)
+
+// AppendServiceHandlerChecked is like AddServiceHandler, but also returns ErrNoRegistries if the handler cannot
+// be called yet, so that the caller does not wait for events that may never come. The handler is added in any
+// case, and is attached to the registries added later.
+func (c *Controller) AppendServiceHandlerChecked(f func(*model.Service, model.Event)) (HandlerID, error) {
+	id := c.addServiceHandler(&serviceHandler{f: withoutSource(f)})
+	return id, c.checkDelivery("", false)
+}
+
+// AppendServiceHandlerForClusterChecked is like AppendServiceHandlerForCluster, but also returns
+// ErrUnknownCluster if the aggregate has no registry of the cluster, or ErrNoRegistries, see
+// AppendServiceHandlerChecked.
+func (c *Controller) AppendServiceHandlerForClusterChecked(clusterID cluster.ID, f func(*model.Service, model.Event)) (HandlerID, error) {
+	id := c.addServiceHandler(&serviceHandler{clusterID: clusterID, forCluster: true, f: withoutSource(f)})
+	return id, c.checkDelivery(clusterID, true)
+}
+
+// AppendWorkloadHandlerChecked is like AppendServiceHandlerChecked, for workload events.
+func (c *Controller) AppendWorkloadHandlerChecked(f func(*model.WorkloadInstance, model.Event)) (HandlerID, error) {
+	id := c.addWorkloadHandler(&workloadHandler{f: workloadWithoutSource(f)})
+	return id, c.checkDelivery("", false)
+}
+
+// checkDelivery returns an error if a handler, filtered by the cluster if forCluster is set, cannot be called
+// with the current registries.
+func (c *Controller) checkDelivery(clusterID cluster.ID, forCluster bool) error {
+	c.storeLock.RLock()
+	defer c.storeLock.RUnlock()
+	if len(c.registries) == 0 && c.running.Load() {
+		return ErrNoRegistries
+	}
+	if !forCluster {
+		return nil
+	}
+	for _, r := range c.registries {
+		if r.Cluster() == clusterID {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %s", ErrUnknownCluster, clusterID)
+}
+
+// HandlerInfo describes a handler of the aggregate, for debugging.
+type HandlerInfo struct {
+	ID HandlerID `json:"id"`
+	// Kind is service or workload.
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Site is where the handler was added.
+	Site string `json:"site"`
+	// Events are the kinds of events the handler is called for, empty for every event.
+	Events []string `json:"events,omitempty"`
+	// Failures are the last failures of the handler, see Options.HandlerFailureBuffer.
+	Failures []HandlerFailure `json:"failures,omitempty"`
+}
+
+func newHandlerInfo(id HandlerID, kind, name, site string, events eventFilter, failures *failureBuffer) HandlerInfo {
+	info := HandlerInfo{ID: id, Kind: kind, Name: name, Site: site, Failures: failures.list()}
+	for _, event := range events.events() {
+		info.Events = append(info.Events, event.String())
+	}
+	return info
+}
+
+// Handlers returns the service and workload handlers of the aggregate, in the order they are called.
+func (c *Controller) Handlers() []HandlerInfo {
+	c.storeLock.RLock()
+	defer c.storeLock.RUnlock()
+	out := make([]HandlerInfo, 0, len(c.serviceHandlers)+len(c.workloadHandlers))
+	for _, h := range c.serviceHandlers {
+		out = append(out, newHandlerInfo(h.id, "service", h.name, h.site, h.events, h.failures))
+	}
+	for _, h := range c.workloadHandlers {
+		out = append(out, newHandlerInfo(h.id, "workload", h.name, h.site, h.events, h.failures))
+	}
+	return out
+}
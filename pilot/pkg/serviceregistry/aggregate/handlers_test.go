@@ -0,0 +1,526 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pilot/pkg/util/sets"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/host"
+)
+
+func TestRemoveHandlers(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	existing := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl.AddRegistry(existing)
+
+	var services, workloads []string
+	first := ctl.AddServiceHandler(func(*model.Service, model.Event) { services = append(services, "first") })
+	ctl.AddServiceHandler(func(*model.Service, model.Event) { services = append(services, "second") })
+	firstWorkload := ctl.AddWorkloadHandler(func(*model.WorkloadInstance, model.Event) { workloads = append(workloads, "first") })
+	ctl.AddWorkloadHandler(func(*model.WorkloadInstance, model.Event) { workloads = append(workloads, "second") })
+
+	ctl.RemoveServiceHandler(first)
+	ctl.RemoveWorkloadHandler(firstWorkload)
+	// removing twice, or an unknown handler, is a no-op
+	ctl.RemoveServiceHandler(first)
+	ctl.RemoveWorkloadHandler(HandlerID(100))
+
+	added := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	ctl.AddRegistry(added)
+	for _, r := range []*fakeController{fakeControllerOf(existing), fakeControllerOf(added)} {
+		r.fireService(svc, model.EventAdd)
+		r.fireWorkload(makeWorkload("vm", "default", "1.1.1.1"), model.EventAdd)
+	}
+	want := []string{"second", "second"}
+	if diff := cmp.Diff(services, want); diff != "" {
+		t.Errorf("unexpected service handlers called, diff %v", diff)
+	}
+	if diff := cmp.Diff(workloads, want); diff != "" {
+		t.Errorf("unexpected workload handlers called, diff %v", diff)
+	}
+}
+
+func TestAppendServiceHandlerForCluster(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	kube1 := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	kube2 := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	ctl.AddRegistry(kube1)
+	ctl.AddRegistry(kube2)
+
+	got := map[cluster.ID]int{}
+	ctl.AppendServiceHandlerForCluster("cluster-1", func(*model.Service, model.Event) { got["cluster-1"]++ })
+	ctl.AppendServiceHandlerForCluster("cluster-2", func(*model.Service, model.Event) { got["cluster-2"]++ })
+	// registries added later, including other providers of the cluster, receive the handlers of their cluster
+	external1 := newMemoryRegistry(provider.External, "cluster-1", svc)
+	ctl.AddRegistry(external1)
+
+	fire := func() {
+		for _, r := range []serviceregistry.Simple{kube1, kube2, external1} {
+			fakeControllerOf(r).fireService(svc, model.EventAdd)
+		}
+	}
+	fire()
+	if want := (map[cluster.ID]int{"cluster-1": 2, "cluster-2": 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected events %v, got %v", want, got)
+	}
+
+	// the events of a deleted registry are no longer delivered
+	got = map[cluster.ID]int{}
+	ctl.DeleteRegistry("cluster-1", provider.Kubernetes)
+	fire()
+	if want := (map[cluster.ID]int{"cluster-1": 1, "cluster-2": 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected events %v after deleting the registry, got %v", want, got)
+	}
+}
+
+func TestAppendServiceHandlerForNamespaces(t *testing.T) {
+	ctl := NewController(Options{})
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl.AddRegistry(kube)
+
+	var got []string
+	h := ctl.AppendServiceHandlerForNamespaces(sets.NewSet("default"), func(s *model.Service, _ model.Event) {
+		got = append(got, s.Attributes.Namespace)
+	})
+	var all []string
+	ctl.AppendServiceHandlerForNamespaces(sets.NewSet(), func(s *model.Service, _ model.Event) {
+		all = append(all, s.Attributes.Namespace)
+	})
+	fire := func() {
+		for _, ns := range []string{"default", "other", "istio-system"} {
+			s := mock.MakeService("hello."+host.Name(ns)+".svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+			s.Attributes.Namespace = ns
+			fakeControllerOf(kube).fireService(s, model.EventAdd)
+		}
+	}
+
+	fire()
+	if diff := cmp.Diff(got, []string{"default"}); diff != "" {
+		t.Errorf("unexpected namespaces, diff %v", diff)
+	}
+	if diff := cmp.Diff(all, []string{"default", "other", "istio-system"}); diff != "" {
+		t.Errorf("an empty set should select every namespace, diff %v", diff)
+	}
+
+	got = nil
+	h.SetNamespaces(sets.NewSet("default", "other"))
+	fire()
+	if diff := cmp.Diff(got, []string{"default", "other"}); diff != "" {
+		t.Errorf("unexpected namespaces after the update, diff %v", diff)
+	}
+
+	got = nil
+	ctl.RemoveServiceHandler(h.ID())
+	fire()
+	if len(got) != 0 {
+		t.Errorf("expected no events after removing the handler, got %v", got)
+	}
+}
+
+func TestAppendWorkloadHandlerForProvider(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl.AddRegistry(kube)
+
+	var got []string
+	ctl.AppendWorkloadHandlerForProvider(provider.External, func(wi *model.WorkloadInstance, _ model.Event) {
+		got = append(got, wi.Name)
+	})
+	external := newMemoryRegistry(provider.External, "cluster-1", svc)
+	unknown := newMemoryRegistry("", "cluster-1", svc)
+	ctl.AddRegistry(external)
+	ctl.AddRegistry(unknown)
+
+	fakeControllerOf(kube).fireWorkload(makeWorkload("pod", "default", "1.1.1.1"), model.EventAdd)
+	fakeControllerOf(external).fireWorkload(makeWorkload("vm", "default", "2.2.2.2"), model.EventAdd)
+	fakeControllerOf(unknown).fireWorkload(makeWorkload("unknown", "default", "3.3.3.3"), model.EventAdd)
+	if diff := cmp.Diff(got, []string{"vm"}); diff != "" {
+		t.Errorf("unexpected workload events, diff %v", diff)
+	}
+}
+
+func TestAppendHandlersWithSource(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	kube1 := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl.AddRegistry(kube1)
+	recorder := NewEventRecorder(ctl)
+	defer recorder.Close()
+	external2 := newMemoryRegistry(provider.External, "cluster-2", svc)
+	ctl.AddRegistry(external2)
+
+	// the same hostname fires from both registries
+	for _, r := range []serviceregistry.Simple{kube1, external2} {
+		fakeControllerOf(r).fireService(svc, model.EventAdd)
+		fakeControllerOf(r).fireWorkload(makeWorkload("vm", "default", "1.1.1.1"), model.EventAdd)
+	}
+	var services, workloads []string
+	for i := 0; i < 2; i++ {
+		e := recorder.WaitForHostname(t, svc.ClusterLocal.Hostname, model.EventAdd, time.Second)
+		services = append(services, string(e.Service.ClusterLocal.Hostname)+"@"+string(e.Cluster)+"/"+string(e.Provider))
+		e = recorder.WaitForWorkload(t, "vm", model.EventAdd, time.Second)
+		workloads = append(workloads, e.Workload.Name+"@"+string(e.Cluster)+"/"+string(e.Provider))
+	}
+	recorder.AssertNoEvents(t, 0)
+	wantServices := []string{"hello.default.svc.cluster.local@cluster-1/Kubernetes", "hello.default.svc.cluster.local@cluster-2/External"}
+	if diff := cmp.Diff(services, wantServices); diff != "" {
+		t.Errorf("unexpected service sources, diff %v", diff)
+	}
+	if diff := cmp.Diff(workloads, []string{"vm@cluster-1/Kubernetes", "vm@cluster-2/External"}); diff != "" {
+		t.Errorf("unexpected workload sources, diff %v", diff)
+	}
+}
+
+func TestHandlerPanicRecovered(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl.AddRegistry(kube)
+
+	var called []string
+	ctl.AppendServiceHandler(func(*model.Service, model.Event) { panic("boom") })
+	ctl.AppendServiceHandler(func(*model.Service, model.Event) { called = append(called, "second") })
+	ctl.AppendServiceHandler(func(*model.Service, model.Event) { called = append(called, "third") })
+	ctl.AppendWorkloadHandler(func(*model.WorkloadInstance, model.Event) { panic("boom") })
+	ctl.AppendWorkloadHandler(func(*model.WorkloadInstance, model.Event) { called = append(called, "workload") })
+
+	before := getCounterTotal(t, "pilot_aggregate_handler_panics")
+	fakeControllerOf(kube).fireService(svc, model.EventAdd)
+	fakeControllerOf(kube).fireWorkload(makeWorkload("vm", "default", "1.1.1.1"), model.EventAdd)
+	if diff := cmp.Diff(called, []string{"second", "third", "workload"}); diff != "" {
+		t.Errorf("unexpected handlers called, diff %v", diff)
+	}
+	if panics := getCounterTotal(t, "pilot_aggregate_handler_panics") - before; panics != 2 {
+		t.Errorf("expected 2 panics recorded, got %v", panics)
+	}
+	if site := ctl.serviceHandlers[0].site; !strings.Contains(site, "handlers_test.go") {
+		t.Errorf("expected the handler to be added by the test, got %s", site)
+	}
+}
+
+// handlerMetricRow returns the data of the metric for the given handler, nil if none was recorded.
+func handlerMetricRow(t *testing.T, name, handler string) view.AggregationData {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get metric %s: %v", name, err)
+	}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key.Name() == "handler" && tag.Value == handler {
+				return row.Data
+			}
+		}
+	}
+	return nil
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{HandlerMetrics: true})
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl.AddRegistry(kube)
+
+	called := 0
+	ctl.AppendServiceHandlerNamed("test-named", func(*model.Service, model.Event) { called++ })
+	unnamed := ctl.AddServiceHandler(func(*model.Service, model.Event) { called++ })
+	ctl.AppendServiceHandlerNamed("test-panicking", func(*model.Service, model.Event) { panic("boom") })
+	fakeControllerOf(kube).fireService(svc, model.EventAdd)
+	fakeControllerOf(kube).fireService(svc, model.EventUpdate)
+	if called != 4 {
+		t.Fatalf("expected the handlers to be called 4 times, got %d", called)
+	}
+
+	for _, handler := range []string{"test-named", fmt.Sprintf("service-%d", unnamed)} {
+		if data, ok := handlerMetricRow(t, "pilot_aggregate_handler_invocations", handler).(*view.SumData); !ok || data.Value != 2 {
+			t.Errorf("expected 2 invocations of %s, got %v", handler, data)
+		}
+		if data, ok := handlerMetricRow(t, "pilot_aggregate_handler_latency_seconds", handler).(*view.DistributionData); !ok || data.Count != 2 {
+			t.Errorf("expected 2 latencies of %s, got %v", handler, data)
+		}
+	}
+	if data, ok := handlerMetricRow(t, "pilot_aggregate_handler_panics", "test-panicking").(*view.SumData); !ok || data.Value != 2 {
+		t.Errorf("expected 2 panics of the panicking handler, got %v", data)
+	}
+}
+
+func TestAppendHandlersFiltered(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	allEvents := []model.Event{model.EventAdd, model.EventUpdate, model.EventDelete}
+	cases := []struct {
+		name   string
+		events []model.Event
+	}{
+		{"add", []model.Event{model.EventAdd}},
+		{"update", []model.Event{model.EventUpdate}},
+		{"delete", []model.Event{model.EventDelete}},
+		{"add and delete", []model.Event{model.EventAdd, model.EventDelete}},
+		{"empty", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctl := NewController(Options{})
+			kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+			ctl.AddRegistry(kube)
+			var services, workloads []model.Event
+			ctl.AppendServiceHandlerFiltered(tc.events, func(_ *model.Service, event model.Event) {
+				services = append(services, event)
+			})
+			ctl.AppendWorkloadHandlerFiltered(tc.events, func(_ *model.WorkloadInstance, event model.Event) {
+				workloads = append(workloads, event)
+			})
+			for _, event := range allEvents {
+				fakeControllerOf(kube).fireService(svc, event)
+				fakeControllerOf(kube).fireWorkload(makeWorkload("vm", "default", "1.1.1.1"), event)
+			}
+			want := tc.events
+			if len(want) == 0 {
+				want = allEvents
+			}
+			if diff := cmp.Diff(services, want); diff != "" {
+				t.Errorf("unexpected service events, diff %v", diff)
+			}
+			if diff := cmp.Diff(workloads, want); diff != "" {
+				t.Errorf("unexpected workload events, diff %v", diff)
+			}
+		})
+	}
+}
+
+func TestAppendServiceHandlerOnce(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Run(fmt.Sprintf("async %v", async), func(t *testing.T) {
+			opts := Options{}
+			if async {
+				opts.AsyncHandlerQueueSize = 10
+			}
+			ctl := NewController(opts)
+			versions := makeServiceVersions("hello.default.svc.cluster.local", 100)
+			kube1 := newMemoryRegistry(provider.Kubernetes, "cluster-1", versions[0])
+			kube2 := newMemoryRegistry(provider.Kubernetes, "cluster-2", versions[0])
+			ctl.AddRegistry(kube1)
+			ctl.AddRegistry(kube2)
+
+			var calls, clusterCalls atomic.Int32
+			var clusterEvent atomic.String
+			done := make(chan struct{}, 2)
+			ctl.AppendServiceHandlerOnce(func(*model.Service, model.Event) {
+				calls.Inc()
+				done <- struct{}{}
+			})
+			ctl.AppendServiceHandlerOnceForCluster("cluster-2", func(svc *model.Service, _ model.Event) {
+				clusterCalls.Inc()
+				clusterEvent.Store(svc.Address)
+				done <- struct{}{}
+			})
+
+			// both registries fire concurrently
+			var wg sync.WaitGroup
+			for i, r := range []*fakeController{fakeControllerOf(kube1), fakeControllerOf(kube2)} {
+				r, mine := r, versions[i*50:(i+1)*50]
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for _, svc := range mine {
+						r.fireService(svc, model.EventUpdate)
+					}
+				}()
+			}
+			wg.Wait()
+			for i := 0; i < 2; i++ {
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the handlers")
+				}
+			}
+			// leaves time for extra calls of the asynchronous handlers
+			time.Sleep(10 * time.Millisecond)
+			if calls.Load() != 1 || clusterCalls.Load() != 1 {
+				t.Errorf("expected a single call of each handler, got %d and %d", calls.Load(), clusterCalls.Load())
+			}
+			if got := clusterEvent.Load(); got != versions[50].Address {
+				t.Errorf("expected the first event of cluster-2, got %s", got)
+			}
+			ctl.storeLock.RLock()
+			defer ctl.storeLock.RUnlock()
+			if len(ctl.serviceHandlers) != 0 {
+				t.Errorf("expected the handlers to be removed, got %d", len(ctl.serviceHandlers))
+			}
+		})
+	}
+}
+
+func TestAppendHandlersChecked(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	if _, err := ctl.AppendServiceHandlerChecked(func(*model.Service, model.Event) {}); err != nil {
+		t.Errorf("expected no error before running, got %v", err)
+	}
+	ctl.running.Store(true)
+
+	var services, workloads int
+	if _, err := ctl.AppendServiceHandlerChecked(func(*model.Service, model.Event) { services++ }); !errors.Is(err, ErrNoRegistries) {
+		t.Errorf("expected ErrNoRegistries, got %v", err)
+	}
+	if _, err := ctl.AppendWorkloadHandlerChecked(func(*model.WorkloadInstance, model.Event) { workloads++ }); !errors.Is(err, ErrNoRegistries) {
+		t.Errorf("expected ErrNoRegistries, got %v", err)
+	}
+
+	// the handlers are still attached to the registries added later
+	r := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl.AddRegistry(r)
+	fakeControllerOf(r).fireService(svc, model.EventAdd)
+	fakeControllerOf(r).fireWorkload(makeWorkload("vm", "default", "10.0.0.1"), model.EventAdd)
+	if services != 1 || workloads != 1 {
+		t.Errorf("expected the handlers to be called once, got %d and %d", services, workloads)
+	}
+
+	if _, err := ctl.AppendServiceHandlerForClusterChecked("cluster-1", func(*model.Service, model.Event) {}); err != nil {
+		t.Errorf("expected no error for a known cluster, got %v", err)
+	}
+	if _, err := ctl.AppendServiceHandlerForClusterChecked("cluster-2", func(*model.Service, model.Event) {}); !errors.Is(err, ErrUnknownCluster) {
+		t.Errorf("expected ErrUnknownCluster, got %v", err)
+	}
+}
+
+// deleteHandler is a ServiceEventHandler only called for the deletions.
+type deleteHandler struct {
+	deleted []host.Name
+}
+
+func (h *deleteHandler) Handle(svc *model.Service, _ model.Event) {
+	h.deleted = append(h.deleted, svc.ClusterLocal.Hostname)
+}
+
+func (h *deleteHandler) Name() string {
+	return "deletions"
+}
+
+func (h *deleteHandler) Filters() []model.Event {
+	return []model.Event{model.EventDelete}
+}
+
+func TestRegisterServiceHandler(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	r := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl.AddRegistry(r)
+
+	deletions := &deleteHandler{}
+	ctl.RegisterServiceHandler(deletions)
+	var events []model.Event
+	plain := ctl.RegisterServiceHandler(ServiceHandlerFunc(func(_ *model.Service, event model.Event) {
+		events = append(events, event)
+	}))
+	ctl.RegisterServiceHandler(NamedServiceHandler("push", func(*model.Service, model.Event) {}))
+
+	fakeControllerOf(r).fireService(svc, model.EventAdd)
+	fakeControllerOf(r).fireService(svc, model.EventDelete)
+	if diff := cmp.Diff(deletions.deleted, []host.Name{svc.ClusterLocal.Hostname}); diff != "" {
+		t.Errorf("unexpected deletions: %v", diff)
+	}
+	if diff := cmp.Diff(events, []model.Event{model.EventAdd, model.EventDelete}); diff != "" {
+		t.Errorf("unexpected events of the function: %v", diff)
+	}
+
+	var got []HandlerInfo
+	for _, info := range ctl.Handlers() {
+		if !strings.Contains(info.Site, "handlers_test.go") {
+			t.Errorf("expected the handler %s to be added by the test, got %s", info.Name, info.Site)
+		}
+		info.Site = ""
+		got = append(got, info)
+	}
+	want := []HandlerInfo{
+		{ID: plain - 1, Kind: "service", Name: "deletions", Events: []string{"delete"}},
+		{ID: plain, Kind: "service", Name: fmt.Sprintf("service-%d", plain)},
+		{ID: plain + 1, Kind: "service", Name: "push"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected handlers: %v", diff)
+	}
+}
+
+func TestAppendServiceHandlerWithPriority(t *testing.T) {
+	ctl := NewController(Options{})
+	var registries []*fakeController
+	for i := 0; i < 4; i++ {
+		clusterID := cluster.ID(fmt.Sprintf("cluster-%d", i))
+		r := newMemoryRegistry(provider.Kubernetes, clusterID, mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, clusterID))
+		ctl.AddRegistry(r)
+		registries = append(registries, fakeControllerOf(r))
+	}
+
+	var mu sync.Mutex
+	calls := map[string][]string{}
+	handler := func(name string) func(*model.Service, model.Event) {
+		return func(svc *model.Service, _ model.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[svc.Address] = append(calls[svc.Address], name)
+		}
+	}
+	ctl.AppendServiceHandlerWithPriority(10, handler("push-1"))
+	ctl.AppendServiceHandler(handler("default-1"))
+	ctl.AppendServiceHandlerWithPriority(-5, handler("invalidate"))
+	ctl.AppendServiceHandler(handler("default-2"))
+	ctl.AppendServiceHandlerWithPriority(10, handler("push-2"))
+	want := []string{"invalidate", "default-1", "default-2", "push-1", "push-2"}
+
+	// the registries report events of their own hostnames concurrently
+	var wg sync.WaitGroup
+	for i, r := range registries {
+		i, r := i, r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				hostname := host.Name(fmt.Sprintf("svc-%d.default.svc.cluster.local", j%5))
+				r.fireService(mock.MakeService(hostname, fmt.Sprintf("10.%d.0.%d", i, j), []string{}, "cluster-1"), model.EventUpdate)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(calls) != 200 {
+		t.Fatalf("expected 200 events, got %d", len(calls))
+	}
+	for addr, got := range calls {
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Fatalf("unexpected order of the handlers for the event %s: %v", addr, diff)
+		}
+	}
+}
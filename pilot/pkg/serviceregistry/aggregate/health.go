@@ -0,0 +1,244 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/pkg/log"
+)
+
+// RegistryHealth reports a registry found to be unhealthy by the aggregate.
+type RegistryHealth struct {
+	Cluster  cluster.ID  `json:"cluster"`
+	Provider provider.ID `json:"provider"`
+	// Reason describes why the registry is unhealthy.
+	Reason string `json:"reason"`
+	// Since is when the registry was first found unhealthy.
+	Since time.Time `json:"since"`
+	// Stack is the stack of the panic of the Run of a dead registry.
+	Stack string `json:"stack,omitempty"`
+}
+
+type unhealthyRegistry struct {
+	reason string
+	since  time.Time
+	// hungCalls counts the calls that timed out and have not returned yet.
+	hungCalls int
+}
+
+// deadRegistry is a registry whose Run panicked or failed.
+type deadRegistry struct {
+	reason string
+	stack  string
+	since  time.Time
+}
+
+// registryHealth tracks the registries with calls that did not return in time.
+type registryHealth struct {
+	mu        sync.Mutex
+	unhealthy map[registryKey]*unhealthyRegistry
+	dead      map[registryKey]*deadRegistry
+	// rejoined counts the registries healthy again, which the sync excluded until then.
+	rejoined uint64
+	// lastErrors keeps the reason a registry was last found unhealthy, once healthy again.
+	lastErrors map[registryKey]string
+	now        func() time.Time
+}
+
+func newRegistryHealth() *registryHealth {
+	return &registryHealth{
+		unhealthy:  map[registryKey]*unhealthyRegistry{},
+		dead:       map[registryKey]*deadRegistry{},
+		lastErrors: map[registryKey]string{},
+		now:        time.Now,
+	}
+}
+
+// hung returns true if a call to the registry timed out and has not returned yet.
+func (h *registryHealth) hung(key registryKey) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u, f := h.unhealthy[key]
+	return f && u.hungCalls > 0
+}
+
+// timedOut records a call to the registry that did not return in time.
+func (h *registryHealth) timedOut(key registryKey, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u, f := h.unhealthy[key]
+	if !f {
+		u = &unhealthyRegistry{since: h.now()}
+		h.unhealthy[key] = u
+	}
+	u.hungCalls++
+	u.reason = reason
+	h.lastErrors[key] = reason
+}
+
+// died records the panic of the Run of the registry.
+func (h *registryHealth) died(key registryKey, reason, stack string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dead[key] = &deadRegistry{reason: reason, stack: stack, since: h.now()}
+	h.lastErrors[key] = reason
+}
+
+// revived records that the registry is run again, and returns true if it was dead.
+func (h *registryHealth) revived(key registryKey) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, f := h.dead[key]; f {
+		delete(h.dead, key)
+		h.rejoined++
+		return true
+	}
+	return false
+}
+
+// epoch changes when a registry becomes healthy again.
+func (h *registryHealth) epoch() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rejoined
+}
+
+// isDead returns true if the Run of the registry panicked or failed, and it was not run again.
+func (h *registryHealth) isDead(key registryKey) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, f := h.dead[key]
+	return f
+}
+
+// lastError returns the reason the registry was last found unhealthy, empty if never.
+func (h *registryHealth) lastError(key registryKey) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastErrors[key]
+}
+
+// returned records that a call to the registry that timed out has returned. The registry is healthy again
+// once every such call has returned.
+func (h *registryHealth) returned(key registryKey) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if u, f := h.unhealthy[key]; f {
+		u.hungCalls--
+		if u.hungCalls <= 0 {
+			delete(h.unhealthy, key)
+			h.rejoined++
+		}
+	}
+}
+
+// list returns the unhealthy registries, sorted by cluster and provider.
+func (h *registryHealth) list() []RegistryHealth {
+	h.mu.Lock()
+	out := make([]RegistryHealth, 0, len(h.unhealthy)+len(h.dead))
+	for key, u := range h.unhealthy {
+		if _, f := h.dead[key]; f {
+			continue
+		}
+		out = append(out, RegistryHealth{Cluster: key.cluster, Provider: key.provider, Reason: u.reason, Since: u.since})
+	}
+	for key, d := range h.dead {
+		out = append(out, RegistryHealth{Cluster: key.cluster, Provider: key.provider, Reason: d.reason, Since: d.since, Stack: d.stack})
+	}
+	h.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Cluster != out[j].Cluster {
+			return out[i].Cluster < out[j].Cluster
+		}
+		return out[i].Provider < out[j].Provider
+	})
+	return out
+}
+
+// deleteRegistry forgets the health of a deleted registry.
+func (h *registryHealth) deleteRegistry(key registryKey) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.unhealthy, key)
+	delete(h.dead, key)
+	delete(h.lastErrors, key)
+}
+
+// UnhealthyRegistries returns the registries with a call that did not return within
+// Options.RegistryTimeout and is still pending, and the dead registries, whose Run panicked or failed.
+func (c *Controller) UnhealthyRegistries() []RegistryHealth {
+	return c.health.list()
+}
+
+// callWithTimeout calls fn, a call to the registry r, and waits for it at most Options.RegistryTimeout.
+// It returns the result of fn, or false if fn did not complete in time. The registry is then reported unhealthy
+// until fn returns; meanwhile, further calls to it are skipped without calling fn, so that a hung registry holds
+// at most one goroutine per kind of call instead of one per caller. The result is passed back by fn rather than
+// captured by it, as fn may still run once the call timed out.
+func (c *Controller) callWithTimeout(r serviceregistry.Instance, call string, fn func() interface{}) (interface{}, bool) {
+	if c.registryTimeout <= 0 {
+		return fn(), true
+	}
+	key := registryKey{cluster: r.Cluster(), provider: r.Provider()}
+	if c.health.hung(key) {
+		return nil, false
+	}
+
+	var (
+		mu       sync.Mutex
+		finished bool
+		timedOut bool
+	)
+	done := make(chan interface{}, 1)
+	go func() {
+		result := fn()
+		mu.Lock()
+		finished = true
+		if timedOut {
+			c.health.returned(key)
+			c.gatewaySourcesChanged()
+			log.Infof("%s for registry %s/%s returned after timing out", call, key.provider, key.cluster)
+		}
+		mu.Unlock()
+		done <- result
+	}()
+
+	timer := time.NewTimer(c.registryTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result, true
+	case <-timer.C:
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if finished {
+		return <-done, true
+	}
+	timedOut = true
+	c.health.timedOut(key, fmt.Sprintf("%s did not return within %v", call, c.registryTimeout))
+	c.gatewaySourcesChanged()
+	if c.timeoutLogLimiter.Allow(string(key.provider) + "/" + string(key.cluster)) {
+		log.Warnf("%s for registry %s/%s did not return within %v, skipping it", call, key.provider, key.cluster, c.registryTimeout)
+	}
+	return nil, false
+}
@@ -0,0 +1,124 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// blockingRegistry blocks GetProxyServiceInstances until unblocked.
+type blockingRegistry struct {
+	serviceregistry.Simple
+	unblock chan struct{}
+	calls   *atomic.Int32
+}
+
+func (r blockingRegistry) GetProxyServiceInstances(node *model.Proxy) []*model.ServiceInstance {
+	r.calls.Inc()
+	<-r.unblock
+	return r.Simple.GetProxyServiceInstances(node)
+}
+
+func TestGetProxyServiceInstancesTimeout(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	blocking := blockingRegistry{
+		Simple:  newMemoryRegistry(provider.Kubernetes, "cluster-2", svc, makeInstance(svc, "1.1.1.1", 81, "", nil)),
+		unblock: make(chan struct{}),
+		calls:   atomic.NewInt32(0),
+	}
+	// with the cache enabled, to check that partial results are not cached
+	ctl := NewController(Options{RegistryTimeout: 50 * time.Millisecond, ProxyInstancesCacheSize: 10})
+	ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc, makeInstance(svc, "1.1.1.1", 80, "", nil)))
+	ctl.AddRegistry(blocking)
+	proxy := &model.Proxy{IPAddresses: []string{"1.1.1.1"}}
+
+	// the hung registry is skipped, and the other instances are returned
+	if got := ctl.GetProxyServiceInstances(proxy); len(got) != 1 || got[0].Endpoint.EndpointPort != 80 {
+		t.Fatalf("expected the instance of the responsive registry, got %v", got)
+	}
+	unhealthy := ctl.UnhealthyRegistries()
+	if len(unhealthy) != 1 || unhealthy[0].Cluster != "cluster-2" || unhealthy[0].Reason == "" {
+		t.Fatalf("expected the blocking registry to be reported unhealthy, got %v", unhealthy)
+	}
+
+	// while hung, the registry is not called again, so callers do not pile up
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if got := ctl.GetProxyServiceInstances(proxy); len(got) != 1 {
+			t.Fatalf("expected a single instance, got %v", got)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("lookups waited for the hung registry: %v", elapsed)
+	}
+	if calls := blocking.calls.Load(); calls != 1 {
+		t.Fatalf("expected the hung registry to be called once, got %d", calls)
+	}
+
+	// once the call returns, the registry is healthy and searched again
+	close(blocking.unblock)
+	retry.UntilSuccessOrFail(t, func() error {
+		if unhealthy := ctl.UnhealthyRegistries(); len(unhealthy) != 0 {
+			return fmt.Errorf("registry still unhealthy: %v", unhealthy)
+		}
+		return nil
+	}, retry.Timeout(time.Second))
+	if got := ctl.GetProxyServiceInstances(proxy); len(got) != 2 {
+		t.Fatalf("expected the instances of both registries, got %v", got)
+	}
+}
+
+// slowRegistry answers GetProxyServiceInstances after a delay.
+type slowRegistry struct {
+	serviceregistry.Simple
+	delay time.Duration
+}
+
+func (r slowRegistry) GetProxyServiceInstances(node *model.Proxy) []*model.ServiceInstance {
+	time.Sleep(r.delay)
+	return r.Simple.GetProxyServiceInstances(node)
+}
+
+func TestGetProxyServiceInstancesReturnedAfterTimeout(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	slow := slowRegistry{
+		Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc, makeInstance(svc, "1.1.1.1", 80, "", nil)),
+		delay:  100 * time.Millisecond,
+	}
+	ctl := NewController(Options{RegistryTimeout: 20 * time.Millisecond})
+	ctl.AddRegistry(slow)
+	proxy := &model.Proxy{IPAddresses: []string{"1.1.1.1"}}
+
+	// the call returning after the timeout does not change the result of the lookup, run with -race
+	if got := ctl.GetProxyServiceInstances(proxy); len(got) != 0 {
+		t.Fatalf("expected no instances from the timed out registry, got %v", got)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if unhealthy := ctl.UnhealthyRegistries(); len(unhealthy) != 0 {
+			return fmt.Errorf("registry still unhealthy: %v", unhealthy)
+		}
+		return nil
+	}, retry.Timeout(time.Second))
+}
@@ -0,0 +1,175 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sort"
+	"strings"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/spiffe"
+	"istio.io/pkg/log"
+)
+
+// ServiceIdentity is a service account returned by GetIstioServiceAccounts, parsed. The Kubernetes form
+// spiffe://<trust domain>/ns/<namespace>/sa/<service account> sets all the fields of the identity, the form of an
+// annotated account such as spiffe://<trust domain>/<account>@iam.gserviceaccount.com sets the trust domain and
+// the service account only. The fields of an account of another form are left empty.
+type ServiceIdentity struct {
+	spiffe.Identity
+	// Raw is the account as returned by GetIstioServiceAccounts.
+	Raw string
+}
+
+// parseServiceIdentity parses the service account.
+func parseServiceIdentity(raw string) ServiceIdentity {
+	if id, err := spiffe.ParseIdentity(raw); err == nil {
+		return ServiceIdentity{Identity: id, Raw: raw}
+	}
+	if !strings.HasPrefix(raw, spiffe.URIPrefix) {
+		return ServiceIdentity{Raw: raw}
+	}
+	split := strings.Split(raw[spiffe.URIPrefixLen:], "/")
+	if len(split) != 2 || split[0] == "" || split[1] == "" {
+		return ServiceIdentity{Raw: raw}
+	}
+	return ServiceIdentity{Identity: spiffe.Identity{TrustDomain: split[0], ServiceAccount: split[1]}, Raw: raw}
+}
+
+// canonicalServiceAccount returns the account in the form the aggregate deduplicates, so that registries formatting
+// an identity differently still report the same account: with the spiffe:// prefix, added if missing and lowercased
+// if not, and with the trust domain lowercased. It returns false for an account of neither form accepted by
+// parseServiceIdentity, which is kept as is.
+func canonicalServiceAccount(raw string) (string, bool) {
+	var rest string
+	if len(raw) >= spiffe.URIPrefixLen && strings.EqualFold(raw[:spiffe.URIPrefixLen], spiffe.URIPrefix) {
+		rest = raw[spiffe.URIPrefixLen:]
+	} else {
+		rest = raw
+	}
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 {
+		return raw, false
+	}
+	canonical := spiffe.URIPrefix + strings.ToLower(rest[:i]) + rest[i:]
+	if parseServiceIdentity(canonical).TrustDomain == "" {
+		return raw, false
+	}
+	return canonical, true
+}
+
+// canonicalServiceAccounts returns the accounts reported by the registry r in canonical form, see
+// canonicalServiceAccount. The accounts, which may be owned by the registry, are not modified.
+func canonicalServiceAccounts(r registryKey, accounts []string) []string {
+	out, copied := accounts, false
+	for i, sa := range accounts {
+		canonical, ok := canonicalServiceAccount(sa)
+		if !ok {
+			log.Debugf("service account %q of registry %s/%s is not a SPIFFE identity, not normalized", sa, r.provider, r.cluster)
+			continue
+		}
+		if canonical == sa {
+			continue
+		}
+		if !copied {
+			out, copied = append([]string(nil), accounts...), true
+		}
+		out[i] = canonical
+	}
+	return out
+}
+
+// GetIstioServiceIdentities is like GetIstioServiceAccounts, but returns the accounts parsed, including those
+// expanded with the trust domain aliases, in the same order.
+func (c *Controller) GetIstioServiceIdentities(svc *model.Service, ports []int) []ServiceIdentity {
+	accounts := c.GetIstioServiceAccounts(svc, ports)
+	out := make([]ServiceIdentity, 0, len(accounts))
+	for _, sa := range accounts {
+		out = append(out, parseServiceIdentity(sa))
+	}
+	return out
+}
+
+// ServiceAccountInfo is a service account returned by GetIstioServiceAccounts, with where it comes from.
+type ServiceAccountInfo struct {
+	Account string `json:"account"`
+	// Clusters are the clusters of the registries the account was found in, or expanded for, sorted.
+	Clusters []cluster.ID `json:"clusters"`
+	// Expanded is set if the account was only produced by the expansion with the trust domain aliases, of the
+	// accounts ExpandedFrom.
+	Expanded     bool     `json:"expanded,omitempty"`
+	ExpandedFrom []string `json:"expandedFrom,omitempty"`
+}
+
+// accountProvenance collects the provenance of a service account.
+type accountProvenance struct {
+	clusters map[cluster.ID]struct{}
+	reported bool
+	from     map[string]struct{}
+}
+
+// GetIstioServiceAccountsDetailed returns the accounts of GetIstioServiceAccounts with the clusters that contributed
+// each of them, and for those only produced by the expansion with the trust domain aliases, the accounts they were
+// expanded from. It is meant for debugging: it is not cached, nor bounded by Options.MaxExpandedServiceAccounts.
+func (c *Controller) GetIstioServiceAccountsDetailed(svc *model.Service, ports []int) []ServiceAccountInfo {
+	registries := c.GetRegistries()
+	aliases, _ := c.trustDomainAliases(registries)
+	results, _ := c.registryServiceAccounts(svc, ports, registries, aliases)
+
+	accounts := map[string]*accountProvenance{}
+	provenance := func(sa string, clusterID cluster.ID) *accountProvenance {
+		p, f := accounts[sa]
+		if !f {
+			p = &accountProvenance{clusters: map[cluster.ID]struct{}{}, from: map[string]struct{}{}}
+			accounts[sa] = p
+		}
+		p.clusters[clusterID] = struct{}{}
+		return p
+	}
+	for _, res := range results {
+		for _, sa := range res.reported {
+			provenance(sa, res.cluster).reported = true
+			if len(res.aliases) == 0 {
+				continue
+			}
+			id, err := spiffe.ParseIdentity(sa)
+			if err != nil {
+				continue
+			}
+			for _, td := range res.aliases {
+				id.TrustDomain = td
+				if expanded := id.String(); expanded != sa {
+					provenance(expanded, res.cluster).from[sa] = struct{}{}
+				}
+			}
+		}
+	}
+
+	out := make([]ServiceAccountInfo, 0, len(accounts))
+	for sa, p := range accounts {
+		info := ServiceAccountInfo{Account: sa, Clusters: make([]cluster.ID, 0, len(p.clusters)), Expanded: !p.reported}
+		for clusterID := range p.clusters {
+			info.Clusters = append(info.Clusters, clusterID)
+		}
+		sort.Slice(info.Clusters, func(i, j int) bool { return info.Clusters[i] < info.Clusters[j] })
+		if info.Expanded {
+			info.ExpandedFrom = sortedAccounts(p.from)
+		}
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Account < out[j].Account })
+	return out
+}
@@ -0,0 +1,155 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/spiffe"
+)
+
+func TestGetIstioServiceIdentities(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	r := newAccountsRegistry("cluster-1", svc,
+		"spiffe://cluster.local/ns/default/sa/hello",
+		"spiffe://cluster.local/hello@iam.gserviceaccount.com",
+		"not-spiffe")
+	holder := &mockMeshConfigHolder{trustDomainAliases: []string{"cluster.local", "example.com"}}
+	ctl := NewController(Options{MeshHolder: holder})
+	ctl.AddRegistry(r)
+
+	want := []ServiceIdentity{
+		{Raw: "not-spiffe"},
+		{
+			Identity: spiffe.Identity{TrustDomain: "cluster.local", ServiceAccount: "hello@iam.gserviceaccount.com"},
+			Raw:      "spiffe://cluster.local/hello@iam.gserviceaccount.com",
+		},
+		{
+			Identity: spiffe.Identity{TrustDomain: "cluster.local", Namespace: "default", ServiceAccount: "hello"},
+			Raw:      "spiffe://cluster.local/ns/default/sa/hello",
+		},
+		// the expansion with the aliases gives more identities
+		{
+			Identity: spiffe.Identity{TrustDomain: "example.com", Namespace: "default", ServiceAccount: "hello"},
+			Raw:      "spiffe://example.com/ns/default/sa/hello",
+		},
+	}
+	if got := ctl.GetIstioServiceIdentities(svc, []int{80}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the identities %+v, got %+v", want, got)
+	}
+	// the accounts are the raw identities
+	accounts := ctl.GetIstioServiceAccounts(svc, []int{80})
+	for i, id := range want {
+		if accounts[i] != id.Raw {
+			t.Fatalf("expected the account %s, got %s", id.Raw, accounts[i])
+		}
+	}
+}
+
+func TestCanonicalServiceAccount(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want string
+		ok   bool
+	}{
+		{"spiffe://cluster.local/ns/default/sa/hello", "spiffe://cluster.local/ns/default/sa/hello", true},
+		{"cluster.local/ns/default/sa/hello", "spiffe://cluster.local/ns/default/sa/hello", true},
+		{"SPIFFE://Cluster.Local/ns/default/sa/hello", "spiffe://cluster.local/ns/default/sa/hello", true},
+		{"spiffe://Cluster.Local/hello@iam.gserviceaccount.com", "spiffe://cluster.local/hello@iam.gserviceaccount.com", true},
+		// only the trust domain is case insensitive
+		{"spiffe://cluster.local/ns/Default/sa/Hello", "spiffe://cluster.local/ns/Default/sa/Hello", true},
+		{"not-spiffe", "not-spiffe", false},
+		{"Not/A/SPIFFE/identity", "Not/A/SPIFFE/identity", false},
+		{"spiffe:///ns/default/sa/hello", "spiffe:///ns/default/sa/hello", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.raw, func(t *testing.T) {
+			got, ok := canonicalServiceAccount(tc.raw)
+			if got != tc.want || ok != tc.ok {
+				t.Fatalf("expected %s %v, got %s %v", tc.want, tc.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestGetIstioServiceAccountsNormalized(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	first := newAccountsRegistry("cluster-1", svc, "SPIFFE://Cluster.Local/ns/default/sa/hello", "Not/A/SPIFFE/identity")
+	second := newAccountsRegistry("cluster-2", svc,
+		"cluster.local/ns/default/sa/hello",
+		"spiffe://CLUSTER.local/hello@iam.gserviceaccount.com",
+		"spiffe://cluster.local/hello@iam.gserviceaccount.com",
+		"Not/A/SPIFFE/identity")
+	ctl := NewController(Options{})
+	ctl.AddRegistry(first)
+	ctl.AddRegistry(second)
+
+	want := []string{
+		"Not/A/SPIFFE/identity",
+		"spiffe://cluster.local/hello@iam.gserviceaccount.com",
+		"spiffe://cluster.local/ns/default/sa/hello",
+	}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts %v, got %v", want, got)
+	}
+	if got := ctl.GetIstioServiceAccountsRaw(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the raw accounts %v, got %v", want, got)
+	}
+}
+
+func TestGetIstioServiceAccountsDetailed(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "east")
+	shared := "spiffe://cluster.local/ns/default/sa/shared"
+	holder := &federationHolder{clusterAliases: map[cluster.ID][]string{"west": {"cluster.local", "west.example.com"}}}
+	ctl := NewController(Options{MeshHolder: holder})
+	ctl.AddRegistry(newAccountsRegistry("east", svc, shared, "spiffe://cluster.local/ns/default/sa/east"))
+	ctl.AddRegistry(newAccountsRegistry("west", svc, shared, "spiffe://west.example.com/ns/default/sa/west"))
+
+	want := []ServiceAccountInfo{
+		{Account: "spiffe://cluster.local/ns/default/sa/east", Clusters: []cluster.ID{"east"}},
+		{Account: shared, Clusters: []cluster.ID{"east", "west"}},
+		// expanded from an account of another trust domain
+		{
+			Account:      "spiffe://cluster.local/ns/default/sa/west",
+			Clusters:     []cluster.ID{"west"},
+			Expanded:     true,
+			ExpandedFrom: []string{"spiffe://west.example.com/ns/default/sa/west"},
+		},
+		{
+			Account:      "spiffe://west.example.com/ns/default/sa/shared",
+			Clusters:     []cluster.ID{"west"},
+			Expanded:     true,
+			ExpandedFrom: []string{shared},
+		},
+		{Account: "spiffe://west.example.com/ns/default/sa/west", Clusters: []cluster.ID{"west"}},
+	}
+	got := ctl.GetIstioServiceAccountsDetailed(svc, nil)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts %+v, got %+v", want, got)
+	}
+	// the detailed accounts are those of GetIstioServiceAccounts
+	accounts := ctl.GetIstioServiceAccounts(svc, nil)
+	if len(accounts) != len(got) {
+		t.Fatalf("expected the accounts %v, got %+v", accounts, got)
+	}
+	for i, info := range got {
+		if accounts[i] != info.Account {
+			t.Fatalf("expected the account %s, got %s", accounts[i], info.Account)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+// invalidationTokens guards the caches of the controller against storing stale values: a value computed
+// concurrently with an invalidation of one of its keys is not stored. The tokens are ordered, an invalidation
+// records the next token for its keys, and a value computed from a token is valid if none of its keys was
+// invalidated after it. The caches embed it under their own mutex.
+type invalidationTokens struct {
+	last uint64
+	// floor is the last token of an invalidation of every key. The invalidations before it are forgotten.
+	floor uint64
+	keys  map[interface{}]uint64
+	// limit bounds the number of keys remembered; past it, they are forgotten and the floor raised. The zero
+	// value remembers none, any invalidation is one of every key.
+	limit int
+}
+
+func newInvalidationTokens(limit int) invalidationTokens {
+	return invalidationTokens{limit: limit}
+}
+
+// token returns the token to compute a value from.
+func (it *invalidationTokens) token() uint64 {
+	return it.last
+}
+
+// invalidate records the invalidation of the keys.
+func (it *invalidationTokens) invalidate(keys ...interface{}) {
+	it.last++
+	added := 0
+	for _, key := range keys {
+		if _, f := it.keys[key]; !f {
+			added++
+		}
+	}
+	if len(it.keys)+added > it.limit {
+		it.floor = it.last
+		it.keys = nil
+		return
+	}
+	if it.keys == nil {
+		it.keys = map[interface{}]uint64{}
+	}
+	for _, key := range keys {
+		it.keys[key] = it.last
+	}
+}
+
+// invalidateAll records the invalidation of every key.
+func (it *invalidationTokens) invalidateAll() {
+	it.last++
+	it.floor = it.last
+	it.keys = nil
+}
+
+// valid returns true if none of the keys was invalidated since token was read.
+func (it *invalidationTokens) valid(token uint64, keys ...interface{}) bool {
+	if it.floor > token {
+		return false
+	}
+	for _, key := range keys {
+		if it.keys[key] > token {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"testing"
+)
+
+func TestInvalidationTokens(t *testing.T) {
+	it := newInvalidationTokens(2)
+	token := it.token()
+	it.invalidate("a")
+	if it.valid(token, "a") {
+		t.Fatal("expected a value of an invalidated key not to be valid")
+	}
+	if !it.valid(token, "b") || !it.valid(token) {
+		t.Fatal("expected the values of the other keys to be valid")
+	}
+	if !it.valid(it.token(), "a") {
+		t.Fatal("expected a value computed after the invalidation to be valid")
+	}
+
+	// the keys invalidated again are remembered once
+	it.invalidate("a")
+	if len(it.keys) != 1 {
+		t.Fatalf("expected the key to be remembered once, got %d keys", len(it.keys))
+	}
+
+	// the keys past the limit are forgotten, invalidating every key
+	it.invalidate("b")
+	token = it.token()
+	it.invalidate("c")
+	if it.valid(token, "d") {
+		t.Fatal("expected the values to be invalid once the invalidations are forgotten")
+	}
+	if len(it.keys) > 2 {
+		t.Fatalf("expected at most 2 keys to be remembered, got %d", len(it.keys))
+	}
+
+	token = it.token()
+	it.invalidateAll()
+	if it.valid(token) {
+		t.Fatal("expected the values to be invalid after the invalidation of every key")
+	}
+
+	var zero invalidationTokens
+	token = zero.token()
+	zero.invalidate("a")
+	if zero.valid(token, "b") {
+		t.Fatal("expected the zero value to invalidate every key")
+	}
+}
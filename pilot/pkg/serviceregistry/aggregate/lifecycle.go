@@ -0,0 +1,129 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+// lifecycleEventBuffer is the number of events buffered for the consumer of LifecycleEvents.
+const lifecycleEventBuffer = 64
+
+// LifecycleEventKind is the kind of transition reported by a LifecycleEvent.
+type LifecycleEventKind int
+
+const (
+	// LifecycleControllerStarted is the start of Run.
+	LifecycleControllerStarted LifecycleEventKind = iota
+	// LifecycleRegistryAdded is the addition of a registry.
+	LifecycleRegistryAdded
+	// LifecycleRegistrySynced is the first sync of a registry.
+	LifecycleRegistrySynced
+	// LifecycleAllSynced is the sync of all the registries, reported again once a registry added later syncs.
+	LifecycleAllSynced
+	// LifecycleRegistryRemoved is the deletion of a registry.
+	LifecycleRegistryRemoved
+	// LifecycleControllerStopped is the end of Run, once the registries it started have returned.
+	LifecycleControllerStopped
+)
+
+func (k LifecycleEventKind) String() string {
+	switch k {
+	case LifecycleControllerStarted:
+		return "ControllerStarted"
+	case LifecycleRegistryAdded:
+		return "RegistryAdded"
+	case LifecycleRegistrySynced:
+		return "RegistrySynced"
+	case LifecycleAllSynced:
+		return "AllSynced"
+	case LifecycleRegistryRemoved:
+		return "RegistryRemoved"
+	case LifecycleControllerStopped:
+		return "ControllerStopped"
+	}
+	return "Unknown"
+}
+
+// terminal tells whether the event ends a run of the aggregate, and is never dropped.
+func (k LifecycleEventKind) terminal() bool {
+	return k == LifecycleControllerStopped
+}
+
+// LifecycleEvent is a transition of the aggregate or of one of its registries, see Controller.LifecycleEvents.
+type LifecycleEvent struct {
+	Kind LifecycleEventKind
+	// Cluster and Provider identify the registry, unset for the events of the aggregate.
+	Cluster  cluster.ID
+	Provider provider.ID
+}
+
+// lifecycleStream buffers the lifecycle events, once LifecycleEvents has been called.
+type lifecycleStream struct {
+	mu     sync.Mutex
+	events chan LifecycleEvent
+}
+
+func (s *lifecycleStream) channel() <-chan LifecycleEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.events == nil {
+		s.events = make(chan LifecycleEvent, lifecycleEventBuffer)
+	}
+	return s.events
+}
+
+// push buffers the event if there is a consumer. When the buffer is full the event is dropped, unless it is
+// terminal, in which case the oldest events are dropped to make room for it.
+func (s *lifecycleStream) push(e LifecycleEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.events == nil {
+		return
+	}
+	for {
+		select {
+		case s.events <- e:
+			return
+		default:
+		}
+		if !e.Kind.terminal() {
+			handlerEventsDropped.With(eventTag.Value("lifecycle")).Increment()
+			return
+		}
+		select {
+		case <-s.events:
+			handlerEventsDropped.With(eventTag.Value("lifecycle")).Increment()
+		default:
+		}
+	}
+}
+
+// LifecycleEvents returns the channel of the lifecycle events of the aggregate: the start and stop of Run, the
+// addition, first sync and deletion of the registries, and the sync of all of them. The events are recorded
+// from the first call on; every call returns the same channel, which is never closed. The transitions are not
+// blocked by a slow consumer: the events that do not fit the buffer are dropped, except ControllerStopped which
+// replaces the oldest events instead.
+func (c *Controller) LifecycleEvents() <-chan LifecycleEvent {
+	return c.lifecycleEvents.channel()
+}
+
+// notifyLifecycle reports the transition to the consumer of LifecycleEvents.
+func (c *Controller) notifyLifecycle(kind LifecycleEventKind, clusterID cluster.ID, providerID provider.ID) {
+	c.lifecycleEvents.push(LifecycleEvent{Kind: kind, Cluster: clusterID, Provider: providerID})
+}
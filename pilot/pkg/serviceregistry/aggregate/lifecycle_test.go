@@ -0,0 +1,94 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+func expectLifecycleEvent(t *testing.T, events <-chan LifecycleEvent, want LifecycleEvent) {
+	t.Helper()
+	select {
+	case got := <-events:
+		if got != want {
+			t.Fatalf("expected the event %v %s, got %v %s", want.Kind, want.Cluster, got.Kind, got.Cluster)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the event %v %s", want.Kind, want.Cluster)
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	ctl := NewController(Options{})
+	events := ctl.LifecycleEvents()
+	if ctl.LifecycleEvents() != events {
+		t.Fatal("expected every call to return the same channel")
+	}
+	var registries []*notifyingRegistry
+	for _, id := range []cluster.ID{"cluster-1", "cluster-2"} {
+		svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, id)
+		r := &notifyingRegistry{Simple: newMemoryRegistry(provider.Kubernetes, id, svc), synced: make(chan struct{})}
+		registries = append(registries, r)
+		ctl.AddRegistry(r)
+		expectLifecycleEvent(t, events, LifecycleEvent{Kind: LifecycleRegistryAdded, Cluster: id, Provider: provider.Kubernetes})
+	}
+
+	stop := make(chan struct{})
+	go ctl.Run(stop)
+	expectLifecycleEvent(t, events, LifecycleEvent{Kind: LifecycleControllerStarted})
+
+	close(registries[0].synced)
+	expectLifecycleEvent(t, events, LifecycleEvent{Kind: LifecycleRegistrySynced, Cluster: "cluster-1", Provider: provider.Kubernetes})
+	close(registries[1].synced)
+	expectLifecycleEvent(t, events, LifecycleEvent{Kind: LifecycleRegistrySynced, Cluster: "cluster-2", Provider: provider.Kubernetes})
+	expectLifecycleEvent(t, events, LifecycleEvent{Kind: LifecycleAllSynced})
+	// the sync is reported once
+	if !ctl.HasSynced() {
+		t.Fatal("expected the aggregate to be synced")
+	}
+
+	ctl.DeleteRegistry("cluster-1", provider.Kubernetes)
+	expectLifecycleEvent(t, events, LifecycleEvent{Kind: LifecycleRegistryRemoved, Cluster: "cluster-1", Provider: provider.Kubernetes})
+	close(stop)
+	expectLifecycleEvent(t, events, LifecycleEvent{Kind: LifecycleControllerStopped})
+
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %v %s", e.Kind, e.Cluster)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLifecycleEventsKeepTerminal(t *testing.T) {
+	ctl := NewController(Options{})
+	events := ctl.LifecycleEvents()
+	for i := 0; i < 2*lifecycleEventBuffer; i++ {
+		ctl.notifyLifecycle(LifecycleRegistryAdded, "cluster-1", provider.Kubernetes)
+	}
+	ctl.notifyLifecycle(LifecycleControllerStopped, "", "")
+	// the events beyond the buffer are dropped, and the oldest one makes room for the terminal event
+	for i := 0; i < lifecycleEventBuffer-1; i++ {
+		expectLifecycleEvent(t, events, LifecycleEvent{Kind: LifecycleRegistryAdded, Cluster: "cluster-1", Provider: provider.Kubernetes})
+	}
+	expectLifecycleEvent(t, events, LifecycleEvent{Kind: LifecycleControllerStopped})
+	if len(events) != 0 {
+		t.Fatalf("expected no more events, got %d", len(events))
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const (
+	// defaultLogInterval is the minimum time between two rate limited log lines for the same key.
+	defaultLogInterval = time.Minute
+	// maxLimiterKeys bounds the number of keys tracked by a keyedLimiter, since keys such as proxy IDs churn.
+	maxLimiterKeys = 1000
+)
+
+// keyedLimiter allows an action at most once per interval for each key. It is used to rate limit
+// log lines that may otherwise be emitted on every push for the same proxy or registry.
+type keyedLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     *simplelru.LRU
+	now      func() time.Time
+}
+
+func newKeyedLimiter(interval time.Duration) *keyedLimiter {
+	last, err := simplelru.NewLRU(maxLimiterKeys, nil)
+	if err != nil {
+		panic(err)
+	}
+	return &keyedLimiter{
+		interval: interval,
+		last:     last,
+		now:      time.Now,
+	}
+}
+
+// Allow returns true if the action for key has not been allowed within the last interval.
+func (l *keyedLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if last, ok := l.last.Get(key); ok && now.Sub(last.(time.Time)) < l.interval {
+		return false
+	}
+	l.last.Add(key, now)
+	return true
+}
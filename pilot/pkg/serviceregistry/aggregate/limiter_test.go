@@ -0,0 +1,36 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newKeyedLimiter(time.Minute)
+	l.now = func() time.Time { return now }
+	if !l.Allow("a") || l.Allow("a") {
+		t.Fatal("expected only the first call for a key to be allowed")
+	}
+	if !l.Allow("b") {
+		t.Fatal("expected keys to be limited independently")
+	}
+	now = now.Add(time.Minute)
+	if !l.Allow("a") {
+		t.Fatal("expected key to be allowed again after the interval")
+	}
+}
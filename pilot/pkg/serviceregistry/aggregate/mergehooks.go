@@ -0,0 +1,98 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sort"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/cluster"
+)
+
+// InstanceMergeHook merges the instances reported by the registries, keyed by the cluster of the registry.
+// The instances of registries sharing a cluster are concatenated in registry order. The hook must not
+// modify the instances, which are owned by the registries.
+type InstanceMergeHook func(byRegistry map[cluster.ID][]*model.ServiceInstance) []*model.ServiceInstance
+
+// runMergeHook hands the registry results to the merge hook. The result is copied, since it is later
+// filtered and sorted in place and the hook may return a slice of a registry.
+func (c *Controller) runMergeHook(results []registryInstances) []*model.ServiceInstance {
+	byRegistry := make(map[cluster.ID][]*model.ServiceInstance, len(results))
+	for _, res := range results {
+		if len(res.instances) > 0 {
+			byRegistry[res.cluster] = append(byRegistry[res.cluster], res.instances...)
+		}
+	}
+	merged := c.mergeHook(byRegistry)
+	if len(merged) == 0 {
+		return nil
+	}
+	out := make([]*model.ServiceInstance, len(merged))
+	copy(out, merged)
+	return out
+}
+
+// sortedClusters returns the clusters of the map in order, so that hooks produce stable results.
+func sortedClusters(byRegistry map[cluster.ID][]*model.ServiceInstance) []cluster.ID {
+	clusters := make([]cluster.ID, 0, len(byRegistry))
+	for clusterID := range byRegistry {
+		clusters = append(clusters, clusterID)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i] < clusters[j] })
+	return clusters
+}
+
+// DedupInstancesByAddress is an InstanceMergeHook keeping a single instance for each endpoint address and
+// port, the one of the first cluster in order. Unlike the built-in deduplication it ignores the network
+// and the provider of the instances.
+func DedupInstancesByAddress(byRegistry map[cluster.ID][]*model.ServiceInstance) []*model.ServiceInstance {
+	type addressKey struct {
+		address string
+		port    uint32
+	}
+	var out []*model.ServiceInstance
+	seen := map[addressKey]struct{}{}
+	for _, clusterID := range sortedClusters(byRegistry) {
+		for _, inst := range byRegistry[clusterID] {
+			if inst == nil || inst.Endpoint == nil {
+				out = append(out, inst)
+				continue
+			}
+			key := addressKey{address: inst.Endpoint.Address, port: inst.Endpoint.EndpointPort}
+			if _, f := seen[key]; f {
+				continue
+			}
+			seen[key] = struct{}{}
+			out = append(out, inst)
+		}
+	}
+	return out
+}
+
+// CapInstancesPerCluster returns an InstanceMergeHook keeping at most limit instances of each cluster, so
+// that a cluster with many endpoints does not dominate the others.
+func CapInstancesPerCluster(limit int) InstanceMergeHook {
+	return func(byRegistry map[cluster.ID][]*model.ServiceInstance) []*model.ServiceInstance {
+		var out []*model.ServiceInstance
+		for _, clusterID := range sortedClusters(byRegistry) {
+			instances := byRegistry[clusterID]
+			if len(instances) > limit {
+				instances = instances[:limit]
+			}
+			out = append(out, instances...)
+		}
+		return out
+	}
+}
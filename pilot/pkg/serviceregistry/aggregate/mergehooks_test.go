@@ -0,0 +1,133 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func TestInstanceMergeHooks(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	build := func(hook InstanceMergeHook) *Controller {
+		ctl := NewController(Options{InstanceMergeHook: hook, SkipInstanceSort: true})
+		ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+			makeInstance(svc, "1.1.1.1", 80, "network-1", labels.Instance{"cluster": "1"}),
+			makeInstance(svc, "1.1.1.2", 80, "network-1", labels.Instance{"cluster": "1"}),
+			makeInstance(svc, "1.1.1.3", 80, "network-1", labels.Instance{"cluster": "1"})))
+		ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc,
+			makeInstance(svc, "1.1.1.1", 80, "network-2", labels.Instance{"cluster": "2"}),
+			makeInstance(svc, "2.2.2.1", 80, "network-2", labels.Instance{"cluster": "2"})))
+		return ctl
+	}
+	format := func(instances []*model.ServiceInstance) []string {
+		var out []string
+		for _, inst := range instances {
+			out = append(out, fmt.Sprintf("%s/%s", inst.Endpoint.Address, inst.Endpoint.Labels["cluster"]))
+		}
+		return out
+	}
+
+	cases := []struct {
+		name  string
+		hook  InstanceMergeHook
+		want  []string
+		proxy []string
+	}{
+		{
+			name:  "built-in",
+			want:  []string{"1.1.1.1/1", "1.1.1.2/1", "1.1.1.3/1", "1.1.1.1/2", "2.2.2.1/2"},
+			proxy: []string{"1.1.1.1/1", "1.1.1.1/2"},
+		},
+		{
+			name:  "dedup by address",
+			hook:  DedupInstancesByAddress,
+			want:  []string{"1.1.1.1/1", "1.1.1.2/1", "1.1.1.3/1", "2.2.2.1/2"},
+			proxy: []string{"1.1.1.1/1"},
+		},
+		{
+			name:  "cap per cluster",
+			hook:  CapInstancesPerCluster(1),
+			want:  []string{"1.1.1.1/1", "1.1.1.1/2"},
+			proxy: []string{"1.1.1.1/1", "1.1.1.1/2"},
+		},
+		{
+			name: "custom",
+			hook: func(byRegistry map[cluster.ID][]*model.ServiceInstance) []*model.ServiceInstance {
+				return byRegistry["cluster-2"]
+			},
+			want:  []string{"1.1.1.1/2", "2.2.2.1/2"},
+			proxy: []string{"1.1.1.1/2"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctl := build(tc.hook)
+			if diff := cmp.Diff(format(ctl.InstancesByPort(svc, port, nil)), tc.want); diff != "" {
+				t.Errorf("unexpected instances, diff %v", diff)
+			}
+			if diff := cmp.Diff(format(ctl.GetProxyServiceInstances(&model.Proxy{IPAddresses: []string{"1.1.1.1"}})), tc.proxy); diff != "" {
+				t.Errorf("unexpected proxy instances, diff %v", diff)
+			}
+		})
+	}
+}
+
+func TestInstanceMergeHookClusters(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	var got [][]cluster.ID
+	hook := func(byRegistry map[cluster.ID][]*model.ServiceInstance) []*model.ServiceInstance {
+		got = append(got, sortedClusters(byRegistry))
+		return CapInstancesPerCluster(1)(byRegistry)
+	}
+	ctl := NewController(Options{InstanceMergeHook: hook})
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+		makeInstance(svc, "1.1.1.1", 80, "", nil), makeInstance(svc, "1.1.1.2", 80, "", nil)))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc,
+		makeInstance(svc, "1.1.1.1", 80, "", nil), makeInstance(svc, "2.2.2.1", 80, "", nil)))
+	want := []cluster.ID{"cluster-1", "cluster-2"}
+
+	t.Run("InstancesByPorts", func(t *testing.T) {
+		got = nil
+		instances := ctl.InstancesByPorts(svc, []int{port}, nil)[port]
+		if diff := cmp.Diff(got, [][]cluster.ID{want}); diff != "" {
+			t.Errorf("unexpected clusters given to the hook, diff %v", diff)
+		}
+		// capped per cluster, rather than for the whole mesh
+		if len(instances) != 2 {
+			t.Errorf("expected an instance of each cluster, got %v", instances)
+		}
+	})
+	t.Run("GetInstancesByIP", func(t *testing.T) {
+		got = nil
+		instances := ctl.GetInstancesByIP("1.1.1.1")
+		if diff := cmp.Diff(got, [][]cluster.ID{want}); diff != "" {
+			t.Errorf("unexpected clusters given to the hook, diff %v", diff)
+		}
+		if len(instances) != 2 {
+			t.Errorf("expected an instance of each cluster, got %v", instances)
+		}
+	})
+}
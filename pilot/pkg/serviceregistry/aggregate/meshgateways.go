@@ -0,0 +1,132 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/network"
+)
+
+// meshNetworksNotifier is implemented by the mesh holders able to notify the changes of the mesh networks.
+type meshNetworksNotifier interface {
+	AddNetworksHandler(h func())
+}
+
+// meshNetworkGateways returns the gateways of the mesh networks configuration, with
+// Options.ResolveMeshNetworkGateways. The gateways given by address are returned as is, with no cluster. The
+// gateways given by registryServiceName are resolved against the registries of their network, as placed by
+// the mesh networks configuration: a gateway for every external address the service of a registry has in
+// its cluster, on the node port of the gateway port if the service is exposed by node ports. The services are
+// looked up in the registries rather than through GetService, which keeps the external addresses of the first
+// cluster only.
+func (c *Controller) meshNetworkGateways(registries []serviceregistry.Instance) []*model.NetworkGateway {
+	holder, ok := c.meshHolder.(mesh.NetworksHolder)
+	if !c.meshGateways || !ok {
+		return nil
+	}
+	meshNetworks := holder.Networks()
+	if meshNetworks == nil {
+		return nil
+	}
+	registryNetworks := c.registryNetworks()
+	var out []*model.NetworkGateway
+	for name, nw := range meshNetworks.Networks {
+		for _, gw := range nw.GetGateways() {
+			if addr := gw.GetAddress(); addr != "" {
+				out = append(out, &model.NetworkGateway{Network: network.ID(name), Addr: addr, Port: gw.GetPort()})
+				continue
+			}
+			hostname := host.Name(gw.GetRegistryServiceName())
+			if hostname == "" {
+				continue
+			}
+			for _, r := range registries {
+				if registryNetworks[r.Cluster()] != network.ID(name) {
+					continue
+				}
+				for _, resolved := range serviceGateways(r, hostname, network.ID(name), gw.GetPort()) {
+					if c.gatewayHasEndpoints(r, resolved) {
+						out = append(out, resolved)
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// serviceGateways returns the gateways of the network given by the external addresses of the service of the
+// registry in its cluster.
+func serviceGateways(r serviceregistry.Instance, hostname host.Name, nw network.ID, port uint32) []*model.NetworkGateway {
+	svc, err := r.GetService(hostname)
+	if err != nil || svc == nil {
+		return nil
+	}
+	if nodePorts, f := svc.Attributes.ClusterExternalPorts[r.Cluster()]; f {
+		if nodePort, f := nodePorts[port]; f {
+			port = nodePort
+		}
+	}
+	var out []*model.NetworkGateway
+	for _, addr := range svc.Attributes.ClusterExternalAddresses.GetAddressesFor(r.Cluster()) {
+		out = append(out, &model.NetworkGateway{Network: nw, Cluster: r.Cluster(), Addr: addr, Port: port, Service: hostname})
+	}
+	return out
+}
+
+// isMeshGatewayService returns true if the service is given by registryServiceName as a gateway of the mesh
+// networks configuration.
+func (c *Controller) isMeshGatewayService(hostname host.Name) bool {
+	holder, ok := c.meshHolder.(mesh.NetworksHolder)
+	if !ok {
+		return false
+	}
+	meshNetworks := holder.Networks()
+	if meshNetworks == nil {
+		return false
+	}
+	for _, nw := range meshNetworks.Networks {
+		for _, gw := range nw.GetGateways() {
+			if host.Name(gw.GetRegistryServiceName()) == hostname {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watchMeshGatewayServices notifies the gateway handlers of the events of the registry for the services of the
+// gateways of the mesh networks configuration, as their addresses are those of the gateways.
+func (c *Controller) watchMeshGatewayServices(registry serviceregistry.Instance) {
+	registry.AppendServiceHandler(func(svc *model.Service, _ model.Event) {
+		if c.isMeshGatewayService(svc.ClusterLocal.Hostname) {
+			c.gatewaySourcesChanged()
+		}
+	})
+}
+
+// watchMeshNetworks notifies the gateway handlers of the changes of the mesh networks, once. The storeLock
+// must be held.
+func (c *Controller) watchMeshNetworks() {
+	notifier, ok := c.meshHolder.(meshNetworksNotifier)
+	if !c.meshGateways || !ok || c.meshNetsWatched {
+		return
+	}
+	c.meshNetsWatched = true
+	notifier.AddNetworksHandler(c.gatewaySourcesChanged)
+}
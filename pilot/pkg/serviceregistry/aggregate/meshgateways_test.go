@@ -0,0 +1,200 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/atomic"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// notifyingNetworksHolder is a meshNetworksHolder notifying the changes of its mesh networks.
+type notifyingNetworksHolder struct {
+	meshNetworksHolder
+	mu       sync.Mutex
+	handlers []func()
+}
+
+func (h *notifyingNetworksHolder) AddNetworksHandler(handler func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlers = append(h.handlers, handler)
+}
+
+func (h *notifyingNetworksHolder) Networks() *meshconfig.MeshNetworks {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.networks
+}
+
+func (h *notifyingNetworksHolder) SetNetworks(networks *meshconfig.MeshNetworks) {
+	h.mu.Lock()
+	h.networks = networks
+	handlers := h.handlers
+	h.mu.Unlock()
+	for _, handler := range handlers {
+		handler()
+	}
+}
+
+func (h *notifyingNetworksHolder) watched() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.handlers) > 0
+}
+
+func TestMeshNetworkGateways(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	gwHostname := host.Name("eastwest.istio-system.svc.cluster.local")
+	// gwSvc returns the gateway service with the external address and node port it has in the cluster
+	gwSvc := func(clusterID cluster.ID, addr string, nodePort uint32) *model.Service {
+		s := mock.MakeService(gwHostname, "10.10.0.1", []string{}, clusterID)
+		if addr != "" {
+			s.Attributes.ClusterExternalAddresses.SetAddressesFor(clusterID, []string{addr})
+		}
+		if nodePort != 0 {
+			s.Attributes.ClusterExternalPorts = map[cluster.ID]map[uint32]uint32{clusterID: {15443: nodePort}}
+		}
+		return s
+	}
+	meshNetworks := func(gws ...*meshconfig.Network_IstioNetworkGateway) *meshconfig.MeshNetworks {
+		return &meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+			"network-1": {
+				Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+					Ne: &meshconfig.Network_NetworkEndpoints_FromRegistry{FromRegistry: "cluster-1"},
+				}},
+				Gateways: gws,
+			},
+			"network-2": {
+				Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+					Ne: &meshconfig.Network_NetworkEndpoints_FromRegistry{FromRegistry: "cluster-2"},
+				}},
+			},
+		}}
+	}
+	byName := &meshconfig.Network_IstioNetworkGateway{
+		Gw:   &meshconfig.Network_IstioNetworkGateway_RegistryServiceName{RegistryServiceName: string(gwHostname)},
+		Port: 15443,
+	}
+	byAddress := &meshconfig.Network_IstioNetworkGateway{
+		Gw:   &meshconfig.Network_IstioNetworkGateway_Address{Address: "3.3.3.3"},
+		Port: 15443,
+	}
+	holder := &notifyingNetworksHolder{meshNetworksHolder: meshNetworksHolder{networks: meshNetworks(byName)}}
+	local := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	// updateGateway replaces the gateway service of the local registry and fires its event
+	updateGateway := func(gw *model.Service) {
+		local.ServiceDiscovery.(*memory.ServiceDiscovery).AddService(gwHostname, gw)
+		fakeControllerOf(local).fireService(gw, model.EventUpdate)
+	}
+	local.ServiceDiscovery.(*memory.ServiceDiscovery).AddService(gwHostname, gwSvc("cluster-1", "", 0))
+	// the service of the other network is not a gateway of network-1
+	remote := newMemoryRegistry(provider.Kubernetes, "cluster-2", gwSvc("cluster-2", "2.2.2.2", 0))
+	ctl := NewController(Options{MeshHolder: holder, ResolveMeshNetworkGateways: true})
+	ctl.AddRegistry(local)
+	ctl.AddRegistry(remote)
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+	retry.UntilSuccessOrFail(t, func() error {
+		if !holder.watched() {
+			return fmt.Errorf("expected the mesh networks to be watched")
+		}
+		return nil
+	}, retry.Timeout(time.Second*5))
+
+	calls := atomic.NewInt32(0)
+	ctl.AppendNetworkGatewayHandler(func() {
+		calls.Inc()
+	})
+	expect := func(t *testing.T, called bool, want ...*model.NetworkGateway) {
+		t.Helper()
+		if diff := cmp.Diff(ctl.NetworkGateways(), want); diff != "" {
+			t.Fatalf("unexpected gateways, diff %v", diff)
+		}
+		if !called {
+			return
+		}
+		retry.UntilSuccessOrFail(t, func() error {
+			if calls.Load() == 0 {
+				return fmt.Errorf("expected the gateway handler to be called")
+			}
+			return nil
+		}, retry.Timeout(time.Second*5))
+		calls.Store(0)
+	}
+
+	t.Run("service without address", func(t *testing.T) {
+		expect(t, false)
+	})
+	lb := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443, Service: gwHostname}
+	t.Run("service gets a load balancer address", func(t *testing.T) {
+		updateGateway(gwSvc("cluster-1", "1.1.1.1", 0))
+		expect(t, true, lb)
+		if diff := cmp.Diff(ctl.NetworkGatewaysForCluster("cluster-1"), []*model.NetworkGateway{lb}); diff != "" {
+			t.Fatalf("unexpected gateways of the cluster, diff %v", diff)
+		}
+		if got := ctl.NetworkGatewaysForNetwork("network-2"); len(got) != 0 {
+			t.Fatalf("expected no gateways for the other network, got %v", got)
+		}
+	})
+	t.Run("service exposed by node port", func(t *testing.T) {
+		updateGateway(gwSvc("cluster-1", "1.1.1.1", 31443))
+		expect(t, true, &model.NetworkGateway{
+			Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 31443, Service: gwHostname,
+		})
+		updateGateway(gwSvc("cluster-1", "1.1.1.1", 0))
+		expect(t, true, lb)
+	})
+	t.Run("gateway by address added to the config", func(t *testing.T) {
+		holder.SetNetworks(meshNetworks(byName, byAddress))
+		expect(t, true, lb, &model.NetworkGateway{Network: "network-1", Addr: "3.3.3.3", Port: 15443})
+	})
+	t.Run("gateways removed from the config", func(t *testing.T) {
+		holder.SetNetworks(meshNetworks())
+		expect(t, true)
+		if got := ctl.NetworkGatewaysByCluster()["cluster-1"]; len(got) != 0 {
+			t.Fatalf("expected the configured gateways not to be listed by cluster, got %v", got)
+		}
+	})
+}
+
+func TestMeshNetworkGatewaysDisabled(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	holder := &meshNetworksHolder{networks: &meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+		"network-1": {Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+			Gw:   &meshconfig.Network_IstioNetworkGateway_Address{Address: "3.3.3.3"},
+			Port: 15443,
+		}}},
+	}}}
+	ctl := NewController(Options{MeshHolder: holder})
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc))
+	if got := ctl.NetworkGateways(); len(got) != 0 {
+		t.Fatalf("expected the configured gateways to be left to the callers, got %v", got)
+	}
+}
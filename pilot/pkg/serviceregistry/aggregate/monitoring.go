@@ -0,0 +1,184 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"istio.io/pkg/monitoring"
+)
+
+var (
+	clusterTag    = monitoring.MustCreateLabel("cluster")
+	providerTag   = monitoring.MustCreateLabel("provider")
+	searchTag     = monitoring.MustCreateLabel("search")
+	eventTag      = monitoring.MustCreateLabel("event")
+	handlerTag    = monitoring.MustCreateLabel("handler")
+	escalationTag = monitoring.MustCreateLabel("escalation")
+	stageTag      = monitoring.MustCreateLabel("stage")
+	resultTag     = monitoring.MustCreateLabel("result")
+
+	unhealthyInstancesFiltered = monitoring.NewSum(
+		"pilot_aggregate_unhealthy_instances_filtered",
+		"Number of unhealthy instances filtered out of the aggregated instances of a service.",
+	)
+
+	networkViewInstancesDropped = monitoring.NewSum(
+		"pilot_aggregate_network_view_instances_dropped",
+		"Number of instances left out of EndpointsForNetworkView for being on another network without gateway.",
+	)
+
+	unreachableInstancesFiltered = monitoring.NewSum(
+		"pilot_aggregate_unreachable_instances_filtered",
+		"Number of instances filtered out for being on a network without gateway, unreachable from the proxy.",
+	)
+
+	unsyncedRegistriesSkipped = monitoring.NewSum(
+		"pilot_aggregate_unsynced_registries_skipped",
+		"Number of lookups that skipped a registry that has not synced yet, serving partial data.",
+		monitoring.WithLabels(clusterTag, providerTag, searchTag),
+	)
+
+	handlerPanics = monitoring.NewSum(
+		"pilot_aggregate_handler_panics",
+		"Number of panics recovered from the handlers of the aggregate, by kind of event and handler.",
+		monitoring.WithLabels(eventTag, handlerTag),
+	)
+
+	handlerInvocations = monitoring.NewSum(
+		"pilot_aggregate_handler_invocations",
+		"Number of calls to the handlers of the aggregate, by kind of event and handler.",
+		monitoring.WithLabels(eventTag, handlerTag),
+	)
+
+	handlerLatency = monitoring.NewDistribution(
+		"pilot_aggregate_handler_latency_seconds",
+		"Duration of the calls to the handlers of the aggregate, by kind of event and handler.",
+		[]float64{.0001, .001, .01, .1, 1, 10},
+		monitoring.WithLabels(eventTag, handlerTag),
+	)
+
+	registeredHandlers = monitoring.NewGauge(
+		"pilot_aggregate_handlers",
+		"Number of handlers added to the aggregate, by kind of event.",
+		monitoring.WithLabels(eventTag),
+	)
+
+	handlerEventsDropped = monitoring.NewSum(
+		"pilot_aggregate_handler_events_dropped",
+		"Number of events dropped from the full queue of an asynchronous handler of the aggregate, by kind of event.",
+		monitoring.WithLabels(eventTag),
+	)
+
+	serviceEventsSuppressed = monitoring.NewSum(
+		"pilot_aggregate_service_events_suppressed",
+		"Number of service events not delivered as the merged service did not change, see SuppressUnchangedServiceEvents.",
+	)
+
+	registryRunPanics = monitoring.NewSum(
+		"pilot_aggregate_registry_run_panics",
+		"Number of panics recovered from the Run of a registry started by the aggregate.",
+		monitoring.WithLabels(clusterTag, providerTag),
+	)
+
+	registryRunFailures = monitoring.NewSum(
+		"pilot_aggregate_registry_run_failures",
+		"Number of errors returned by the Run of a registry started by the aggregate.",
+		monitoring.WithLabels(clusterTag, providerTag),
+	)
+
+	registrySyncTimeouts = monitoring.NewSum(
+		"pilot_aggregate_registry_sync_timeouts",
+		"Number of registries that have not synced within the RegistrySyncTimeout of the aggregate.",
+		monitoring.WithLabels(clusterTag, providerTag),
+	)
+
+	registryStuckSyncs = monitoring.NewSum(
+		"pilot_aggregate_registry_stuck_syncs",
+		"Number of warnings about a registry still syncing after 1, 5 and 10 times the StuckSyncThreshold of the aggregate.",
+		monitoring.WithLabels(clusterTag, providerTag, escalationTag),
+	)
+
+	expandedAccountsTruncated = monitoring.NewSum(
+		"pilot_aggregate_expanded_service_accounts_truncated",
+		"Number of service account lookups whose trust domain expansion was truncated to the MaxExpandedServiceAccounts of the aggregate.",
+	)
+
+	serviceAccountCounts = monitoring.NewDistribution(
+		"pilot_aggregate_service_accounts",
+		"Number of service accounts of a service returned by GetIstioServiceAccounts, as reported by the registries and once expanded with the trust domain aliases.",
+		[]float64{0, 1, 10, 100, 1000},
+		monitoring.WithLabels(stageTag),
+	)
+
+	registryServiceAccounts = monitoring.NewSum(
+		"pilot_aggregate_registry_service_accounts",
+		"Number of service accounts contributed by a registry to the service account lookups.",
+		monitoring.WithLabels(clusterTag, providerTag),
+	)
+
+	serviceAccountsCacheLookups = monitoring.NewSum(
+		"pilot_aggregate_service_accounts_cache_lookups",
+		"Number of lookups of the service accounts cache of the aggregate, by result.",
+		monitoring.WithLabels(resultTag),
+	)
+
+	serviceAccountsLatency = monitoring.NewDistribution(
+		"pilot_aggregate_service_accounts_latency_seconds",
+		"Duration of the calls to GetIstioServiceAccounts of the aggregate.",
+		[]float64{.0001, .001, .01, .1, 1, 10},
+	)
+
+	gatewayConflicts = monitoring.NewGauge(
+		"pilot_aggregate_gateway_conflicts",
+		"Number of gateway addresses and ports given for more than one network, as last found by NetworkGateways.",
+	)
+
+	registryEventAge = monitoring.NewGauge(
+		"pilot_aggregate_registry_seconds_since_last_event",
+		"Seconds since the last service or workload event of a registry, or since it was added if it had none.",
+		monitoring.WithLabels(clusterTag, providerTag),
+	)
+
+	registryInstanceCount = monitoring.NewDistribution(
+		"pilot_aggregate_registry_instances",
+		"Number of instances contributed by a registry to a sampled aggregated lookup.",
+		[]float64{0, 1, 10, 100, 1000, 10000, 100000},
+		monitoring.WithLabels(clusterTag, providerTag, searchTag),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(unhealthyInstancesFiltered)
+	monitoring.MustRegister(networkViewInstancesDropped)
+	monitoring.MustRegister(unreachableInstancesFiltered)
+	monitoring.MustRegister(registryInstanceCount)
+	monitoring.MustRegister(unsyncedRegistriesSkipped)
+	monitoring.MustRegister(handlerPanics)
+	monitoring.MustRegister(handlerEventsDropped)
+	monitoring.MustRegister(serviceEventsSuppressed)
+	monitoring.MustRegister(registryRunPanics)
+	monitoring.MustRegister(registrySyncTimeouts)
+	monitoring.MustRegister(registryRunFailures)
+	monitoring.MustRegister(gatewayConflicts)
+	monitoring.MustRegister(registryEventAge)
+	monitoring.MustRegister(registryStuckSyncs)
+	monitoring.MustRegister(expandedAccountsTruncated)
+	monitoring.MustRegister(serviceAccountCounts)
+	monitoring.MustRegister(registryServiceAccounts)
+	monitoring.MustRegister(serviceAccountsCacheLookups)
+	monitoring.MustRegister(serviceAccountsLatency)
+	monitoring.MustRegister(handlerInvocations)
+	monitoring.MustRegister(handlerLatency)
+	monitoring.MustRegister(registeredHandlers)
+}
@@ -0,0 +1,608 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/network"
+	"istio.io/pkg/log"
+)
+
+// InstancesByPortForProxy is like InstancesByPort, but when Options.FilterUnreachableNetworks is set, leaves
+// out the instances the proxy cannot reach: those on another network that has no gateway.
+func (c *Controller) InstancesByPortForProxy(svc *model.Service, port int, labels labels.Collection,
+	proxy *model.Proxy) []*model.ServiceInstance {
+	return c.filterUnreachableInstances(proxy, c.InstancesByPort(svc, port, labels))
+}
+
+// EndpointsForNetworkView returns the instances of the service on the port as seen from the viewer network. The
+// instances of the viewer network, or without a network, are returned as is. The instances of another network
+// with gateways are replaced by an instance per gateway, whose endpoint is the address and port of the gateway,
+// preferring the gateways residing in the cluster of the instances. The instances of a network without gateway
+// are unreachable, and left out. The instances are returned first, in the order of InstancesByPort, then the
+// gateways, sorted as by NetworkGateways.
+//
+// The weight of a gateway instance is the total weight of the instances it replaces, an instance without
+// weight counting as 1, split among the gateways of their network by the weights of the gateways, or evenly.
+func (c *Controller) EndpointsForNetworkView(svc *model.Service, port int, viewerNetwork network.ID) []*model.ServiceInstance {
+	instances := c.InstancesByPort(svc, port, nil)
+	all := c.NetworkGateways()
+	gateways := map[network.ID][]*model.NetworkGateway{}
+	for _, gw := range all {
+		gateways[gw.Network] = append(gateways[gw.Network], gw)
+	}
+	out := make([]*model.ServiceInstance, 0, len(instances))
+	// weights are the weights of the gateway instances, rounded once summed
+	weights := map[*model.NetworkGateway]float64{}
+	var ports map[*model.NetworkGateway]*model.Port
+	dropped := 0
+	for _, inst := range instances {
+		if inst.Endpoint == nil || inst.Endpoint.Network == "" || inst.Endpoint.Network == viewerNetwork {
+			out = append(out, inst)
+			continue
+		}
+		gws := gatewaysForCluster(gateways[inst.Endpoint.Network], inst.Endpoint.Locality.ClusterID)
+		if len(gws) == 0 {
+			dropped++
+			continue
+		}
+		weight := float64(inst.Endpoint.LbWeight)
+		if weight == 0 {
+			weight = 1
+		}
+		total := 0.0
+		for _, gw := range gws {
+			total += float64(gatewayShare(gw))
+		}
+		if ports == nil {
+			ports = map[*model.NetworkGateway]*model.Port{}
+		}
+		for _, gw := range gws {
+			weights[gw] += weight * float64(gatewayShare(gw)) / total
+			ports[gw] = inst.ServicePort
+		}
+	}
+	if dropped > 0 {
+		networkViewInstancesDropped.RecordInt(int64(dropped))
+	}
+	for _, gw := range all {
+		weight, f := weights[gw]
+		if !f {
+			continue
+		}
+		out = append(out, gatewayInstance(svc, ports[gw], gw, weight))
+	}
+	return out
+}
+
+// gatewaysForCluster returns the gateways residing in the cluster, or all the gateways if none does.
+func gatewaysForCluster(gws []*model.NetworkGateway, clusterID cluster.ID) []*model.NetworkGateway {
+	var out []*model.NetworkGateway
+	for _, gw := range gws {
+		if gw.Cluster == clusterID {
+			out = append(out, gw)
+		}
+	}
+	if len(out) == 0 {
+		return gws
+	}
+	return out
+}
+
+// gatewayShare is the share of the traffic to its network the gateway gets, 1 for the gateways without weight.
+func gatewayShare(gw *model.NetworkGateway) uint32 {
+	if gw.Weight == 0 {
+		return 1
+	}
+	return gw.Weight
+}
+
+// gatewayInstance returns the instance of the service reached through the gateway, with the weight rounded.
+func gatewayInstance(svc *model.Service, port *model.Port, gw *model.NetworkGateway, weight float64) *model.ServiceInstance {
+	weight = math.Max(1, math.Min(math.Round(weight), math.MaxUint32))
+	ep := &model.IstioEndpoint{
+		Address:      gw.Addr,
+		EndpointPort: gw.Port,
+		Network:      gw.Network,
+		Locality:     model.Locality{ClusterID: gw.Cluster},
+		LbWeight:     uint32(weight),
+		// the cross-network traffic relies on mTLS, for the SNI routing of the gateway
+		TLSMode: model.IstioMutualTLSModeLabel,
+	}
+	if port != nil {
+		ep.ServicePortName = port.Name
+	}
+	return &model.ServiceInstance{Service: svc, ServicePort: port, Endpoint: ep}
+}
+
+// gatewayNetworks returns the networks that have a gateway, either discovered by a registry or declared in
+// the mesh networks configuration. Declared gateways count even if they are not resolved yet. It returns
+// false when there is no gateway information at all, in which case nothing should be filtered.
+func (c *Controller) gatewayNetworks() (map[network.ID]struct{}, bool) {
+	networks := map[network.ID]struct{}{}
+	for _, gw := range c.NetworkGateways() {
+		networks[gw.Network] = struct{}{}
+	}
+	if holder, ok := c.meshHolder.(mesh.NetworksHolder); ok {
+		if meshNetworks := holder.Networks(); meshNetworks != nil {
+			for name, nw := range meshNetworks.Networks {
+				if len(nw.GetGateways()) > 0 {
+					networks[network.ID(name)] = struct{}{}
+				}
+			}
+		}
+	}
+	return networks, len(networks) > 0
+}
+
+// filterUnreachableInstances returns the instances reachable from the proxy network in a new slice. The
+// instances are returned as is if filtering is disabled, or if the proxy network or the gateways are unknown.
+func (c *Controller) filterUnreachableInstances(proxy *model.Proxy, instances []*model.ServiceInstance) []*model.ServiceInstance {
+	if !c.filterNetworks || len(instances) == 0 || proxy == nil || proxy.Metadata == nil || proxy.Metadata.Network == "" {
+		return instances
+	}
+	gateways, ok := c.gatewayNetworks()
+	if !ok {
+		return instances
+	}
+	out := make([]*model.ServiceInstance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.Endpoint != nil && inst.Endpoint.Network != "" && inst.Endpoint.Network != proxy.Metadata.Network {
+			if _, f := gateways[inst.Endpoint.Network]; !f {
+				continue
+			}
+		}
+		out = append(out, inst)
+	}
+	if dropped := len(instances) - len(out); dropped > 0 {
+		unreachableInstancesFiltered.RecordInt(int64(dropped))
+	}
+	return out
+}
+
+// NetworkGatewaysForNetwork is like NetworkGateways, but returns only the gateways of the network, all of them
+// if the network is empty. The registries the mesh networks configuration places on another network are not
+// asked for their gateways, so the gateways conflicting with those of another network, see GatewayConflicts,
+// are returned as well.
+func (c *Controller) NetworkGatewaysForNetwork(nw network.ID) []*model.NetworkGateway {
+	if nw == "" {
+		return c.NetworkGateways()
+	}
+	registryNetworks := c.registryNetworks()
+	var gws []*model.NetworkGateway
+	registries := c.gatewayRegistries(c.GetRegistries())
+	for _, r := range registries {
+		if rn, f := registryNetworks[r.Cluster()]; f && rn != nw {
+			continue
+		}
+		for _, gw := range c.registryGateways(r) {
+			if gw.Network == nw {
+				gws = append(gws, gw)
+			}
+		}
+	}
+	for _, gw := range c.meshNetworkGateways(registries) {
+		if gw.Network == nw {
+			gws = append(gws, gw)
+		}
+	}
+	gws, _ = mergeNetworkGateways(gws)
+	return gws
+}
+
+// NetworkGatewaysForCluster is like NetworkGateways, but returns only the gateways residing in the cluster, all
+// of them if the cluster is empty. The conflicts are only resolved between the gateways of the cluster.
+func (c *Controller) NetworkGatewaysForCluster(clusterID cluster.ID) []*model.NetworkGateway {
+	if clusterID == "" {
+		return c.NetworkGateways()
+	}
+	var gws []*model.NetworkGateway
+	registries := c.gatewayRegistries(c.GetRegistries())
+	for _, r := range registries {
+		for _, gw := range c.registryGateways(r) {
+			if gw.Cluster == clusterID {
+				gws = append(gws, gw)
+			}
+		}
+	}
+	for _, gw := range c.meshNetworkGateways(registries) {
+		if gw.Cluster == clusterID {
+			gws = append(gws, gw)
+		}
+	}
+	gws, _ = mergeNetworkGateways(gws)
+	return gws
+}
+
+// NetworkGatewaysByCluster returns the gateways of each cluster as its registries give them, neither merged nor
+// sorted, concatenated in the order of the registries when a cluster has several. The clusters without gateways
+// have an empty list. Like NetworkGateways, it leaves out the registries stopped, unhealthy, or unsynced with
+// Options.RequireSyncedRegistries. The gateways of the mesh networks configuration are not listed, and the
+// gateways without healthy endpoints are kept with Options.RequireGatewayEndpoints.
+func (c *Controller) NetworkGatewaysByCluster() map[cluster.ID][]*model.NetworkGateway {
+	out := map[cluster.ID][]*model.NetworkGateway{}
+	for _, r := range c.gatewayRegistries(c.GetRegistries()) {
+		gws := r.NetworkGateways()
+		if out[r.Cluster()] == nil {
+			out[r.Cluster()] = make([]*model.NetworkGateway, 0, len(gws))
+		}
+		out[r.Cluster()] = append(out[r.Cluster()], gws...)
+	}
+	return out
+}
+
+// gatewayRegistries returns the registries asked for their gateways, reusing the slice: a registry reporting a
+// partial gateway set would route the cross-network traffic to a gateway without its address. The stopped
+// registries are left out, as are the unsynced ones with Options.RequireSyncedRegistries, and the registries
+// found unhealthy: hung on a call past Options.RegistryTimeout, or dead.
+func (c *Controller) gatewayRegistries(registries []serviceregistry.Instance) []serviceregistry.Instance {
+	registries = c.syncedRegistries("NetworkGateways", registries)
+	out := registries[:0]
+	for _, r := range registries {
+		key := registryKey{cluster: r.Cluster(), provider: r.Provider()}
+		if c.health.hung(key) || c.health.isDead(key) {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// gatewaySourcesChanged is called when a registry becomes left out of the gateway lookups, or asked again, or
+// when the gateways of the mesh networks configuration may have changed, to notify the gateway handlers of the
+// gateways added or removed. The handlers are called asynchronously, as the storeLock may be held, by a single
+// goroutine merging the changes received meanwhile.
+func (c *Controller) gatewaySourcesChanged() {
+	if c.gatewayCache != nil {
+		c.gatewayCache.clear()
+	}
+	c.gatewayNotifications.request()
+}
+
+// registryNetworks returns the network of the clusters whose endpoints the mesh networks configuration
+// assigns to a single network. A cluster listed in several networks, or not at all, has no entry.
+func (c *Controller) registryNetworks() map[cluster.ID]network.ID {
+	holder, ok := c.meshHolder.(mesh.NetworksHolder)
+	if !ok {
+		return nil
+	}
+	meshNetworks := holder.Networks()
+	if meshNetworks == nil {
+		return nil
+	}
+	out := map[cluster.ID]network.ID{}
+	ambiguous := map[cluster.ID]struct{}{}
+	for name, nw := range meshNetworks.Networks {
+		for _, ep := range nw.GetEndpoints() {
+			clusterID := cluster.ID(ep.GetFromRegistry())
+			if clusterID == "" {
+				continue
+			}
+			if prev, f := out[clusterID]; f && prev != network.ID(name) {
+				ambiguous[clusterID] = struct{}{}
+			}
+			out[clusterID] = network.ID(name)
+		}
+	}
+	for clusterID := range ambiguous {
+		delete(out, clusterID)
+	}
+	return out
+}
+
+// networkGatewayKey identifies a gateway regardless of the registry and cluster it was discovered in.
+type networkGatewayKey struct {
+	network network.ID
+	addr    string
+	port    uint32
+}
+
+func gatewayKeyOf(gw *model.NetworkGateway) networkGatewayKey {
+	return networkGatewayKey{network: gw.Network, addr: gw.Addr, port: gw.Port}
+}
+
+func (k networkGatewayKey) less(o networkGatewayKey) bool {
+	if k.network != o.network {
+		return k.network < o.network
+	}
+	if k.addr != o.addr {
+		return k.addr < o.addr
+	}
+	return k.port < o.port
+}
+
+// GatewayConflict is an address and port that the registries give as the gateway of more than one network.
+type GatewayConflict struct {
+	Addr string `json:"addr"`
+	Port uint32 `json:"port"`
+	// Gateways are the conflicting gateways, one per network, the one NetworkGateways keeps first.
+	Gateways []model.NetworkGateway `json:"gateways"`
+}
+
+// GatewayConflicts returns the conflicts between the gateways of the registries, sorted by address and port.
+// See mergeNetworkGateways for the gateway kept.
+func (c *Controller) GatewayConflicts() []GatewayConflict {
+	_, conflicts := c.mergedNetworkGateways()
+	return conflicts
+}
+
+// mergedNetworkGateways returns the merged gateways of the registries, and their conflicts.
+func (c *Controller) mergedNetworkGateways() ([]*model.NetworkGateway, []GatewayConflict) {
+	return c.mergeRegistryGateways(c.GetRegistries())
+}
+
+// mergeRegistryGateways returns the merged gateways of the given registries, and their conflicts. The slice of
+// registries is reused.
+func (c *Controller) mergeRegistryGateways(registries []serviceregistry.Instance) ([]*model.NetworkGateway, []GatewayConflict) {
+	var gws []*model.NetworkGateway
+	registries = c.gatewayRegistries(registries)
+	for _, r := range registries {
+		gws = append(gws, c.registryGateways(r)...)
+	}
+	gws = append(gws, c.meshNetworkGateways(registries)...)
+	return mergeNetworkGateways(gws)
+}
+
+// reportGatewayConflicts records the number of conflicts, and warns about each of them at most once per interval.
+func (c *Controller) reportGatewayConflicts(conflicts []GatewayConflict) {
+	gatewayConflicts.Record(float64(len(conflicts)))
+	for _, conflict := range conflicts {
+		if !c.conflictLogLimiter.Allow(fmt.Sprintf("%s:%d", conflict.Addr, conflict.Port)) {
+			continue
+		}
+		kept := conflict.Gateways[0]
+		for _, gw := range conflict.Gateways[1:] {
+			log.Warnf("gateway %s:%d is given for network %s by cluster %s and for network %s by cluster %s, keeping network %s",
+				conflict.Addr, conflict.Port, kept.Network, kept.Cluster, gw.Network, gw.Cluster, kept.Network)
+		}
+	}
+}
+
+// mergeNetworkGateways returns the gateways in a new slice sorted by network, address and port, so that the
+// cross-network endpoints built from them do not churn with the order of the registries. The gateways with
+// the same network, address and port are collapsed into the one of the lowest cluster ID. The model weights
+// the cross-network endpoints by the number of gateways of each network, so a gateway discovered by several
+// registries must not count more than once: the merged gateway weighs as a single one, never as the sum of
+// the duplicates. The merged gateway has the largest weight of the duplicates, so a weight given by a single
+// registry is kept. The weights are not rescaled, preserving their ratios within a network; in a network where
+// some gateways have a weight, those without one are given the weight 1, while the gateways of a network where
+// none has a weight keep 0, to share the traffic evenly.
+//
+// The address and port of a gateway can only lead to one network. When they are given for several networks,
+// the gateway of the lowest cluster ID is kept, of the lowest network ID if that cluster gives several, and
+// the others are returned as conflicts.
+func mergeNetworkGateways(gws []*model.NetworkGateway) ([]*model.NetworkGateway, []GatewayConflict) {
+	if len(gws) < 2 {
+		return gws, nil
+	}
+	sorted := append(make([]*model.NetworkGateway, 0, len(gws)), gws...)
+	sort.Slice(sorted, func(i, j int) bool {
+		ki, kj := gatewayKeyOf(sorted[i]), gatewayKeyOf(sorted[j])
+		if ki != kj {
+			return ki.less(kj)
+		}
+		return sorted[i].Cluster < sorted[j].Cluster
+	})
+	out := sorted[:1]
+	for _, gw := range sorted[1:] {
+		last := out[len(out)-1]
+		if gatewayKeyOf(gw) != gatewayKeyOf(last) {
+			out = append(out, gw)
+			continue
+		}
+		if gw.Weight > last.Weight {
+			// the gateways belong to the registries, and are copied to be modified
+			merged := *last
+			merged.Weight = gw.Weight
+			out[len(out)-1] = &merged
+		}
+	}
+	out, conflicts := resolveGatewayConflicts(out)
+	return weighUnweightedGateways(out), conflicts
+}
+
+// weighUnweightedGateways gives the weight 1 to the gateways without one, in the networks where some have one.
+// The gateways are sorted by network.
+func weighUnweightedGateways(gws []*model.NetworkGateway) []*model.NetworkGateway {
+	for start := 0; start < len(gws); {
+		end, weighted := start, false
+		for ; end < len(gws) && gws[end].Network == gws[start].Network; end++ {
+			weighted = weighted || gws[end].Weight > 0
+		}
+		for i := start; weighted && i < end; i++ {
+			if gws[i].Weight == 0 {
+				gw := *gws[i]
+				gw.Weight = 1
+				gws[i] = &gw
+			}
+		}
+		start = end
+	}
+	return gws
+}
+
+// resolveGatewayConflicts drops the gateways whose address and port are those of a gateway of another network
+// that is kept, see mergeNetworkGateways. The gateways are sorted by network, address and port.
+func resolveGatewayConflicts(gws []*model.NetworkGateway) ([]*model.NetworkGateway, []GatewayConflict) {
+	type addrPort struct {
+		addr string
+		port uint32
+	}
+	byAddr := make(map[addrPort][]*model.NetworkGateway, len(gws))
+	for _, gw := range gws {
+		key := addrPort{addr: gw.Addr, port: gw.Port}
+		byAddr[key] = append(byAddr[key], gw)
+	}
+	if len(byAddr) == len(gws) {
+		return gws, nil
+	}
+	var conflicts []GatewayConflict
+	dropped := map[*model.NetworkGateway]struct{}{}
+	for key, candidates := range byAddr {
+		if len(candidates) < 2 {
+			continue
+		}
+		// the candidates are sorted by network, so the first of the lowest cluster is kept
+		kept := 0
+		for i, gw := range candidates {
+			if gw.Cluster < candidates[kept].Cluster {
+				kept = i
+			}
+		}
+		conflict := GatewayConflict{Addr: key.addr, Port: key.port, Gateways: []model.NetworkGateway{*candidates[kept]}}
+		for i, gw := range candidates {
+			if i != kept {
+				conflict.Gateways = append(conflict.Gateways, *gw)
+				dropped[gw] = struct{}{}
+			}
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Addr != conflicts[j].Addr {
+			return conflicts[i].Addr < conflicts[j].Addr
+		}
+		return conflicts[i].Port < conflicts[j].Port
+	})
+	out := gws[:0]
+	for _, gw := range gws {
+		if _, f := dropped[gw]; !f {
+			out = append(out, gw)
+		}
+	}
+	return out, conflicts
+}
+
+type gatewayHandler struct {
+	id   HandlerID
+	site string
+	f    func()
+}
+
+func (h gatewayHandler) handle() {
+	defer recoverHandler(nil, "gateway", "gateway", h.site, model.EventUpdate, "network gateways", "", "")
+	h.f()
+}
+
+// networkGatewayNotifier is implemented by registries able to notify the changes of their NetworkGateways.
+type networkGatewayNotifier interface {
+	AppendNetworkGatewayHandler(h func())
+}
+
+// AppendNetworkGatewayHandler adds a handler called when the gateways returned by NetworkGateways change: the
+// merged gateways are computed again when a registry able to notify the changes of its gateways does so, on
+// the service events of the other registries, when a registry is added or deleted, and when a registry is left out of NetworkGateways or asked again, as it
+// syncs, stops, starts or becomes unhealthy; the handlers are called only if they differ from the previous
+// ones. The handler is called once NetworkGateways reflects the change.
+func (c *Controller) AppendNetworkGatewayHandler(h func()) {
+	c.addGatewayHandler(h)
+}
+
+func (c *Controller) addGatewayHandler(h func()) HandlerID {
+	c.storeLock.Lock()
+	c.lastHandlerID++
+	id := c.lastHandlerID
+	// the handlers are replaced rather than modified, so that they can be called without the lock
+	n := len(c.gatewayHandlers)
+	c.gatewayHandlers = append(c.gatewayHandlers[:n:n], gatewayHandler{id: id, site: registrationSite(), f: h})
+	recordHandlerCount("gateway", len(c.gatewayHandlers))
+	c.storeLock.Unlock()
+	if n == 0 {
+		// the merged gateways are not computed without handlers, and the first one is only notified of the
+		// changes from now on
+		c.networkGatewaysChanged()
+	}
+	return id
+}
+
+func (c *Controller) removeGatewayHandler(id HandlerID) {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	for i, h := range c.gatewayHandlers {
+		if h.id == id {
+			c.gatewayHandlers = append(c.gatewayHandlers[:i:i], c.gatewayHandlers[i+1:]...)
+			recordHandlerCount("gateway", len(c.gatewayHandlers))
+			return
+		}
+	}
+}
+
+// watchNetworkGateways relays the gateway changes of the registry to the gateway handlers, until the registry
+// is deleted. The gateways of the registries not notifying their changes, such as Kubernetes, are derived from
+// their services, and are computed again on their service events: an east-west gateway service getting its
+// load balancer address adds a gateway. The storeLock must be held.
+func (c *Controller) watchNetworkGateways(r serviceregistry.Instance) {
+	attached := c.attached[registryKey{cluster: r.Cluster(), provider: r.Provider()}]
+	changed := func() {
+		if attached.Load() {
+			if c.gatewayCache != nil {
+				c.gatewayCache.clear()
+			}
+			c.notifyNetworkGatewayHandlers()
+		}
+	}
+	if notifier, ok := r.(networkGatewayNotifier); ok {
+		notifier.AppendNetworkGatewayHandler(changed)
+		return
+	}
+	if !hasController(r) {
+		return
+	}
+	r.AppendServiceHandler(func(*model.Service, model.Event) {
+		changed()
+	})
+}
+
+// notifyNetworkGatewayHandlers calls the gateway handlers, if any, if the merged gateways changed since they
+// were last computed.
+func (c *Controller) notifyNetworkGatewayHandlers() {
+	c.storeLock.RLock()
+	handlers := c.gatewayHandlers
+	c.storeLock.RUnlock()
+	if len(handlers) == 0 || !c.networkGatewaysChanged() {
+		return
+	}
+	for _, h := range handlers {
+		h.handle()
+	}
+}
+
+// networkGatewaysChanged computes the merged gateways, and tells whether they differ from the previous ones.
+// The gateways are compared by value, as the registries may update them in place.
+func (c *Controller) networkGatewaysChanged() bool {
+	c.gatewayMutex.Lock()
+	defer c.gatewayMutex.Unlock()
+	merged := c.NetworkGateways()
+	changed := len(merged) != len(c.mergedGateways)
+	for i := 0; !changed && i < len(merged); i++ {
+		changed = *merged[i] != c.mergedGateways[i]
+	}
+	if !changed {
+		return false
+	}
+	c.mergedGateways = make([]model.NetworkGateway, 0, len(merged))
+	for _, gw := range merged {
+		c.mergedGateways = append(c.mergedGateways, *gw)
+	}
+	return true
+}
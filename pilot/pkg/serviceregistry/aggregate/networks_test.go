@@ -0,0 +1,645 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/atomic"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/network"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+type meshNetworksHolder struct {
+	mockMeshConfigHolder
+	networks *meshconfig.MeshNetworks
+}
+
+func (h *meshNetworksHolder) SetNetworks(networks *meshconfig.MeshNetworks) {
+	h.networks = networks
+}
+
+func (h *meshNetworksHolder) Networks() *meshconfig.MeshNetworks {
+	return h.networks
+}
+
+func TestFilterUnreachableNetworks(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	// network-2 has a gateway discovered by the registry, network-3 one declared in the mesh networks
+	networks := &meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+		"network-3": {Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+			Gw:   &meshconfig.Network_IstioNetworkGateway_RegistryServiceName{RegistryServiceName: "gw.istio-system.svc.cluster.local"},
+			Port: 15443,
+		}}},
+		"network-4": {},
+	}}
+	gateways := []*model.NetworkGateway{{Network: "network-2", Cluster: "cluster-1", Addr: "20.0.0.1", Port: 15443}}
+
+	addresses := func(instances []*model.ServiceInstance) []string {
+		var out []string
+		for _, inst := range instances {
+			out = append(out, inst.Endpoint.Address)
+		}
+		return out
+	}
+	all := []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5"}
+	cases := []struct {
+		name     string
+		disabled bool
+		networks *meshconfig.MeshNetworks
+		gateways []*model.NetworkGateway
+		network  network.ID
+		want     []string
+	}{
+		{
+			name:     "unreachable network dropped",
+			networks: networks,
+			gateways: gateways,
+			network:  "network-1",
+			want:     []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "5.5.5.5"},
+		},
+		{
+			name:     "same network is kept without gateway",
+			networks: networks,
+			gateways: gateways,
+			network:  "network-4",
+			want:     []string{"2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5"},
+		},
+		{
+			name:    "no gateway information",
+			network: "network-1",
+			want:    all,
+		},
+		{
+			name:     "proxy without network",
+			networks: networks,
+			gateways: gateways,
+			want:     all,
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+			networks: networks,
+			gateways: gateways,
+			network:  "network-1",
+			want:     all,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			registry := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+				makeInstance(svc, "1.1.1.1", 80, "network-1", nil),
+				makeInstance(svc, "2.2.2.2", 80, "network-2", nil),
+				makeInstance(svc, "3.3.3.3", 80, "network-3", nil),
+				makeInstance(svc, "4.4.4.4", 80, "network-4", nil),
+				makeInstance(svc, "5.5.5.5", 80, "", nil))
+			registry.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(tc.gateways...)
+			ctl := NewController(Options{
+				MeshHolder:                &meshNetworksHolder{networks: tc.networks},
+				FilterUnreachableNetworks: !tc.disabled,
+			})
+			ctl.AddRegistry(registry)
+
+			proxy := &model.Proxy{Metadata: &model.NodeMetadata{Network: tc.network}}
+			before := getCounterValue(t, "pilot_aggregate_unreachable_instances_filtered")
+			if diff := cmp.Diff(addresses(ctl.InstancesByPortForProxy(svc, port, nil, proxy)), tc.want); diff != "" {
+				t.Errorf("unexpected instances, diff %v", diff)
+			}
+			if dropped := getCounterValue(t, "pilot_aggregate_unreachable_instances_filtered") - before; int(dropped) != len(all)-len(tc.want) {
+				t.Errorf("expected %d dropped instances to be recorded, got %v", len(all)-len(tc.want), dropped)
+			}
+		})
+	}
+}
+
+// gatewayRegistry notifies the changes of its gateways.
+type gatewayRegistry struct {
+	serviceregistry.Simple
+	handlers []func()
+}
+
+func (r *gatewayRegistry) AppendNetworkGatewayHandler(h func()) {
+	r.handlers = append(r.handlers, h)
+}
+
+func (r *gatewayRegistry) addGateway(gw *model.NetworkGateway) {
+	r.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw)
+	r.notify()
+}
+
+func (r *gatewayRegistry) notify() {
+	for _, h := range r.handlers {
+		h()
+	}
+}
+
+func TestAppendNetworkGatewayHandler(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	notifying := &gatewayRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)}
+	ctl.AddRegistry(notifying)
+
+	var observed [][]string
+	ctl.AppendNetworkGatewayHandler(func() {
+		var addrs []string
+		for _, gw := range ctl.NetworkGateways() {
+			addrs = append(addrs, gw.Addr)
+		}
+		observed = append(observed, addrs)
+	})
+
+	// a registry changing its gateways
+	notifying.addGateway(&model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443})
+	// a registry with gateways being added and deleted
+	other := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	other.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(&model.NetworkGateway{Network: "network-2", Cluster: "cluster-2", Addr: "2.2.2.2", Port: 15443})
+	ctl.AddRegistry(other)
+	ctl.DeleteRegistry("cluster-2", provider.Kubernetes)
+	// a registry without gateways changes nothing
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-3", svc))
+
+	want := [][]string{{"1.1.1.1"}, {"1.1.1.1", "2.2.2.2"}, {"1.1.1.1"}}
+	if diff := cmp.Diff(observed, want); diff != "" {
+		t.Errorf("unexpected gateways observed, diff %v", diff)
+	}
+
+	// a deleted registry no longer notifies
+	observed = nil
+	ctl.DeleteRegistry("cluster-1", provider.Kubernetes)
+	notifying.addGateway(&model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.2", Port: 15443})
+	if len(observed) != 1 {
+		t.Errorf("expected only the deletion to be notified, got %v", observed)
+	}
+}
+
+func TestNetworkGatewayHandlerServiceEvents(t *testing.T) {
+	svc := mock.MakeService("eastwest.istio-system.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	for _, cached := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cached=%v", cached), func(t *testing.T) {
+			// the memory registry does not notify the changes of its gateways, as the kube registry
+			registry := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+			if _, ok := interface{}(registry).(networkGatewayNotifier); ok {
+				t.Fatalf("expected the registry not to notify its gateways")
+			}
+			ctl := NewController(Options{CacheNetworkGateways: cached})
+			ctl.AddRegistry(registry)
+			calls := 0
+			ctl.AppendNetworkGatewayHandler(func() {
+				calls++
+			})
+
+			// the gateway service gets its load balancer address
+			gw := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443}
+			registry.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw)
+			fakeControllerOf(registry).fireService(svc, model.EventUpdate)
+			if calls != 1 {
+				t.Fatalf("expected the gateway handler to be called once, got %d", calls)
+			}
+			// an event leaving the gateways as they are is not notified
+			fakeControllerOf(registry).fireService(svc, model.EventUpdate)
+			if calls != 1 {
+				t.Fatalf("expected the unchanged gateways not to be notified, got %d calls", calls)
+			}
+			if diff := cmp.Diff(ctl.NetworkGateways(), []*model.NetworkGateway{gw}); diff != "" {
+				t.Fatalf("unexpected gateways, diff %v", diff)
+			}
+		})
+	}
+}
+
+func TestNetworkGatewaysDeduplicated(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "primary")
+	eastWest := model.NetworkGateway{Network: "network-1", Addr: "1.1.1.1", Port: 15443}
+	registry := func(clusterID string, gws ...model.NetworkGateway) serviceregistry.Instance {
+		r := newMemoryRegistry(provider.Kubernetes, cluster.ID(clusterID), svc)
+		for _, gw := range gws {
+			gw := gw
+			gw.Cluster = cluster.ID(clusterID)
+			r.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(&gw)
+		}
+		return r
+	}
+	ctl := NewController(Options{})
+	// the primary and the remote both discover the east-west gateway of the primary
+	ctl.AddRegistry(registry("primary", eastWest))
+	ctl.AddRegistry(registry("remote", eastWest))
+	ctl.AddRegistry(registry("other", model.NetworkGateway{Network: "network-2", Addr: "2.2.2.2", Port: 15443}))
+
+	want := []*model.NetworkGateway{
+		{Network: "network-1", Cluster: "primary", Addr: "1.1.1.1", Port: 15443},
+		{Network: "network-2", Cluster: "other", Addr: "2.2.2.2", Port: 15443},
+	}
+	if diff := cmp.Diff(ctl.NetworkGateways(), want); diff != "" {
+		t.Errorf("unexpected gateways, diff %v", diff)
+	}
+}
+
+func TestNetworkGatewaysSorted(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "primary")
+	registries := func() []serviceregistry.Instance {
+		primary := newMemoryRegistry(provider.Kubernetes, "primary", svc)
+		primary.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(
+			&model.NetworkGateway{Network: "network-2", Cluster: "primary", Addr: "2.2.2.2", Port: 15443},
+			&model.NetworkGateway{Network: "network-1", Cluster: "primary", Addr: "1.1.1.2", Port: 15443},
+			&model.NetworkGateway{Network: "network-1", Cluster: "primary", Addr: "1.1.1.1", Port: 15443})
+		remote := newMemoryRegistry(provider.Kubernetes, "remote", svc)
+		remote.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(
+			&model.NetworkGateway{Network: "network-1", Cluster: "remote", Addr: "1.1.1.1", Port: 15444},
+			&model.NetworkGateway{Network: "network-1", Cluster: "remote", Addr: "1.1.1.1", Port: 15443})
+		other := newMemoryRegistry(provider.Kubernetes, "other", svc)
+		other.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(
+			&model.NetworkGateway{Network: "network-0", Cluster: "other", Addr: "3.3.3.3", Port: 15443})
+		return []serviceregistry.Instance{primary, remote, other}
+	}
+	want := []*model.NetworkGateway{
+		{Network: "network-0", Cluster: "other", Addr: "3.3.3.3", Port: 15443},
+		{Network: "network-1", Cluster: "primary", Addr: "1.1.1.1", Port: 15443},
+		{Network: "network-1", Cluster: "remote", Addr: "1.1.1.1", Port: 15444},
+		{Network: "network-1", Cluster: "primary", Addr: "1.1.1.2", Port: 15443},
+		{Network: "network-2", Cluster: "primary", Addr: "2.2.2.2", Port: 15443},
+	}
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 0, 2}, {1, 2, 0}} {
+		all := registries()
+		ctl := NewController(Options{})
+		for _, i := range order {
+			ctl.AddRegistry(all[i])
+		}
+		if diff := cmp.Diff(ctl.NetworkGateways(), want); diff != "" {
+			t.Errorf("unexpected gateways with the registries in the order %v, diff %v", order, diff)
+		}
+	}
+}
+
+// countingGatewayRegistry counts the calls to NetworkGateways.
+type countingGatewayRegistry struct {
+	serviceregistry.Simple
+	calls int
+}
+
+func (r *countingGatewayRegistry) NetworkGateways() []*model.NetworkGateway {
+	r.calls++
+	return r.Simple.NetworkGateways()
+}
+
+func TestNetworkGatewaysForNetwork(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	registry := func(clusterID cluster.ID, gws ...*model.NetworkGateway) *countingGatewayRegistry {
+		r := newMemoryRegistry(provider.Kubernetes, clusterID, svc)
+		r.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gws...)
+		return &countingGatewayRegistry{Simple: r}
+	}
+	gw1 := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443}
+	gw2 := &model.NetworkGateway{Network: "network-2", Cluster: "cluster-2", Addr: "2.2.2.2", Port: 15443}
+	gw3 := &model.NetworkGateway{Network: "network-3", Cluster: "cluster-3", Addr: "3.3.3.3", Port: 15443}
+	// cluster-4 is in no network of the configuration, and discovers the gateways of the others
+	gw4 := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-4", Addr: "4.4.4.4", Port: 15443}
+	registries := []*countingGatewayRegistry{
+		registry("cluster-1", gw1),
+		registry("cluster-2", gw2),
+		registry("cluster-3", gw3),
+		registry("cluster-4", gw4, gw2),
+	}
+	endpoints := func(clusterID string) []*meshconfig.Network_NetworkEndpoints {
+		return []*meshconfig.Network_NetworkEndpoints{{Ne: &meshconfig.Network_NetworkEndpoints_FromRegistry{FromRegistry: clusterID}}}
+	}
+	networks := &meshconfig.MeshNetworks{Networks: map[string]*meshconfig.Network{
+		"network-1": {Endpoints: endpoints("cluster-1")},
+		"network-2": {Endpoints: endpoints("cluster-2")},
+		"network-3": {Endpoints: endpoints("cluster-3")},
+	}}
+	ctl := NewController(Options{MeshHolder: &meshNetworksHolder{networks: networks}})
+	for _, r := range registries {
+		ctl.AddRegistry(r)
+	}
+
+	cases := []struct {
+		network network.ID
+		want    []*model.NetworkGateway
+		// asked are the indexes of the registries asked for their gateways
+		asked []int
+	}{
+		{network: "network-1", want: []*model.NetworkGateway{gw1, gw4}, asked: []int{0, 3}},
+		{network: "network-2", want: []*model.NetworkGateway{gw2}, asked: []int{1, 3}},
+		{network: "network-3", want: []*model.NetworkGateway{gw3}, asked: []int{2, 3}},
+		{network: "network-4", asked: []int{3}},
+		{want: []*model.NetworkGateway{gw1, gw4, gw2, gw3}, asked: []int{0, 1, 2, 3}},
+	}
+	for _, tc := range cases {
+		t.Run(string(tc.network), func(t *testing.T) {
+			for _, r := range registries {
+				r.calls = 0
+			}
+			if diff := cmp.Diff(ctl.NetworkGatewaysForNetwork(tc.network), tc.want); diff != "" {
+				t.Errorf("unexpected gateways, diff %v", diff)
+			}
+			var asked []int
+			for i, r := range registries {
+				if r.calls > 0 {
+					asked = append(asked, i)
+				}
+			}
+			if diff := cmp.Diff(asked, tc.asked); diff != "" {
+				t.Errorf("unexpected registries asked, diff %v", diff)
+			}
+		})
+	}
+
+	if diff := cmp.Diff(ctl.NetworkGatewaysForCluster("cluster-2"), []*model.NetworkGateway{gw2}); diff != "" {
+		t.Errorf("unexpected gateways of cluster-2, diff %v", diff)
+	}
+	if diff := cmp.Diff(ctl.NetworkGatewaysForCluster("cluster-4"), []*model.NetworkGateway{gw4}); diff != "" {
+		t.Errorf("unexpected gateways of cluster-4, diff %v", diff)
+	}
+	if got := ctl.NetworkGatewaysForCluster("cluster-5"); len(got) != 0 {
+		t.Errorf("expected no gateways of cluster-5, got %v", got)
+	}
+}
+
+func TestNetworkGatewayHandlerOnlyOnChanges(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	gw := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443}
+	notifying := &gatewayRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)}
+	notifying.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw)
+	ctl := NewController(Options{})
+	ctl.AddRegistry(notifying)
+
+	calls := 0
+	ctl.AppendNetworkGatewayHandler(func() {
+		calls++
+	})
+	expect := func(t *testing.T, want int) {
+		t.Helper()
+		if calls != want {
+			t.Fatalf("expected %d calls to the handler, got %d", want, calls)
+		}
+		calls = 0
+	}
+
+	t.Run("no-op notification", func(t *testing.T) {
+		// the gateways known before the handler was added are not a change
+		notifying.notify()
+		expect(t, 0)
+	})
+	t.Run("registry adding a duplicate", func(t *testing.T) {
+		remote := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+		remote.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(
+			&model.NetworkGateway{Network: "network-1", Cluster: "cluster-2", Addr: "1.1.1.1", Port: 15443})
+		ctl.AddRegistry(remote)
+		expect(t, 0)
+		ctl.DeleteRegistry("cluster-2", provider.Kubernetes)
+		expect(t, 0)
+	})
+	t.Run("registry without gateways", func(t *testing.T) {
+		ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-3", svc))
+		expect(t, 0)
+	})
+	t.Run("gateway updated in place", func(t *testing.T) {
+		// the east-west gateway gets its load balancer address
+		gw.Addr = "1.1.1.2"
+		notifying.notify()
+		expect(t, 1)
+		notifying.notify()
+		expect(t, 0)
+	})
+	t.Run("cluster removed", func(t *testing.T) {
+		ctl.DeleteRegistry("cluster-1", provider.Kubernetes)
+		expect(t, 1)
+	})
+}
+
+func TestGatewayConflicts(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	registry := func(clusterID cluster.ID, gws ...*model.NetworkGateway) serviceregistry.Instance {
+		r := newMemoryRegistry(provider.Kubernetes, clusterID, svc)
+		r.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gws...)
+		return r
+	}
+	// both clusters label the same external address as the gateway of their network
+	first := &model.NetworkGateway{Network: "network-b", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443}
+	second := &model.NetworkGateway{Network: "network-a", Cluster: "cluster-2", Addr: "1.1.1.1", Port: 15443}
+	other := &model.NetworkGateway{Network: "network-a", Cluster: "cluster-2", Addr: "2.2.2.2", Port: 15443}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(registry("cluster-2", second, other))
+	ctl.AddRegistry(registry("cluster-1", first))
+
+	// the gateway of the lowest cluster is kept, whatever the order of the registries
+	if diff := cmp.Diff(ctl.NetworkGateways(), []*model.NetworkGateway{other, first}); diff != "" {
+		t.Errorf("unexpected gateways, diff %v", diff)
+	}
+	want := []GatewayConflict{{Addr: "1.1.1.1", Port: 15443, Gateways: []model.NetworkGateway{*first, *second}}}
+	if diff := cmp.Diff(ctl.GatewayConflicts(), want); diff != "" {
+		t.Errorf("unexpected conflicts, diff %v", diff)
+	}
+	if got := metricRow(t, "pilot_aggregate_gateway_conflicts", nil).(*view.LastValueData).Value; got != 1 {
+		t.Errorf("expected 1 conflict to be recorded, got %v", got)
+	}
+
+	ctl.DeleteRegistry("cluster-1", provider.Kubernetes)
+	if diff := cmp.Diff(ctl.NetworkGateways(), []*model.NetworkGateway{second, other}); diff != "" {
+		t.Errorf("unexpected gateways once the conflict is gone, diff %v", diff)
+	}
+	if got := ctl.GatewayConflicts(); len(got) != 0 {
+		t.Errorf("expected no conflict, got %v", got)
+	}
+	if got := metricRow(t, "pilot_aggregate_gateway_conflicts", nil).(*view.LastValueData).Value; got != 0 {
+		t.Errorf("expected no conflict to be recorded, got %v", got)
+	}
+}
+
+func TestNetworkGatewayWeights(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	registry := func(clusterID cluster.ID, gws ...*model.NetworkGateway) serviceregistry.Instance {
+		r := newMemoryRegistry(provider.Kubernetes, clusterID, svc)
+		r.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gws...)
+		return r
+	}
+	ctl := NewController(Options{})
+	// the same gateways, weighted by the second cluster only
+	ctl.AddRegistry(registry("cluster-1",
+		&model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443},
+		&model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.2", Port: 15443}))
+	weighted := []*model.NetworkGateway{
+		{Network: "network-1", Cluster: "cluster-2", Addr: "1.1.1.1", Port: 15443, Weight: 80},
+		{Network: "network-1", Cluster: "cluster-2", Addr: "1.1.1.2", Port: 15443, Weight: 20},
+		// a gateway left unweighted next to weighted ones
+		{Network: "network-1", Cluster: "cluster-2", Addr: "1.1.1.3", Port: 15443},
+	}
+	ctl.AddRegistry(registry("cluster-2", weighted...))
+	// a network without weights
+	ctl.AddRegistry(registry("cluster-3",
+		&model.NetworkGateway{Network: "network-2", Cluster: "cluster-3", Addr: "2.2.2.1", Port: 15443},
+		&model.NetworkGateway{Network: "network-2", Cluster: "cluster-3", Addr: "2.2.2.2", Port: 15443}))
+
+	want := []*model.NetworkGateway{
+		{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443, Weight: 80},
+		{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.2", Port: 15443, Weight: 20},
+		{Network: "network-1", Cluster: "cluster-2", Addr: "1.1.1.3", Port: 15443, Weight: 1},
+		{Network: "network-2", Cluster: "cluster-3", Addr: "2.2.2.1", Port: 15443},
+		{Network: "network-2", Cluster: "cluster-3", Addr: "2.2.2.2", Port: 15443},
+	}
+	if diff := cmp.Diff(ctl.NetworkGateways(), want); diff != "" {
+		t.Errorf("unexpected gateways, diff %v", diff)
+	}
+	// the gateways of the registries are left as is
+	if weighted[2].Weight != 0 {
+		t.Errorf("expected the gateway of the registry not to be modified, got the weight %d", weighted[2].Weight)
+	}
+}
+
+func TestNetworkGatewaysByCluster(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	gw1 := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443}
+	gw2 := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.2", Port: 15443}
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	kube.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw2)
+	external := newMemoryRegistry(provider.External, "cluster-1", svc)
+	// the duplicates are kept
+	external.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw1, gw2)
+	ctl := NewController(Options{})
+	ctl.AddRegistry(kube)
+	ctl.AddRegistry(external)
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc))
+
+	want := map[cluster.ID][]*model.NetworkGateway{
+		"cluster-1": {gw2, gw1, gw2},
+		"cluster-2": {},
+	}
+	if diff := cmp.Diff(ctl.NetworkGatewaysByCluster(), want); diff != "" {
+		t.Errorf("unexpected gateways, diff %v", diff)
+	}
+
+	if err := ctl.StopRegistry("cluster-2", provider.Kubernetes); err != nil {
+		t.Fatal(err)
+	}
+	if got := ctl.NetworkGatewaysByCluster(); len(got) != 1 {
+		t.Errorf("expected the stopped registry to be left out, got %v", got)
+	}
+}
+
+func TestNetworkGatewaysOfSkippedRegistries(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	gw1 := &model.NetworkGateway{Network: "network-1", Cluster: "cluster-1", Addr: "1.1.1.1", Port: 15443}
+	gw2 := &model.NetworkGateway{Network: "network-2", Cluster: "cluster-2", Addr: "2.2.2.2", Port: 15443}
+	synced := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	synced.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw1)
+	syncing := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	syncing.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(gw2)
+	fakeControllerOf(syncing).unsynced.Store(true)
+	ctl := NewController(Options{RequireSyncedRegistries: true, CacheNetworkGateways: true})
+	ctl.AddRegistry(synced)
+	ctl.AddRegistry(syncing)
+	var calls atomic.Int32
+	ctl.AppendNetworkGatewayHandler(func() {
+		calls.Inc()
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+
+	if diff := cmp.Diff(ctl.NetworkGateways(), []*model.NetworkGateway{gw1}); diff != "" {
+		t.Fatalf("unexpected gateways while a registry syncs, diff %v", diff)
+	}
+	// the gateway of the registry is notified once it syncs
+	fakeControllerOf(syncing).unsynced.Store(false)
+	retry.UntilSuccessOrFail(t, func() error {
+		if calls.Load() != 1 {
+			return fmt.Errorf("expected the handler to be called once, got %d calls", calls.Load())
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	if diff := cmp.Diff(ctl.NetworkGateways(), []*model.NetworkGateway{gw1, gw2}); diff != "" {
+		t.Fatalf("unexpected gateways once synced, diff %v", diff)
+	}
+
+	// a registry hung on a call is left out until the call returns
+	key := registryKey{cluster: "cluster-1", provider: provider.Kubernetes}
+	ctl.health.timedOut(key, "GetProxyServiceInstances did not return within 1s")
+	ctl.gatewaySourcesChanged()
+	if diff := cmp.Diff(ctl.NetworkGateways(), []*model.NetworkGateway{gw2}); diff != "" {
+		t.Fatalf("unexpected gateways while a registry is hung, diff %v", diff)
+	}
+	ctl.health.returned(key)
+	ctl.gatewaySourcesChanged()
+	if diff := cmp.Diff(ctl.NetworkGateways(), []*model.NetworkGateway{gw1, gw2}); diff != "" {
+		t.Fatalf("unexpected gateways once the registry is healthy, diff %v", diff)
+	}
+}
+
+func TestEndpointsForNetworkView(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	weighted := makeInstance(svc, "2.2.2.2", 80, "network-2", nil)
+	weighted.Endpoint.LbWeight = 3
+	registry := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+		makeInstance(svc, "1.1.1.1", 80, "network-1", nil),
+		makeInstance(svc, "2.2.2.1", 80, "network-2", nil),
+		weighted,
+		makeInstance(svc, "3.3.3.3", 80, "network-3", nil),
+		makeInstance(svc, "5.5.5.5", 80, "", nil))
+	// network-2 is reachable through two gateways, one getting three times the traffic of the other
+	registry.ServiceDiscovery.(*memory.ServiceDiscovery).AddGateways(
+		&model.NetworkGateway{Network: "network-2", Cluster: "cluster-2", Addr: "20.0.0.1", Port: 15443, Weight: 3},
+		&model.NetworkGateway{Network: "network-2", Cluster: "cluster-2", Addr: "20.0.0.2", Port: 15443, Weight: 1})
+	ctl := NewController(Options{})
+	ctl.AddRegistry(registry)
+
+	type endpoint struct {
+		Address string
+		Port    uint32
+		Weight  uint32
+	}
+	before := getCounterValue(t, "pilot_aggregate_network_view_instances_dropped")
+	var got []endpoint
+	for _, inst := range ctl.EndpointsForNetworkView(svc, port, "network-1") {
+		got = append(got, endpoint{inst.Endpoint.Address, inst.Endpoint.EndpointPort, inst.Endpoint.LbWeight})
+	}
+	want := []endpoint{
+		{"1.1.1.1", 80, 0},
+		{"5.5.5.5", 80, 0},
+		// the 4 instances of weight 1 and 3 are split 3 to 1 among the gateways
+		{"20.0.0.1", 15443, 3},
+		{"20.0.0.2", 15443, 1},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected endpoints, diff %v", diff)
+	}
+	// the instance of network-3 has no gateway to reach it
+	if dropped := getCounterValue(t, "pilot_aggregate_network_view_instances_dropped") - before; dropped != 1 {
+		t.Errorf("expected 1 dropped instance to be recorded, got %v", dropped)
+	}
+
+	// from network-2, its instances are reached directly, and those of network-1 are unreachable
+	got = nil
+	for _, inst := range ctl.EndpointsForNetworkView(svc, port, "network-2") {
+		got = append(got, endpoint{inst.Endpoint.Address, inst.Endpoint.EndpointPort, inst.Endpoint.LbWeight})
+	}
+	want = []endpoint{{"2.2.2.1", 80, 0}, {"2.2.2.2", 80, 3}, {"5.5.5.5", 80, 0}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected endpoints from network-2, diff %v", diff)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// ErrRegistriesChanged is returned when paging with a continue token issued before a registry was added or
+// deleted. The caller must restart from the first page.
+var ErrRegistriesChanged = errors.New("registries changed since the continue token was issued")
+
+// ContinueToken is an opaque position in a paged listing. The empty token is the start of the listing when
+// given, and its end when returned.
+type ContinueToken string
+
+// PageOptions configures a page of a paged listing.
+type PageOptions struct {
+	// Limit is the maximum number of instances in the page. Zero or less returns every remaining instance.
+	Limit int
+	// Continue is the token returned with the previous page, empty for the first page.
+	Continue ContinueToken
+}
+
+type pagePosition struct {
+	generation uint64
+	registry   int
+	offset     int
+}
+
+func (p pagePosition) token() ContinueToken {
+	return ContinueToken(fmt.Sprintf("%d/%d/%d", p.generation, p.registry, p.offset))
+}
+
+func parseContinueToken(token ContinueToken) (pagePosition, error) {
+	var p pagePosition
+	if _, err := fmt.Sscanf(string(token), "%d/%d/%d", &p.generation, &p.registry, &p.offset); err != nil {
+		return p, fmt.Errorf("invalid continue token %q: %v", token, err)
+	}
+	if p.registry < 0 || p.offset < 0 {
+		return p, fmt.Errorf("invalid continue token %q", token)
+	}
+	return p, nil
+}
+
+// InstancesByPortPaged lists the instances of InstancesByPort a page at a time, walking the registries in
+// order, so very large services need not be materialized at once. The pages are stable as long as no
+// registry is added or deleted; otherwise ErrRegistriesChanged is returned. Unlike InstancesByPort, the
+// instances are neither deduplicated nor sorted across registries, as that needs the complete listing. Like
+// InstancesByPort, the registries unsynced with Options.RequireSyncedRegistries are skipped, and the labels are
+// matched by the aggregate with Options.CentralLabelMatching.
+//
+// The instances are not kept across pages: every page looks up again all the instances of the registries it
+// covers, including those of the previous pages in the registry it starts in. Listing n instances of a single
+// registry by pages of k thus builds about n*n/k instances, against n for InstancesByPort. Use large pages, or
+// InstancesByPort unless materializing the listing at once is the problem.
+func (c *Controller) InstancesByPortPaged(svc *model.Service, port int, labels labels.Collection,
+	opts PageOptions) ([]*model.ServiceInstance, ContinueToken, error) {
+	registries, generation := c.getRegistriesAndGeneration()
+	pos := pagePosition{generation: generation}
+	if opts.Continue != "" {
+		var err error
+		if pos, err = parseContinueToken(opts.Continue); err != nil {
+			return nil, "", err
+		}
+		if pos.generation != generation {
+			return nil, "", ErrRegistriesChanged
+		}
+	}
+
+	var out []*model.ServiceInstance
+	for ; pos.registry < len(registries); pos.registry, pos.offset = pos.registry+1, 0 {
+		// the registries skipped keep their position, which does not change as they sync
+		if !c.registryServed("InstancesByPortPaged", registries[pos.registry]) {
+			continue
+		}
+		instances := c.registryPageInstances(registries[pos.registry], svc, port, labels)
+		if pos.offset >= len(instances) {
+			continue
+		}
+		instances = instances[pos.offset:]
+		if opts.Limit > 0 && len(out)+len(instances) > opts.Limit {
+			taken := opts.Limit - len(out)
+			out = append(out, instances[:taken]...)
+			pos.offset += taken
+			return out, pos.token(), nil
+		}
+		out = append(out, instances...)
+		if opts.Limit > 0 && len(out) == opts.Limit {
+			// the page is full, but only report a next page if there may be one
+			if pos.registry+1 < len(registries) {
+				return out, pagePosition{generation: generation, registry: pos.registry + 1}.token(), nil
+			}
+			return out, "", nil
+		}
+	}
+	return out, "", nil
+}
+
+// registryPageInstances returns the instances of the registry for a page, with the labels matched as
+// InstancesByPort does.
+func (c *Controller) registryPageInstances(r serviceregistry.Instance, svc *model.Service, port int,
+	lbls labels.Collection) []*model.ServiceInstance {
+	instances := r.InstancesByPort(svc, port, c.registryLabels(lbls))
+	if !c.centralLabelMatching || len(lbls) == 0 {
+		return instances
+	}
+	// match a copy, the slice may be owned by the registry
+	return matchInstanceLabels(append([]*model.ServiceInstance(nil), instances...), lbls)
+}
@@ -0,0 +1,133 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func buildPagingController(svc *model.Service, counts ...int) *Controller {
+	ctl := NewController(Options{SkipInstanceDedup: true, SkipInstanceSort: true})
+	for c, count := range counts {
+		var instances []*model.ServiceInstance
+		for i := 0; i < count; i++ {
+			instances = append(instances, makeInstance(svc, fmt.Sprintf("10.0.%d.%d", c, i), 80, "", nil))
+		}
+		ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, cluster.ID(fmt.Sprintf("cluster-%d", c)), svc, instances...))
+	}
+	return ctl
+}
+
+func TestInstancesByPortPaged(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	ctl := buildPagingController(svc, 5, 0, 7)
+	want := ctl.InstancesByPort(svc, port, nil)
+
+	for _, limit := range []int{0, 1, 3, 4, 5, 12, 20} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			var got []*model.ServiceInstance
+			opts := PageOptions{Limit: limit}
+			for pages := 0; ; pages++ {
+				if pages > len(want) {
+					t.Fatalf("paging did not terminate")
+				}
+				page, next, err := ctl.InstancesByPortPaged(svc, port, nil, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if limit > 0 && len(page) > limit {
+					t.Fatalf("page of %d instances exceeds the limit", len(page))
+				}
+				got = append(got, page...)
+				if next == "" {
+					break
+				}
+				opts.Continue = next
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("paged instances do not match InstancesByPort: got %d, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestInstancesByPortPagedCentralLabelMatching(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	v1 := labels.Instance{"version": "v1"}
+	registry := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc, makeInstance(svc, "10.0.0.1", 80, "", v1),
+		makeInstance(svc, "10.0.0.2", 80, "", nil), makeInstance(svc, "10.0.0.3", 80, "", v1))
+	ctl := NewController(Options{CentralLabelMatching: true, SkipInstanceSort: true})
+	ctl.AddRegistry(registry)
+
+	// the memory registry does not match labels, the aggregate does
+	want := ctl.InstancesByPort(svc, port, labels.Collection{v1})
+	if len(want) != 2 {
+		t.Fatalf("expected 2 instances matching the labels, got %d", len(want))
+	}
+	var got []*model.ServiceInstance
+	opts := PageOptions{Limit: 1}
+	for pages := 0; pages <= len(want); pages++ {
+		page, next, err := ctl.InstancesByPortPaged(svc, port, labels.Collection{v1}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, page...)
+		if next == "" {
+			break
+		}
+		opts.Continue = next
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("paged instances do not match InstancesByPort: got %v, want %v", got, want)
+	}
+	if all := registry.InstancesByPort(svc, port, nil); len(all) != 3 {
+		t.Fatalf("expected the instances of the registry to be left as is, got %d", len(all))
+	}
+}
+
+func TestInstancesByPortPagedRegistriesChanged(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	ctl := buildPagingController(svc, 5, 0, 7)
+
+	page, next, err := ctl.InstancesByPortPaged(svc, port, nil, PageOptions{Limit: 3})
+	if err != nil || len(page) != 3 || next == "" {
+		t.Fatalf("unexpected first page: %d instances, next %q, err %v", len(page), next, err)
+	}
+	ctl.DeleteRegistry("cluster-0", provider.Kubernetes)
+	if _, _, err := ctl.InstancesByPortPaged(svc, port, nil, PageOptions{Limit: 3, Continue: next}); !errors.Is(err, ErrRegistriesChanged) {
+		t.Fatalf("expected ErrRegistriesChanged, got %v", err)
+	}
+	// restarting lists the remaining registries
+	page, next, err = ctl.InstancesByPortPaged(svc, port, nil, PageOptions{})
+	if err != nil || len(page) != 7 || next != "" {
+		t.Fatalf("unexpected restarted page: %d instances, next %q, err %v", len(page), next, err)
+	}
+
+	if _, _, err := ctl.InstancesByPortPaged(svc, port, nil, PageOptions{Continue: "garbage"}); err == nil {
+		t.Fatalf("expected an error for an invalid token")
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/cluster"
+)
+
+// proxyInstancesCache caches the result of GetProxyServiceInstances for each proxy. Entries are
+// invalidated by the events of the registries that were searched to compute them, and the number of
+// entries is bounded since proxies churn.
+type proxyInstancesCache struct {
+	mu      sync.Mutex
+	entries *simplelru.LRU
+	// byIP indexes the cache keys by proxy IP address, for the invalidation on workload events.
+	byIP          map[string]map[string]struct{}
+	invalidations invalidationTokens
+}
+
+type proxyInstancesEntry struct {
+	ips       []string
+	clusterID cluster.ID
+	// searchedAll is set when every registry was searched, through the proxy cluster fallback.
+	searchedAll bool
+	instances   []*model.ServiceInstance
+}
+
+func newProxyInstancesCache(size int) *proxyInstancesCache {
+	pc := &proxyInstancesCache{byIP: map[string]map[string]struct{}{}, invalidations: newInvalidationTokens(size)}
+	entries, err := simplelru.NewLRU(size, func(key, value interface{}) {
+		pc.unindex(key.(string), value.(*proxyInstancesEntry))
+	})
+	if err != nil {
+		panic(err)
+	}
+	pc.entries = entries
+	return pc
+}
+
+// proxyCacheKey identifies the inputs of GetProxyServiceInstances for a proxy.
+func proxyCacheKey(node *model.Proxy) string {
+	return node.ID + "~" + string(nodeClusterID(node)) + "~" + strings.Join(node.IPAddresses, ",")
+}
+
+// get returns a copy of the instances cached for the key, since the callers sort them in place.
+func (pc *proxyInstancesCache) get(key string) ([]*model.ServiceInstance, uint64, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if e, ok := pc.entries.Get(key); ok {
+		return copyInstances(e.(*proxyInstancesEntry).instances), pc.invalidations.token(), true
+	}
+	return nil, pc.invalidations.token(), false
+}
+
+// add stores a copy of the instances computed for a proxy, unless the searched registries or the IP addresses
+// of the proxy were invalidated since token was read.
+func (pc *proxyInstancesCache) add(token uint64, key string, node *model.Proxy, instances []*model.ServiceInstance, searchedAll bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	ips := make([]interface{}, 0, len(node.IPAddresses))
+	for _, ip := range node.IPAddresses {
+		ips = append(ips, ip)
+	}
+	if !pc.invalidations.valid(token, ips...) {
+		return
+	}
+	if old, ok := pc.entries.Peek(key); ok {
+		pc.unindex(key, old.(*proxyInstancesEntry))
+	}
+	e := &proxyInstancesEntry{
+		ips:         append([]string(nil), node.IPAddresses...),
+		clusterID:   nodeClusterID(node),
+		searchedAll: searchedAll,
+		instances:   copyInstances(instances),
+	}
+	pc.entries.Add(key, e)
+	for _, ip := range e.ips {
+		keys := pc.byIP[ip]
+		if keys == nil {
+			keys = map[string]struct{}{}
+			pc.byIP[ip] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+// copyInstances copies the slice, keeping a non-nil empty slice non-nil.
+func copyInstances(instances []*model.ServiceInstance) []*model.ServiceInstance {
+	return append(make([]*model.ServiceInstance, 0, len(instances)), instances...)
+}
+
+func (pc *proxyInstancesCache) unindex(key string, e *proxyInstancesEntry) {
+	for _, ip := range e.ips {
+		if keys := pc.byIP[ip]; keys != nil {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(pc.byIP, ip)
+			}
+		}
+	}
+}
+
+// invalidateIP drops the entries of proxies with the given IP address.
+func (pc *proxyInstancesCache) invalidateIP(ip string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.invalidations.invalidate(ip)
+	for key := range pc.byIP[ip] {
+		pc.entries.Remove(key)
+	}
+}
+
+// invalidateSearched drops the entries that may have been computed from a registry; searched reports
+// whether the registry is searched for a proxy of the given cluster.
+func (pc *proxyInstancesCache) invalidateSearched(searched func(clusterID cluster.ID) bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	// the registry may be searched for any proxy
+	pc.invalidations.invalidateAll()
+	for _, key := range pc.entries.Keys() {
+		e, ok := pc.entries.Peek(key)
+		if !ok {
+			continue
+		}
+		if entry := e.(*proxyInstancesEntry); entry.searchedAll || searched(entry.clusterID) {
+			pc.entries.Remove(key)
+		}
+	}
+}
+
+// clear drops every entry.
+func (pc *proxyInstancesCache) clear() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.invalidations.invalidateAll()
+	pc.entries.Purge()
+	pc.byIP = map[string]map[string]struct{}{}
+}
+
+func (pc *proxyInstancesCache) len() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.entries.Len()
+}
@@ -0,0 +1,172 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// countingDiscovery counts the calls to GetProxyServiceInstances.
+type countingDiscovery struct {
+	*memory.ServiceDiscovery
+	proxyCalls *atomic.Int32
+}
+
+func (d countingDiscovery) GetProxyServiceInstances(node *model.Proxy) []*model.ServiceInstance {
+	d.proxyCalls.Inc()
+	return d.ServiceDiscovery.GetProxyServiceInstances(node)
+}
+
+func newCountingRegistry(r serviceregistry.Simple) (serviceregistry.Simple, *atomic.Int32) {
+	calls := atomic.NewInt32(0)
+	r.ServiceDiscovery = countingDiscovery{ServiceDiscovery: r.ServiceDiscovery.(*memory.ServiceDiscovery), proxyCalls: calls}
+	return r, calls
+}
+
+func TestProxyInstancesCache(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	kube, calls := newCountingRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+		makeInstance(svc, "1.1.1.1", 80, "", labels.Instance{"version": "v1"}),
+		makeInstance(svc, "2.2.2.2", 80, "", labels.Instance{"version": "v1"})))
+	ctl := NewController(Options{ProxyInstancesCacheSize: 10})
+	ctl.AddRegistry(kube)
+
+	proxy1 := &model.Proxy{ID: "p1", IPAddresses: []string{"1.1.1.1"}, Metadata: &model.NodeMetadata{ClusterID: "cluster-1"}}
+	proxy2 := &model.Proxy{ID: "p2", IPAddresses: []string{"2.2.2.2"}, Metadata: &model.NodeMetadata{ClusterID: "cluster-1"}}
+	lookup := func(p *model.Proxy, wantInstances int, wantCalls int32) {
+		t.Helper()
+		if got := ctl.GetProxyServiceInstances(p); len(got) != wantInstances {
+			t.Fatalf("%s: expected %d instances, got %d", p.ID, wantInstances, len(got))
+		}
+		if got := calls.Load(); got != wantCalls {
+			t.Fatalf("%s: expected %d registry calls, got %d", p.ID, wantCalls, got)
+		}
+	}
+
+	lookup(proxy1, 1, 1)
+	lookup(proxy2, 1, 2)
+	// served from the cache
+	lookup(proxy1, 1, 2)
+	lookup(proxy2, 1, 2)
+
+	// a workload change for proxy1 only invalidates proxy1
+	kube.ServiceDiscovery.(countingDiscovery).AddInstance(svc.ClusterLocal.Hostname,
+		makeInstance(svc, "1.1.1.1", 81, "", labels.Instance{"version": "v2"}))
+	fakeControllerOf(kube).fireWorkload(&model.WorkloadInstance{
+		Name:     "p1",
+		Endpoint: &model.IstioEndpoint{Address: "1.1.1.1", Labels: labels.Instance{"version": "v2"}},
+	}, model.EventUpdate)
+	lookup(proxy1, 2, 3)
+	lookup(proxy2, 1, 3)
+
+	// a service change invalidates every proxy of the cluster
+	fakeControllerOf(kube).fireService(svc, model.EventUpdate)
+	lookup(proxy1, 2, 4)
+	lookup(proxy2, 1, 5)
+
+	// adding a registry invalidates everything
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc))
+	lookup(proxy1, 2, 6)
+	if got := ctl.proxyCache.len(); got != 1 {
+		t.Fatalf("expected 1 cache entry, got %d", got)
+	}
+}
+
+func TestProxyInstancesCacheBounded(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{ProxyInstancesCacheSize: 2})
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc))
+	for i := 0; i < 10; i++ {
+		ctl.GetProxyServiceInstances(&model.Proxy{ID: fmt.Sprintf("p%d", i), IPAddresses: []string{fmt.Sprintf("1.1.1.%d", i)}})
+	}
+	if got := ctl.proxyCache.len(); got != 2 {
+		t.Fatalf("expected the cache to be bounded to 2 entries, got %d", got)
+	}
+	if got := len(ctl.proxyCache.byIP); got != 2 {
+		t.Fatalf("expected the IP index to be bounded to 2 entries, got %d", got)
+	}
+}
+
+func BenchmarkGetProxyServiceInstances(b *testing.B) {
+	svc := mock.MakeService("bench.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	for _, bc := range []struct {
+		name string
+		size int
+	}{
+		{"uncached", 0},
+		{"cached", 100},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctl := NewController(Options{ProxyInstancesCacheSize: bc.size})
+			for c := 0; c < 10; c++ {
+				ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc, makeInstance(svc, fmt.Sprintf("10.0.0.%d", c), 80, "", nil)))
+			}
+			proxy := &model.Proxy{ID: "p", IPAddresses: []string{"10.0.0.1"}}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				_ = ctl.GetProxyServiceInstances(proxy)
+			}
+		})
+	}
+}
+
+func TestProxyInstancesCacheCopies(t *testing.T) {
+	// the proxy sorts its instances by service creation, the aggregate by endpoint port
+	older := mock.MakeService("older.default.svc.cluster.local", "10.10.0.1", []string{}, "cluster-1")
+	older.CreationTime = older.CreationTime.Add(-time.Hour)
+	newer := mock.MakeService("newer.default.svc.cluster.local", "10.10.0.2", []string{}, "cluster-1")
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", newer, makeInstance(newer, "1.1.1.1", 80, "", nil))
+	sd := kube.ServiceDiscovery.(*memory.ServiceDiscovery)
+	sd.AddService(older.ClusterLocal.Hostname, older)
+	sd.AddInstance(older.ClusterLocal.Hostname, makeInstance(older, "1.1.1.1", 81, "", nil))
+	ctl := NewController(Options{ProxyInstancesCacheSize: 10})
+	ctl.AddRegistry(kube)
+	newProxy := func() *model.Proxy {
+		return &model.Proxy{ID: "p1", IPAddresses: []string{"1.1.1.1"}, Metadata: &model.NodeMetadata{ClusterID: "cluster-1"}}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				newProxy().SetServiceInstances(ctl)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the callers sorting or modifying their result leave the cached instances as they were
+	got := ctl.GetProxyServiceInstances(newProxy())
+	got[0] = nil
+	got = ctl.GetProxyServiceInstances(newProxy())
+	if len(got) != 2 || got[0] == nil || got[0].Endpoint.EndpointPort != 80 {
+		t.Fatalf("expected the cached instances sorted by port, got %v", got)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+// SyncDetail details the readiness of a registry.
+type SyncDetail struct {
+	Synced bool `json:"synced"`
+	// SecondsSinceAdded is the time since the registry was added to the aggregate.
+	SecondsSinceAdded int64 `json:"secondsSinceAdded"`
+	// LastError is the reason the registry was last found unhealthy, empty if never.
+	LastError string `json:"lastError,omitempty"`
+	// Excluded is why the registry is not waited for by HasSynced, see RegistrySyncStatus.
+	Excluded string `json:"excluded,omitempty"`
+}
+
+// readinessKey is the key of a registry in ReadinessDetails.
+func readinessKey(clusterID cluster.ID, providerID provider.ID) string {
+	return string(providerID) + "/" + string(clusterID)
+}
+
+// ReadinessDetails returns the readiness of every registry, keyed by provider/cluster. It only checks HasSynced
+// on the registries, so that it can be called on every readiness probe.
+func (c *Controller) ReadinessDetails() map[string]SyncDetail {
+	now := c.syncs.now()
+	out := map[string]SyncDetail{}
+	for _, s := range c.SyncStatus() {
+		out[readinessKey(s.Cluster, s.Provider)] = SyncDetail{
+			Synced:            s.Synced,
+			SecondsSinceAdded: int64(now.Sub(s.Added).Seconds()),
+			LastError:         c.health.lastError(registryKey{cluster: s.Cluster, provider: s.Provider}),
+			Excluded:          s.Excluded,
+		}
+	}
+	return out
+}
+
+// ReadinessHandler returns an HTTP handler rendering ReadinessDetails as JSON, with a 503 status while the
+// aggregate has not synced.
+func (c *Controller) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		details := c.ReadinessDetails()
+		by, err := json.MarshalIndent(details, "", "  ")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// like HasSynced, without checking the registries again
+		for _, d := range details {
+			if !d.Synced && d.Excluded == "" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				break
+			}
+		}
+		_, _ = w.Write(by)
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	synced := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	lagging := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	fakeControllerOf(lagging).unsynced.Store(true)
+	ctl := NewController(Options{})
+	now := time.Unix(1000, 0)
+	ctl.syncs.now = func() time.Time { return now }
+	ctl.AddRegistry(synced)
+	now = now.Add(30 * time.Second)
+	ctl.AddRegistry(lagging)
+	// a call to the lagging registry timed out and has returned since
+	key := registryKey{cluster: "cluster-2", provider: provider.Kubernetes}
+	ctl.health.timedOut(key, "GetProxyServiceInstances did not return within 1s")
+	ctl.health.returned(key)
+	now = now.Add(10 * time.Second)
+
+	get := func() (int, map[string]interface{}) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		ctl.ReadinessHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/debug/readinessz", nil))
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("expected a JSON content type, got %q", ct)
+		}
+		got := map[string]interface{}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Code, got
+	}
+
+	code, got := get()
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the status %d while not ready, got %d", http.StatusServiceUnavailable, code)
+	}
+	want := map[string]interface{}{
+		"Kubernetes/cluster-1": map[string]interface{}{"synced": true, "secondsSinceAdded": 40.0},
+		"Kubernetes/cluster-2": map[string]interface{}{
+			"synced":            false,
+			"secondsSinceAdded": 10.0,
+			"lastError":         "GetProxyServiceInstances did not return within 1s",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the readiness %v, got %v", want, got)
+	}
+
+	fakeControllerOf(lagging).unsynced.Store(false)
+	code, got = get()
+	if code != http.StatusOK {
+		t.Fatalf("expected the status %d once ready, got %d", http.StatusOK, code)
+	}
+	if d := got["Kubernetes/cluster-2"].(map[string]interface{}); d["synced"] != true {
+		t.Fatalf("expected the registry to be synced, got %v", d)
+	}
+}
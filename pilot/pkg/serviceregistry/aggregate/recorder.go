@@ -0,0 +1,149 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/host"
+)
+
+// RecorderT is the part of testing.TB used by EventRecorder.
+type RecorderT interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+// EventRecorder records the service and workload events of an aggregate, for tests. The events are those
+// given to AppendServiceHandlerWithSource and AppendWorkloadHandlerWithSource, so each one has the cluster and
+// provider of its registry. It is safe for concurrent use.
+type EventRecorder struct {
+	c         *Controller
+	services  HandlerID
+	workloads HandlerID
+
+	mu     sync.Mutex
+	events []recordedEvent
+	// changed is closed and replaced when an event is recorded.
+	changed chan struct{}
+}
+
+type recordedEvent struct {
+	AggregateEvent
+	// waited is set once the event is returned by a wait.
+	waited bool
+}
+
+// NewEventRecorder starts recording the events of the aggregate, until Close is called.
+func NewEventRecorder(c *Controller) *EventRecorder {
+	r := &EventRecorder{c: c, changed: make(chan struct{})}
+	r.services = c.AppendServiceHandlerWithSource(func(svc *model.Service, event model.Event, clusterID cluster.ID, providerID provider.ID) {
+		r.record(AggregateEvent{Kind: ServiceChanged, Event: event, Service: svc, Cluster: clusterID, Provider: providerID})
+	})
+	r.workloads = c.AppendWorkloadHandlerWithSource(func(wi *model.WorkloadInstance, event model.Event, clusterID cluster.ID, providerID provider.ID) {
+		r.record(AggregateEvent{Kind: WorkloadChanged, Event: event, Workload: wi, Cluster: clusterID, Provider: providerID})
+	})
+	return r
+}
+
+func (r *EventRecorder) record(e AggregateEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, recordedEvent{AggregateEvent: e})
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Close stops recording the events.
+func (r *EventRecorder) Close() {
+	r.c.RemoveServiceHandler(r.services)
+	r.c.RemoveWorkloadHandler(r.workloads)
+}
+
+// Events returns the events recorded so far, in the order they were delivered.
+func (r *EventRecorder) Events() []AggregateEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]AggregateEvent, 0, len(r.events))
+	for _, e := range r.events {
+		out = append(out, e.AggregateEvent)
+	}
+	return out
+}
+
+// WaitForHostname waits for an event of the service with the given hostname, failing the test after the
+// timeout. It returns the first such event not returned by a previous wait.
+func (r *EventRecorder) WaitForHostname(t RecorderT, hostname host.Name, event model.Event, timeout time.Duration) AggregateEvent {
+	t.Helper()
+	e, ok := r.wait(timeout, func(e AggregateEvent) bool {
+		return e.Kind == ServiceChanged && e.Event == event && e.Service.ClusterLocal.Hostname == hostname
+	})
+	if !ok {
+		t.Fatalf("timed out waiting for the %v of the service %s", event, hostname)
+	}
+	return e
+}
+
+// WaitForWorkload is like WaitForHostname, for an event of the workload with the given name.
+func (r *EventRecorder) WaitForWorkload(t RecorderT, name string, event model.Event, timeout time.Duration) AggregateEvent {
+	t.Helper()
+	e, ok := r.wait(timeout, func(e AggregateEvent) bool {
+		return e.Kind == WorkloadChanged && e.Event == event && e.Workload.Name == name
+	})
+	if !ok {
+		t.Fatalf("timed out waiting for the %v of the workload %s", event, name)
+	}
+	return e
+}
+
+func (r *EventRecorder) wait(timeout time.Duration, match func(AggregateEvent) bool) (AggregateEvent, bool) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		r.mu.Lock()
+		for i := range r.events {
+			if e := &r.events[i]; !e.waited && match(e.AggregateEvent) {
+				e.waited = true
+				r.mu.Unlock()
+				return e.AggregateEvent, true
+			}
+		}
+		changed := r.changed
+		r.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return AggregateEvent{}, false
+		}
+	}
+}
+
+// AssertNoEvents waits for the given duration, and fails the test if events not returned by a wait were
+// recorded by then.
+func (r *EventRecorder) AssertNoEvents(t RecorderT, d time.Duration) {
+	t.Helper()
+	time.Sleep(d)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.events {
+		if !e.waited {
+			t.Fatalf("unexpected %v of %s from %s/%s", e.Event, e.subject(), e.Cluster, e.Provider)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+// failures records the failures of a test, instead of failing it.
+type failures struct {
+	messages []string
+}
+
+func (f *failures) Helper() {}
+
+func (f *failures) Fatalf(format string, args ...interface{}) {
+	f.messages = append(f.messages, fmt.Sprintf(format, args...))
+}
+
+func TestEventRecorder(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		clusterID := cluster.ID(fmt.Sprintf("cluster-%d", i))
+		t.Run(string(clusterID), func(t *testing.T) {
+			t.Parallel()
+			svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, clusterID)
+			ctl := NewController(Options{})
+			r := newMemoryRegistry(provider.Kubernetes, clusterID, svc)
+			ctl.AddRegistry(r)
+			recorder := NewEventRecorder(ctl)
+			defer recorder.Close()
+
+			go func() {
+				fakeControllerOf(r).fireService(svc, model.EventAdd)
+				fakeControllerOf(r).fireWorkload(makeWorkload("vm", "default", "10.0.0.1"), model.EventUpdate)
+			}()
+			if e := recorder.WaitForHostname(t, svc.ClusterLocal.Hostname, model.EventAdd, 5*time.Second); e.Cluster != clusterID {
+				t.Errorf("expected the event of %s, got %s", clusterID, e.Cluster)
+			}
+			recorder.WaitForWorkload(t, "vm", model.EventUpdate, 5*time.Second)
+			recorder.AssertNoEvents(t, 10*time.Millisecond)
+
+			// a wait does not return the same event twice
+			f := &failures{}
+			recorder.WaitForHostname(f, svc.ClusterLocal.Hostname, model.EventAdd, 10*time.Millisecond)
+			fakeControllerOf(r).fireService(svc, model.EventDelete)
+			recorder.AssertNoEvents(f, 0)
+			if len(f.messages) != 2 {
+				t.Errorf("expected the wait to time out and the delete to be reported, got %v", f.messages)
+			}
+			if len(recorder.Events()) != 3 {
+				t.Errorf("expected 3 events, got %d", len(recorder.Events()))
+			}
+
+			recorder.Close()
+			fakeControllerOf(r).fireService(svc, model.EventUpdate)
+			if len(recorder.Events()) != 3 {
+				t.Errorf("expected no event once closed, got %d", len(recorder.Events()))
+			}
+		})
+	}
+}
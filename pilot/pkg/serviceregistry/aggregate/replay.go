@@ -0,0 +1,109 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/pkg/log"
+)
+
+// serviceReplay tracks the services given to a replaying handler. Like the dispatch, it is used with the
+// sequence of the hostname held, so the replay of a hostname and its live events are not interleaved.
+type serviceReplay struct {
+	mu sync.Mutex
+	// seen holds the hostnames given to the handler since it was added, by the replay or by a live event. It
+	// is nil once the replay is complete.
+	seen map[host.Name]struct{}
+	// known holds the hostnames of the services the handler was given and not told are deleted.
+	known map[host.Name]struct{}
+}
+
+func newServiceReplay() *serviceReplay {
+	return &serviceReplay{seen: map[host.Name]struct{}{}, known: map[host.Name]struct{}{}}
+}
+
+// replay returns true if the hostname is to be replayed, it has not been given to the handler yet.
+func (r *serviceReplay) replay(hostname host.Name) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, f := r.seen[hostname]; f {
+		return false
+	}
+	r.seen[hostname] = struct{}{}
+	r.known[hostname] = struct{}{}
+	return true
+}
+
+// live adapts a live event of the hostname to what the handler was given. The services are listed ahead of
+// the dispatch of their events, so the replay may give a service before its own add, which becomes an update,
+// or miss a service whose delete is still to be dispatched, which is dropped. An update of a service the
+// handler does not know follows an add.
+func (r *serviceReplay) live(hostname host.Name, event model.Event) (add bool, out model.Event, deliver bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen != nil {
+		r.seen[hostname] = struct{}{}
+	}
+	_, known := r.known[hostname]
+	switch event {
+	case model.EventAdd:
+		r.known[hostname] = struct{}{}
+		if known {
+			return false, model.EventUpdate, true
+		}
+	case model.EventUpdate:
+		r.known[hostname] = struct{}{}
+		return !known, event, true
+	case model.EventDelete:
+		delete(r.known, hostname)
+		return false, event, known
+	}
+	return false, event, true
+}
+
+func (r *serviceReplay) complete() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen = nil
+}
+
+// AppendServiceHandlerWithReplay is like AddServiceHandler, but the handler is first called with an add for
+// every service of the aggregate, before it returns, so that it does not have to list the services itself.
+// The handler is not given a live event of a service before its add, nor a second add: a service updated
+// during the replay is added with the update, and is not replayed again. The aggregate tracks the hostnames
+// given to the handler to do so. As the replay waits for the dispatch of the events, it must not be run from a
+// handler.
+func (c *Controller) AppendServiceHandlerWithReplay(f func(*model.Service, model.Event)) HandlerID {
+	h := &serviceHandler{replay: newServiceReplay(), f: withoutSource(f)}
+	id := c.addServiceHandler(h)
+	// the services are listed once the handler is added, so that the later changes reach it as live events
+	services, err := c.Services()
+	if err != nil {
+		log.Warnf("replaying the services to the handler %s added at %s: %v", h.name, h.site, err)
+	}
+	for _, svc := range services {
+		svc := svc
+		c.sequencer.replay(svc.ClusterLocal.Hostname, func() {
+			if h.replay.replay(svc.ClusterLocal.Hostname) {
+				h.handle(svc, model.EventAdd, "", "")
+			}
+		})
+	}
+	h.replay.complete()
+	return id
+}
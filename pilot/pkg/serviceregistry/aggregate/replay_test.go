@@ -0,0 +1,144 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/config/host"
+)
+
+func TestAppendServiceHandlerWithReplay(t *testing.T) {
+	hostnames := make([]host.Name, 0, 20)
+	for i := 0; i < 20; i++ {
+		hostnames = append(hostnames, host.Name(fmt.Sprintf("svc-%d.default.svc.cluster.local", i)))
+	}
+	r := newMemoryRegistry(provider.Kubernetes, "cluster-1", mock.MakeService(hostnames[0], "10.0.0.0", []string{}, "cluster-1"))
+	sd := r.ServiceDiscovery.(*memory.ServiceDiscovery)
+	sd.EDSUpdater = svcUpdater{}
+	for i, hostname := range hostnames[1:10] {
+		sd.AddService(hostname, mock.MakeService(hostname, fmt.Sprintf("10.0.0.%d", i+1), []string{}, "cluster-1"))
+	}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(r)
+
+	// the registry changes while the handler is added
+	stop, started := make(chan struct{}), make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rnd := rand.New(rand.NewSource(1))
+		for n := 0; ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if n == 100 {
+				close(started)
+			}
+			hostname := hostnames[rnd.Intn(len(hostnames))]
+			svc, _ := sd.GetService(hostname)
+			switch {
+			case svc == nil:
+				svc = mock.MakeService(hostname, fmt.Sprintf("10.1.%d.%d", n/250%250, n%250), []string{}, "cluster-1")
+				sd.AddService(hostname, svc)
+				fakeControllerOf(r).fireService(svc, model.EventAdd)
+			case rnd.Intn(2) == 0:
+				svc = mock.MakeService(hostname, fmt.Sprintf("10.1.%d.%d", n/250%250, n%250), []string{}, "cluster-1")
+				sd.AddService(hostname, svc)
+				fakeControllerOf(r).fireService(svc, model.EventUpdate)
+			default:
+				sd.RemoveService(hostname)
+				fakeControllerOf(r).fireService(svc, model.EventDelete)
+			}
+		}
+	}()
+
+	<-started
+	var mu sync.Mutex
+	seen := map[host.Name]*model.Service{}
+	var errs []string
+	ctl.AppendServiceHandlerWithReplay(func(svc *model.Service, event model.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		hostname := svc.ClusterLocal.Hostname
+		_, known := seen[hostname]
+		switch {
+		case event == model.EventAdd && known:
+			errs = append(errs, fmt.Sprintf("duplicate add of %s", hostname))
+		case event != model.EventAdd && !known:
+			errs = append(errs, fmt.Sprintf("%v of %s before its add", event, hostname))
+		}
+		if event == model.EventDelete {
+			delete(seen, hostname)
+		} else {
+			seen[hostname] = svc
+		}
+	})
+	close(stop)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, err := range errs {
+		t.Error(err)
+	}
+	for _, hostname := range hostnames {
+		want, _ := sd.GetService(hostname)
+		got := seen[hostname]
+		switch {
+		case want == nil && got != nil:
+			t.Errorf("expected %s to be deleted", hostname)
+		case want != nil && got == nil:
+			t.Errorf("expected %s to be added", hostname)
+		case want != nil && got.Address != want.Address:
+			t.Errorf("expected %s at %s, got %s", hostname, want.Address, got.Address)
+		}
+	}
+}
+
+func TestAppendServiceHandlerWithReplayAsync(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{AsyncHandlerQueueSize: 10})
+	r := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl.AddRegistry(r)
+
+	events := make(chan serviceEvent, 10)
+	ctl.AppendServiceHandlerWithReplay(func(svc *model.Service, event model.Event) {
+		events <- serviceEvent{svc, event}
+	})
+	fakeControllerOf(r).fireService(svc, model.EventUpdate)
+	// the replayed add is queued ahead of the update
+	for _, want := range []model.Event{model.EventAdd, model.EventUpdate} {
+		select {
+		case got := <-events:
+			if got.event != want {
+				t.Errorf("expected %v, got %v", want, got.event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the %v", want)
+		}
+	}
+}
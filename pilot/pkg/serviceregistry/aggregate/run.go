@@ -0,0 +1,631 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/pkg/log"
+)
+
+// registryRun is the start of a registry by the aggregate.
+type registryRun struct {
+	// stop, if set, stops the registry instead of the channel given to Run.
+	stop    <-chan struct{}
+	started bool
+	// cancel stops the registry started, for StopRegistry.
+	cancel chan struct{}
+	// stopped is set by StopRegistry, until StartRegistry.
+	stopped bool
+	// state is the state of the registry, and current its run in progress, if any. They are only changed by
+	// setRunState and the start and stop of the registry.
+	state   RunState
+	current *registryGoroutine
+}
+
+// RunState is the state of the run of a registry by the aggregate.
+type RunState string
+
+const (
+	// RunStateNotStarted is the state of a registry not run by the aggregate yet, as the aggregate is not running.
+	RunStateNotStarted RunState = "not-started"
+	// RunStateRunning is the state of a registry whose Run is in progress.
+	RunStateRunning RunState = "running"
+	// RunStateStopped is the state of a registry stopped by StopRegistry, or whose stop channel is closed.
+	RunStateStopped RunState = "stopped"
+	// RunStateDead is the state of a registry whose Run panicked or failed, until it is run again.
+	RunStateDead RunState = "dead"
+)
+
+// RegistryRunning returns the state of the run of the registry, empty if there is no such registry.
+func (c *Controller) RegistryRunning(clusterID cluster.ID, providerID provider.ID) RunState {
+	c.storeLock.RLock()
+	defer c.storeLock.RUnlock()
+	run, f := c.runs[registryKey{cluster: clusterID, provider: providerID}]
+	if !f {
+		return ""
+	}
+	return run.state
+}
+
+// setRunState sets the state of the registry, unless its run g was replaced by a new start.
+func (c *Controller) setRunState(g *registryGoroutine, state RunState) {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	if g.run.current == g {
+		g.run.state = state
+	}
+}
+
+// restartableRegistry is implemented by the registries telling whether their Run can be called again once
+// stopped. The others are assumed to support it.
+type restartableRegistry interface {
+	Restartable() bool
+}
+
+// ErrNotRestartable is returned by StartRegistry for a registry whose Run cannot be called again.
+var ErrNotRestartable = errors.New("the registry cannot be restarted")
+
+// restartError returns why the registry, stopped, cannot be run again, nil if it can.
+func restartError(r serviceregistry.Instance, run *registryRun) error {
+	if rr, ok := r.(restartableRegistry); ok && !rr.Restartable() {
+		return fmt.Errorf("%w: %s of cluster %s", ErrNotRestartable, r.Provider(), r.Cluster())
+	}
+	if run.stop != nil && isClosed(run.stop) {
+		return fmt.Errorf("%w: %s of cluster %s was stopped on its own", ErrNotRestartable, r.Provider(), r.Cluster())
+	}
+	return nil
+}
+
+// Run starts all the controllers. The registries added while running are started by AddRegistry, so that each
+// registry is started exactly once per run, unless it is deleted first. Once stop is closed, Run can be called
+// again with a new stop channel to restart the registries it stopped. Run returns without waiting for the
+// registries to exit, which Shutdown does.
+//
+// With Options.BlockRunUntilSync, the aggregate is only reported running once the registries have synced, or
+// once Options.BlockRunUntilSyncTimeout has expired. The registries added meanwhile are started by AddRegistry
+// as well, and waited for.
+func (c *Controller) Run(stop <-chan struct{}) {
+	c.run(context.Background(), stop)
+}
+
+// RunWithContext is like Run, stopped once the context is done, but returns only once the registries it started
+// have returned. The registries implementing RunWithContext are given a context derived from ctx, the others
+// its done channel. The error is that of the context if its deadline ended the run, and nil if it was canceled.
+func (c *Controller) RunWithContext(ctx context.Context) error {
+	<-c.run(ctx, ctx.Done()).done
+	if err := ctx.Err(); errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return nil
+}
+
+// run runs the registries until stop is closed, and returns the lifecycle it ran.
+func (c *Controller) run(ctx context.Context, stop <-chan struct{}) *runLifecycle {
+	c.storeLock.Lock()
+	if c.lifecycle.ended {
+		c.lifecycle = newRunLifecycle()
+	}
+	lifecycle := c.lifecycle
+	c.stop = stop
+	c.runContext = ctx
+	waitPrimary := c.primaryCluster != "" && c.primarySyncTimeout > 0
+	c.primaryPending = waitPrimary
+	c.notifyLifecycle(LifecycleControllerStarted, "", "")
+	c.watchMeshConfig()
+	c.watchMeshNetworks()
+	c.startRegistries()
+	go c.reportEventAges(stop)
+	if c.stuckSyncThreshold > 0 {
+		go c.watchStuckSyncs(stop)
+	}
+	if !c.blockUntilSync && !waitPrimary {
+		c.running.Store(true)
+	}
+	c.storeLock.Unlock()
+	if waitPrimary {
+		c.waitForPrimary(stop)
+		c.storeLock.Lock()
+		c.primaryPending = false
+		if c.stop == stop {
+			c.startRegistries()
+			if !c.blockUntilSync {
+				c.running.Store(true)
+			}
+		}
+		c.storeLock.Unlock()
+	}
+	if c.blockUntilSync && !c.waitForInitialSync(stop) {
+		c.stopped(stop, lifecycle)
+		return lifecycle
+	}
+	<-stop
+	c.stopped(stop, lifecycle)
+	log.Info("Registry Aggregator terminated")
+	return lifecycle
+}
+
+// startRegistries starts the registries not started yet, those of Options.PrimaryCluster first. The storeLock
+// must be held.
+func (c *Controller) startRegistries() {
+	for _, primary := range []bool{true, false} {
+		for _, r := range c.registries {
+			if (c.primaryCluster != "" && r.Cluster() == c.primaryCluster) == primary {
+				c.startRegistry(registryKey{cluster: r.Cluster(), provider: r.Provider()}, r)
+			}
+		}
+	}
+}
+
+// waitForPrimary waits for the registries of Options.PrimaryCluster to sync, for at most
+// Options.PrimarySyncTimeout, or until stop is closed.
+func (c *Controller) waitForPrimary(stop <-chan struct{}) {
+	expired := make(chan struct{})
+	t := time.AfterFunc(c.primarySyncTimeout, func() { close(expired) })
+	defer t.Stop()
+	for {
+		var unsynced serviceregistry.Instance
+		for _, r := range c.unsyncedRegistries() {
+			if r.Cluster() == c.primaryCluster {
+				unsynced = r
+				break
+			}
+		}
+		if unsynced == nil {
+			return
+		}
+		if !awaitSync(unsynced, stop, expired) {
+			if !isClosed(stop) {
+				log.Warnf("the registries of the primary cluster %s have not synced within %v, starting the other registries",
+					c.primaryCluster, c.primarySyncTimeout)
+			}
+			return
+		}
+	}
+}
+
+// runLifecycle is a run of the aggregate, from Run until its registries have exited once stopped.
+type runLifecycle struct {
+	// registries are the runs of the registries started during the lifecycle.
+	registries sync.WaitGroup
+	done       chan struct{}
+	// ended is set once the stop channel of Run is closed, no registry is then started in the lifecycle.
+	ended bool
+}
+
+func newRunLifecycle() *runLifecycle {
+	return &runLifecycle{done: make(chan struct{})}
+}
+
+// Done returns a channel closed once Run has returned after its stop channel was closed, and all the registries
+// it started have exited, including those run with their own stop channel. Before Run, it returns the channel of
+// the first run. Once closed, it keeps returning it until Run is called again.
+func (c *Controller) Done() <-chan struct{} {
+	c.storeLock.RLock()
+	defer c.storeLock.RUnlock()
+	return c.lifecycle.done
+}
+
+// waitForInitialSync waits for the registries to sync, or for Options.BlockRunUntilSyncTimeout, then reports the
+// aggregate running. It returns false if stop is closed first.
+func (c *Controller) waitForInitialSync(stop <-chan struct{}) bool {
+	var timeout <-chan struct{}
+	if c.blockSyncTimeout > 0 {
+		expired := make(chan struct{})
+		t := time.AfterFunc(c.blockSyncTimeout, func() { close(expired) })
+		defer t.Stop()
+		timeout = expired
+	}
+	if unsynced := c.waitForSync(stop, timeout); len(unsynced) > 0 {
+		if isClosed(stop) {
+			return false
+		}
+		names := make([]string, 0, len(unsynced))
+		for _, r := range unsynced {
+			names = append(names, fmt.Sprintf("%s/%s", r.Provider(), r.Cluster()))
+		}
+		log.Warnf("the registries %v have not synced within %v, running without them", names, c.blockSyncTimeout)
+	}
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	if c.stop == stop {
+		c.running.Store(true)
+	}
+	return true
+}
+
+// stopped resets the run once its stop channel is closed, unless Run was called again meanwhile, and ends its
+// lifecycle. The registries
+// run with the stop channel of Run are started again by the next run, unless they are not restartable. Those run
+// with their own stop channel are left to it: they keep running if it is still open, and cannot be restarted by
+// the aggregate if it is closed.
+func (c *Controller) stopped(stop <-chan struct{}, lifecycle *runLifecycle) {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	if c.stop != stop {
+		return
+	}
+	c.stop = nil
+	c.runContext = nil
+	c.running.Store(false)
+	lifecycle.ended = true
+	go func() {
+		lifecycle.registries.Wait()
+		close(lifecycle.done)
+		c.notifyLifecycle(LifecycleControllerStopped, "", "")
+	}()
+	for key, run := range c.runs {
+		if !run.started {
+			continue
+		}
+		i, f := c.getRegistryIndex(key.cluster, key.provider)
+		if !f {
+			continue
+		}
+		if err := restartError(c.registries[i], run); err != nil {
+			log.Warnf("the aggregate cannot run again %v", err)
+			continue
+		}
+		if run.stop == nil {
+			run.started = false
+			run.cancel = nil
+		}
+	}
+}
+
+// startRegistry runs the registry, unless it was already started. The storeLock must be held.
+func (c *Controller) startRegistry(key registryKey, r serviceregistry.Instance) {
+	run, f := c.runs[key]
+	if !f || run.started || run.stopped {
+		return
+	}
+	if c.stop == nil || isClosed(c.stop) {
+		// the aggregate is stopping, the registry is started by the next Run
+		return
+	}
+	if c.primaryPending && key.cluster != c.primaryCluster {
+		// started once the primary cluster has synced
+		return
+	}
+	if c.shutdowns > 0 {
+		// started once Shutdown returns
+		return
+	}
+	run.started = true
+	stop := run.stop
+	if stop == nil {
+		stop = c.stop
+	}
+	// the registry is stopped by either stop or StopRegistry
+	run.cancel = make(chan struct{})
+	stop = mergeStops(stop, run.cancel)
+	if c.health.revived(key) {
+		c.gatewaySourcesChanged()
+	}
+	g := &registryGoroutine{key: key, run: run, lifecycle: c.lifecycle, ctx: c.runContext}
+	run.current = g
+	run.state = RunStateRunning
+	if len(c.runningRegistries) == 0 {
+		c.registriesExited = make(chan struct{})
+	}
+	c.runningRegistries[g] = struct{}{}
+	g.lifecycle.registries.Add(1)
+	go func() {
+		defer c.registryExited(g)
+		c.runRegistry(g, r, stop)
+	}()
+	if t, _ := c.syncs.observe(key, false); t.synced.IsZero() {
+		go c.watchInitialSync(key, r, stop)
+	}
+}
+
+var (
+	// panickedRegistryBackoff is the wait before the first restart of a registry whose Run panicked, doubled
+	// on each following panic up to maxPanickedRegistryBackoff.
+	panickedRegistryBackoff    = time.Second
+	maxPanickedRegistryBackoff = 5 * time.Minute
+)
+
+// runRegistry runs the registry until stop is closed. When Options.RestartPanickedRegistries is set, the registry
+// is run again after its Run panics, unless stopped or deleted meanwhile.
+func (c *Controller) runRegistry(g *registryGoroutine, r serviceregistry.Instance, stop <-chan struct{}) {
+	key := g.key
+	backoff := panickedRegistryBackoff
+	for c.runRecovered(g, r, stop) && c.restartPanicked {
+		t := time.NewTimer(backoff)
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if backoff *= 2; backoff > maxPanickedRegistryBackoff {
+			backoff = maxPanickedRegistryBackoff
+		}
+		c.storeLock.RLock()
+		current := c.runs[key] == g.run && g.run.current == g && !g.run.stopped
+		c.storeLock.RUnlock()
+		if !current {
+			return
+		}
+		log.Infof("restarting the registry %s of cluster %s after its Run panicked", key.provider, key.cluster)
+		c.health.revived(key)
+		c.gatewaySourcesChanged()
+		c.setRunState(g, RunStateRunning)
+	}
+}
+
+// runRecovered runs the registry, and returns true if its Run panicked. The registry is then reported dead, as
+// it is when its Run fails.
+func (c *Controller) runRecovered(g *registryGoroutine, r serviceregistry.Instance, stop <-chan struct{}) (panicked bool) {
+	key := g.key
+	defer func() {
+		if p := recover(); p != nil {
+			panicked = true
+			c.setRunState(g, RunStateDead)
+			stack := string(debug.Stack())
+			c.health.died(key, fmt.Sprintf("Run panicked: %v", p), stack)
+			c.gatewaySourcesChanged()
+			registryRunPanics.With(clusterTag.Value(string(key.cluster)), providerTag.Value(string(key.provider))).Increment()
+			log.Errorf("the Run of the registry %s of cluster %s panicked: %v\n%s", key.provider, key.cluster, p, stack)
+		}
+	}()
+	var err error
+	switch runner := r.(type) {
+	case contextRunner:
+		ctx, cancel := stopContext(g.ctx, stop)
+		defer cancel()
+		if err = runner.RunWithContext(ctx); errors.Is(err, context.Canceled) {
+			err = nil
+		}
+	case RunnableWithError:
+		err = runner.RunWithError(stop)
+	default:
+		r.Run(stop)
+	}
+	if err != nil {
+		c.runFailed(g, err, stop)
+	}
+	return false
+}
+
+// runFailed reports the registry dead after its Run returned the error, unless it was stopped meanwhile.
+func (c *Controller) runFailed(g *registryGoroutine, err error, stop <-chan struct{}) {
+	key := g.key
+	if isClosed(stop) {
+		log.Debugf("the registry %s of cluster %s returned once stopped: %v", key.provider, key.cluster, err)
+		return
+	}
+	c.setRunState(g, RunStateDead)
+	c.health.died(key, fmt.Sprintf("Run failed: %v", err), "")
+	c.gatewaySourcesChanged()
+	registryRunFailures.With(clusterTag.Value(string(key.cluster)), providerTag.Value(string(key.provider))).Increment()
+	log.Errorf("the Run of the registry %s of cluster %s failed: %v", key.provider, key.cluster, err)
+}
+
+// RunnableWithError is implemented by the registries whose Run can fail, such as when their cluster is not
+// reachable. The aggregate calls RunWithError instead of Run, and reports the registry dead once it returns an
+// error, with the error as the reason given by UnhealthyRegistries; it is not restarted.
+type RunnableWithError interface {
+	RunWithError(stop <-chan struct{}) error
+}
+
+// contextRunner is implemented by the registries running with a context rather than a stop channel. It fails
+// like RunnableWithError, but for returning the error of the context.
+type contextRunner interface {
+	RunWithContext(ctx context.Context) error
+}
+
+// stopContext returns a context derived from the parent, canceled once stop is closed.
+func stopContext(parent context.Context, stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// isClosed returns true if the channel is closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func closedChannel() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// mergeStops returns a channel closed once either a or b is closed.
+func mergeStops(a, b <-chan struct{}) <-chan struct{} {
+	out := make(chan struct{})
+	go func() {
+		select {
+		case <-a:
+		case <-b:
+		}
+		close(out)
+	}()
+	return out
+}
+
+// StopRegistry stops the registry without deleting it, closing the stop channel of its Run, to release its
+// resources while draining its cluster. The registry keeps its place in the aggregate, but is left out of the
+// instance, gateway and service account lookups, and of HasSynced, until StartRegistry.
+func (c *Controller) StopRegistry(clusterID cluster.ID, providerID provider.ID) error {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	run, f := c.runs[registryKey{cluster: clusterID, provider: providerID}]
+	if !f {
+		return fmt.Errorf("%w %s", ErrUnknownCluster, clusterID)
+	}
+	if run.stopped {
+		return nil
+	}
+	run.stopped = true
+	run.state = RunStateStopped
+	c.stoppedRegistries.Inc()
+	c.registriesChanged()
+	c.gatewaySourcesChanged()
+	if run.started {
+		close(run.cancel)
+		run.started = false
+		run.cancel = nil
+	}
+	log.Infof("Registry for the cluster %s has been stopped.", clusterID)
+	return nil
+}
+
+// StartRegistry runs again a registry stopped by StopRegistry, at once if the aggregate is running or with Run
+// otherwise. It returns ErrNotRestartable if the Run of the registry cannot be called again, the registry is then
+// left stopped.
+func (c *Controller) StartRegistry(clusterID cluster.ID, providerID provider.ID) error {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	key := registryKey{cluster: clusterID, provider: providerID}
+	run, f := c.runs[key]
+	i, found := c.getRegistryIndex(clusterID, providerID)
+	if !f || !found {
+		return fmt.Errorf("%w %s", ErrUnknownCluster, clusterID)
+	}
+	if !run.stopped {
+		return nil
+	}
+	if err := restartError(c.registries[i], run); err != nil {
+		return err
+	}
+	run.stopped = false
+	run.state = RunStateNotStarted
+	c.stoppedRegistries.Dec()
+	c.registriesChanged()
+	c.gatewaySourcesChanged()
+	if c.stop != nil {
+		c.startRegistry(key, c.registries[i])
+	}
+	log.Infof("Registry for the cluster %s has been started.", clusterID)
+	return nil
+}
+
+// registriesChanged records a change of the registries served, as they are added, deleted, stopped or started.
+// The storeLock must be held.
+func (c *Controller) registriesChanged() {
+	c.generation++
+	if c.proxyCache != nil {
+		c.proxyCache.clear()
+	}
+	if c.accountsCache != nil {
+		c.accountsCache.clear()
+	}
+	if c.gatewayCache != nil {
+		c.gatewayCache.clear()
+	}
+	if c.gatewayEndpoints != nil {
+		c.gatewayEndpoints.clear()
+	}
+}
+
+// registryStopped returns true if the registry was stopped by StopRegistry.
+func (c *Controller) registryStopped(key registryKey) bool {
+	if c.stoppedRegistries.Load() == 0 {
+		return false
+	}
+	c.storeLock.RLock()
+	defer c.storeLock.RUnlock()
+	run, f := c.runs[key]
+	return f && run.stopped
+}
+
+// registryGoroutine is a run of a registry, not returned yet.
+type registryGoroutine struct {
+	key       registryKey
+	run       *registryRun
+	lifecycle *runLifecycle
+	// ctx is the context of the run of the aggregate, the parent of the one given to a contextRunner.
+	ctx context.Context
+}
+
+func (c *Controller) registryExited(g *registryGoroutine) {
+	c.storeLock.Lock()
+	delete(c.runningRegistries, g)
+	if len(c.runningRegistries) == 0 {
+		close(c.registriesExited)
+	}
+	if g.run.current == g {
+		g.run.current = nil
+		if g.run.state == RunStateRunning {
+			g.run.state = RunStateStopped
+		}
+	}
+	c.storeLock.Unlock()
+	g.lifecycle.registries.Done()
+}
+
+// Shutdown waits for the runs of the registries to return, once their stop channel is closed, so that they are
+// done flushing their queues. It gives up when the context is done, logging the clusters of the registries still
+// running, and returns an error naming them. No registry is started while it waits: the registries added or
+// started meanwhile are started once it returns, if the aggregate is still running.
+func (c *Controller) Shutdown(ctx context.Context) error {
+	c.storeLock.Lock()
+	c.shutdowns++
+	exited := c.registriesExited
+	c.storeLock.Unlock()
+	defer func() {
+		c.storeLock.Lock()
+		defer c.storeLock.Unlock()
+		c.shutdowns--
+		if c.shutdowns == 0 && c.stop != nil {
+			c.startRegistries()
+		}
+	}()
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+	}
+	c.storeLock.RLock()
+	clusters := make([]string, 0, len(c.runningRegistries))
+	for g := range c.runningRegistries {
+		log.Warnf("the registry %s of cluster %s did not exit in time", g.key.provider, g.key.cluster)
+		clusters = append(clusters, string(g.key.cluster))
+	}
+	c.storeLock.RUnlock()
+	sort.Strings(clusters)
+	return fmt.Errorf("the registries of clusters %v did not exit: %v", clusters, ctx.Err())
+}
+
+// Running returns true while Run is running, until its stop channel is closed, and with
+// Options.BlockRunUntilSync once the registries have synced. The registries passed to AddRegistry are started by
+// the aggregate from the call to Run.
+func (c *Controller) Running() bool {
+	return c.running.Load()
+}
@@ -0,0 +1,969 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/network"
+)
+
+// runningRegistry counts the runs of the registry, and those in progress. While running, it adds the services sent to feed.
+type runningRegistry struct {
+	serviceregistry.Simple
+	runs   atomic.Int32
+	active atomic.Int32
+	feed   chan *model.Service
+}
+
+func (r *runningRegistry) Run(stop <-chan struct{}) {
+	r.runs.Inc()
+	r.active.Inc()
+	defer r.active.Dec()
+	for {
+		select {
+		case svc := <-r.feed:
+			fakeControllerOf(r.Simple).fireService(svc, model.EventAdd)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func newRunningRegistry(clusterID cluster.ID) *runningRegistry {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, clusterID)
+	return &runningRegistry{Simple: newMemoryRegistry(provider.Kubernetes, clusterID, svc), feed: make(chan *model.Service, 1)}
+}
+
+// waitForRuns waits for the registry to be run the given number of times, and checks it is not run again.
+func waitForRuns(t *testing.T, r *runningRegistry, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for r.runs.Load() < want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if got := r.runs.Load(); got != want {
+		t.Errorf("expected the registry of %s to be run %d times, got %d", r.Cluster(), want, got)
+	}
+}
+
+func closed() <-chan struct{} {
+	stop := make(chan struct{})
+	close(stop)
+	return stop
+}
+
+func TestRunStartsAddedRegistries(t *testing.T) {
+	ctl := NewController(Options{})
+	before := newRunningRegistry("cluster-1")
+	ctl.AddRegistry(before)
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+	waitForRuns(t, before, 1)
+
+	// a registry added while running is started by the aggregate, with its own stop channel if given
+	after := newRunningRegistry("cluster-2")
+	ctl.AddRegistry(after)
+	waitForRuns(t, after, 1)
+	own := newRunningRegistry("cluster-3")
+	ownStop := make(chan struct{})
+	ctl.AddRegistryAndRun(own, ownStop)
+	waitForRuns(t, own, 1)
+	close(ownStop)
+
+	// the registries already started are not started again by a later run
+	ctl.Run(closed())
+	waitForRuns(t, before, 1)
+	waitForRuns(t, after, 1)
+}
+
+func TestRunConcurrentRegistries(t *testing.T) {
+	const registries = 200
+	ctl := NewController(Options{})
+	stop := make(chan struct{})
+	defer close(stop)
+
+	all := make([]*runningRegistry, registries)
+	deleted := make([]bool, registries)
+	for i := range all {
+		all[i] = newRunningRegistry(cluster.ID(fmt.Sprintf("cluster-%d", i)))
+	}
+	var wg sync.WaitGroup
+	for i := range all {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctl.AddRegistry(all[i])
+			if i%3 == 0 {
+				ctl.DeleteRegistry(all[i].Cluster(), all[i].Provider())
+				deleted[i] = true
+			}
+		}()
+		if i == registries/2 {
+			go ctl.Run(stop)
+		}
+	}
+	wg.Wait()
+	for !ctl.Running() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the registries left are run once, the deleted ones at most once
+	time.Sleep(10 * time.Millisecond)
+	for i, r := range all {
+		if deleted[i] {
+			if r.runs.Load() > 1 {
+				t.Errorf("expected the deleted registry of %s to be run at most once, got %d", r.Cluster(), r.runs.Load())
+			}
+			continue
+		}
+		waitForRuns(t, r, 1)
+	}
+}
+
+func TestRunRestart(t *testing.T) {
+	ctl := NewController(Options{})
+	r := newRunningRegistry("cluster-1")
+	ctl.AddRegistry(r)
+	own := newRunningRegistry("cluster-2")
+	ownStop := make(chan struct{})
+	ctl.AddRegistryAndRun(own, ownStop)
+	recorder := NewEventRecorder(ctl)
+	defer recorder.Close()
+
+	run := func() (chan struct{}, chan struct{}) {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			ctl.Run(stop)
+			close(done)
+		}()
+		return stop, done
+	}
+	stop, done := run()
+	waitForRuns(t, r, 1)
+	waitForRuns(t, own, 1)
+	if !ctl.Running() {
+		t.Fatal("expected the aggregate to be running")
+	}
+	r.feed <- mock.MakeService("first.default.svc.cluster.local", "10.10.0.1", []string{}, "cluster-1")
+	recorder.WaitForHostname(t, "first.default.svc.cluster.local", model.EventAdd, 5*time.Second)
+
+	close(stop)
+	close(ownStop)
+	<-done
+	if ctl.Running() {
+		t.Fatal("expected the aggregate to be stopped")
+	}
+	for r.active.Load() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the registry is stopped, and does not add the service until restarted
+	r.feed <- mock.MakeService("second.default.svc.cluster.local", "10.10.0.2", []string{}, "cluster-1")
+	recorder.AssertNoEvents(t, 50*time.Millisecond)
+
+	stop, done = run()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	recorder.WaitForHostname(t, "second.default.svc.cluster.local", model.EventAdd, 5*time.Second)
+	if !ctl.Running() {
+		t.Fatal("expected the aggregate to be running again")
+	}
+	waitForRuns(t, r, 2)
+	// the registry stopped on its own is not restarted
+	waitForRuns(t, own, 1)
+}
+
+// exitingRegistry takes exit to return once stopped.
+type exitingRegistry struct {
+	serviceregistry.Simple
+	exit   time.Duration
+	exited atomic.Bool
+}
+
+func (r *exitingRegistry) Run(stop <-chan struct{}) {
+	<-stop
+	time.Sleep(r.exit)
+	r.exited.Store(true)
+}
+
+func TestShutdown(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	fast := &exitingRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc), exit: 10 * time.Millisecond}
+	slow := &exitingRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-2", svc), exit: time.Second}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(fast)
+	stop := make(chan struct{})
+	go ctl.Run(stop)
+	ctl.AddRegistry(slow)
+	for !ctl.Running() {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := ctl.Shutdown(ctx)
+	if err == nil || !strings.Contains(err.Error(), "cluster-2") || strings.Contains(err.Error(), "cluster-1") {
+		t.Fatalf("expected the shutdown to time out on cluster-2 only, got %v", err)
+	}
+	if !fast.exited.Load() || slow.exited.Load() {
+		t.Fatalf("expected only the fast registry to be exited, got %v and %v", fast.exited.Load(), slow.exited.Load())
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ctl.Shutdown(ctx); err != nil {
+		t.Fatalf("expected the shutdown to wait for the slow registry, got %v", err)
+	}
+	if !slow.exited.Load() {
+		t.Fatal("expected the slow registry to be exited")
+	}
+}
+
+// hungRegistry does not return from its Run until released, ignoring its stop channel.
+type hungRegistry struct {
+	serviceregistry.Simple
+	release chan struct{}
+}
+
+func (r *hungRegistry) Run(<-chan struct{}) {
+	<-r.release
+}
+
+func TestShutdownHungRegistry(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	hung := &hungRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc), release: make(chan struct{})}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(hung)
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+	for ctl.RegistryRunning("cluster-1", provider.Kubernetes) != RunStateRunning {
+		time.Sleep(time.Millisecond)
+	}
+	if err := ctl.StopRegistry("cluster-1", provider.Kubernetes); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("timing out leaves no goroutine behind", func(t *testing.T) {
+		before := runtime.NumGoroutine()
+		for i := 0; i < 20; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			err := ctl.Shutdown(ctx)
+			cancel()
+			if err == nil || !strings.Contains(err.Error(), "cluster-1") {
+				t.Fatalf("expected the shutdown to time out on cluster-1, got %v", err)
+			}
+		}
+		// allow for the goroutines of the test framework and of the contexts returning
+		if after := runtime.NumGoroutine(); after >= before+10 {
+			t.Fatalf("expected the timed out shutdowns not to leak goroutines, got %d then %d", before, after)
+		}
+	})
+
+	t.Run("no registry started while waiting", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- ctl.Shutdown(ctx)
+		}()
+		for {
+			ctl.storeLock.RLock()
+			waiting := ctl.shutdowns > 0
+			ctl.storeLock.RUnlock()
+			if waiting {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-2", svc))
+		if got := ctl.RegistryRunning("cluster-2", provider.Kubernetes); got != RunStateNotStarted {
+			t.Fatalf("expected the registry not to be started during the shutdown, got %q", got)
+		}
+		cancel()
+		if err := <-done; err == nil {
+			t.Fatal("expected the shutdown to give up on the hung registry")
+		}
+		// started once the shutdown returned, as the aggregate is still running
+		if got := ctl.RegistryRunning("cluster-2", provider.Kubernetes); got == RunStateNotStarted {
+			t.Fatalf("expected the registry to be started after the shutdown, got %q", got)
+		}
+	})
+
+	close(hung.release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ctl.Shutdown(ctx); err != nil {
+		t.Fatalf("expected the shutdown to wait for the released registry, got %v", err)
+	}
+}
+
+// panickingRegistry panics in its Run when told to.
+type panickingRegistry struct {
+	serviceregistry.Simple
+	runs  atomic.Int32
+	panic chan struct{}
+}
+
+func (r *panickingRegistry) Run(stop <-chan struct{}) {
+	r.runs.Inc()
+	select {
+	case <-r.panic:
+		panic("boom")
+	case <-stop:
+	}
+}
+
+func newPanickingRegistry(clusterID cluster.ID) *panickingRegistry {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, clusterID)
+	r := &panickingRegistry{Simple: newMemoryRegistry(provider.Kubernetes, clusterID, svc), panic: make(chan struct{})}
+	fakeControllerOf(r.Simple).unsynced.Store(true)
+	return r
+}
+
+func waitForHealth(t *testing.T, ctl *Controller, want int) []RegistryHealth {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ctl.UnhealthyRegistries()) != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	got := ctl.UnhealthyRegistries()
+	if len(got) != want {
+		t.Fatalf("expected %d unhealthy registries, got %+v", want, got)
+	}
+	return got
+}
+
+func TestRunPanickedRegistry(t *testing.T) {
+	before := getCounterTotal(t, "pilot_aggregate_registry_run_panics")
+	ctl := NewController(Options{})
+	r := newPanickingRegistry("cluster-1")
+	ctl.AddRegistry(r)
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+	for r.runs.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if ctl.HasSynced() {
+		t.Fatal("expected the aggregate not to be synced while the registry is syncing")
+	}
+
+	r.panic <- struct{}{}
+	health := waitForHealth(t, ctl, 1)[0]
+	if health.Cluster != "cluster-1" || !strings.Contains(health.Reason, "boom") || !strings.Contains(health.Stack, "panickingRegistry") {
+		t.Fatalf("expected the registry to be reported dead with the panic, got %+v", health)
+	}
+	if got := ctl.SyncStatus()[0].Excluded; got != "dead" {
+		t.Fatalf("expected the registry to be excluded from the sync as dead, got %q", got)
+	}
+	if !ctl.HasSynced() {
+		t.Fatal("expected the aggregate to be synced without the dead registry")
+	}
+	if got := getCounterTotal(t, "pilot_aggregate_registry_run_panics") - before; got != 1 {
+		t.Fatalf("expected 1 panic to be counted, got %v", got)
+	}
+	// the registry is not run again
+	time.Sleep(20 * time.Millisecond)
+	if got := r.runs.Load(); got != 1 {
+		t.Fatalf("expected the dead registry not to be run again, got %d runs", got)
+	}
+}
+
+func TestRestartPanickedRegistries(t *testing.T) {
+	defer func(b time.Duration) { panickedRegistryBackoff = b }(panickedRegistryBackoff)
+	panickedRegistryBackoff = 10 * time.Millisecond
+	ctl := NewController(Options{RestartPanickedRegistries: true})
+	r := newPanickingRegistry("cluster-1")
+	ctl.AddRegistry(r)
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+
+	for i := int32(1); i <= 2; i++ {
+		for r.runs.Load() != i {
+			time.Sleep(time.Millisecond)
+		}
+		waitForHealth(t, ctl, 0)
+		r.panic <- struct{}{}
+	}
+	// the registry is run again after each panic, and is healthy once running
+	for r.runs.Load() != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	waitForHealth(t, ctl, 0)
+}
+
+func waitForRunning(t *testing.T, ctl *Controller, timeout time.Duration) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !ctl.Running() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return ctl.Running()
+}
+
+func TestBlockRunUntilSync(t *testing.T) {
+	ctl := NewController(Options{BlockRunUntilSync: true})
+	first := newRunningRegistry("cluster-1")
+	fakeControllerOf(first.Simple).unsynced.Store(true)
+	ctl.AddRegistry(first)
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+
+	// the registries are started at once, including those added during the wait, but not reported running
+	waitForRuns(t, first, 1)
+	second := newRunningRegistry("cluster-2")
+	fakeControllerOf(second.Simple).unsynced.Store(true)
+	ctl.AddRegistry(second)
+	waitForRuns(t, second, 1)
+	fakeControllerOf(first.Simple).unsynced.Store(false)
+	if waitForRunning(t, ctl, 3*syncPollInterval) {
+		t.Fatal("expected the aggregate not to be running while a registry is syncing")
+	}
+	fakeControllerOf(second.Simple).unsynced.Store(false)
+	if !waitForRunning(t, ctl, 5*time.Second) {
+		t.Fatal("expected the aggregate to be running once synced")
+	}
+}
+
+func TestBlockRunUntilSyncTimeout(t *testing.T) {
+	ctl := NewController(Options{BlockRunUntilSync: true, BlockRunUntilSyncTimeout: 50 * time.Millisecond})
+	r := newRunningRegistry("cluster-1")
+	fakeControllerOf(r.Simple).unsynced.Store(true)
+	ctl.AddRegistry(r)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ctl.Run(stop)
+		close(done)
+	}()
+
+	start := time.Now()
+	if !waitForRunning(t, ctl, 5*time.Second) {
+		t.Fatal("expected the aggregate to be running once the wait timed out")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("expected the aggregate to wait for the sync, running after %v", elapsed)
+	}
+	close(stop)
+	<-done
+	if ctl.Running() {
+		t.Fatal("expected the aggregate to be stopped")
+	}
+}
+
+// oneShotRegistry cannot be run again once stopped.
+type oneShotRegistry struct {
+	*runningRegistry
+}
+
+func (r oneShotRegistry) Restartable() bool { return false }
+
+func TestStopRegistry(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	r := &runningRegistry{
+		Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc, makeInstance(svc, "10.0.0.1", 80, "", nil)),
+		feed:   make(chan *model.Service, 1),
+	}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(r)
+	if err := ctl.StopRegistry("cluster-1", provider.Kubernetes); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+	// the stopped registry is not started by Run
+	time.Sleep(10 * time.Millisecond)
+	if got := r.runs.Load(); got != 0 {
+		t.Fatalf("expected the stopped registry not to be run, got %d runs", got)
+	}
+
+	for i := int32(1); i <= 2; i++ {
+		if err := ctl.StartRegistry("cluster-1", provider.Kubernetes); err != nil {
+			t.Fatal(err)
+		}
+		waitForRuns(t, r, i)
+		if got := ctl.InstancesByPort(svc, 80, nil); len(got) != 1 {
+			t.Fatalf("expected the instance of the started registry, got %v", got)
+		}
+		if err := ctl.StopRegistry("cluster-1", provider.Kubernetes); err != nil {
+			t.Fatal(err)
+		}
+		for r.active.Load() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		// the stopped registry keeps its place, but is not served nor waited for
+		if got := len(ctl.GetRegistries()); got != 1 {
+			t.Fatalf("expected the stopped registry to be kept, got %d registries", got)
+		}
+		if got := ctl.InstancesByPort(svc, 80, nil); len(got) != 0 {
+			t.Fatalf("expected no instance of the stopped registry, got %v", got)
+		}
+		if got := ctl.SyncStatus()[0].Excluded; got != "stopped" {
+			t.Fatalf("expected the registry to be excluded from the sync as stopped, got %q", got)
+		}
+	}
+
+	if err := ctl.StopRegistry("cluster-2", provider.Kubernetes); !errors.Is(err, ErrUnknownCluster) {
+		t.Fatalf("expected an unknown cluster error, got %v", err)
+	}
+	oneShot := oneShotRegistry{newRunningRegistry("cluster-2")}
+	ctl.AddRegistry(oneShot)
+	waitForRuns(t, oneShot.runningRegistry, 1)
+	if err := ctl.StopRegistry("cluster-2", provider.Kubernetes); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.StartRegistry("cluster-2", provider.Kubernetes); !errors.Is(err, ErrNotRestartable) {
+		t.Fatalf("expected a not restartable error, got %v", err)
+	}
+	waitForRuns(t, oneShot.runningRegistry, 1)
+}
+
+func TestStopRegistryLookups(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	ctl := NewController(Options{})
+	for _, clusterID := range []cluster.ID{"cluster-1", "cluster-2"} {
+		// the instances of the two networks are not merged
+		nw := network.ID("network-" + strings.TrimPrefix(string(clusterID), "cluster-"))
+		r := newMemoryRegistry(provider.Kubernetes, clusterID, svc, makeInstance(svc, "1.1.1.1", 80, nw, nil))
+		r.ServiceDiscovery.(*memory.ServiceDiscovery).AddWorkload("1.1.1.1", labels.Instance{"cluster": string(clusterID)})
+		ctl.AddRegistry(r)
+	}
+	proxy := &model.Proxy{IPAddresses: []string{"1.1.1.1"}, Metadata: &model.NodeMetadata{}}
+	// expect checks the lookups serve the instances of the given number of registries, and the labels of the
+	// given cluster, the first served
+	expect := func(want int, labelsCluster cluster.ID) {
+		t.Helper()
+		if got := ctl.GetInstancesByIP("1.1.1.1"); len(got) != want {
+			t.Fatalf("GetInstancesByIP: expected %d instances, got %v", want, got)
+		}
+		if got, _, err := ctl.InstancesByPortPaged(svc, 80, nil, PageOptions{}); err != nil || len(got) != want {
+			t.Fatalf("InstancesByPortPaged: expected %d instances, got %v, %v", want, got, err)
+		}
+		if got := ctl.GetProxyWorkloadLabels(proxy); len(got) != 1 || got[0]["cluster"] != string(labelsCluster) {
+			t.Fatalf("GetProxyWorkloadLabels: expected the labels of %s, got %v", labelsCluster, got)
+		}
+	}
+
+	expect(2, "cluster-1")
+	if err := ctl.StopRegistry("cluster-1", provider.Kubernetes); err != nil {
+		t.Fatal(err)
+	}
+	expect(1, "cluster-2")
+	if err := ctl.StartRegistry("cluster-1", provider.Kubernetes); err != nil {
+		t.Fatal(err)
+	}
+	expect(2, "cluster-1")
+}
+
+func TestRegistryRunning(t *testing.T) {
+	ctl := NewController(Options{})
+	r := newPanickingRegistry("cluster-1")
+	expect := func(want RunState) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for ctl.RegistryRunning("cluster-1", provider.Kubernetes) != want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := ctl.RegistryRunning("cluster-1", provider.Kubernetes); got != want {
+			t.Fatalf("expected the registry to be %q, got %q", want, got)
+		}
+		if got := ctl.SyncStatus()[0].Run; got != want {
+			t.Fatalf("expected the sync status of the registry to be %q, got %q", want, got)
+		}
+	}
+	if got := ctl.RegistryRunning("cluster-1", provider.Kubernetes); got != "" {
+		t.Fatalf("expected no state for an unknown registry, got %q", got)
+	}
+	ctl.AddRegistry(r)
+	expect(RunStateNotStarted)
+
+	run := func() (chan struct{}, chan struct{}) {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			ctl.Run(stop)
+			close(done)
+		}()
+		return stop, done
+	}
+	stop, done := run()
+	expect(RunStateRunning)
+	if err := ctl.StopRegistry("cluster-1", provider.Kubernetes); err != nil {
+		t.Fatal(err)
+	}
+	expect(RunStateStopped)
+	// the Run of the stopped registry returns
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ctl.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.StartRegistry("cluster-1", provider.Kubernetes); err != nil {
+		t.Fatal(err)
+	}
+	expect(RunStateRunning)
+	r.panic <- struct{}{}
+	expect(RunStateDead)
+
+	// the aggregate stopped and run again runs the dead registry again
+	close(stop)
+	<-done
+	expect(RunStateDead)
+	stop, done = run()
+	expect(RunStateRunning)
+	close(stop)
+	<-done
+	expect(RunStateStopped)
+}
+
+func TestDone(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	r := &exitingRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc), exit: 50 * time.Millisecond}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(r)
+
+	// the channel of the first run is returned before Run, and is not closed until it is done
+	done := ctl.Done()
+	time.Sleep(10 * time.Millisecond)
+	if isClosed(done) {
+		t.Fatal("expected the aggregate not to be done before Run")
+	}
+	stop := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		ctl.Run(stop)
+		close(returned)
+	}()
+	for !ctl.Running() {
+		time.Sleep(time.Millisecond)
+	}
+	if ctl.Done() != done {
+		t.Fatal("expected Run to use the channel returned before it")
+	}
+	close(stop)
+	<-returned
+	// Run returns once stopped, the aggregate is done once the registry has exited
+	if isClosed(done) && !r.exited.Load() {
+		t.Fatal("expected the aggregate not to be done before the registry has exited")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the aggregate to be done")
+	}
+	if !r.exited.Load() {
+		t.Fatal("expected the registry to have exited once the aggregate is done")
+	}
+	if ctl.Done() != done {
+		t.Fatal("expected the closed channel until Run is called again")
+	}
+
+	// a new run has its own channel
+	stop = make(chan struct{})
+	go ctl.Run(stop)
+	for !ctl.Running() {
+		time.Sleep(time.Millisecond)
+	}
+	if next := ctl.Done(); next == done || isClosed(next) {
+		t.Fatal("expected a new channel for the new run")
+	}
+	close(stop)
+	select {
+	case <-ctl.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the aggregate to be done")
+	}
+}
+
+func TestDoneNeverRun(t *testing.T) {
+	ctl := NewController(Options{})
+	ctl.AddRegistry(newRunningRegistry("cluster-1"))
+	time.Sleep(10 * time.Millisecond)
+	if isClosed(ctl.Done()) {
+		t.Fatal("expected the aggregate never run not to be done")
+	}
+}
+
+// informerRegistry only knows its services once run and synced, like a registry based on informers.
+type informerRegistry struct {
+	*runningRegistry
+}
+
+func (r informerRegistry) Services() ([]*model.Service, error) {
+	if r.runs.Load() == 0 || !r.HasSynced() {
+		return nil, nil
+	}
+	return r.runningRegistry.Services()
+}
+
+func TestRunPrimaryClusterFirst(t *testing.T) {
+	ctl := NewController(Options{PrimaryCluster: "primary", PrimarySyncTimeout: 5 * time.Second})
+	remote := informerRegistry{newRunningRegistry("remote")}
+	primary := informerRegistry{newRunningRegistry("primary")}
+	for _, r := range []informerRegistry{remote, primary} {
+		fakeControllerOf(r.Simple).unsynced.Store(true)
+		ctl.AddRegistry(r)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+
+	// the remote registry, added first, is started once the primary has synced
+	waitForRuns(t, primary.runningRegistry, 1)
+	waitForRuns(t, remote.runningRegistry, 0)
+	if ctl.Running() {
+		t.Fatal("expected the aggregate not to be running before the primary has synced")
+	}
+	fakeControllerOf(primary.Simple).unsynced.Store(false)
+	waitForRuns(t, remote.runningRegistry, 1)
+	services, _ := ctl.Services()
+	if len(services) != 1 || services[0].ClusterLocal.ClusterVIPs.GetAddressesFor("primary") == nil {
+		t.Fatalf("expected the service of the primary cluster, got %v", services)
+	}
+	if !waitForRunning(t, ctl, 5*time.Second) {
+		t.Fatal("expected the aggregate to be running")
+	}
+}
+
+func TestRunPrimaryClusterTimeout(t *testing.T) {
+	ctl := NewController(Options{PrimaryCluster: "primary", PrimarySyncTimeout: 20 * time.Millisecond})
+	remote := newRunningRegistry("remote")
+	primary := newRunningRegistry("primary")
+	fakeControllerOf(primary.Simple).unsynced.Store(true)
+	ctl.AddRegistry(remote)
+	ctl.AddRegistry(primary)
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+	// the primary never syncs, the remote registry is started after the timeout
+	waitForRuns(t, remote, 1)
+	waitForRuns(t, primary, 1)
+}
+
+type contextKey struct{}
+
+// contextRegistry runs with a context, recording its value for contextKey.
+type contextRegistry struct {
+	*runningRegistry
+	value atomic.Value
+}
+
+func (r *contextRegistry) RunWithContext(ctx context.Context) error {
+	r.value.Store(ctx.Value(contextKey{}))
+	r.runningRegistry.Run(ctx.Done())
+	time.Sleep(20 * time.Millisecond)
+	return ctx.Err()
+}
+
+func TestRunWithContext(t *testing.T) {
+	plain := newRunningRegistry("cluster-1")
+	withContext := &contextRegistry{runningRegistry: newRunningRegistry("cluster-2")}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(plain)
+	ctl.AddRegistry(withContext)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey{}, "value"))
+	returned := make(chan error, 1)
+	go func() {
+		returned <- ctl.RunWithContext(ctx)
+	}()
+	waitForRuns(t, plain, 1)
+	waitForRuns(t, withContext.runningRegistry, 1)
+	if got := withContext.value.Load(); got != "value" {
+		t.Fatalf("expected the registry to be given a context derived from the one of the aggregate, got %v", got)
+	}
+
+	cancel()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatalf("expected no error once canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for RunWithContext to return")
+	}
+	// the registries have returned
+	if plain.active.Load() != 0 || withContext.active.Load() != 0 || !isClosed(ctl.Done()) || ctl.Running() {
+		t.Fatal("expected the aggregate and its registries to be stopped")
+	}
+
+	// the aggregate runs again with a new context, and reports its deadline
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ctl.RunWithContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be reported, got %v", err)
+	}
+	waitForRuns(t, plain, 2)
+	if withContext.active.Load() != 0 {
+		t.Fatal("expected the registry to be stopped")
+	}
+}
+
+func TestAddRegistryDuringStop(t *testing.T) {
+	var notStarted int
+	for i := 0; i < 2000; i++ {
+		ctl := NewController(Options{})
+		ctl.AddRegistry(newRunningRegistry("cluster-1"))
+		late := newRunningRegistry("cluster-2")
+		stop := make(chan struct{})
+		returned := make(chan struct{})
+		go func() {
+			ctl.Run(stop)
+			close(returned)
+		}()
+		for !ctl.Running() {
+			runtime.Gosched()
+		}
+		// the addition and the stop race once the gate is open
+		gate := make(chan struct{})
+		added := make(chan struct{})
+		go func() {
+			<-gate
+			ctl.AddRegistry(late)
+			close(added)
+		}()
+		go func() {
+			<-gate
+			close(stop)
+		}()
+		close(gate)
+		<-added
+		<-returned
+		<-ctl.Done()
+
+		// the registry is either started before the stop and stopped, or left not started
+		if late.active.Load() != 0 {
+			t.Fatalf("iteration %d: expected the registry added during the stop not to be running", i)
+		}
+		switch state := ctl.RegistryRunning("cluster-2", provider.Kubernetes); state {
+		case RunStateNotStarted:
+			notStarted++
+		case RunStateStopped:
+		default:
+			t.Fatalf("iteration %d: unexpected state %q of the registry added during the stop", i, state)
+		}
+		ctl.DeleteRegistry("cluster-2", provider.Kubernetes)
+		if len(ctl.GetRegistries()) != 1 {
+			t.Fatalf("iteration %d: expected the registry to be deleted", i)
+		}
+	}
+	t.Logf("%d registries added once stopped", notStarted)
+}
+
+func TestRegistryAddedOnceStoppedStartsOnNextRun(t *testing.T) {
+	ctl := NewController(Options{})
+	stop := make(chan struct{})
+	ctl.storeLock.Lock()
+	// the stop channel is closed, but Run has not returned yet
+	ctl.stop = closed()
+	ctl.storeLock.Unlock()
+	r := newRunningRegistry("cluster-1")
+	ctl.AddRegistry(r)
+	time.Sleep(10 * time.Millisecond)
+	if r.runs.Load() != 0 || ctl.RegistryRunning("cluster-1", provider.Kubernetes) != RunStateNotStarted {
+		t.Fatal("expected the registry not to be started once stop is closed")
+	}
+	ctl.storeLock.Lock()
+	ctl.stop = nil
+	ctl.storeLock.Unlock()
+
+	go ctl.Run(stop)
+	defer close(stop)
+	waitForRuns(t, r, 1)
+}
+
+// failingRegistry fails its Run once started, or returns once stopped.
+type failingRegistry struct {
+	serviceregistry.Simple
+	err error
+}
+
+func (r *failingRegistry) RunWithError(stop <-chan struct{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	<-stop
+	return errors.New("stopped")
+}
+
+func TestRunWithErrorFailure(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	failing := &failingRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc), err: errors.New("bad kubeconfig")}
+	fakeControllerOf(failing.Simple).unsynced.Store(true)
+	healthy := &failingRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)}
+	plain := newRunningRegistry("cluster-3")
+	ctl := NewController(Options{})
+	ctl.AddRegistry(failing)
+	ctl.AddRegistry(healthy)
+	ctl.AddRegistry(plain)
+	stop := make(chan struct{})
+	go ctl.Run(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ctl.RegistryRunning("cluster-1", provider.Kubernetes) != RunStateDead {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the registry to fail, got %q", ctl.RegistryRunning("cluster-1", provider.Kubernetes))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	waitForRuns(t, plain, 1)
+	health := ctl.UnhealthyRegistries()
+	if len(health) != 1 || health[0].Cluster != "cluster-1" || health[0].Reason != "Run failed: bad kubeconfig" {
+		t.Fatalf("expected the failed registry to be reported with its error, got %+v", health)
+	}
+	// the failed registry is not waited for
+	if !ctl.HasSynced() {
+		t.Fatal("expected the aggregate to be synced without the failed registry")
+	}
+	for _, id := range []cluster.ID{"cluster-2", "cluster-3"} {
+		if state := ctl.RegistryRunning(id, provider.Kubernetes); state != RunStateRunning {
+			t.Fatalf("expected the registry of %s to be running, got %q", id, state)
+		}
+	}
+
+	// the error returned once stopped is not a failure
+	close(stop)
+	<-ctl.Done()
+	if state := ctl.RegistryRunning("cluster-2", provider.Kubernetes); state != RunStateStopped {
+		t.Fatalf("expected the registry to be stopped, got %q", state)
+	}
+	if health := ctl.UnhealthyRegistries(); len(health) != 1 {
+		t.Fatalf("expected only the failed registry to be unhealthy, got %+v", health)
+	}
+}
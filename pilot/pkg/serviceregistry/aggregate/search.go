@@ -0,0 +1,87 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+// Search identifies a kind of lookup that the aggregate controller may scope to a single cluster.
+type Search string
+
+const (
+	// SearchProxyInstances finds the service instances co-located with a proxy.
+	// Kubernetes registries of other clusters are skipped; other registries are always searched, since
+	// ServiceEntry stores may hold workloads of any cluster.
+	SearchProxyInstances Search = "ProxyInstances"
+	// SearchWorkloadLabels finds the workload labels of a proxy.
+	// Only the registries of the cluster are searched, whatever their provider.
+	SearchWorkloadLabels Search = "WorkloadLabels"
+	// SearchInstances finds the instances of a service in a cluster.
+	// Only the registries of the cluster are searched, whatever their provider: ServiceEntry stores with no
+	// cluster are skipped as well.
+	SearchInstances Search = "Instances"
+)
+
+// SearchDecision explains whether a registry is searched by a lookup scoped to a cluster.
+type SearchDecision struct {
+	Cluster  cluster.ID  `json:"cluster"`
+	Provider provider.ID `json:"provider"`
+	Skip     bool        `json:"skip"`
+	Reason   string      `json:"reason"`
+}
+
+// skipRegistry decides whether registry r can be skipped by the given search scoped to clusterID,
+// and explains why. An empty clusterID searches every registry.
+func (c *Controller) skipRegistry(search Search, clusterID cluster.ID, r serviceregistry.Instance) (bool, string) {
+	if clusterID == "" {
+		return false, "no cluster requested"
+	}
+	switch search {
+	case SearchWorkloadLabels:
+		if r.Cluster() != clusterID {
+			return true, "workload labels are only read from registries of the requested cluster"
+		}
+	case SearchInstances:
+		if r.Cluster() != clusterID {
+			return true, "service instances are only read from registries of the requested cluster"
+		}
+	default:
+		if !isClusterScoped(r) {
+			return false, "non-Kubernetes registries are searched for every cluster"
+		}
+		if skipSearchingRegistryForProxy(clusterID, r) {
+			if r.Provider() != provider.Kubernetes {
+				return true, "cluster-scoped registry of a different cluster"
+			}
+			return true, "Kubernetes registry of a different cluster"
+		}
+	}
+	return false, "registry of the requested cluster"
+}
+
+// ExplainSearch reports, for every registry, whether it is searched by the given kind of lookup scoped to
+// clusterID, and why. It is intended for debugging.
+func (c *Controller) ExplainSearch(search Search, clusterID cluster.ID) []SearchDecision {
+	registries := c.GetRegistries()
+	out := make([]SearchDecision, 0, len(registries))
+	for _, r := range registries {
+		skip, reason := c.skipRegistry(search, clusterID, r)
+		out = append(out, SearchDecision{Cluster: r.Cluster(), Provider: r.Provider(), Skip: skip, Reason: reason})
+	}
+	return out
+}
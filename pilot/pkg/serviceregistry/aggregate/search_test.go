@@ -0,0 +1,79 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func TestSkipRegistry(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	cases := []struct {
+		name            string
+		provider        provider.ID
+		registryCluster cluster.ID
+		requested       cluster.ID
+		// whether the registry is searched for the proxy instances, workload labels and service instances
+		proxyInstances, workloadLabels, instances bool
+	}{
+		{"kube, no cluster requested", provider.Kubernetes, "cluster-1", "", true, true, true},
+		{"kube, same cluster", provider.Kubernetes, "cluster-1", "cluster-1", true, true, true},
+		{"kube, other cluster", provider.Kubernetes, "cluster-1", "cluster-2", false, false, false},
+		{"external, no cluster requested", provider.External, "cluster-1", "", true, true, true},
+		{"external, same cluster", provider.External, "cluster-1", "cluster-1", true, true, true},
+		{"external, other cluster", provider.External, "cluster-1", "cluster-2", true, false, false},
+		{"external without cluster, cluster requested", provider.External, "", "cluster-1", true, false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newMemoryRegistry(tc.provider, tc.registryCluster, svc, makeInstance(svc, "1.1.1.1", 80, "", nil))
+			r.ServiceDiscovery.(*memory.ServiceDiscovery).AddWorkload("1.1.1.1", labels.Instance{"app": "hello"})
+			ctl := NewController(Options{})
+			ctl.AddRegistry(r)
+
+			proxy := &model.Proxy{IPAddresses: []string{"1.1.1.1"}, Metadata: &model.NodeMetadata{ClusterID: tc.requested}}
+			if got := len(ctl.GetProxyServiceInstances(proxy)) > 0; got != tc.proxyInstances {
+				t.Errorf("GetProxyServiceInstances: searched %v, want %v", got, tc.proxyInstances)
+			}
+			if got := len(ctl.GetProxyWorkloadLabels(proxy)) > 0; got != tc.workloadLabels {
+				t.Errorf("GetProxyWorkloadLabels: searched %v, want %v", got, tc.workloadLabels)
+			}
+			if got := len(ctl.InstancesByPortForCluster(svc, 80, nil, tc.requested)) > 0; got != tc.instances {
+				t.Errorf("InstancesByPortForCluster: searched %v, want %v", got, tc.instances)
+			}
+
+			for search, want := range map[Search]bool{
+				SearchProxyInstances: tc.proxyInstances,
+				SearchWorkloadLabels: tc.workloadLabels,
+				SearchInstances:      tc.instances,
+			} {
+				decisions := ctl.ExplainSearch(search, tc.requested)
+				if len(decisions) != 1 {
+					t.Fatalf("expected a single decision, got %v", decisions)
+				}
+				if d := decisions[0]; d.Skip == want || d.Reason == "" || d.Cluster != tc.registryCluster || d.Provider != tc.provider {
+					t.Errorf("%s: unexpected decision %+v", search, d)
+				}
+			}
+		})
+	}
+}
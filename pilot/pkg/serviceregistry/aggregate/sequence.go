@@ -0,0 +1,130 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pkg/config/host"
+)
+
+// hostnameSequence orders the service events of a hostname. Its fields but last are guarded by the mutex of
+// the sequencer.
+type hostnameSequence struct {
+	// busy is set while an event of the hostname is dispatched.
+	busy bool
+	// pending are the dispatches queued while busy, in order.
+	pending []sequencedDispatch
+	last    atomic.Uint64
+}
+
+type sequencedDispatch struct {
+	dispatch func()
+	// event is set for the dispatch of an event, which is stamped, rather than of a replay.
+	event bool
+	// deleted is set for the dispatch of a delete of the hostname.
+	deleted bool
+}
+
+// eventSequencer stamps the service events of each hostname with increasing sequence numbers, and serializes
+// their dispatch so that every handler observes the events of a hostname in stamp order. The events of
+// different hostnames are dispatched in parallel.
+type eventSequencer struct {
+	mu        sync.Mutex
+	hostnames map[host.Name]*hostnameSequence
+}
+
+func newEventSequencer() *eventSequencer {
+	return &eventSequencer{hostnames: map[host.Name]*hostnameSequence{}}
+}
+
+// dispatchEvent stamps the next event of the hostname and calls dispatch for it, once the previous events of
+// the hostname are dispatched. If one is being dispatched, by another goroutine or by a handler of the caller
+// itself, the event is queued and dispatched after it by the goroutine dispatching, and dispatchEvent returns
+// at once: a handler causing another event of its hostname does not wait for itself. A hostname whose delete
+// is its last dispatched event is forgotten, and its events are then numbered from 1 again.
+func (s *eventSequencer) dispatchEvent(hostname host.Name, deleted bool, dispatch func()) {
+	s.run(hostname, sequencedDispatch{dispatch: dispatch, event: true, deleted: deleted})
+}
+
+// replay calls dispatch once the previous events of the hostname are dispatched, without stamping an event,
+// and waits for it. It must not be called from a handler.
+func (s *eventSequencer) replay(hostname host.Name, dispatch func()) {
+	done := make(chan struct{})
+	s.run(hostname, sequencedDispatch{dispatch: func() {
+		defer close(done)
+		dispatch()
+	}})
+	<-done
+}
+
+func (s *eventSequencer) run(hostname host.Name, d sequencedDispatch) {
+	s.mu.Lock()
+	seq, f := s.hostnames[hostname]
+	if !f {
+		seq = &hostnameSequence{}
+		s.hostnames[hostname] = seq
+	}
+	if seq.busy {
+		seq.pending = append(seq.pending, d)
+		s.mu.Unlock()
+		return
+	}
+	seq.busy = true
+	s.mu.Unlock()
+
+	for {
+		if d.event {
+			seq.last.Inc()
+		}
+		d.dispatch()
+		s.mu.Lock()
+		if len(seq.pending) == 0 {
+			seq.busy = false
+			seq.pending = nil
+			if d.deleted {
+				delete(s.hostnames, hostname)
+			}
+			s.mu.Unlock()
+			return
+		}
+		d = seq.pending[0]
+		seq.pending[0] = sequencedDispatch{}
+		seq.pending = seq.pending[1:]
+		s.mu.Unlock()
+	}
+}
+
+// last returns the sequence number of the latest event of the hostname, zero if none was dispatched.
+func (s *eventSequencer) last(hostname host.Name) uint64 {
+	s.mu.Lock()
+	seq, f := s.hostnames[hostname]
+	s.mu.Unlock()
+	if !f {
+		return 0
+	}
+	return seq.last.Load()
+}
+
+// LastServiceEventSequence returns the sequence number of the latest service event of the hostname dispatched
+// to the handlers, zero if none was or if the hostname was deleted since. The events of a hostname, reported by
+// any registry, are numbered from 1 and dispatched one at a time, in order: an event of the hostname caused by a
+// handler is dispatched once the handler returns, so a handler must not wait for it. It is intended for
+// debugging.
+func (c *Controller) LastServiceEventSequence(hostname host.Name) uint64 {
+	return c.sequencer.last(hostname)
+}
@@ -0,0 +1,155 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/config/host"
+)
+
+func TestServiceEventSequence(t *testing.T) {
+	const events = 200
+	hostname := host.Name("hello.default.svc.cluster.local")
+	other := host.Name("other.default.svc.cluster.local")
+	ctl := NewController(Options{})
+	versions := makeServiceVersions(hostname, 2*events)
+	kubeA := newMemoryRegistry(provider.Kubernetes, "cluster-a", versions[0])
+	kubeB := newMemoryRegistry(provider.Kubernetes, "cluster-b", versions[0])
+	ctl.AddRegistry(kubeA)
+	ctl.AddRegistry(kubeB)
+
+	// every handler observes the same order, matching the stamps
+	var mu sync.Mutex
+	observed := make([][]string, 2)
+	var stamps []uint64
+	for i := range observed {
+		i := i
+		ctl.AppendServiceHandler(func(svc *model.Service, _ model.Event) {
+			if svc.ClusterLocal.Hostname != hostname {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			observed[i] = append(observed[i], svc.Address)
+			if i == 0 {
+				stamps = append(stamps, ctl.LastServiceEventSequence(hostname))
+			}
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i, r := range []*fakeController{fakeControllerOf(kubeA), fakeControllerOf(kubeB)} {
+		r := r
+		mine := versions[i*events : (i+1)*events]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, svc := range mine {
+				r.fireService(svc, model.EventUpdate)
+			}
+		}()
+	}
+	wg.Wait()
+	fakeControllerOf(kubeA).fireService(makeServiceVersions(other, 1)[0], model.EventAdd)
+
+	if len(observed[0]) != 2*events {
+		t.Fatalf("expected %d events, got %d", 2*events, len(observed[0]))
+	}
+	if diff := cmp.Diff(observed[0], observed[1]); diff != "" {
+		t.Errorf("the handlers observed different orders, diff %v", diff)
+	}
+	for i, stamp := range stamps {
+		if stamp != uint64(i+1) {
+			t.Fatalf("event %d dispatched with stamp %d", i, stamp)
+		}
+	}
+	if got := ctl.LastServiceEventSequence(hostname); got != 2*events {
+		t.Errorf("expected the last sequence to be %d, got %d", 2*events, got)
+	}
+	if got := ctl.LastServiceEventSequence(other); got != 1 {
+		t.Errorf("expected the sequences of each hostname to be separate, got %d", got)
+	}
+	if got := ctl.LastServiceEventSequence("unknown.default.svc.cluster.local"); got != 0 {
+		t.Errorf("expected no sequence for an unknown hostname, got %d", got)
+	}
+}
+
+func TestServiceEventSequenceDeleted(t *testing.T) {
+	ctl := NewController(Options{})
+	registry := newMemoryRegistry(provider.External, "cluster-1", makeServiceVersions("hello.default.svc.cluster.local", 1)[0])
+	ctl.AddRegistry(registry)
+	ctl.AppendServiceHandler(func(*model.Service, model.Event) {})
+
+	// the service entries churning do not leave their hostnames behind
+	for i := 0; i < 100; i++ {
+		svc := makeServiceVersions(host.Name(fmt.Sprintf("se-%d.default.svc.cluster.local", i)), 1)[0]
+		fakeControllerOf(registry).fireService(svc, model.EventAdd)
+		fakeControllerOf(registry).fireService(svc, model.EventUpdate)
+		fakeControllerOf(registry).fireService(svc, model.EventDelete)
+	}
+	ctl.sequencer.mu.Lock()
+	remaining := len(ctl.sequencer.hostnames)
+	ctl.sequencer.mu.Unlock()
+	if remaining != 0 {
+		t.Fatalf("expected the deleted hostnames to be forgotten, %d remain", remaining)
+	}
+	if got := ctl.LastServiceEventSequence("se-0.default.svc.cluster.local"); got != 0 {
+		t.Errorf("expected no sequence for a deleted hostname, got %d", got)
+	}
+}
+
+func TestServiceEventSequenceReentrant(t *testing.T) {
+	hostname := host.Name("hello.default.svc.cluster.local")
+	versions := makeServiceVersions(hostname, 2)
+	ctl := NewController(Options{})
+	registry := newMemoryRegistry(provider.Kubernetes, "cluster-1", versions[0])
+	ctl.AddRegistry(registry)
+
+	var observed []string
+	ctl.AppendServiceHandler(func(svc *model.Service, event model.Event) {
+		observed = append(observed, svc.Address)
+		if event == model.EventAdd {
+			// the handler causes another event of its hostname, dispatched once it returns
+			fakeControllerOf(registry).fireService(versions[1], model.EventUpdate)
+			if len(observed) != 1 {
+				t.Errorf("expected the event caused by the handler to wait for it, observed %v", observed)
+			}
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fakeControllerOf(registry).fireService(versions[0], model.EventAdd)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event caused by a handler deadlocked")
+	}
+	if diff := cmp.Diff(observed, []string{versions[0].Address, versions[1].Address}); diff != "" {
+		t.Errorf("unexpected events, diff %v", diff)
+	}
+	if got := ctl.LastServiceEventSequence(hostname); got != 2 {
+		t.Errorf("expected the last sequence to be 2, got %d", got)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sort"
+	"sync"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+// InstanceContribution reports the instances a registry contributed to the sampled lookups of a kind.
+type InstanceContribution struct {
+	Cluster  cluster.ID  `json:"cluster"`
+	Provider provider.ID `json:"provider"`
+	Search   Search      `json:"search"`
+	// Samples is the number of sampled lookups the registry was consulted for.
+	Samples int64 `json:"samples"`
+	// Total is the number of instances contributed over every sampled lookup.
+	Total int64 `json:"total"`
+	// Last is the number of instances contributed to the last sampled lookup.
+	Last int64 `json:"last"`
+}
+
+type contributionKey struct {
+	registry registryKey
+	search   Search
+}
+
+type contributionCounters struct {
+	samples atomic.Int64
+	total   atomic.Int64
+	last    atomic.Int64
+}
+
+// contributionStats samples the number of instances contributed by each registry.
+type contributionStats struct {
+	sampling int64
+	calls    atomic.Int64
+
+	mu       sync.RWMutex
+	counters map[contributionKey]*contributionCounters
+}
+
+func newContributionStats(sampling int) *contributionStats {
+	return &contributionStats{sampling: int64(sampling), counters: map[contributionKey]*contributionCounters{}}
+}
+
+// sample returns true if the current lookup is to be recorded.
+func (s *contributionStats) sample() bool {
+	return s.sampling > 0 && s.calls.Inc()%s.sampling == 0
+}
+
+func (s *contributionStats) countersFor(key contributionKey) *contributionCounters {
+	s.mu.RLock()
+	counters, f := s.counters[key]
+	s.mu.RUnlock()
+	if f {
+		return counters
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if counters, f = s.counters[key]; !f {
+		counters = &contributionCounters{}
+		s.counters[key] = counters
+	}
+	return counters
+}
+
+// deleteRegistry drops the counters of a deleted registry.
+func (s *contributionStats) deleteRegistry(registry registryKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.counters {
+		if key.registry == registry {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// recordContributions records the number of instances of each registry result, if the lookup is sampled.
+func (c *Controller) recordContributions(search Search, results []registryInstances) {
+	if !c.contributions.sample() {
+		return
+	}
+	for _, res := range results {
+		n := int64(len(res.instances))
+		counters := c.contributions.countersFor(contributionKey{registry: registryKey{cluster: res.cluster, provider: res.provider}, search: search})
+		counters.samples.Inc()
+		counters.total.Add(n)
+		counters.last.Store(n)
+		registryInstanceCount.With(clusterTag.Value(string(res.cluster)), providerTag.Value(string(res.provider)),
+			searchTag.Value(string(search))).Record(float64(n))
+	}
+}
+
+// InstanceContributionStats returns the number of instances each registry contributed to the sampled
+// InstancesByPort and GetProxyServiceInstances calls, sorted by cluster, provider and kind of lookup.
+// Nothing is recorded unless Options.InstanceStatsSampling is set. Registries not contributing to the
+// lookups of a proxy are not recorded for them.
+func (c *Controller) InstanceContributionStats() []InstanceContribution {
+	c.contributions.mu.RLock()
+	out := make([]InstanceContribution, 0, len(c.contributions.counters))
+	for key, counters := range c.contributions.counters {
+		out = append(out, InstanceContribution{
+			Cluster:  key.registry.cluster,
+			Provider: key.registry.provider,
+			Search:   key.search,
+			Samples:  counters.samples.Load(),
+			Total:    counters.total.Load(),
+			Last:     counters.last.Load(),
+		})
+	}
+	c.contributions.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Cluster != out[j].Cluster {
+			return out[i].Cluster < out[j].Cluster
+		}
+		if out[i].Provider != out[j].Provider {
+			return out[i].Provider < out[j].Provider
+		}
+		return out[i].Search < out[j].Search
+	})
+	return out
+}
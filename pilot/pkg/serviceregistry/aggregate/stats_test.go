@@ -0,0 +1,86 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+)
+
+func TestInstanceContributionStats(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	port := svc.Ports[0].Port
+	build := func(sampling int) *Controller {
+		ctl := NewController(Options{InstanceStatsSampling: sampling})
+		ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "cluster-1", svc,
+			makeInstance(svc, "1.1.1.1", 80, "", nil),
+			makeInstance(svc, "1.1.1.2", 80, "", nil),
+			makeInstance(svc, "1.1.1.3", 80, "", nil)))
+		ctl.AddRegistry(newMemoryRegistry(provider.External, "", svc, makeInstance(svc, "2.2.2.2", 80, "", nil)))
+		return ctl
+	}
+	proxy := &model.Proxy{IPAddresses: []string{"2.2.2.2"}}
+
+	cases := []struct {
+		name     string
+		sampling int
+		calls    int
+		want     []InstanceContribution
+	}{
+		{
+			name:  "disabled",
+			calls: 4,
+			want:  []InstanceContribution{},
+		},
+		{
+			name:     "every call",
+			sampling: 1,
+			calls:    4,
+			want: []InstanceContribution{
+				{Cluster: "", Provider: provider.External, Search: SearchInstances, Samples: 4, Total: 4, Last: 1},
+				{Cluster: "", Provider: provider.External, Search: SearchProxyInstances, Samples: 4, Total: 4, Last: 1},
+				{Cluster: "cluster-1", Provider: provider.Kubernetes, Search: SearchInstances, Samples: 4, Total: 12, Last: 3},
+			},
+		},
+		{
+			// the service and proxy lookups share a single sampling counter
+			name:     "sampled",
+			sampling: 3,
+			calls:    6,
+			want: []InstanceContribution{
+				{Cluster: "", Provider: provider.External, Search: SearchInstances, Samples: 2, Total: 2, Last: 1},
+				{Cluster: "", Provider: provider.External, Search: SearchProxyInstances, Samples: 2, Total: 2, Last: 1},
+				{Cluster: "cluster-1", Provider: provider.Kubernetes, Search: SearchInstances, Samples: 2, Total: 6, Last: 3},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctl := build(tc.sampling)
+			for i := 0; i < tc.calls; i++ {
+				ctl.InstancesByPort(svc, port, nil)
+				ctl.GetProxyServiceInstances(proxy)
+			}
+			if diff := cmp.Diff(ctl.InstanceContributionStats(), tc.want); diff != "" {
+				t.Errorf("unexpected stats, diff %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"time"
+
+	"istio.io/pkg/log"
+)
+
+// maxStuckSyncCheckInterval bounds the interval of the checks of Options.StuckSyncThreshold.
+const maxStuckSyncCheckInterval = 10 * time.Second
+
+// stuckSyncEscalation is a warning about a registry still syncing after factor times the threshold.
+type stuckSyncEscalation struct {
+	factor int
+	name   string
+	logf   func(args ...interface{})
+}
+
+// stuckSyncEscalations are the warnings given in turn about a registry still syncing.
+var stuckSyncEscalations = []stuckSyncEscalation{
+	{factor: 1, name: "1x", logf: log.Infof},
+	{factor: 5, name: "5x", logf: log.Warnf},
+	{factor: 10, name: "10x", logf: log.Errorf},
+}
+
+// escalateStuck returns the index of the last escalation the registry, still syncing the given time after it was
+// added, has newly reached, or -1 if none.
+func (s *registrySyncs) escalateStuck(key registryKey, threshold time.Duration) (int, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, f := s.registries[key]
+	if !f || !t.synced.IsZero() {
+		return -1, 0
+	}
+	age := s.now().Sub(t.added)
+	reached := t.stuck
+	for reached < len(stuckSyncEscalations) && age >= time.Duration(stuckSyncEscalations[reached].factor)*threshold {
+		reached++
+	}
+	if reached == t.stuck {
+		return -1, age
+	}
+	t.stuck = reached
+	return reached - 1, age
+}
+
+// checkStuckSyncs warns about the registries still syncing past Options.StuckSyncThreshold, once per
+// escalation. The registries stopped or dead are not syncing, and are left out.
+func (c *Controller) checkStuckSyncs() {
+	for _, r := range c.GetRegistries() {
+		if excluded := c.syncExcluded(r); excluded == "stopped" || excluded == "dead" {
+			continue
+		}
+		if c.hasSynced(r) {
+			continue
+		}
+		key := registryKey{cluster: r.Cluster(), provider: r.Provider()}
+		i, age := c.syncs.escalateStuck(key, c.stuckSyncThreshold)
+		if i < 0 {
+			continue
+		}
+		e := stuckSyncEscalations[i]
+		registryStuckSyncs.With(clusterTag.Value(string(key.cluster)), providerTag.Value(string(key.provider)),
+			escalationTag.Value(e.name)).Increment()
+		e.logf("the registry %s of cluster %s is still syncing %v after it was added, %s the threshold of %v",
+			key.provider, key.cluster, age, e.name, c.stuckSyncThreshold)
+	}
+}
+
+// watchStuckSyncs checks the registries against Options.StuckSyncThreshold periodically, until stop is closed.
+func (c *Controller) watchStuckSyncs(stop <-chan struct{}) {
+	interval := c.stuckSyncThreshold
+	if interval > maxStuckSyncCheckInterval {
+		interval = maxStuckSyncCheckInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			c.checkStuckSyncs()
+		}
+	}
+}
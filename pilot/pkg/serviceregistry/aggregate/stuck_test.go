@@ -0,0 +1,119 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+// stuckSyncWarnings returns the number of warnings about the cluster by escalation.
+func stuckSyncWarnings(t *testing.T, clusterID cluster.ID) map[string]float64 {
+	t.Helper()
+	data, err := view.RetrieveData("pilot_aggregate_registry_stuck_syncs")
+	if err != nil {
+		t.Fatalf("failed to get the stuck syncs: %v", err)
+	}
+	out := map[string]float64{}
+	for _, row := range data {
+		var escalation string
+		var found bool
+		for _, tag := range row.Tags {
+			switch tag.Key.Name() {
+			case "cluster":
+				found = tag.Value == string(clusterID)
+			case "escalation":
+				escalation = tag.Value
+			}
+		}
+		if found {
+			out[escalation] += row.Data.(*view.SumData).Value
+		}
+	}
+	return out
+}
+
+func TestStuckSyncEscalation(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "stuck")
+	stuck := newMemoryRegistry(provider.Kubernetes, "stuck", svc)
+	fakeControllerOf(stuck).unsynced.Store(true)
+	synced := newMemoryRegistry(provider.Kubernetes, "synced-in-time", svc)
+	ctl := NewController(Options{StuckSyncThreshold: time.Minute})
+	now := time.Unix(1000, 0)
+	ctl.syncs.now = func() time.Time { return now }
+	ctl.AddRegistry(stuck)
+	ctl.AddRegistry(synced)
+
+	steps := []struct {
+		elapsed time.Duration
+		want    map[string]float64
+	}{
+		{30 * time.Second, map[string]float64{}},
+		{time.Minute, map[string]float64{"1x": 1}},
+		{4 * time.Minute, map[string]float64{"1x": 1}},
+		{5 * time.Minute, map[string]float64{"1x": 1, "5x": 1}},
+		{10 * time.Minute, map[string]float64{"1x": 1, "5x": 1, "10x": 1}},
+		// the warnings end with the last escalation
+		{time.Hour, map[string]float64{"1x": 1, "5x": 1, "10x": 1}},
+	}
+	before := stuckSyncWarnings(t, "stuck")
+	for _, step := range steps {
+		now = time.Unix(1000, 0).Add(step.elapsed)
+		ctl.checkStuckSyncs()
+		got := stuckSyncWarnings(t, "stuck")
+		for escalation, n := range before {
+			if got[escalation] -= n; got[escalation] == 0 {
+				delete(got, escalation)
+			}
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("after %v expected the warnings %v, got %v", step.elapsed, step.want, got)
+		}
+		if got := stuckSyncWarnings(t, "synced-in-time"); len(got) != 0 {
+			t.Fatalf("expected no warning about the synced registry, got %v", got)
+		}
+	}
+	// the warnings do not change the sync
+	if ctl.HasSynced() {
+		t.Fatal("expected the aggregate not to be synced")
+	}
+}
+
+func TestStuckSyncTimer(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "stuck-timer")
+	stuck := newMemoryRegistry(provider.Kubernetes, "stuck-timer", svc)
+	fakeControllerOf(stuck).unsynced.Store(true)
+	ctl := NewController(Options{StuckSyncThreshold: 10 * time.Millisecond})
+	ctl.AddRegistry(stuck)
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	before := stuckSyncWarnings(t, "stuck-timer")["10x"]
+	for stuckSyncWarnings(t, "stuck-timer")["10x"] == before {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the warnings, got %v", stuckSyncWarnings(t, "stuck-timer"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
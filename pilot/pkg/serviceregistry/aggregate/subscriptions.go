@@ -0,0 +1,125 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"context"
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// subscription guards the calls of a handler added with a context, so that none is in flight or starts once
+// it is cancelled.
+type subscription struct {
+	mu        sync.Mutex
+	idle      *sync.Cond
+	calls     int
+	cancelled bool
+}
+
+func newSubscription() *subscription {
+	s := &subscription{}
+	s.idle = sync.NewCond(&s.mu)
+	return s
+}
+
+// enter returns true if the handler can be called, in which case exit must be called once it returns.
+func (s *subscription) enter() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancelled {
+		return false
+	}
+	s.calls++
+	return true
+}
+
+func (s *subscription) exit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls--
+	if s.calls == 0 {
+		s.idle.Broadcast()
+	}
+}
+
+// cancel prevents the later calls, and waits for the calls in flight.
+func (s *subscription) cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelled = true
+	for s.calls > 0 {
+		s.idle.Wait()
+	}
+}
+
+// removeWhenDone cancels the subscription and removes its handler once the context is done. The returned
+// channel is closed after that.
+func removeWhenDone(ctx context.Context, s *subscription, remove func()) <-chan struct{} {
+	removed := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		s.cancel()
+		remove()
+		close(removed)
+	}()
+	return removed
+}
+
+// AppendServiceHandlerWithContext is like AddServiceHandler, but removes the handler once the context is done.
+// The returned channel is closed once the handler is removed, after the calls in flight returned: the handler
+// is not called after that. The handler must not wait for the channel.
+func (c *Controller) AppendServiceHandlerWithContext(ctx context.Context, f func(*model.Service, model.Event)) <-chan struct{} {
+	s := newSubscription()
+	id := c.AddServiceHandler(func(svc *model.Service, event model.Event) {
+		if s.enter() {
+			defer s.exit()
+			f(svc, event)
+		}
+	})
+	return removeWhenDone(ctx, s, func() {
+		c.RemoveServiceHandler(id)
+	})
+}
+
+// AppendWorkloadHandlerWithContext is like AppendServiceHandlerWithContext, for workload events.
+func (c *Controller) AppendWorkloadHandlerWithContext(ctx context.Context, f func(*model.WorkloadInstance, model.Event)) <-chan struct{} {
+	s := newSubscription()
+	id := c.AddWorkloadHandler(func(wi *model.WorkloadInstance, event model.Event) {
+		if s.enter() {
+			defer s.exit()
+			f(wi, event)
+		}
+	})
+	return removeWhenDone(ctx, s, func() {
+		c.RemoveWorkloadHandler(id)
+	})
+}
+
+// AppendNetworkGatewayHandlerWithContext is like AppendServiceHandlerWithContext, for the handlers of
+// AppendNetworkGatewayHandler.
+func (c *Controller) AppendNetworkGatewayHandlerWithContext(ctx context.Context, f func()) <-chan struct{} {
+	s := newSubscription()
+	id := c.addGatewayHandler(func() {
+		if s.enter() {
+			defer s.exit()
+			f()
+		}
+	})
+	return removeWhenDone(ctx, s, func() {
+		c.removeGatewayHandler(id)
+	})
+}
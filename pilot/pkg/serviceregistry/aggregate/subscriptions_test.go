@@ -0,0 +1,104 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+)
+
+func TestHandlersWithContext(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	for _, async := range []bool{false, true} {
+		opts := Options{}
+		if async {
+			opts.AsyncHandlerQueueSize = 10
+		}
+		ctl := NewController(opts)
+		r := &gatewayRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)}
+		ctl.AddRegistry(r)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var calls, late atomic.Int32
+		var removed atomic.Bool
+		call := func() {
+			calls.Inc()
+			if removed.Load() {
+				late.Inc()
+			}
+		}
+		done := []<-chan struct{}{
+			ctl.AppendServiceHandlerWithContext(ctx, func(*model.Service, model.Event) { call() }),
+			ctl.AppendWorkloadHandlerWithContext(ctx, func(*model.WorkloadInstance, model.Event) { call() }),
+			ctl.AppendNetworkGatewayHandlerWithContext(ctx, call),
+		}
+
+		// the handlers are cancelled during a burst of events
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				wi := makeWorkload("vm", "default", "10.0.0.1")
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					fakeControllerOf(r.Simple).fireService(svc, model.EventUpdate)
+					fakeControllerOf(r.Simple).fireWorkload(wi, model.EventUpdate)
+					for _, h := range r.handlers {
+						h()
+					}
+				}
+			}()
+		}
+		for calls.Load() < 100 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		for _, ch := range done {
+			select {
+			case <-ch:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the handlers to be removed")
+			}
+		}
+		removed.Store(true)
+		time.Sleep(10 * time.Millisecond)
+		close(stop)
+		wg.Wait()
+
+		if late.Load() != 0 {
+			t.Errorf("expected no call once the handlers are removed, got %d", late.Load())
+		}
+		ctl.storeLock.RLock()
+		if len(ctl.serviceHandlers) != 0 || len(ctl.workloadHandlers) != 0 || len(ctl.gatewayHandlers) != 0 {
+			t.Errorf("expected the handlers to be removed, got %d, %d and %d",
+				len(ctl.serviceHandlers), len(ctl.workloadHandlers), len(ctl.gatewayHandlers))
+		}
+		ctl.storeLock.RUnlock()
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/pkg/log"
+)
+
+var (
+	// syncPollInterval is the interval at which HasSynced is polled for the registries unable to notify it.
+	syncPollInterval = 100 * time.Millisecond
+	// syncNotifiedPollInterval is the interval at which HasSynced is still polled for the registries able to
+	// notify it, so that the wait notices the registries deleted or added meanwhile.
+	syncNotifiedPollInterval = time.Second
+	// eventAgeInterval is the interval at which the time since the last event of each registry is recorded.
+	eventAgeInterval = 15 * time.Second
+)
+
+// syncNotifier is implemented by registries able to notify the end of their initial sync.
+type syncNotifier interface {
+	// SyncedNotify returns a channel closed once HasSynced returns true.
+	SyncedNotify() <-chan struct{}
+}
+
+// RegistrySyncStatus reports the initial sync of a registry.
+type RegistrySyncStatus struct {
+	Cluster  cluster.ID  `json:"cluster"`
+	Provider provider.ID `json:"provider"`
+	Synced   bool        `json:"synced"`
+	// Added is when the registry was added to the aggregate.
+	Added time.Time `json:"added"`
+	// SyncedAt is when the registry was first found synced, zero if never.
+	SyncedAt time.Time `json:"syncedAt"`
+	// Excluded is set when the registry is not waited for by HasSynced, because the aggregate is not serving
+	// it, for the reason given: "stopped" if stopped by StopRegistry, "dead" if its Run panicked or failed,
+	// "sync-timeout" if it has not synced within Options.RegistrySyncTimeout, "unhealthy" if a call to it timed
+	// out. Synced is then as last checked.
+	Excluded string `json:"excluded,omitempty"`
+	// Run is the state of the run of the registry.
+	Run RunState `json:"run"`
+	// LastEvent is when the aggregate last received a service or workload event of the registry, zero if never.
+	// A registry quiet for long while the others are not may have lost its watch.
+	LastEvent time.Time `json:"lastEvent"`
+}
+
+type registrySyncTimes struct {
+	added  time.Time
+	synced time.Time
+	// timedOut is set while the registry has not synced within Options.RegistrySyncTimeout.
+	timedOut bool
+	// stuck is the number of warnings given about the registry still syncing, see Options.StuckSyncThreshold.
+	stuck int
+	// lastEvent is the last event of the registry in Unix nanoseconds, zero if none. It is updated on every
+	// event, without the lock.
+	lastEvent *atomic.Int64
+}
+
+// lastEventTime returns the time of the last event of the registry, zero if none.
+func (t registrySyncTimes) lastEventTime() time.Time {
+	if t.lastEvent == nil || t.lastEvent.Load() == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t.lastEvent.Load())
+}
+
+// registrySyncs tracks when the registries were added, and when they were first found synced by the checks of
+// the aggregate.
+type registrySyncs struct {
+	mu         sync.Mutex
+	registries map[registryKey]*registrySyncTimes
+	now        func() time.Time
+}
+
+func newRegistrySyncs() *registrySyncs {
+	return &registrySyncs{registries: map[registryKey]*registrySyncTimes{}, now: time.Now}
+}
+
+// addRegistry starts tracking the registry, and returns the time of its last event for the handlers to update.
+func (s *registrySyncs) addRegistry(key registryKey) *atomic.Int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &registrySyncTimes{added: s.now(), lastEvent: atomic.NewInt64(0)}
+	s.registries[key] = t
+	return t.lastEvent
+}
+
+// recordEvent records an event of the registry now.
+func (s *registrySyncs) recordEvent(lastEvent *atomic.Int64) {
+	lastEvent.Store(s.now().UnixNano())
+}
+
+// eventAges returns the time since the last event of each registry, or since it was added if it had none.
+func (s *registrySyncs) eventAges() map[registryKey]time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	ages := make(map[registryKey]time.Duration, len(s.registries))
+	for key, t := range s.registries {
+		last := t.lastEventTime()
+		if last.IsZero() {
+			last = t.added
+		}
+		ages[key] = now.Sub(last)
+	}
+	return ages
+}
+
+func (s *registrySyncs) deleteRegistry(key registryKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.registries, key)
+}
+
+// observe records the sync of the registry the first time it is found synced, and returns its times and
+// whether this was the first time.
+func (s *registrySyncs) observe(key registryKey, synced bool) (registrySyncTimes, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, f := s.registries[key]
+	if !f {
+		return registrySyncTimes{}, false
+	}
+	first := synced && t.synced.IsZero()
+	if first {
+		t.synced = s.now()
+	}
+	return *t, first
+}
+
+// syncExcluded returns why the registry is excluded from the sync, as the aggregate is not serving it, or an
+// empty string if it is waited for.
+func (c *Controller) syncExcluded(r serviceregistry.Instance) string {
+	if c.strictSync {
+		return ""
+	}
+	key := registryKey{cluster: r.Cluster(), provider: r.Provider()}
+	if c.registryStopped(key) {
+		return "stopped"
+	}
+	if c.health.isDead(key) {
+		return "dead"
+	}
+	if c.syncs.isTimedOut(key) {
+		return "sync-timeout"
+	}
+	if c.health.hung(key) {
+		return "unhealthy"
+	}
+	return ""
+}
+
+// setTimedOut sets whether the registry has not synced within Options.RegistrySyncTimeout. It returns false if
+// the registry was deleted.
+func (s *registrySyncs) setTimedOut(key registryKey, timedOut bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, f := s.registries[key]
+	if f {
+		t.timedOut = timedOut
+	}
+	return f
+}
+
+func (s *registrySyncs) known(key registryKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, f := s.registries[key]
+	return f
+}
+
+func (s *registrySyncs) isTimedOut(key registryKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, f := s.registries[key]
+	return f && t.timedOut
+}
+
+// watchInitialSync waits for the registry started to sync, until stop is closed or the registry is deleted, to
+// report its sync to LifecycleEvents. If it has not synced within Options.RegistrySyncTimeout, it is excluded
+// from the sync until it does, and its services are then notified to the handlers, as they may have been left
+// out meanwhile.
+func (c *Controller) watchInitialSync(key registryKey, r serviceregistry.Instance, stop <-chan struct{}) {
+	var deadline <-chan struct{}
+	if c.registrySyncTimeout > 0 {
+		expired := make(chan struct{})
+		t := time.AfterFunc(c.registrySyncTimeout, func() { close(expired) })
+		defer t.Stop()
+		deadline = expired
+	}
+	for !c.hasSynced(r) {
+		if awaitSync(r, stop, deadline) {
+			if !c.syncs.known(key) {
+				return
+			}
+			continue
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		// the deadline expired, the registry is now waited for without it
+		deadline = nil
+		if !c.syncs.setTimedOut(key, true) {
+			return
+		}
+		registrySyncTimeouts.With(clusterTag.Value(string(key.cluster)), providerTag.Value(string(key.provider))).Increment()
+		log.Errorf("the registry %s of cluster %s has not synced within %v, the aggregate is synced without it",
+			key.provider, key.cluster, c.registrySyncTimeout)
+	}
+	if c.syncs.isTimedOut(key) && c.syncs.setTimedOut(key, false) {
+		log.Infof("the registry %s of cluster %s has synced after timing out", key.provider, key.cluster)
+		c.notifyRegistryServices(key, r)
+	}
+	// the registry may be the last one to sync
+	c.HasSynced()
+}
+
+// notifyRegistryServices notifies an update of every service of the registry to the handlers.
+func (c *Controller) notifyRegistryServices(key registryKey, r serviceregistry.Instance) {
+	c.storeLock.RLock()
+	attached := c.attached[key]
+	c.storeLock.RUnlock()
+	if attached == nil {
+		return
+	}
+	services, err := r.Services()
+	if err != nil {
+		log.Warnf("listing the services of the registry %s of cluster %s: %v", key.provider, key.cluster, err)
+	}
+	for _, svc := range services {
+		c.dispatchServiceEvent(svc, model.EventUpdate, &eventSource{cluster: key.cluster, provider: key.provider, attached: attached})
+	}
+}
+
+// hasSynced checks the sync of the registry, recording its first success.
+func (c *Controller) hasSynced(r serviceregistry.Instance) bool {
+	synced := r.HasSynced()
+	c.observeSync(registryKey{cluster: r.Cluster(), provider: r.Provider()}, synced)
+	return synced
+}
+
+// observeSync is registrySyncs.observe, reporting the first sync of the registry to LifecycleEvents.
+func (c *Controller) observeSync(key registryKey, synced bool) registrySyncTimes {
+	t, first := c.syncs.observe(key, synced)
+	if first {
+		c.notifyLifecycle(LifecycleRegistrySynced, key.cluster, key.provider)
+		c.gatewaySourcesChanged()
+	}
+	return t
+}
+
+// SyncStatus returns the sync status of every registry, in the order of the registries.
+func (c *Controller) SyncStatus() []RegistrySyncStatus {
+	registries := c.GetRegistries()
+	out := make([]RegistrySyncStatus, 0, len(registries))
+	for _, r := range registries {
+		key := registryKey{cluster: r.Cluster(), provider: r.Provider()}
+		excluded := c.syncExcluded(r)
+		var synced bool
+		var t registrySyncTimes
+		if excluded == "" {
+			synced = r.HasSynced()
+			t = c.observeSync(key, synced)
+		} else {
+			// the registry may not answer, it is reported synced if it was found so before
+			t, _ = c.syncs.observe(key, false)
+			synced = !t.synced.IsZero()
+		}
+		out = append(out, RegistrySyncStatus{
+			Cluster:   r.Cluster(),
+			Provider:  r.Provider(),
+			Synced:    synced,
+			Added:     t.added,
+			SyncedAt:  t.synced,
+			Excluded:  excluded,
+			Run:       c.RegistryRunning(r.Cluster(), r.Provider()),
+			LastEvent: t.lastEventTime(),
+		})
+	}
+	return out
+}
+
+// unsyncedRegistries returns the registries that have not synced yet, leaving out the excluded ones like
+// HasSynced.
+func (c *Controller) unsyncedRegistries() []serviceregistry.Instance {
+	var unsynced []serviceregistry.Instance
+	for _, r := range c.GetRegistries() {
+		if c.syncExcluded(r) == "" && !c.hasSynced(r) {
+			unsynced = append(unsynced, r)
+		}
+	}
+	return unsynced
+}
+
+// waitForSync waits for the registries to sync until stop or timeout is closed, and returns the registries that
+// have not synced yet, none if all did. The registries are waited for one at a time, on their notification if
+// they have one, polling them otherwise.
+func (c *Controller) waitForSync(stop, timeout <-chan struct{}) []serviceregistry.Instance {
+	for {
+		unsynced := c.unsyncedRegistries()
+		if len(unsynced) == 0 {
+			return nil
+		}
+		if !awaitSync(unsynced[0], stop, timeout) {
+			return unsynced
+		}
+	}
+}
+
+// awaitSync waits until the registry may have synced: until it notifies it if it can, or until the next poll.
+// It returns false if stop or timeout is closed first.
+func awaitSync(r serviceregistry.Instance, stop, timeout <-chan struct{}) bool {
+	var synced <-chan struct{}
+	poll := syncPollInterval
+	if notifier, ok := r.(syncNotifier); ok {
+		synced = notifier.SyncedNotify()
+		poll = syncNotifiedPollInterval
+	}
+	t := time.NewTimer(poll)
+	defer t.Stop()
+	select {
+	case <-synced:
+	case <-t.C:
+	case <-stop:
+		return false
+	case <-timeout:
+		return false
+	}
+	return true
+}
+
+// WaitForSync blocks until all registries have synced, returning true, or until stop is closed, returning false.
+// The registries added while waiting are waited for as well.
+func (c *Controller) WaitForSync(stop <-chan struct{}) bool {
+	return len(c.waitForSync(stop, nil)) == 0
+}
+
+// SyncedWithTimeout is like WaitForSync, but gives up after the timeout, returning an error naming the registries
+// that have not synced yet.
+func (c *Controller) SyncedWithTimeout(d time.Duration) error {
+	timeout := make(chan struct{})
+	t := time.AfterFunc(d, func() { close(timeout) })
+	defer t.Stop()
+	unsynced := c.waitForSync(nil, timeout)
+	if len(unsynced) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(unsynced))
+	for _, r := range unsynced {
+		names = append(names, fmt.Sprintf("%s/%s", r.Provider(), r.Cluster()))
+	}
+	sort.Strings(names)
+	return fmt.Errorf("the registries %v have not synced after %v", names, d)
+}
+
+// recordEventAges records the time since the last event of each registry, see RegistrySyncStatus.LastEvent.
+func (c *Controller) recordEventAges() {
+	for key, age := range c.syncs.eventAges() {
+		registryEventAge.With(clusterTag.Value(string(key.cluster)), providerTag.Value(string(key.provider))).Record(age.Seconds())
+	}
+}
+
+// reportEventAges records the time since the last event of each registry periodically, until stop is closed.
+func (c *Controller) reportEventAges(stop <-chan struct{}) {
+	t := time.NewTicker(eventAgeInterval)
+	defer t.Stop()
+	for {
+		c.recordEventAges()
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+// notifyingRegistry notifies the end of its sync.
+type notifyingRegistry struct {
+	serviceregistry.Simple
+	synced chan struct{}
+}
+
+func (r *notifyingRegistry) HasSynced() bool {
+	select {
+	case <-r.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *notifyingRegistry) SyncedNotify() <-chan struct{} {
+	return r.synced
+}
+
+func TestSyncedWithTimeout(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	synced := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	lagging := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	fakeControllerOf(lagging).unsynced.Store(true)
+	ctl := NewController(Options{})
+	ctl.AddRegistry(synced)
+	ctl.AddRegistry(lagging)
+
+	start := time.Now()
+	err := ctl.SyncedWithTimeout(50 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "Kubernetes/cluster-2") || strings.Contains(err.Error(), "cluster-1") {
+		t.Fatalf("expected the sync to time out on cluster-2 only, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected the sync to wait for the timeout, returned after %v", elapsed)
+	}
+
+	time.AfterFunc(10*time.Millisecond, func() { fakeControllerOf(lagging).unsynced.Store(false) })
+	if err := ctl.SyncedWithTimeout(5 * time.Second); err != nil {
+		t.Fatalf("expected the registries to sync, got %v", err)
+	}
+}
+
+func TestWaitForSync(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	r := &notifyingRegistry{Simple: newMemoryRegistry(provider.Kubernetes, "cluster-1", svc), synced: make(chan struct{})}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(r)
+
+	stop := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(stop) })
+	if ctl.WaitForSync(stop) {
+		t.Fatal("expected the wait to be stopped before the sync")
+	}
+
+	// the notification ends the wait well before the registry would be polled again
+	time.AfterFunc(10*time.Millisecond, func() { close(r.synced) })
+	start := time.Now()
+	if !ctl.WaitForSync(make(chan struct{})) {
+		t.Fatal("expected the registry to sync")
+	}
+	if elapsed := time.Since(start); elapsed >= syncNotifiedPollInterval {
+		t.Fatalf("expected the wait to end on the notification, returned after %v", elapsed)
+	}
+}
+
+func TestSyncStatus(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	synced := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	lagging := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	fakeControllerOf(lagging).unsynced.Store(true)
+	ctl := NewController(Options{})
+	now := time.Unix(1000, 0)
+	ctl.syncs.now = func() time.Time { return now }
+	ctl.AddRegistry(synced)
+	now = now.Add(time.Second)
+	ctl.AddRegistry(lagging)
+
+	now = now.Add(time.Second)
+	if ctl.HasSynced() {
+		t.Fatal("expected the aggregate not to be synced")
+	}
+	want := []RegistrySyncStatus{
+		{Cluster: "cluster-1", Provider: provider.Kubernetes, Synced: true, Added: time.Unix(1000, 0), SyncedAt: time.Unix(1002, 0),
+			Run: RunStateNotStarted},
+		{Cluster: "cluster-2", Provider: provider.Kubernetes, Added: time.Unix(1001, 0), Run: RunStateNotStarted},
+	}
+	now = now.Add(time.Second)
+	if got := ctl.SyncStatus(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the sync status %+v, got %+v", want, got)
+	}
+
+	// the first sync is kept
+	fakeControllerOf(lagging).unsynced.Store(false)
+	want[1].Synced, want[1].SyncedAt = true, time.Unix(1003, 0)
+	if got := ctl.SyncStatus(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the sync status %+v, got %+v", want, got)
+	}
+	now = now.Add(time.Second)
+	if got := ctl.SyncStatus(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the sync status %+v, got %+v", want, got)
+	}
+
+	// a registry added again starts over
+	ctl.DeleteRegistry("cluster-2", provider.Kubernetes)
+	fakeControllerOf(lagging).unsynced.Store(true)
+	ctl.AddRegistry(lagging)
+	want[1] = RegistrySyncStatus{Cluster: "cluster-2", Provider: provider.Kubernetes, Added: time.Unix(1004, 0), Run: RunStateNotStarted}
+	if got := ctl.SyncStatus(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the sync status %+v, got %+v", want, got)
+	}
+}
+
+func TestHasSyncedExcludesUnservedRegistries(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+			synced := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+			wedged := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+			fakeControllerOf(wedged).unsynced.Store(true)
+			ctl := NewController(Options{StrictSync: strict})
+			ctl.AddRegistry(synced)
+			ctl.AddRegistry(wedged)
+			key := registryKey{cluster: "cluster-2", provider: provider.Kubernetes}
+
+			if ctl.HasSynced() {
+				t.Fatal("expected the aggregate not to be synced while the registry is syncing")
+			}
+			// a call to the registry times out, the aggregate stops serving it
+			ctl.health.timedOut(key, "GetProxyServiceInstances")
+			if got := ctl.HasSynced(); got == strict {
+				t.Fatalf("expected the aggregate to be synced %v with the registry unhealthy, got %v", !strict, got)
+			}
+			wantExcluded := "unhealthy"
+			if strict {
+				wantExcluded = ""
+			}
+			if got := ctl.SyncStatus()[1]; got.Excluded != wantExcluded || got.Synced {
+				t.Fatalf("expected the registry to be unsynced and excluded %q, got %+v", wantExcluded, got)
+			}
+			if err := ctl.SyncedWithTimeout(10 * time.Millisecond); (err == nil) == strict {
+				t.Fatalf("expected the wait to time out %v, got %v", strict, err)
+			}
+
+			// the call returns, the registry is served and waited for again
+			ctl.health.returned(key)
+			if ctl.HasSynced() {
+				t.Fatal("expected the aggregate not to be synced once the registry is healthy again")
+			}
+			if got := ctl.SyncStatus()[1]; got.Excluded != "" {
+				t.Fatalf("expected the registry not to be excluded, got %+v", got)
+			}
+			fakeControllerOf(wedged).unsynced.Store(false)
+			if !ctl.HasSynced() {
+				t.Fatal("expected the aggregate to be synced")
+			}
+		})
+	}
+}
+
+func TestRegistrySyncTimeout(t *testing.T) {
+	before := getCounterTotal(t, "pilot_aggregate_registry_sync_timeouts")
+	ctl := NewController(Options{RegistrySyncTimeout: 20 * time.Millisecond})
+	late := newRunningRegistry("cluster-1")
+	never := newRunningRegistry("cluster-2")
+	for _, r := range []*runningRegistry{late, never} {
+		fakeControllerOf(r.Simple).unsynced.Store(true)
+		ctl.AddRegistry(r)
+	}
+	recorder := NewEventRecorder(ctl)
+	defer recorder.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+
+	// both registries time out, the aggregate is synced without them
+	if err := ctl.SyncedWithTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range ctl.SyncStatus() {
+		if s.Synced || s.Excluded != "sync-timeout" {
+			t.Fatalf("expected the registry to be excluded as timed out, got %+v", s)
+		}
+	}
+	if got := getCounterTotal(t, "pilot_aggregate_registry_sync_timeouts") - before; got != 2 {
+		t.Fatalf("expected 2 sync timeouts to be counted, got %v", got)
+	}
+
+	// the late registry rejoins once synced, notifying its services
+	fakeControllerOf(late.Simple).unsynced.Store(false)
+	event := recorder.WaitForHostname(t, "hello.default.svc.cluster.local", model.EventUpdate, 5*time.Second)
+	if event.Cluster != "cluster-1" {
+		t.Fatalf("expected the update of the service of cluster-1, got %+v", event)
+	}
+	status := ctl.SyncStatus()
+	if !status[0].Synced || status[0].Excluded != "" {
+		t.Fatalf("expected the late registry to rejoin the sync, got %+v", status[0])
+	}
+	if status[1].Synced || status[1].Excluded != "sync-timeout" {
+		t.Fatalf("expected the registry never synced to stay excluded, got %+v", status[1])
+	}
+	if !ctl.HasSynced() {
+		t.Fatal("expected the aggregate to be synced")
+	}
+}
+
+func TestHasSyncedCached(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	first := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl := NewController(Options{})
+	ctl.AddRegistry(first)
+	if !ctl.HasSynced() {
+		t.Fatal("expected the aggregate to be synced")
+	}
+	// the result is kept once true, without checking the registries again
+	fakeControllerOf(first).unsynced.Store(true)
+	if !ctl.HasSynced() {
+		t.Fatal("expected the aggregate to stay synced")
+	}
+	fakeControllerOf(first).unsynced.Store(false)
+
+	// a registry added unsynced unsyncs the aggregate
+	second := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc)
+	fakeControllerOf(second).unsynced.Store(true)
+	ctl.AddRegistry(second)
+	if ctl.HasSynced() {
+		t.Fatal("expected the aggregate not to be synced with a new registry syncing")
+	}
+	fakeControllerOf(second).unsynced.Store(false)
+	if !ctl.HasSynced() {
+		t.Fatal("expected the aggregate to be synced")
+	}
+
+	// so does a registry started again, or healthy again, that is syncing
+	fakeControllerOf(second).unsynced.Store(true)
+	if err := ctl.StopRegistry("cluster-2", provider.Kubernetes); err != nil {
+		t.Fatal(err)
+	}
+	if !ctl.HasSynced() {
+		t.Fatal("expected the aggregate to be synced without the stopped registry")
+	}
+	if err := ctl.StartRegistry("cluster-2", provider.Kubernetes); err != nil {
+		t.Fatal(err)
+	}
+	if ctl.HasSynced() {
+		t.Fatal("expected the aggregate not to be synced with the started registry syncing")
+	}
+	key := registryKey{cluster: "cluster-2", provider: provider.Kubernetes}
+	ctl.health.timedOut(key, "GetProxyServiceInstances")
+	if !ctl.HasSynced() {
+		t.Fatal("expected the aggregate to be synced without the unhealthy registry")
+	}
+	ctl.health.returned(key)
+	if ctl.HasSynced() {
+		t.Fatal("expected the aggregate not to be synced with the registry healthy again syncing")
+	}
+}
+
+// countingSyncRegistry counts the calls to HasSynced.
+type countingSyncRegistry struct {
+	serviceregistry.Simple
+	calls *atomic.Int64
+}
+
+func (r countingSyncRegistry) HasSynced() bool {
+	r.calls.Inc()
+	return true
+}
+
+func BenchmarkHasSynced(b *testing.B) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	calls := atomic.NewInt64(0)
+	ctl := NewController(Options{})
+	for i := 0; i < 100; i++ {
+		clusterID := cluster.ID(fmt.Sprintf("cluster-%d", i))
+		ctl.AddRegistry(countingSyncRegistry{Simple: newMemoryRegistry(provider.Kubernetes, clusterID, svc), calls: calls})
+	}
+	b.Run("uncached", func(b *testing.B) {
+		calls.Store(0)
+		for n := 0; n < b.N; n++ {
+			ctl.synced.Store(syncedState{})
+			if !ctl.HasSynced() {
+				b.Fatal("expected the aggregate to be synced")
+			}
+		}
+		b.ReportMetric(float64(calls.Load())/float64(b.N), "registry-calls/op")
+	})
+	b.Run("cached", func(b *testing.B) {
+		calls.Store(0)
+		for n := 0; n < b.N; n++ {
+			if !ctl.HasSynced() {
+				b.Fatal("expected the aggregate to be synced")
+			}
+		}
+		b.ReportMetric(float64(calls.Load())/float64(b.N), "registry-calls/op")
+	})
+}
+
+// getGaugeValue returns the value of the gauge for the cluster.
+func getGaugeValue(t *testing.T, name string, clusterID cluster.ID) float64 {
+	t.Helper()
+	data, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get value for gauge %s: %v", name, err)
+	}
+	for _, row := range data {
+		for _, tag := range row.Tags {
+			if tag.Key.Name() == "cluster" && tag.Value == string(clusterID) {
+				return row.Data.(*view.LastValueData).Value
+			}
+		}
+	}
+	t.Fatalf("no value of gauge %s for cluster %s", name, clusterID)
+	return 0
+}
+
+func TestRegistryLastEvent(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "active")
+	active := newMemoryRegistry(provider.Kubernetes, "active", svc)
+	quiet := newMemoryRegistry(provider.Kubernetes, "quiet", svc)
+	ctl := NewController(Options{})
+	now := time.Unix(1000, 0)
+	ctl.syncs.now = func() time.Time { return now }
+	ctl.AddRegistry(active)
+	ctl.AddRegistry(quiet)
+
+	lastEvents := func() []time.Time {
+		var out []time.Time
+		for _, s := range ctl.SyncStatus() {
+			out = append(out, s.LastEvent)
+		}
+		return out
+	}
+	if got := lastEvents(); !got[0].IsZero() || !got[1].IsZero() {
+		t.Fatalf("expected no event yet, got %v", got)
+	}
+
+	// the service and workload events bump the time of the registry
+	now = now.Add(time.Hour)
+	fakeControllerOf(active).fireService(svc, model.EventUpdate)
+	if got := lastEvents(); !got[0].Equal(now) || !got[1].IsZero() {
+		t.Fatalf("expected the service event at %v, got %v", now, got)
+	}
+	now = now.Add(time.Hour)
+	fakeControllerOf(active).fireWorkload(&model.WorkloadInstance{Name: "pod", Namespace: "default"}, model.EventAdd)
+	if got := lastEvents(); !got[0].Equal(now) || !got[1].IsZero() {
+		t.Fatalf("expected the workload event at %v, got %v", now, got)
+	}
+
+	// the quiet registry is stale since it was added
+	now = now.Add(time.Minute)
+	ctl.recordEventAges()
+	if got := getGaugeValue(t, "pilot_aggregate_registry_seconds_since_last_event", "active"); got != 60 {
+		t.Fatalf("expected the active registry to be a minute old, got %v", got)
+	}
+	if got := getGaugeValue(t, "pilot_aggregate_registry_seconds_since_last_event", "quiet"); got != 2*3600+60 {
+		t.Fatalf("expected the quiet registry to be stale since it was added, got %v", got)
+	}
+}
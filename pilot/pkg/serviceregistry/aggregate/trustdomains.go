@@ -0,0 +1,239 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sort"
+	"strings"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/spiffe"
+	"istio.io/pkg/log"
+)
+
+// ClusterTrustDomainHolder may be implemented by Options.MeshHolder to give the clusters of a federation their
+// own trust domain aliases. The service accounts of the registries of such a cluster are expanded with its
+// aliases only, those of the other clusters with the TrustDomainAliases of the mesh.
+type ClusterTrustDomainHolder interface {
+	// ClusterTrustDomainAliases returns the trust domain aliases of the cluster, or false to use those of the
+	// mesh.
+	ClusterTrustDomainAliases(clusterID cluster.ID) ([]string, bool)
+}
+
+// ClusterTrustDomainConfigHolder may be implemented by Options.MeshHolder to give the clusters of a federation their
+// own trust domain, see TrustDomainsForService.
+type ClusterTrustDomainConfigHolder interface {
+	// ClusterTrustDomain returns the trust domain of the cluster and the endpoint of its SPIFFE bundle, which may
+	// be empty, or false to use the trust domain of the mesh.
+	ClusterTrustDomain(clusterID cluster.ID) (trustDomain, bundleEndpoint string, ok bool)
+}
+
+// TrustDomainInfo is a trust domain of the registries of a service.
+type TrustDomainInfo struct {
+	TrustDomain string `json:"trustDomain"`
+	// BundleEndpoint is the endpoint of the SPIFFE bundle of the trust domain, empty if unknown.
+	BundleEndpoint string `json:"bundleEndpoint,omitempty"`
+	// Clusters are the clusters of the registries of the service in the trust domain, sorted.
+	Clusters []cluster.ID `json:"clusters"`
+}
+
+// TrustDomainsForService returns the trust domains of the registries reporting the service, sorted: the trust
+// domain of their cluster if Options.MeshHolder is a ClusterTrustDomainConfigHolder configuring it, that of the
+// mesh otherwise. The bundle endpoint configured for the cluster is preferred to that of
+// Options.SpiffeBundleEndpoints.
+func (c *Controller) TrustDomainsForService(svc *model.Service) []TrustDomainInfo {
+	meshTrustDomain := ""
+	if c.meshHolder != nil {
+		meshTrustDomain = c.meshHolder.Mesh().GetTrustDomain()
+	}
+	if meshTrustDomain == "" {
+		meshTrustDomain = spiffe.GetTrustDomain()
+	}
+	holder, _ := c.meshHolder.(ClusterTrustDomainConfigHolder)
+
+	byTrustDomain := map[string]*TrustDomainInfo{}
+	clusters := map[string]map[cluster.ID]struct{}{}
+	for _, r := range c.GetRegistries() {
+		if c.registryStopped(registryKey{cluster: r.Cluster(), provider: r.Provider()}) {
+			continue
+		}
+		if found, _ := r.GetService(svc.ClusterLocal.Hostname); found == nil {
+			continue
+		}
+		trustDomain, endpoint := meshTrustDomain, ""
+		if holder != nil {
+			if td, e, ok := holder.ClusterTrustDomain(r.Cluster()); ok && td != "" {
+				trustDomain, endpoint = td, e
+			}
+		}
+		trustDomain = strings.ToLower(trustDomain)
+		info, f := byTrustDomain[trustDomain]
+		if !f {
+			info = &TrustDomainInfo{TrustDomain: trustDomain}
+			byTrustDomain[trustDomain] = info
+			clusters[trustDomain] = map[cluster.ID]struct{}{}
+		}
+		if info.BundleEndpoint == "" {
+			info.BundleEndpoint = endpoint
+		}
+		clusters[trustDomain][r.Cluster()] = struct{}{}
+	}
+
+	out := make([]TrustDomainInfo, 0, len(byTrustDomain))
+	for trustDomain, info := range byTrustDomain {
+		if info.BundleEndpoint == "" {
+			info.BundleEndpoint = c.bundleEndpoints[trustDomain]
+		}
+		info.Clusters = make([]cluster.ID, 0, len(clusters[trustDomain]))
+		for clusterID := range clusters[trustDomain] {
+			info.Clusters = append(info.Clusters, clusterID)
+		}
+		sort.Slice(info.Clusters, func(i, j int) bool { return info.Clusters[i] < info.Clusters[j] })
+		out = append(out, *info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].TrustDomain < out[j].TrustDomain })
+	return out
+}
+
+// trustDomainAliases returns the trust domain aliases to expand the service accounts of each registry with, and
+// a signature identifying them, for the service accounts cache.
+func (c *Controller) trustDomainAliases(registries []serviceregistry.Instance) ([][]string, []string) {
+	meshAliases := []string{}
+	if c.meshHolder != nil {
+		if mesh := c.meshHolder.Mesh(); mesh != nil {
+			meshAliases = mesh.TrustDomainAliases
+		}
+	}
+	aliases := make([][]string, len(registries))
+	holder, ok := c.meshHolder.(ClusterTrustDomainHolder)
+	if !ok {
+		for i := range registries {
+			aliases[i] = meshAliases
+		}
+		return aliases, meshAliases
+	}
+	signature := make([]string, 0, len(registries))
+	for i, r := range registries {
+		if clusterAliases, f := holder.ClusterTrustDomainAliases(r.Cluster()); f {
+			aliases[i] = clusterAliases
+		} else {
+			aliases[i] = meshAliases
+		}
+		signature = append(signature, string(r.Cluster())+"="+strings.Join(aliases[i], ","))
+	}
+	return aliases, signature
+}
+
+// truncateExpandedAccounts returns the accounts bounded by Options.MaxExpandedServiceAccounts: the accounts reported
+// by the registries, and as many of the accounts added by the expansion as fit, the first in order.
+func (c *Controller) truncateExpandedAccounts(svc *model.Service, results []registryAccounts,
+	accounts map[string]struct{}) []string {
+	reported := map[string]struct{}{}
+	for _, res := range results {
+		for _, sa := range res.reported {
+			reported[sa] = struct{}{}
+		}
+	}
+	expanded := make([]string, 0, len(accounts))
+	for sa := range accounts {
+		if _, f := reported[sa]; !f {
+			expanded = append(expanded, sa)
+		}
+	}
+	sort.Strings(expanded)
+	keep := c.maxExpandedAccounts - len(reported)
+	if keep < 0 {
+		keep = 0
+	}
+	if keep >= len(expanded) {
+		return sortedAccounts(accounts)
+	}
+	out := sortedAccounts(reported)
+	out = append(out, expanded[:keep]...)
+	sort.Strings(out)
+
+	expandedAccountsTruncated.Increment()
+	if c.expansionLogLimiter.Allow(string(svc.ClusterLocal.Hostname)) {
+		log.Warnf("service accounts of %s expanded with the trust domain aliases truncated from %d to %d, past MaxExpandedServiceAccounts",
+			svc.ClusterLocal.Hostname, len(accounts), len(out))
+	}
+	return out
+}
+
+// meshConfigNotifier is implemented by mesh holders able to notify the changes of the mesh config, such as
+// mesh.Watcher and model.Environment.
+type meshConfigNotifier interface {
+	AddMeshHandler(h func())
+}
+
+type meshConfigHandler struct {
+	site string
+	f    func()
+}
+
+func (h meshConfigHandler) handle() {
+	defer recoverHandler(nil, "meshconfig", "meshconfig", h.site, model.EventUpdate, "trust domain aliases", "", "")
+	h.f()
+}
+
+// AppendMeshConfigDependentHandler adds a handler called when the trust domain aliases of the mesh config change,
+// once GetIstioServiceAccounts reflects them, so that what was derived from the service accounts can be pushed
+// again. The changes are only known if Options.MeshHolder notifies them, as mesh.Watcher does, from the first Run.
+func (c *Controller) AppendMeshConfigDependentHandler(h func()) {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+	// the handlers are replaced rather than modified, so that they can be called without the lock
+	n := len(c.meshConfigHandlers)
+	c.meshConfigHandlers = append(c.meshConfigHandlers[:n:n], meshConfigHandler{site: registrationSite(), f: h})
+	recordHandlerCount("meshconfig", len(c.meshConfigHandlers))
+}
+
+// watchMeshConfig registers with Options.MeshHolder for the changes of the mesh config, once. It is deferred to
+// Run as the holder, such as the model.Environment of the server, may not be able to notify them before.
+// The storeLock must be held.
+func (c *Controller) watchMeshConfig() {
+	notifier, ok := c.meshHolder.(meshConfigNotifier)
+	if !ok || c.meshWatched {
+		return
+	}
+	c.meshWatched = true
+	_, signature := c.trustDomainAliases(c.registries)
+	c.meshAliases = strings.Join(signature, ";")
+	notifier.AddMeshHandler(c.meshConfigChanged)
+}
+
+// meshConfigChanged clears the service accounts cache and calls the mesh config dependent handlers if the
+// trust domain aliases changed.
+func (c *Controller) meshConfigChanged() {
+	c.storeLock.Lock()
+	_, signature := c.trustDomainAliases(c.registries)
+	aliases := strings.Join(signature, ";")
+	if aliases == c.meshAliases {
+		c.storeLock.Unlock()
+		return
+	}
+	c.meshAliases = aliases
+	if c.accountsCache != nil {
+		c.accountsCache.clear()
+	}
+	handlers := c.meshConfigHandlers
+	c.storeLock.Unlock()
+	log.Infof("Trust domain aliases changed to %v", signature)
+	for _, h := range handlers {
+		h.handle()
+	}
+}
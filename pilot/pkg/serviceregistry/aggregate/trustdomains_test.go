@@ -0,0 +1,285 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"go.uber.org/atomic"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/spiffe"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// federationHolder gives some clusters their own trust domain aliases.
+type federationHolder struct {
+	meshAliases    []string
+	clusterAliases map[cluster.ID][]string
+}
+
+func (h *federationHolder) Mesh() *meshconfig.MeshConfig {
+	return &meshconfig.MeshConfig{TrustDomainAliases: h.meshAliases}
+}
+
+func (h *federationHolder) ClusterTrustDomainAliases(clusterID cluster.ID) ([]string, bool) {
+	aliases, f := h.clusterAliases[clusterID]
+	return aliases, f
+}
+
+func TestClusterTrustDomainAliases(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "east")
+	holder := &federationHolder{
+		meshAliases:    []string{"cluster.local", "mesh.example.com"},
+		clusterAliases: map[cluster.ID][]string{"west": {"west.example.com", "west-legacy.example.com"}},
+	}
+	for _, size := range []int{0, 10} {
+		ctl := NewController(Options{MeshHolder: holder, ServiceAccountsCacheSize: size})
+		ctl.AddRegistry(newAccountsRegistry("east", svc, "spiffe://cluster.local/ns/default/sa/east"))
+		ctl.AddRegistry(newAccountsRegistry("west", svc, "spiffe://west.example.com/ns/default/sa/west"))
+
+		// each registry is expanded with its own aliases, the east one with those of the mesh
+		want := []string{
+			"spiffe://cluster.local/ns/default/sa/east",
+			"spiffe://mesh.example.com/ns/default/sa/east",
+			"spiffe://west-legacy.example.com/ns/default/sa/west",
+			"spiffe://west.example.com/ns/default/sa/west",
+		}
+		if got := ctl.GetIstioServiceAccounts(svc, []int{80}); !reflect.DeepEqual(got, want) {
+			t.Fatalf("cache size %d: expected the accounts %v, got %v", size, want, got)
+		}
+
+		// the aliases of a cluster are not cached past their change
+		holder.clusterAliases["west"] = []string{"west.example.com"}
+		want = []string{
+			"spiffe://cluster.local/ns/default/sa/east",
+			"spiffe://mesh.example.com/ns/default/sa/east",
+			"spiffe://west.example.com/ns/default/sa/west",
+		}
+		if got := ctl.GetIstioServiceAccounts(svc, []int{80}); !reflect.DeepEqual(got, want) {
+			t.Fatalf("cache size %d: expected the accounts %v, got %v", size, want, got)
+		}
+		holder.clusterAliases["west"] = []string{"west.example.com", "west-legacy.example.com"}
+	}
+}
+
+// notifyingMeshHolder is a federationHolder notifying the changes of its mesh config.
+type notifyingMeshHolder struct {
+	federationHolder
+	mu       sync.Mutex
+	handlers []func()
+}
+
+func (h *notifyingMeshHolder) AddMeshHandler(f func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlers = append(h.handlers, f)
+}
+
+func (h *notifyingMeshHolder) handlerCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.handlers)
+}
+
+func (h *notifyingMeshHolder) changed() {
+	h.mu.Lock()
+	handlers := h.handlers
+	h.mu.Unlock()
+	for _, f := range handlers {
+		f()
+	}
+}
+
+func TestMeshConfigDependentHandler(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "east")
+	holder := &notifyingMeshHolder{federationHolder: federationHolder{meshAliases: []string{"cluster.local"}}}
+	ctl := NewController(Options{MeshHolder: holder, ServiceAccountsCacheSize: 10})
+	ctl.AddRegistry(newAccountsRegistry("east", svc, "spiffe://cluster.local/ns/default/sa/hello"))
+	fired := atomic.NewInt32(0)
+	ctl.AppendMeshConfigDependentHandler(func() {
+		fired.Inc()
+	})
+	// the aggregate watches the mesh config once, from the first Run
+	for i := 0; i < 2; i++ {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			ctl.Run(stop)
+			close(done)
+		}()
+		retry.UntilSuccessOrFail(t, func() error {
+			if holder.handlerCount() == 0 {
+				return errors.New("the aggregate is not watching the mesh config yet")
+			}
+			return nil
+		})
+		close(stop)
+		<-done
+	}
+	if holder.handlerCount() != 1 {
+		t.Fatalf("expected a single mesh handler, got %d", holder.handlerCount())
+	}
+
+	want := []string{"spiffe://cluster.local/ns/default/sa/hello"}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts %v, got %v", want, got)
+	}
+
+	// a change not touching the aliases is ignored
+	holder.changed()
+	if fired.Load() != 0 {
+		t.Fatalf("expected the handler not to be called, got %d calls", fired.Load())
+	}
+
+	holder.meshAliases = []string{"cluster.local", "example.com"}
+	holder.changed()
+	if fired.Load() != 1 {
+		t.Fatalf("expected the handler to be called once, got %d calls", fired.Load())
+	}
+	want = []string{"spiffe://cluster.local/ns/default/sa/hello", "spiffe://example.com/ns/default/sa/hello"}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts %v, got %v", want, got)
+	}
+	if ctl.accountsCache.len() != 1 {
+		t.Fatalf("expected a single cached entry, got %d", ctl.accountsCache.len())
+	}
+}
+
+func TestMaxExpandedServiceAccounts(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "east")
+	holder := &mockMeshConfigHolder{trustDomainAliases: []string{"cluster.local", "a.example.com", "b.example.com"}}
+	reported := []string{"spiffe://cluster.local/ns/default/sa/one", "spiffe://cluster.local/ns/default/sa/two"}
+	// the expansion gives 6 accounts: the 2 reported, and 4 with the aliases
+	all := []string{
+		"spiffe://a.example.com/ns/default/sa/one",
+		"spiffe://a.example.com/ns/default/sa/two",
+		"spiffe://b.example.com/ns/default/sa/one",
+		"spiffe://b.example.com/ns/default/sa/two",
+		"spiffe://cluster.local/ns/default/sa/one",
+		"spiffe://cluster.local/ns/default/sa/two",
+	}
+	cases := []struct {
+		name string
+		max  int
+		want []string
+	}{
+		{"unbounded", 0, all},
+		{"under cap", 10, all},
+		{"at cap", 6, all},
+		{
+			name: "over cap",
+			max:  4,
+			want: []string{
+				"spiffe://a.example.com/ns/default/sa/one",
+				"spiffe://a.example.com/ns/default/sa/two",
+				"spiffe://cluster.local/ns/default/sa/one",
+				"spiffe://cluster.local/ns/default/sa/two",
+			},
+		},
+		// the accounts reported by the registries are kept past the cap
+		{"below the reported accounts", 1, reported},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := getCounterTotal(t, "pilot_aggregate_expanded_service_accounts_truncated")
+			// the truncation does not depend on the registry reporting the accounts
+			for _, registries := range [][]string{{"east", "west"}, {"west", "east"}} {
+				ctl := NewController(Options{MeshHolder: holder, MaxExpandedServiceAccounts: tc.max})
+				ctl.AddRegistry(newAccountsRegistry(cluster.ID(registries[0]), svc, reported[0]))
+				ctl.AddRegistry(newAccountsRegistry(cluster.ID(registries[1]), svc, reported[1]))
+				if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, tc.want) {
+					t.Fatalf("expected the accounts %v, got %v", tc.want, got)
+				}
+			}
+			truncated := getCounterTotal(t, "pilot_aggregate_expanded_service_accounts_truncated") - before
+			if wantTruncated := tc.max > 0 && tc.max < len(all); truncated != 0 != wantTruncated {
+				t.Fatalf("expected the truncation to be counted %v, got %v", wantTruncated, truncated)
+			}
+		})
+	}
+
+	// without aliases, the accounts are not expanded
+	ctl := NewController(Options{MeshHolder: &mockMeshConfigHolder{}, MaxExpandedServiceAccounts: 1})
+	ctl.AddRegistry(newAccountsRegistry("east", svc, reported[0], "spiffe://cluster.local/hello@iam.gserviceaccount.com"))
+	before := getCounterTotal(t, "pilot_aggregate_expanded_service_accounts_truncated")
+	want := []string{"spiffe://cluster.local/hello@iam.gserviceaccount.com", reported[0]}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts %v, got %v", want, got)
+	}
+	if getCounterTotal(t, "pilot_aggregate_expanded_service_accounts_truncated") != before {
+		t.Fatalf("expected no truncation without expansion")
+	}
+}
+
+// trustDomainHolder gives some clusters their own trust domain.
+type trustDomainHolder struct {
+	meshTrustDomain string
+	trustDomains    map[cluster.ID][2]string
+}
+
+func (h *trustDomainHolder) Mesh() *meshconfig.MeshConfig {
+	return &meshconfig.MeshConfig{TrustDomain: h.meshTrustDomain}
+}
+
+func (h *trustDomainHolder) ClusterTrustDomain(clusterID cluster.ID) (string, string, bool) {
+	td, f := h.trustDomains[clusterID]
+	return td[0], td[1], f
+}
+
+func TestTrustDomainsForService(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "east")
+	other := mock.MakeService("other.default.svc.cluster.local", "10.10.0.1", []string{}, "north")
+	holder := &trustDomainHolder{
+		meshTrustDomain: "mesh.example.com",
+		trustDomains: map[cluster.ID][2]string{
+			"east":  {"East.example.com", "https://bundle.east.example.com"},
+			"south": {"east.example.com", ""},
+			"north": {"north.example.com", "https://bundle.north.example.com"},
+		},
+	}
+	ctl := NewController(Options{
+		MeshHolder:            holder,
+		SpiffeBundleEndpoints: map[string]string{"mesh.example.com": "https://bundle.mesh.example.com"},
+	})
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "south", svc))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "east", svc))
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "west", svc))
+	// the registry of cluster north does not have the service
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "north", other))
+
+	want := []TrustDomainInfo{
+		{TrustDomain: "east.example.com", BundleEndpoint: "https://bundle.east.example.com", Clusters: []cluster.ID{"east", "south"}},
+		// the cluster west without a trust domain of its own is in the trust domain of the mesh
+		{TrustDomain: "mesh.example.com", BundleEndpoint: "https://bundle.mesh.example.com", Clusters: []cluster.ID{"west"}},
+	}
+	if got := ctl.TrustDomainsForService(svc); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the trust domains %+v, got %+v", want, got)
+	}
+
+	// without a mesh trust domain, that of the process is used
+	ctl = NewController(Options{})
+	ctl.AddRegistry(newMemoryRegistry(provider.Kubernetes, "west", svc))
+	want = []TrustDomainInfo{{TrustDomain: spiffe.GetTrustDomain(), Clusters: []cluster.ID{"west"}}}
+	if got := ctl.TrustDomainsForService(svc); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the trust domains %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/host"
+)
+
+// unchangedServices holds a hash of the merged services last dispatched to the handlers, by hostname.
+type unchangedServices struct {
+	mu     sync.Mutex
+	hashes map[host.Name]uint64
+}
+
+func newUnchangedServices() *unchangedServices {
+	return &unchangedServices{hashes: map[host.Name]uint64{}}
+}
+
+// unchanged records the merged service, nil if deleted, returning true if it has the same hash as the previous
+// one of its hostname.
+func (u *unchangedServices) unchanged(hostname host.Name, merged *model.Service) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if merged == nil {
+		delete(u.hashes, hostname)
+		return false
+	}
+	h := hashService(merged)
+	if prev, f := u.hashes[hostname]; f && prev == h {
+		return true
+	}
+	u.hashes[hostname] = h
+	return false
+}
+
+// suppressUnchanged returns true if the event leaves the merged service unchanged, and is not to be dispatched to
+// the coalesced handlers. A nil source is a coalesced event, already carrying the merged service. It is called
+// with the sequence of the hostname held.
+func (c *Controller) suppressUnchanged(svc *model.Service, event model.Event, source *eventSource) bool {
+	if c.unchanged == nil {
+		return false
+	}
+	hostname := svc.ClusterLocal.Hostname
+	if event == model.EventDelete {
+		c.unchanged.unchanged(hostname, nil)
+		return false
+	}
+	merged := svc
+	if source != nil {
+		var err error
+		if merged, err = c.GetService(hostname); err != nil || merged == nil {
+			// the merged service is unknown, forget the previous one
+			c.unchanged.unchanged(hostname, nil)
+			return false
+		}
+	}
+	if !c.unchanged.unchanged(hostname, merged) {
+		return false
+	}
+	serviceEventsSuppressed.Increment()
+	return true
+}
+
+// hashService hashes what the handlers observe of a service: its ports, addresses, labels, service accounts and
+// resolution. The resource version and creation time are left out.
+func hashService(svc *model.Service) uint64 {
+	h := fnv.New64a()
+	write := func(values ...string) {
+		for _, v := range values {
+			_, _ = h.Write([]byte(v))
+			_, _ = h.Write([]byte{0})
+		}
+	}
+	write(string(svc.ClusterLocal.Hostname), svc.Attributes.Namespace, svc.Address, svc.AutoAllocatedAddress,
+		svc.Resolution.String(), strconv.FormatBool(svc.MeshExternal))
+	for _, p := range svc.Ports {
+		write(p.Name, strconv.Itoa(p.Port), string(p.Protocol))
+	}
+	writeAddressMap(write, &svc.ClusterLocal.ClusterVIPs)
+	writeAddressMap(write, &svc.Attributes.ClusterExternalAddresses)
+	writeSortedMap(write, svc.Attributes.Labels)
+	writeSortedMap(write, svc.Attributes.LabelSelectors)
+	accounts := append([]string(nil), svc.ServiceAccounts...)
+	sort.Strings(accounts)
+	write(accounts...)
+	return h.Sum64()
+}
+
+func writeAddressMap(write func(...string), m *cluster.AddressMap) {
+	addresses := m.GetAddresses()
+	clusters := make([]string, 0, len(addresses))
+	for c := range addresses {
+		clusters = append(clusters, string(c))
+	}
+	sort.Strings(clusters)
+	for _, c := range clusters {
+		write(c, strconv.Itoa(len(addresses[cluster.ID(c)])))
+		write(addresses[cluster.ID(c)]...)
+	}
+	write("")
+}
+
+func writeSortedMap(write func(...string), m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		write(k, m[k])
+	}
+	write("")
+}
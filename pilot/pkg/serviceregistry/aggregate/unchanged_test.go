@@ -0,0 +1,90 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+)
+
+func TestSuppressUnchangedServiceEvents(t *testing.T) {
+	ctl := NewController(Options{SuppressUnchangedServiceEvents: true})
+	svc1 := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.1", []string{}, "cluster-1")
+	svc2 := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.2", []string{}, "cluster-2")
+	kube1 := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc1)
+	kube2 := newMemoryRegistry(provider.Kubernetes, "cluster-2", svc2)
+	ctl.AddRegistry(kube1)
+	ctl.AddRegistry(kube2)
+
+	var events []model.Event
+	ctl.AppendServiceHandler(func(_ *model.Service, event model.Event) {
+		events = append(events, event)
+	})
+	recorder := NewEventRecorder(ctl)
+	defer recorder.Close()
+
+	before := getCounterTotal(t, "pilot_aggregate_service_events_suppressed")
+	// both clusters roll the same service
+	fakeControllerOf(kube1).fireService(svc1, model.EventUpdate)
+	fakeControllerOf(kube2).fireService(svc2, model.EventUpdate)
+	if len(events) != 1 {
+		t.Fatalf("expected the identical update to be suppressed, got %d events", len(events))
+	}
+	if got := getCounterTotal(t, "pilot_aggregate_service_events_suppressed") - before; got != 1 {
+		t.Errorf("expected 1 suppressed event, got %v", got)
+	}
+	// the handlers with a source are given every event
+	if len(recorder.Events()) != 2 {
+		t.Errorf("expected the events of both clusters to be recorded, got %d", len(recorder.Events()))
+	}
+
+	// a change of the VIP of a cluster changes the merged service
+	svc2.Address = "10.10.0.3"
+	fakeControllerOf(kube2).fireService(svc2, model.EventUpdate)
+	if len(events) != 2 {
+		t.Fatalf("expected the VIP change to be delivered, got %d events", len(events))
+	}
+
+	// deletes are delivered, and the next update is not compared with the deleted service
+	fakeControllerOf(kube2).fireService(svc2, model.EventDelete)
+	fakeControllerOf(kube2).fireService(svc2, model.EventUpdate)
+	if len(events) != 4 {
+		t.Errorf("expected the delete and the next update to be delivered, got %d events", len(events))
+	}
+}
+
+func TestHashService(t *testing.T) {
+	base := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.1", []string{"sa"}, "cluster-1")
+	same := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.1", []string{"sa"}, "cluster-1")
+	same.ResourceVersion = "2"
+	if hashService(base) != hashService(same) {
+		t.Errorf("expected the services differing by resource version to have the same hash")
+	}
+	for name, change := range map[string]func(*model.Service){
+		"vips":     func(s *model.Service) { s.ClusterLocal.ClusterVIPs.SetAddressesFor("cluster-2", []string{"10.10.0.2"}) },
+		"ports":    func(s *model.Service) { s.Ports = s.Ports[1:] },
+		"labels":   func(s *model.Service) { s.Attributes.Labels = map[string]string{"app": "hello"} },
+		"accounts": func(s *model.Service) { s.ServiceAccounts = []string{"other"} },
+	} {
+		changed := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.1", []string{"sa"}, "cluster-1")
+		change(changed)
+		if hashService(base) == hashService(changed) {
+			t.Errorf("expected a change of the %s to change the hash", name)
+		}
+	}
+}
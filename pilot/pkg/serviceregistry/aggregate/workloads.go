@@ -0,0 +1,306 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sort"
+	"sync"
+
+	"go.uber.org/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/pkg/log"
+)
+
+type workloadKey struct {
+	name      string
+	namespace string
+}
+
+type registryKey struct {
+	cluster  cluster.ID
+	provider provider.ID
+}
+
+type indexedWorkload struct {
+	registry registryKey
+	instance *model.WorkloadInstance
+}
+
+// workloadIndex tracks the workload instances reported by the workload events of the registries.
+// The same workload may be reported by more than one registry; each registry's copy is kept, in the
+// order they were first reported.
+type workloadIndex struct {
+	mu        sync.RWMutex
+	workloads map[workloadKey][]indexedWorkload
+	// selected caches the workloads matching a namespace and selector. It is reset by every change to
+	// the index.
+	selected map[selectorKey][]indexedWorkload
+}
+
+type selectorKey struct {
+	namespace string
+	selector  string
+}
+
+func newWorkloadIndex() *workloadIndex {
+	return &workloadIndex{
+		workloads: map[workloadKey][]indexedWorkload{},
+		selected:  map[selectorKey][]indexedWorkload{},
+	}
+}
+
+func (w *workloadIndex) update(registry registryKey, wi *model.WorkloadInstance, event model.Event) {
+	key := workloadKey{name: wi.Name, namespace: wi.Namespace}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.selected = map[selectorKey][]indexedWorkload{}
+	entries := w.workloads[key]
+	for i, e := range entries {
+		if e.registry != registry {
+			continue
+		}
+		if event == model.EventDelete {
+			entries = append(entries[:i:i], entries[i+1:]...)
+			if len(entries) == 0 {
+				delete(w.workloads, key)
+			} else {
+				w.workloads[key] = entries
+			}
+		} else {
+			entries[i].instance = wi
+		}
+		return
+	}
+	if event != model.EventDelete {
+		w.workloads[key] = append(entries, indexedWorkload{registry: registry, instance: wi})
+	}
+}
+
+// deleteRegistry drops every workload reported by the registry.
+func (w *workloadIndex) deleteRegistry(registry registryKey) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.selected = map[selectorKey][]indexedWorkload{}
+	for key, entries := range w.workloads {
+		kept := entries[:0:0]
+		for _, e := range entries {
+			if e.registry != registry {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(w.workloads, key)
+		} else if len(kept) != len(entries) {
+			w.workloads[key] = kept
+		}
+	}
+}
+
+func (w *workloadIndex) get(name, namespace string) *model.WorkloadInstance {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	entries := w.workloads[workloadKey{name: name, namespace: namespace}]
+	if len(entries) == 0 {
+		return nil
+	}
+	return entries[0].instance
+}
+
+func (w *workloadIndex) list(namespace string) []*model.WorkloadInstance {
+	w.mu.RLock()
+	out := make([]*model.WorkloadInstance, 0)
+	for key, entries := range w.workloads {
+		if namespace == "" || key.namespace == namespace {
+			out = append(out, entries[0].instance)
+		}
+	}
+	w.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Namespace != out[j].Namespace {
+			return out[i].Namespace < out[j].Namespace
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// selectWorkloads returns every registry's copy of the workloads of the namespace whose labels contain the
+// selector, sorted by name.
+func (w *workloadIndex) selectWorkloads(namespace string, selector labels.Instance) []indexedWorkload {
+	key := selectorKey{namespace: namespace, selector: selector.String()}
+	w.mu.RLock()
+	out, ok := w.selected[key]
+	w.mu.RUnlock()
+	if ok {
+		return out
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if out, ok := w.selected[key]; ok {
+		return out
+	}
+	out = make([]indexedWorkload, 0)
+	for k, entries := range w.workloads {
+		if k.namespace != namespace {
+			continue
+		}
+		for _, e := range entries {
+			if e.instance.Endpoint != nil && selector.SubsetOf(e.instance.Endpoint.Labels) {
+				out = append(out, e)
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].instance.Name < out[j].instance.Name
+	})
+	w.selected[key] = out
+	return out
+}
+
+// GetWorkloadInstance returns the workload instance with the given name and namespace, as last reported
+// by the workload events of the registries, or nil if none is known. When more than one registry reports
+// the workload, the copy of the registry that reported it first is returned.
+//
+// The index is updated by a handler registered when the registry is added, ahead of the handlers appended
+// to the aggregate afterwards, so those handlers observe the index already reflecting their event.
+func (c *Controller) GetWorkloadInstance(name, namespace string) *model.WorkloadInstance {
+	return c.workloads.get(name, namespace)
+}
+
+// WorkloadInstances returns the known workload instances of the namespace, or of every namespace if it is
+// empty, sorted by namespace and name.
+func (c *Controller) WorkloadInstances(namespace string) []*model.WorkloadInstance {
+	return c.workloads.list(namespace)
+}
+
+// selectedWorkloadInstances returns, for Options.SelectWorkloadsAcrossRegistries, the instances of the
+// workloads selected by svc that were reported by one of the searched registries, grouped by registry.
+// The endpoint port is the workload port named like the service port, or the service port itself.
+// Workloads the registry of the service already selected are collapsed by the deduplication of the
+// aggregated instances.
+func (c *Controller) selectedWorkloadInstances(svc *model.Service, port int, lbls labels.Collection,
+	registries []serviceregistry.Instance) []registryInstances {
+	if svc.Attributes.ServiceRegistry != provider.Kubernetes || svc.MeshExternal ||
+		svc.Resolution != model.ClientSideLB || len(svc.Attributes.LabelSelectors) == 0 {
+		return nil
+	}
+	servicePort, ok := svc.Ports.GetByPort(port)
+	if !ok {
+		return nil
+	}
+	searched := make(map[registryKey]int, len(registries))
+	for _, r := range registries {
+		searched[registryKey{cluster: r.Cluster(), provider: r.Provider()}] = -1
+	}
+
+	var out []registryInstances
+	for _, e := range c.workloads.selectWorkloads(svc.Attributes.Namespace, svc.Attributes.LabelSelectors) {
+		i, ok := searched[e.registry]
+		if !ok || !lbls.HasSubsetOf(e.instance.Endpoint.Labels) {
+			continue
+		}
+		if i < 0 {
+			i = len(out)
+			searched[e.registry] = i
+			out = append(out, registryInstances{cluster: e.registry.cluster, provider: e.registry.provider})
+		}
+		ep := *e.instance.Endpoint
+		ep.EndpointPort = uint32(port)
+		if p := e.instance.PortMap[servicePort.Name]; p != 0 {
+			ep.EndpointPort = p
+		}
+		ep.ServicePortName = servicePort.Name
+		out[i].instances = append(out[i].instances, &model.ServiceInstance{
+			Service:     svc,
+			ServicePort: servicePort,
+			Endpoint:    &ep,
+		})
+	}
+	return out
+}
+
+// selectedWorkloadAccounts returns the service accounts of the workloads selected by svc, by index of the
+// registry among registries that reported them, or nil if none. The registries do not always report the
+// accounts of the workloads they did not select themselves, such as WorkloadEntries of another registry.
+// With Options.VerifyServiceAccountPorts, only the workloads serving one of the ports are kept.
+func (c *Controller) selectedWorkloadAccounts(svc *model.Service, ports []int,
+	registries []serviceregistry.Instance) [][]string {
+	if len(svc.Attributes.LabelSelectors) == 0 {
+		return nil
+	}
+	indexes := make(map[registryKey]int, len(registries))
+	for i, r := range registries {
+		indexes[registryKey{cluster: r.Cluster(), provider: r.Provider()}] = i
+	}
+	var out [][]string
+	for _, e := range c.workloads.selectWorkloads(svc.Attributes.Namespace, svc.Attributes.LabelSelectors) {
+		i, ok := indexes[e.registry]
+		if !ok || e.instance.Endpoint.ServiceAccount == "" {
+			continue
+		}
+		if c.verifyAccountPorts && len(ports) > 0 && !workloadServesPorts(svc, e.instance, ports) {
+			log.Debugf("dropping the account %s of workload %s/%s selected by service %s, not serving the ports %v",
+				e.instance.Endpoint.ServiceAccount, e.instance.Namespace, e.instance.Name, svc.ClusterLocal.Hostname, ports)
+			continue
+		}
+		if out == nil {
+			out = make([][]string, len(registries))
+		}
+		out[i] = append(out[i], e.instance.Endpoint.ServiceAccount)
+	}
+	return out
+}
+
+// workloadServesPorts returns true if the workload serves one of the ports of svc: a port its PortMap names
+// like the service port, or any port of the service if its PortMap is empty.
+func workloadServesPorts(svc *model.Service, wi *model.WorkloadInstance, ports []int) bool {
+	for _, port := range ports {
+		servicePort, ok := svc.Ports.GetByPort(port)
+		if !ok {
+			continue
+		}
+		if len(wi.PortMap) == 0 || wi.PortMap[servicePort.Name] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// watchWorkloads keeps the workload index up to date with the workload events of the registry, recording the
+// time of each in lastEvent.
+func (c *Controller) watchWorkloads(registry registryKey, r model.Controller, lastEvent *atomic.Int64) {
+	r.AppendWorkloadHandler(func(wi *model.WorkloadInstance, event model.Event) {
+		c.syncs.recordEvent(lastEvent)
+		c.workloads.update(registry, wi, event)
+	})
+}
+
+// hasController returns false for registries assembled from a serviceregistry.Simple without a controller,
+// which produce no events and cannot have handlers appended.
+func hasController(r serviceregistry.Instance) bool {
+	switch s := r.(type) {
+	case serviceregistry.Simple:
+		return s.Controller != nil
+	case *serviceregistry.Simple:
+		return s.Controller != nil
+	}
+	return true
+}
@@ -0,0 +1,296 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func makeWorkload(name, namespace, address string) *model.WorkloadInstance {
+	return &model.WorkloadInstance{
+		Name:      name,
+		Namespace: namespace,
+		Endpoint:  &model.IstioEndpoint{Address: address},
+	}
+}
+
+func workloadNames(instances []*model.WorkloadInstance) []string {
+	out := make([]string, 0, len(instances))
+	for _, wi := range instances {
+		out = append(out, wi.Namespace+"/"+wi.Name)
+	}
+	return out
+}
+
+func TestWorkloadInstances(t *testing.T) {
+	svc := mock.MakeService("vm.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-1")
+	external := newMemoryRegistry(provider.External, "", svc)
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-1", svc)
+	ctl := NewController(Options{})
+	ctl.AddRegistry(external)
+	ctl.AddRegistry(kube)
+
+	// a handler appended to the aggregate sees the index already updated for its event
+	var observed []*model.WorkloadInstance
+	ctl.AppendWorkloadHandler(func(wi *model.WorkloadInstance, _ model.Event) {
+		observed = append(observed, ctl.GetWorkloadInstance(wi.Name, wi.Namespace))
+	})
+
+	vm := makeWorkload("vm", "default", "1.1.1.1")
+	fakeControllerOf(external).fireWorkload(vm, model.EventAdd)
+	if got := ctl.GetWorkloadInstance("vm", "default"); got != vm {
+		t.Fatalf("expected the added workload, got %v", got)
+	}
+	if observed[0] != vm {
+		t.Fatalf("handler observed %v before the index was updated", observed[0])
+	}
+
+	updated := makeWorkload("vm", "default", "1.1.1.2")
+	fakeControllerOf(external).fireWorkload(updated, model.EventUpdate)
+	if got := ctl.GetWorkloadInstance("vm", "default"); got != updated {
+		t.Fatalf("expected the updated workload, got %v", got)
+	}
+
+	// the same workload reported by a second registry survives its removal from the first one
+	fromKube := makeWorkload("vm", "default", "1.1.1.3")
+	fakeControllerOf(kube).fireWorkload(fromKube, model.EventAdd)
+	fakeControllerOf(kube).fireWorkload(makeWorkload("pod", "other", "2.2.2.2"), model.EventAdd)
+	if got := workloadNames(ctl.WorkloadInstances("")); len(got) != 2 || got[0] != "default/vm" || got[1] != "other/pod" {
+		t.Fatalf("unexpected workloads %v", got)
+	}
+	if got := workloadNames(ctl.WorkloadInstances("other")); len(got) != 1 || got[0] != "other/pod" {
+		t.Fatalf("unexpected workloads in namespace other %v", got)
+	}
+	fakeControllerOf(external).fireWorkload(updated, model.EventDelete)
+	if got := ctl.GetWorkloadInstance("vm", "default"); got != fromKube {
+		t.Fatalf("expected the workload reported by kubernetes, got %v", got)
+	}
+
+	fakeControllerOf(kube).fireWorkload(fromKube, model.EventDelete)
+	if got := ctl.GetWorkloadInstance("vm", "default"); got != nil {
+		t.Fatalf("expected the deleted workload to be gone, got %v", got)
+	}
+	if observed[len(observed)-1] != nil {
+		t.Fatalf("handler observed the deleted workload")
+	}
+
+	ctl.DeleteRegistry("cluster-1", provider.Kubernetes)
+	if got := ctl.WorkloadInstances(""); len(got) != 0 {
+		t.Fatalf("expected no workloads after deleting the registry, got %v", workloadNames(got))
+	}
+}
+
+func TestSelectWorkloadsAcrossRegistries(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-a")
+	svc.Attributes = model.ServiceAttributes{
+		ServiceRegistry: provider.Kubernetes,
+		Name:            "hello",
+		Namespace:       "default",
+		LabelSelectors:  map[string]string{"app": "hello"},
+	}
+	kube := newMemoryRegistry(provider.Kubernetes, "cluster-a", svc, makeInstance(svc, "1.1.1.1", 80, "", nil))
+	external := newMemoryRegistry(provider.External, "", svc)
+
+	selected := makeWorkload("vm", "default", "2.2.2.2")
+	selected.Endpoint.Labels = map[string]string{"app": "hello", "version": "v1"}
+	selected.PortMap = map[string]uint32{mock.PortHTTPName: 8080}
+	otherApp := makeWorkload("other-app", "default", "3.3.3.3")
+	otherApp.Endpoint.Labels = map[string]string{"app": "other"}
+	otherNamespace := makeWorkload("vm", "other", "4.4.4.4")
+	otherNamespace.Endpoint.Labels = map[string]string{"app": "hello"}
+
+	for _, enabled := range []bool{false, true} {
+		ctl := NewController(Options{SelectWorkloadsAcrossRegistries: enabled})
+		ctl.AddRegistry(kube)
+		ctl.AddRegistry(external)
+		for _, wi := range []*model.WorkloadInstance{selected, otherApp, otherNamespace} {
+			fakeControllerOf(external).fireWorkload(wi, model.EventAdd)
+		}
+
+		got := ctl.InstancesByPort(svc, 80, nil)
+		if !enabled {
+			if len(got) != 1 {
+				t.Fatalf("expected only the instances of the service registry when disabled, got %d", len(got))
+			}
+			continue
+		}
+		if len(got) != 2 {
+			t.Fatalf("expected the service instance and the selected workload, got %d", len(got))
+		}
+		vm := got[1]
+		if vm.Endpoint.Address != "2.2.2.2" || vm.Endpoint.EndpointPort != 8080 || vm.Endpoint.ServicePortName != mock.PortHTTPName {
+			t.Errorf("unexpected workload instance %+v", vm.Endpoint)
+		}
+		if vm.Service != svc || vm.ServicePort.Port != 80 {
+			t.Errorf("unexpected service %v port %v", vm.Service.ClusterLocal.Hostname, vm.ServicePort)
+		}
+		// a port the workload does not name keeps the service port number
+		if got := ctl.InstancesByPort(svc, 81, nil); len(got) != 1 || got[0].Endpoint.EndpointPort != 81 {
+			t.Errorf("expected the workload on the service port, got %v", got)
+		}
+		// the memory registry does not match labels, only the selected workload is filtered
+		if got := ctl.InstancesByPort(svc, 80, labels.Collection{{"version": "v2"}}); len(got) != 1 || got[0].Endpoint.Address != "1.1.1.1" {
+			t.Errorf("expected the labels to filter the workload, got %v", got)
+		}
+
+		// the selection follows the workload events
+		fakeControllerOf(external).fireWorkload(selected, model.EventDelete)
+		if got := ctl.InstancesByPort(svc, 80, nil); len(got) != 1 {
+			t.Errorf("expected the deleted workload to be dropped, got %d instances", len(got))
+		}
+		fakeControllerOf(external).fireWorkload(selected, model.EventAdd)
+		ctl.DeleteRegistry("", provider.External)
+		if got := ctl.InstancesByPort(svc, 80, nil); len(got) != 1 {
+			t.Errorf("expected the workloads of the deleted registry to be dropped, got %d instances", len(got))
+		}
+	}
+}
+
+func TestGetIstioServiceAccountsSelectedWorkloads(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-a")
+	svc.Attributes = model.ServiceAttributes{
+		ServiceRegistry: provider.Kubernetes,
+		Name:            "hello",
+		Namespace:       "default",
+		LabelSelectors:  map[string]string{"app": "hello"},
+	}
+	podSA := "spiffe://cluster.local/ns/default/sa/pod"
+	kube := newAccountsRegistry("cluster-a", svc, podSA)
+	external := newMemoryRegistry(provider.External, "", svc)
+	fakeControllerOf(external).unsynced.Store(true)
+	holder := &mockMeshConfigHolder{trustDomainAliases: []string{"cluster.local", "example.com"}}
+	ctl := NewController(Options{MeshHolder: holder, ServiceAccountsCacheSize: 10})
+	ctl.AddRegistry(kube)
+	ctl.AddRegistry(external)
+
+	vm := makeWorkload("vm", "default", "2.2.2.2")
+	vm.Endpoint.Labels = map[string]string{"app": "hello"}
+	vm.Endpoint.ServiceAccount = "spiffe://cluster.local/ns/default/sa/vm"
+	otherApp := makeWorkload("other-app", "default", "3.3.3.3")
+	otherApp.Endpoint.Labels = map[string]string{"app": "other"}
+	otherApp.Endpoint.ServiceAccount = "spiffe://cluster.local/ns/default/sa/other"
+	fakeControllerOf(external).fireWorkload(vm, model.EventAdd)
+	fakeControllerOf(external).fireWorkload(otherApp, model.EventAdd)
+
+	// the workload index is not used before every registry has synced
+	want := []string{podSA, "spiffe://example.com/ns/default/sa/pod"}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts %v, got %v", want, got)
+	}
+
+	fakeControllerOf(external).unsynced.Store(false)
+	want = []string{
+		podSA,
+		"spiffe://cluster.local/ns/default/sa/vm",
+		"spiffe://example.com/ns/default/sa/pod",
+		"spiffe://example.com/ns/default/sa/vm",
+	}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts of the selected workload, got %v", got)
+	}
+	want = []string{podSA, "spiffe://cluster.local/ns/default/sa/vm"}
+	if got := ctl.GetIstioServiceAccountsRaw(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the raw accounts %v, got %v", want, got)
+	}
+
+	// the workload events invalidate the cached accounts
+	fakeControllerOf(external).fireWorkload(vm, model.EventDelete)
+	want = []string{podSA, "spiffe://example.com/ns/default/sa/pod"}
+	if got := ctl.GetIstioServiceAccounts(svc, nil); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the accounts of the deleted workload to be dropped, got %v", got)
+	}
+}
+
+func TestGetIstioServiceAccountsSelectedWorkloadsVerifyPorts(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.10.0.0", []string{}, "cluster-a")
+	svc.Attributes = model.ServiceAttributes{
+		ServiceRegistry: provider.Kubernetes,
+		Name:            "hello",
+		Namespace:       "default",
+		LabelSelectors:  map[string]string{"app": "hello"},
+	}
+	kube := newAccountsRegistry("cluster-a", svc)
+	external := newMemoryRegistry(provider.External, "", svc)
+
+	workload := func(name, address string, portMap map[string]uint32) *model.WorkloadInstance {
+		wi := makeWorkload(name, "default", address)
+		wi.Endpoint.Labels = map[string]string{"app": "hello"}
+		wi.Endpoint.ServiceAccount = "spiffe://cluster.local/ns/default/sa/" + name
+		wi.PortMap = portMap
+		return wi
+	}
+	httpVM := workload("http-vm", "2.2.2.2", map[string]uint32{mock.PortHTTPName: 8080})
+	mongoVM := workload("mongo-vm", "2.2.2.3", map[string]uint32{"mongo": 27017})
+	anyVM := workload("any-vm", "2.2.2.4", nil)
+
+	cases := []struct {
+		name   string
+		verify bool
+		ports  []int
+		want   []string
+	}{
+		{
+			name:  "not verified",
+			ports: []int{80},
+			want:  []string{"spiffe://cluster.local/ns/default/sa/any-vm", "spiffe://cluster.local/ns/default/sa/http-vm", "spiffe://cluster.local/ns/default/sa/mongo-vm"},
+		},
+		{
+			name:   "http port",
+			verify: true,
+			ports:  []int{80},
+			want:   []string{"spiffe://cluster.local/ns/default/sa/any-vm", "spiffe://cluster.local/ns/default/sa/http-vm"},
+		},
+		{
+			name:   "mongo port",
+			verify: true,
+			ports:  []int{100},
+			want:   []string{"spiffe://cluster.local/ns/default/sa/any-vm", "spiffe://cluster.local/ns/default/sa/mongo-vm"},
+		},
+		{
+			name:   "unknown port",
+			verify: true,
+			ports:  []int{9999},
+			want:   []string{},
+		},
+		{
+			name:   "no ports",
+			verify: true,
+			want:   []string{"spiffe://cluster.local/ns/default/sa/any-vm", "spiffe://cluster.local/ns/default/sa/http-vm", "spiffe://cluster.local/ns/default/sa/mongo-vm"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctl := NewController(Options{
+				MeshHolder:                      &mockMeshConfigHolder{},
+				SelectWorkloadsAcrossRegistries: true,
+				VerifyServiceAccountPorts:       tc.verify,
+			})
+			ctl.AddRegistry(kube)
+			ctl.AddRegistry(external)
+			for _, wi := range []*model.WorkloadInstance{httpVM, mongoVM, anyVM} {
+				fakeControllerOf(external).fireWorkload(wi, model.EventAdd)
+			}
+			if got := ctl.GetIstioServiceAccounts(svc, tc.ports); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected the accounts %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -35,6 +35,14 @@ type Instance interface {
 
 var _ Instance = &Simple{}
 
+// ClusterScoped may be implemented by non-Kubernetes registries that only hold the workloads of their
+// Cluster(), such as a per-cluster WorkloadEntry store. Registries of a cluster scope are skipped by the
+// lookups of proxies in other clusters, like Kubernetes registries. Registries not implementing it are
+// assumed to hold workloads of any cluster.
+type ClusterScoped interface {
+	ClusterScoped() bool
+}
+
 // Simple Instance implementation, where fields are set individually.
 type Simple struct {
 	ProviderID provider.ID
@@ -35,7 +35,6 @@ import (
 	"istio.io/istio/pkg/cluster"
 	"istio.io/istio/pkg/config/schema/collection"
 	"istio.io/istio/pkg/config/schema/collections"
-	"istio.io/istio/pkg/config/schema/gvk"
 	kubelib "istio.io/istio/pkg/kube"
 	"istio.io/istio/pkg/kube/secretcontroller"
 	"istio.io/istio/pkg/webhooks"
@@ -170,18 +169,9 @@ func (m *Multicluster) AddMemberCluster(clusterID cluster.ID, rc *secretcontroll
 
 	log.Infof("Initializing Kubernetes service registry %q", options.ClusterID)
 	kubeRegistry := NewController(client, options)
-	m.serviceController.AddRegistry(kubeRegistry)
-	m.remoteKubeControllers[clusterID] = &kubeController{
-		Controller: kubeRegistry,
-	}
-	// localCluster may also be the "config" cluster, in an external-istiod setup.
-	localCluster := m.opts.ClusterID == clusterID
 
-	m.m.Unlock()
-
-	// Only need to add service handler for kubernetes registry as `initRegistryEventHandlers`,
-	// because when endpoints update `XDSUpdater.EDSUpdate` has already been called.
-	kubeRegistry.AppendServiceHandler(func(svc *model.Service, ev model.Event) { m.updateHandler(svc) })
+	// The service events of the registry are pushed by the service handlers of the aggregate, see
+	// `initRegistryEventHandlers`, which are attached to the registries added later.
 
 	// TODO move instance cache out of registries
 	if m.serviceEntryStore != nil && features.EnableServiceEntrySelectPods {
@@ -189,6 +179,16 @@ func (m *Multicluster) AddMemberCluster(clusterID cluster.ID, rc *secretcontroll
 		kubeRegistry.AppendWorkloadHandler(m.serviceEntryStore.WorkloadInstanceHandler)
 	}
 
+	// the registry is started by the aggregate once running, until the cluster is removed
+	m.serviceController.AddRegistryAndRun(kubeRegistry, clusterStopCh)
+	m.remoteKubeControllers[clusterID] = &kubeController{
+		Controller: kubeRegistry,
+	}
+	// localCluster may also be the "config" cluster, in an external-istiod setup.
+	localCluster := m.opts.ClusterID == clusterID
+
+	m.m.Unlock()
+
 	// TODO implement deduping in aggregate registry to allow multiple k8s registries to handle WorkloadEntry
 	if features.EnableK8SServiceSelectWorkloadEntries {
 		if m.serviceEntryStore != nil && localCluster {
@@ -201,7 +201,7 @@ func (m *Multicluster) AddMemberCluster(clusterID cluster.ID, rc *secretcontroll
 					configStore, model.MakeIstioStore(configStore), options.XDSUpdater,
 					serviceentry.DisableServiceEntryProcessing(), serviceentry.WithClusterID(clusterID),
 					serviceentry.WithNetworkIDCb(kubeRegistry.Network))
-				m.serviceController.AddRegistry(m.remoteKubeControllers[clusterID].workloadEntryStore)
+				m.serviceController.AddRegistryAndRun(m.remoteKubeControllers[clusterID].workloadEntryStore, clusterStopCh)
 				// Services can select WorkloadEntry from the same cluster. We only duplicate the Service to configure kube-dns.
 				m.remoteKubeControllers[clusterID].workloadEntryStore.AppendWorkloadHandler(kubeRegistry.WorkloadInstanceHandler)
 				go configStore.Run(clusterStopCh)
@@ -211,12 +211,6 @@ func (m *Multicluster) AddMemberCluster(clusterID cluster.ID, rc *secretcontroll
 		}
 	}
 
-	// TODO make the aggregate controller keep clusters tied to their individual stop channels
-	if m.serviceController.Running() {
-		// if serviceController isn't running, it will start its members when it is started
-		go kubeRegistry.Run(clusterStopCh)
-	}
-
 	// TODO only create namespace controller and cert patch for remote clusters (no way to tell currently)
 	if m.fetchCaRoot != nil && m.fetchCaRoot() != nil && (features.ExternalIstiod || localCluster) {
 		// Block server exit on graceful termination of the leader controller.
@@ -336,21 +330,6 @@ func createConfigStore(client kubelib.Client, revision string, opts Options) (mo
 	return crdclient.NewForSchemas(ctx, client, revision, opts.DomainSuffix, workloadEntriesSchemas)
 }
 
-func (m *Multicluster) updateHandler(svc *model.Service) {
-	if m.XDSUpdater != nil {
-		req := &model.PushRequest{
-			Full: true,
-			ConfigsUpdated: map[model.ConfigKey]struct{}{{
-				Kind:      gvk.ServiceEntry,
-				Name:      string(svc.ClusterLocal.Hostname),
-				Namespace: svc.Attributes.Namespace,
-			}: {}},
-			Reason: []model.TriggerReason{model.ServiceUpdate},
-		}
-		m.XDSUpdater.ConfigUpdate(req)
-	}
-}
-
 func (m *Multicluster) GetRemoteKubeClient(clusterID cluster.ID) kubernetes.Interface {
 	m.m.Lock()
 	defer m.m.Unlock()
@@ -26,9 +26,11 @@ import (
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/keycertbundle"
+	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/server"
 	"istio.io/istio/pilot/pkg/serviceregistry/aggregate"
 	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/config/schema/gvk"
 	"istio.io/istio/pkg/kube"
 	"istio.io/istio/pkg/kube/secretcontroller"
 	"istio.io/istio/pkg/test/util/retry"
@@ -201,3 +203,81 @@ func Test_KubeSecretController_ExternalIstiod_MultipleClusters(t *testing.T) {
 	// Test - Verify that the remote controller has been removed.
 	verifyControllers(t, mc, 0, "delete remote controller")
 }
+
+func Test_KubeSecretController_RemoteServicePushedOnce(t *testing.T) {
+	remote := kube.NewFakeClient()
+	secretcontroller.BuildClientsFromConfig = func(kubeConfig []byte) (kube.Client, error) {
+		return remote, nil
+	}
+	clientset := kube.NewFakeClient()
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+	})
+	fx := NewFakeXDS()
+	serviceController := aggregate.NewController(aggregate.Options{})
+	// the push handler of the server, see initRegistryEventHandlers
+	serviceController.RegisterServiceHandler(aggregate.NamedServiceHandler("xds-push", func(svc *model.Service, _ model.Event) {
+		fx.ConfigUpdate(&model.PushRequest{
+			Full: true,
+			ConfigsUpdated: map[model.ConfigKey]struct{}{{
+				Kind:      gvk.ServiceEntry,
+				Name:      string(svc.ClusterLocal.Hostname),
+				Namespace: svc.Attributes.Namespace,
+			}: {}},
+		})
+	}))
+	go serviceController.Run(stop)
+	s := server.New()
+	mc := NewMulticluster(
+		"pilot-abc-123",
+		clientset,
+		testSecretNameSpace,
+		Options{
+			DomainSuffix: DomainSuffix,
+			ResyncPeriod: ResyncPeriod,
+			SyncInterval: time.Microsecond,
+			MeshWatcher:  mesh.NewFixedWatcher(&meshconfig.MeshConfig{}),
+			XDSUpdater:   fx,
+		}, serviceController, nil, nil, "default", nil, nil, s)
+	mc.InitSecretController(stop)
+	cache.WaitForCacheSync(stop, mc.HasSynced)
+	clientset.RunAndWait(stop)
+	_ = s.Start(stop)
+	go func() {
+		_ = mc.Run(stop)
+	}()
+
+	if err := createMultiClusterSecret(clientset, "test-secret-1", "test-remote-cluster-1"); err != nil {
+		t.Fatalf("Unexpected error on secret create: %v", err)
+	}
+	verifyControllers(t, mc, 1, "create remote controller")
+	retry.UntilOrFail(t, serviceController.HasSynced, retry.Message("remote registry synced"), retry.Timeout(time.Second*5))
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "hello", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+	if _, err := remote.CoreV1().Services("default").Create(context.TODO(), svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hostname := "hello.default.svc." + DomainSuffix
+	pushes := 0
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case e := <-fx.Events:
+			if e.Type == "xds" && e.ID == hostname {
+				pushes++
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if pushes != 1 {
+		t.Fatalf("expected the remote service event to be pushed once, got %d pushes", pushes)
+	}
+}
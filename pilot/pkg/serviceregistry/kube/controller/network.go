@@ -194,6 +194,7 @@ func (c *Controller) extractGatewaysInner(svc *model.Service) bool {
 				Network: nw,
 				Addr:    ip,
 				Port:    gwPort,
+				Service: svc.ClusterLocal.Hostname,
 			})
 		}
 	}
@@ -45,6 +45,7 @@ import (
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/istio/pkg/cluster"
 	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/schema/collection"
 	"istio.io/istio/pkg/network"
 	istiolog "istio.io/pkg/log"
@@ -182,6 +183,7 @@ func (s *DiscoveryServer) AddDebugHandlers(mux, internalMux *http.ServeMux, enab
 	s.addDebugHandler(mux, internalMux, "/debug/config_distribution", "Version status of all Envoys connected to this Pilot instance", s.distributedVersions)
 
 	s.addDebugHandler(mux, internalMux, "/debug/registryz", "Debug support for registry", s.registryz)
+	s.addDebugHandler(mux, internalMux, "/debug/readinessz", "Readiness of the registries of the aggregate registry", s.readinessz)
 	s.addDebugHandler(mux, internalMux, "/debug/endpointz", "Debug support for endpoints", s.endpointz)
 	s.addDebugHandler(mux, internalMux, "/debug/endpointShardz", "Info about the endpoint shards", s.endpointShardz)
 	s.addDebugHandler(mux, internalMux, "/debug/cachez", "Info about the internal XDS caches", s.cachez)
@@ -190,7 +192,9 @@ func (s *DiscoveryServer) AddDebugHandlers(mux, internalMux *http.ServeMux, enab
 	s.addDebugHandler(mux, internalMux, "/debug/configz", "Debug support for config", s.configz)
 	s.addDebugHandler(mux, internalMux, "/debug/sidecarz", "Debug sidecar scope for a proxy", s.sidecarz)
 	s.addDebugHandler(mux, internalMux, "/debug/resourcesz", "Debug support for watched resources", s.resourcez)
-	s.addDebugHandler(mux, internalMux, "/debug/instancesz", "Debug support for service instances", s.instancesz)
+	s.addDebugHandler(mux, internalMux, "/debug/instancesz", "Debug support for service instances; with a proxyID, "+
+		"reports the registry of each instance; with stats=true, the number of instances contributed by each registry to sampled lookups",
+		s.instancesz)
 
 	s.addDebugHandler(mux, internalMux, "/debug/authorizationz", "Internal authorization policies", s.authorizationz)
 	s.addDebugHandler(mux, internalMux, "/debug/telemetryz", "Debug Telemetry configuration", s.telemetryz)
@@ -260,8 +264,22 @@ func isRequestFromLocalhost(r *http.Request) bool {
 	return userIP.IsLoopback()
 }
 
-// Syncz dumps the synchronization status of all Envoys connected to this Pilot instance
-func (s *DiscoveryServer) Syncz(w http.ResponseWriter, _ *http.Request) {
+// Syncz dumps the synchronization status of all Envoys connected to this Pilot instance. With ?registries, dumps
+// the synchronization status of the registries of the aggregate registry instead.
+func (s *DiscoveryServer) Syncz(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Failed to parse request\n"))
+		return
+	}
+	if req.Form.Get("registries") != "" {
+		aggregateController, ok := s.aggregateOr404(w, "Registries")
+		if !ok {
+			return
+		}
+		writeJSON(w, aggregateController.SyncStatus())
+		return
+	}
 	syncz := make([]SyncStatus, 0)
 	for _, con := range s.Clients() {
 		node := con.proxy
@@ -284,8 +302,59 @@ func (s *DiscoveryServer) Syncz(w http.ResponseWriter, _ *http.Request) {
 }
 
 // registryz providees debug support for registry - adding and listing model items.
-// Can be combined with the push debug interface to reproduce changes.
+// Can be combined with the push debug interface to reproduce changes. With ?handlers, lists the handlers of
+// the aggregate registry instead. With ?serviceaccounts=<hostname>, lists the service accounts of the service
+// by cluster instead, or with their provenance with &detailed. With ?gatewayconflicts, lists the addresses
+// given for the gateways of more than one network instead, and with ?gateways, the network gateways of each
+// cluster.
 func (s *DiscoveryServer) registryz(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Failed to parse request\n"))
+		return
+	}
+	if req.Form.Get("handlers") != "" {
+		aggregateController, ok := s.aggregateOr404(w, "Handlers")
+		if !ok {
+			return
+		}
+		writeJSON(w, aggregateController.Handlers())
+		return
+	}
+	if req.Form.Get("gateways") != "" {
+		aggregateController, ok := s.aggregateOr404(w, "Gateways by cluster")
+		if !ok {
+			return
+		}
+		writeJSON(w, aggregateController.NetworkGatewaysByCluster())
+		return
+	}
+	if req.Form.Get("gatewayconflicts") != "" {
+		aggregateController, ok := s.aggregateOr404(w, "Gateway conflicts")
+		if !ok {
+			return
+		}
+		writeJSON(w, aggregateController.GatewayConflicts())
+		return
+	}
+	if hostname := req.Form.Get("serviceaccounts"); hostname != "" {
+		aggregateController, ok := s.aggregateOr404(w, "Service accounts by cluster")
+		if !ok {
+			return
+		}
+		svc, err := aggregateController.GetService(host.Name(hostname))
+		if err != nil || svc == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(fmt.Sprintf("Unknown service %s\n", hostname)))
+			return
+		}
+		if req.Form.Get("detailed") != "" {
+			writeJSON(w, aggregateController.GetIstioServiceAccountsDetailed(svc, nil))
+			return
+		}
+		writeJSON(w, aggregateController.ServiceAccountsByCluster(svc, nil))
+		return
+	}
 	all, err := s.Env.ServiceDiscovery.Services()
 	if err != nil {
 		return
@@ -293,6 +362,15 @@ func (s *DiscoveryServer) registryz(w http.ResponseWriter, req *http.Request) {
 	writeJSON(w, all)
 }
 
+// readinessz dumps the readiness of the registries of the aggregate registry.
+func (s *DiscoveryServer) readinessz(w http.ResponseWriter, req *http.Request) {
+	aggregateController, ok := s.aggregateOr404(w, "Readiness checks")
+	if !ok {
+		return
+	}
+	aggregateController.ReadinessHandler().ServeHTTP(w, req)
+}
+
 // Dumps info about the endpoint shards, tracked using the new direct interface.
 // Legacy registry provides are synced to the new data structure as well, during
 // the full push.
@@ -845,6 +923,32 @@ func (s *DiscoveryServer) getProxyConnection(proxyID string) *Connection {
 }
 
 func (s *DiscoveryServer) instancesz(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Failed to parse request\n"))
+		return
+	}
+	if req.Form.Get("stats") != "" {
+		aggregateController, ok := s.aggregateOr404(w, "Instance stats")
+		if !ok {
+			return
+		}
+		writeJSON(w, aggregateController.InstanceContributionStats())
+		return
+	}
+	if proxyID, con := s.getDebugConnection(req); proxyID != "" {
+		// For a single proxy, report which registry each instance came from.
+		if con == nil {
+			s.errorHandler(w, proxyID, con)
+			return
+		}
+		if aggregateController, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+			writeJSON(w, aggregateController.GetProxyServiceInstancesDetailed(con.proxy))
+			return
+		}
+		writeJSON(w, s.Env.ServiceDiscovery.GetProxyServiceInstances(con.proxy))
+		return
+	}
 	instances := map[string][]*model.ServiceInstance{}
 	for _, con := range s.Clients() {
 		con.proxy.RLock()
@@ -926,6 +1030,17 @@ func (s *DiscoveryServer) getDebugConnection(req *http.Request) (string, *Connec
 	return "", nil
 }
 
+// aggregateOr404 returns the aggregate registry, or writes a 404 response saying that what requires it if the
+// service discovery is another registry.
+func (s *DiscoveryServer) aggregateOr404(w http.ResponseWriter, what string) (*aggregate.Controller, bool) {
+	aggregateController, ok := s.Env.ServiceDiscovery.(*aggregate.Controller)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(what + " require the aggregate registry\n"))
+	}
+	return aggregateController, ok
+}
+
 func (s *DiscoveryServer) errorHandler(w http.ResponseWriter, proxyID string, con *Connection) {
 	if proxyID == "" {
 		w.WriteHeader(http.StatusBadRequest)
@@ -25,6 +25,7 @@ import (
 
 	"istio.io/istio/istioctl/pkg/util/configdump"
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/memory"
 	"istio.io/istio/pilot/pkg/xds"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
 )
@@ -67,6 +68,22 @@ func TestSyncz(t *testing.T) {
 	})
 }
 
+func TestSynczRegistriesRequireAggregate(t *testing.T) {
+	server := &xds.DiscoveryServer{Env: &model.Environment{ServiceDiscovery: memory.NewServiceDiscovery(nil)}}
+	req, err := http.NewRequest("GET", "/debug?registries=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(server.Syncz).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected a 404 without the aggregate registry, got %d", rr.Code)
+	}
+	if got, want := rr.Body.String(), "Registries require the aggregate registry\n"; got != want {
+		t.Fatalf("expected the body %q, got %q", want, got)
+	}
+}
+
 func getSyncStatus(t *testing.T, server *xds.DiscoveryServer) []xds.SyncStatus {
 	req, err := http.NewRequest("GET", "/debug", nil)
 	if err != nil {